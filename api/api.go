@@ -39,6 +39,7 @@ func (this *GatewayAPI) RegisterSchema() {
 	orm.MustRegisterSchemaWithIndexName(common.EntryConfig{}, "entry")
 	orm.MustRegisterSchemaWithIndexName(common.RouterConfig{}, "router")
 	orm.MustRegisterSchemaWithIndexName(common.FlowConfig{}, "flow")
+	orm.MustRegisterSchemaWithIndexName(common.RoleConfig{}, "role")
 
 }
 
@@ -68,4 +69,25 @@ func (this *GatewayAPI) RegisterAPI(prefix string) {
 	api.HandleAPIMethod(api.DELETE, path.Join("/", prefix, "/flow/:flow_id"), this.deleteFlow)
 	api.HandleAPIMethod(api.GET, path.Join("/", prefix, "/flow/_search"), this.searchFlow)
 
+	api.HandleAPIMethod(api.POST, path.Join("/", prefix, "/role"), this.createRole)
+	api.HandleAPIMethod(api.GET, path.Join("/", prefix, "/role/:role_id"), this.getRole)
+	api.HandleAPIMethod(api.PUT, path.Join("/", prefix, "/role/:role_id"), this.updateRole)
+	api.HandleAPIMethod(api.DELETE, path.Join("/", prefix, "/role/:role_id"), this.deleteRole)
+	api.HandleAPIMethod(api.GET, path.Join("/", prefix, "/role/_search"), this.searchRole)
+
+	api.HandleAPIMethod(api.GET, path.Join("/", prefix, "/ldap/role_mapping/_test"), this.testLDAPRoleMapping)
+
+	api.HandleAPIMethod(api.GET, path.Join("/", prefix, "/quota"), this.listQuotas)
+	api.HandleAPIMethod(api.GET, path.Join("/", prefix, "/quota/:tenant"), this.getQuota)
+	api.HandleAPIMethod(api.POST, path.Join("/", prefix, "/quota/:tenant/_reset"), this.resetQuota)
+	api.HandleAPIMethod(api.POST, path.Join("/", prefix, "/quota/:tenant/_adjust"), this.adjustQuota)
+	api.HandleAPIMethod(api.PUT, path.Join("/", prefix, "/quota/:tenant/limits"), this.updateQuotaLimits)
+	api.HandleAPIMethod(api.DELETE, path.Join("/", prefix, "/quota/:tenant/limits"), this.deleteQuotaLimits)
+
+	api.HandleAPIMethod(api.GET, path.Join("/", prefix, "/cache/_stats"), this.getCacheStats)
+	api.HandleAPIMethod(api.GET, path.Join("/", prefix, "/cache/entry"), this.listCacheKeys)
+	api.HandleAPIMethod(api.GET, path.Join("/", prefix, "/cache/entry/:key"), this.getCacheEntry)
+	api.HandleAPIMethod(api.DELETE, path.Join("/", prefix, "/cache/entry/:key"), this.deleteCacheEntry)
+	api.HandleAPIMethod(api.POST, path.Join("/", prefix, "/cache/_purge"), this.purgeCache)
+
 }
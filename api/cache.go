@@ -0,0 +1,110 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package api
+
+import (
+	"net/http"
+	"strconv"
+
+	"infini.sh/framework/core/api/router"
+	"infini.sh/framework/core/util"
+	"infini.sh/gateway/proxy/filters/cache"
+)
+
+func (h *GatewayAPI) getCacheStats(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	h.WriteJSON(w, cache.GetStats(), 200)
+}
+
+func (h *GatewayAPI) listCacheKeys(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	prefix := h.GetParameterOrDefault(req, "prefix", "")
+	size, _ := strconv.Atoi(h.GetParameterOrDefault(req, "size", "100"))
+	if size <= 0 {
+		size = 100
+	}
+	h.WriteJSON(w, cache.ListKeys(prefix, size), 200)
+}
+
+func (h *GatewayAPI) getCacheEntry(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	key := ps.MustGetParameter("key")
+	entry, ok := cache.GetEntry(key)
+	if !ok {
+		h.WriteJSON(w, util.MapStr{
+			"key":   key,
+			"found": false,
+		}, http.StatusNotFound)
+		return
+	}
+	h.WriteJSON(w, util.MapStr{
+		"key":   key,
+		"found": true,
+		"entry": entry,
+	}, 200)
+}
+
+func (h *GatewayAPI) deleteCacheEntry(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	key := ps.MustGetParameter("key")
+	count := cache.PurgeKeys([]string{key})
+	h.WriteJSON(w, util.MapStr{
+		"key":    key,
+		"purged": count,
+		"result": "deleted",
+	}, 200)
+}
+
+type cachePurgeRequest struct {
+	Keys    []string `json:"keys"`
+	Prefix  string   `json:"prefix"`
+	Indices []string `json:"indices"`
+	All     bool     `json:"all"`
+}
+
+// purgeCache evicts the entries of the keys, the prefix, the indices or all of them
+func (h *GatewayAPI) purgeCache(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	obj := cachePurgeRequest{}
+	err := h.DecodeJSON(req, &obj)
+	if err != nil {
+		h.WriteError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var count int
+	switch {
+	case obj.All:
+		count = cache.PurgePrefix("")
+	case len(obj.Keys) > 0:
+		count = cache.PurgeKeys(obj.Keys)
+	case obj.Prefix != "":
+		count = cache.PurgePrefix(obj.Prefix)
+	case len(obj.Indices) > 0:
+		count = cache.PurgeIndices(obj.Indices)
+	default:
+		h.WriteError(w, "one of keys, prefix, indices or all is required", http.StatusBadRequest)
+		return
+	}
+
+	h.WriteJSON(w, util.MapStr{
+		"purged": count,
+		"result": "purged",
+	}, 200)
+}
@@ -0,0 +1,54 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package api
+
+import (
+	"net/http"
+	"strings"
+
+	"infini.sh/framework/core/api/router"
+	"infini.sh/framework/core/util"
+	"infini.sh/gateway/proxy/filters/security/ldap"
+)
+
+// testLDAPRoleMapping returns the roles the user would receive from each of
+// the ldap_auth filters, the groups can be provided to skip the ldap search
+func (h *GatewayAPI) testLDAPRoleMapping(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	user := h.GetParameterOrDefault(req, "user", "")
+	groups := []string{}
+	for _, v := range strings.Split(h.GetParameterOrDefault(req, "groups", ""), ";") {
+		if v = strings.TrimSpace(v); v != "" {
+			groups = append(groups, v)
+		}
+	}
+	if user == "" && len(groups) == 0 {
+		h.WriteError(w, "user or groups is required", http.StatusBadRequest)
+		return
+	}
+
+	h.WriteJSON(w, util.MapStr{
+		"user":    user,
+		"results": ldap.TestRoleMapping(user, groups),
+	}, 200)
+}
@@ -0,0 +1,148 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"infini.sh/framework/core/api/router"
+	"infini.sh/framework/core/util"
+	"infini.sh/gateway/common/quota"
+)
+
+func (h *GatewayAPI) getQuotaStatus(tenant string, now time.Time) util.MapStr {
+	limits, override := quota.Default().GetLimits(tenant)
+	usage := quota.Default().GetUsage(tenant, now)
+	windows := util.MapStr{}
+	for _, window := range quota.Windows {
+		windows[window] = util.MapStr{
+			"period": quota.Period(window, now),
+			"reset":  quota.NextReset(window, now),
+			"usage":  usage[window],
+			"limits": limits.Get(window),
+		}
+	}
+	return util.MapStr{
+		"tenant":   tenant,
+		"windows":  windows,
+		"override": override,
+	}
+}
+
+func (h *GatewayAPI) listQuotas(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	now := time.Now()
+	tenants := quota.Default().Tenants()
+	items := make([]util.MapStr, 0, len(tenants))
+	for _, tenant := range tenants {
+		items = append(items, h.getQuotaStatus(tenant, now))
+	}
+	h.WriteJSON(w, util.MapStr{
+		"total":   len(items),
+		"tenants": items,
+	}, 200)
+}
+
+func (h *GatewayAPI) getQuota(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	tenant := ps.MustGetParameter("tenant")
+	h.WriteJSON(w, h.getQuotaStatus(tenant, time.Now()), 200)
+}
+
+func (h *GatewayAPI) resetQuota(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	tenant := ps.MustGetParameter("tenant")
+	window := h.GetParameterOrDefault(req, "window", "")
+	if window != "" && !quota.ValidWindow(window) {
+		h.WriteError(w, fmt.Sprintf("invalid window [%v]", window), http.StatusBadRequest)
+		return
+	}
+
+	quota.Default().Reset(tenant, window, time.Now())
+	h.WriteJSON(w, util.MapStr{
+		"tenant": tenant,
+		"result": "reset",
+	}, 200)
+}
+
+type quotaAdjustment struct {
+	Window string `json:"window"`
+	quota.Usage
+}
+
+// adjustQuota adds the delta to the usage of the current period, negative values give credits
+func (h *GatewayAPI) adjustQuota(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	tenant := ps.MustGetParameter("tenant")
+	obj := quotaAdjustment{}
+	err := h.DecodeJSON(req, &obj)
+	if err != nil {
+		h.WriteError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !quota.ValidWindow(obj.Window) {
+		h.WriteError(w, fmt.Sprintf("invalid window [%v]", obj.Window), http.StatusBadRequest)
+		return
+	}
+
+	usage := quota.Default().Adjust(tenant, obj.Window, obj.Usage, time.Now())
+	h.WriteJSON(w, util.MapStr{
+		"tenant": tenant,
+		"window": obj.Window,
+		"usage":  usage,
+		"result": "adjusted",
+	}, 200)
+}
+
+// updateQuotaLimits overrides the limits configured in the filters for the tenant
+func (h *GatewayAPI) updateQuotaLimits(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	tenant := ps.MustGetParameter("tenant")
+	obj := quota.Limits{}
+	err := h.DecodeJSON(req, &obj)
+	if err != nil {
+		h.WriteError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = quota.Default().SetLimits(tenant, &obj)
+	if err != nil {
+		h.WriteError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.WriteJSON(w, util.MapStr{
+		"tenant": tenant,
+		"result": "updated",
+	}, 200)
+}
+
+func (h *GatewayAPI) deleteQuotaLimits(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	tenant := ps.MustGetParameter("tenant")
+	err := quota.Default().SetLimits(tenant, nil)
+	if err != nil {
+		h.WriteError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.WriteJSON(w, util.MapStr{
+		"tenant": tenant,
+		"result": "deleted",
+	}, 200)
+}
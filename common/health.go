@@ -0,0 +1,59 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package common
+
+import (
+	log "github.com/cihub/seelog"
+	"infini.sh/framework/core/elastic"
+	"infini.sh/framework/core/global"
+)
+
+// CheckElasticsearchHealth requests the cluster health, the cluster is healthy
+// if it responds with 200 or 403 and it is not red, the success is reported to
+// the metadata even if it is red, as the nodes are still reachable
+func CheckElasticsearchHealth(elasticsearch string) bool {
+	client := elastic.GetClientNoPanic(elasticsearch)
+	if client == nil {
+		return false
+	}
+
+	result, err := client.ClusterHealth(nil)
+	if global.Env().IsDebug {
+		log.Trace(elasticsearch, result, err)
+	}
+
+	if err != nil || result == nil {
+		return false
+	}
+
+	if result.StatusCode == 200 || result.StatusCode == 403 {
+		cfg := elastic.GetMetadata(elasticsearch)
+		if cfg != nil {
+			cfg.ReportSuccess()
+		}
+		//some primary shards are not allocated, the writes to them would fail
+		return result.Status != "red"
+	}
+	return false
+}
@@ -0,0 +1,309 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package pressure
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/buger/jsonparser"
+	log "github.com/cihub/seelog"
+	"infini.sh/framework/core/elastic"
+	"infini.sh/framework/core/global"
+	"infini.sh/framework/core/stats"
+	"infini.sh/framework/core/task"
+	"infini.sh/framework/core/util"
+	"infini.sh/framework/lib/fasthttp"
+)
+
+const (
+	PoolSearch = "search"
+	PoolWrite  = "write"
+)
+
+// Config of the collector, the score of a node reaches 1 when any of the
+// signals reaches its threshold
+type Config struct {
+	Interval string `config:"interval"`
+	Timeout  string `config:"timeout"`
+	MaxAge   string `config:"max_age"` //stats older than it are ignored
+
+	Thresholds struct {
+		SearchQueue int     `config:"search_queue"`
+		WriteQueue  int     `config:"write_queue"`
+		HeapPercent float64 `config:"heap_percent"`
+		CPUPercent  float64 `config:"cpu_percent"`
+	} `config:"thresholds"`
+}
+
+func DefaultConfig() Config {
+	cfg := Config{
+		Interval: "5s",
+		Timeout:  "5s",
+		MaxAge:   "30s",
+	}
+	//the heap and cpu usage are not checked by default, a healthy node may
+	//run at high heap usage between the garbage collections
+	cfg.Thresholds.SearchQueue = 500
+	cfg.Thresholds.WriteQueue = 5000
+	return cfg
+}
+
+// NodePressure is the latest pressure of a node
+type NodePressure struct {
+	NodeID         string    `json:"node_id"`
+	Name           string    `json:"name"`
+	Host           string    `json:"host"`
+	SearchQueue    int64     `json:"search_queue"`
+	SearchRejected int64     `json:"search_rejected"`
+	WriteQueue     int64     `json:"write_queue"`
+	WriteRejected  int64     `json:"write_rejected"`
+	HeapPercent    float64   `json:"heap_percent"`
+	CPUPercent     float64   `json:"cpu_percent"`
+	SearchScore    float64   `json:"search_score"`
+	WriteScore     float64   `json:"write_score"`
+	UpdatedAt      time.Time `json:"updated_at"`
+}
+
+// Score returns the pressure of the thread pool, 1 means saturated
+func (n *NodePressure) Score(pool string) float64 {
+	if pool == PoolWrite {
+		return n.WriteScore
+	}
+	return n.SearchScore
+}
+
+type collector struct {
+	cluster string
+	config  Config
+	timeout time.Duration
+	maxAge  time.Duration
+
+	locker sync.RWMutex
+	nodes  map[string]*NodePressure //by the http host
+}
+
+var collectors = map[string]*collector{}
+var collectorsLocker = sync.RWMutex{}
+
+// Watch starts collecting the pressure of the nodes of the cluster, only the
+// first config of the cluster takes effect
+func Watch(cluster string, cfg Config) {
+	collectorsLocker.Lock()
+	defer collectorsLocker.Unlock()
+
+	if _, ok := collectors[cluster]; ok {
+		return
+	}
+
+	c := &collector{
+		cluster: cluster,
+		config:  cfg,
+		timeout: util.GetDurationOrDefault(cfg.Timeout, 5*time.Second),
+		maxAge:  util.GetDurationOrDefault(cfg.MaxAge, 30*time.Second),
+		nodes:   map[string]*NodePressure{},
+	}
+	collectors[cluster] = c
+
+	stats.RegisterStats(fmt.Sprintf("pressure.%v.search", cluster), func() interface{} {
+		return GetClusterPressure(cluster, PoolSearch)
+	})
+	stats.RegisterStats(fmt.Sprintf("pressure.%v.write", cluster), func() interface{} {
+		return GetClusterPressure(cluster, PoolWrite)
+	})
+
+	task.RegisterScheduleTask(task.ScheduleTask{
+		Description: fmt.Sprintf("collect thread pool pressure of elasticsearch [%v]", cluster),
+		Type:        "interval",
+		Interval:    cfg.Interval,
+		Task: func(ctx context.Context) {
+			c.collect()
+		},
+	})
+}
+
+func getCollector(cluster string) *collector {
+	collectorsLocker.RLock()
+	defer collectorsLocker.RUnlock()
+	return collectors[cluster]
+}
+
+// GetNodes returns the fresh pressure of the nodes by the http host
+func GetNodes(cluster string) map[string]NodePressure {
+	c := getCollector(cluster)
+	if c == nil {
+		return nil
+	}
+	now := time.Now()
+	c.locker.RLock()
+	defer c.locker.RUnlock()
+	nodes := map[string]NodePressure{}
+	for k, v := range c.nodes {
+		if now.Sub(v.UpdatedAt) <= c.maxAge {
+			nodes[k] = *v
+		}
+	}
+	return nodes
+}
+
+// GetNodeScore returns the pressure of the node, false if unknown
+func GetNodeScore(cluster, host, pool string) (float64, bool) {
+	c := getCollector(cluster)
+	if c == nil {
+		return 0, false
+	}
+	c.locker.RLock()
+	defer c.locker.RUnlock()
+	v, ok := c.nodes[host]
+	if !ok || time.Since(v.UpdatedAt) > c.maxAge {
+		return 0, false
+	}
+	return v.Score(pool), true
+}
+
+// GetClusterPressure returns the average pressure of the nodes, 0 if unknown
+func GetClusterPressure(cluster, pool string) float64 {
+	nodes := GetNodes(cluster)
+	if len(nodes) == 0 {
+		return 0
+	}
+	var sum float64
+	for _, v := range nodes {
+		sum += v.Score(pool)
+	}
+	return sum / float64(len(nodes))
+}
+
+func (c *collector) collect() {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Errorf("failed to collect thread pool pressure of [%v], %v", c.cluster, r)
+		}
+	}()
+
+	metadata := elastic.GetMetadata(c.cluster)
+	if metadata == nil || !metadata.IsAvailable() {
+		return
+	}
+
+	host := metadata.GetActiveHost()
+	req := fasthttp.AcquireRequest()
+	res := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(res)
+
+	req.SetRequestURI(fmt.Sprintf("%v://%v/_nodes/stats/thread_pool,jvm,os?filter_path=nodes.*.name,nodes.*.thread_pool.search,nodes.*.thread_pool.write,nodes.*.thread_pool.bulk,nodes.*.jvm.mem.heap_used_percent,nodes.*.os.cpu.percent", metadata.GetSchema(), host))
+	req.Header.SetMethod(fasthttp.MethodGet)
+	req.SetHost(host)
+	if auth := metadata.Config.BasicAuth; auth != nil && auth.Username != "" {
+		req.SetBasicAuth(auth.Username, string(auth.Password))
+	}
+
+	err := metadata.GetHttpClient(host).DoTimeout(req, res, c.timeout)
+	if err != nil || res.StatusCode() != fasthttp.StatusOK {
+		stats.Increment("pressure", c.cluster+".collect_failed")
+		if global.Env().IsDebug {
+			log.Debugf("failed to collect thread pool pressure of [%v], %v %v", c.cluster, res.StatusCode(), err)
+		}
+		return
+	}
+
+	hosts := map[string]string{}
+	if metadata.Nodes != nil {
+		for id, node := range *metadata.Nodes {
+			hosts[id] = node.GetHttpPublishHost()
+		}
+	}
+
+	c.update(res.GetRawBody(), hosts, time.Now())
+}
+
+// update parses the nodes stats and scores the nodes, the hosts are the
+// http hosts by the node id
+func (c *collector) update(data []byte, hosts map[string]string, now time.Time) {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+
+	jsonparser.ObjectEach(data, func(key []byte, value []byte, dataType jsonparser.ValueType, offset int) error {
+		id := string(key)
+		host, ok := hosts[id]
+		if !ok || host == "" {
+			return nil
+		}
+		node := &NodePressure{NodeID: id, Host: host, UpdatedAt: now}
+		node.Name, _ = jsonparser.GetString(value, "name")
+		node.SearchQueue, _ = jsonparser.GetInt(value, "thread_pool", "search", "queue")
+		node.SearchRejected, _ = jsonparser.GetInt(value, "thread_pool", "search", "rejected")
+		writePool := "write"
+		if _, _, _, err := jsonparser.Get(value, "thread_pool", writePool); err != nil {
+			//the write pool was named bulk before 6.3
+			writePool = "bulk"
+		}
+		node.WriteQueue, _ = jsonparser.GetInt(value, "thread_pool", writePool, "queue")
+		node.WriteRejected, _ = jsonparser.GetInt(value, "thread_pool", writePool, "rejected")
+		node.HeapPercent, _ = jsonparser.GetFloat(value, "jvm", "mem", "heap_used_percent")
+		node.CPUPercent, _ = jsonparser.GetFloat(value, "os", "cpu", "percent")
+
+		prev := c.nodes[host]
+		node.SearchScore, node.WriteScore = score(&c.config, node, prev)
+		c.nodes[host] = node
+		return nil
+	}, "nodes")
+
+	for k, v := range c.nodes {
+		if now.Sub(v.UpdatedAt) > c.maxAge {
+			delete(c.nodes, k)
+		}
+	}
+}
+
+// score returns the pressure of the search and write pools, the highest of
+// the queue, heap and cpu usage relative to the thresholds, and 1 if there
+// were new rejections since the last collection, zero thresholds are ignored
+func score(cfg *Config, node *NodePressure, prev *NodePressure) (float64, float64) {
+	ratio := func(v, threshold float64) float64 {
+		if threshold <= 0 {
+			return 0
+		}
+		return v / threshold
+	}
+
+	shared := math.Max(ratio(node.HeapPercent, cfg.Thresholds.HeapPercent), ratio(node.CPUPercent, cfg.Thresholds.CPUPercent))
+	search := math.Max(shared, ratio(float64(node.SearchQueue), float64(cfg.Thresholds.SearchQueue)))
+	write := math.Max(shared, ratio(float64(node.WriteQueue), float64(cfg.Thresholds.WriteQueue)))
+
+	//rejected counters only grow until the node restarts
+	if prev != nil {
+		if node.SearchRejected > prev.SearchRejected {
+			search = math.Max(search, 1)
+		}
+		if node.WriteRejected > prev.WriteRejected {
+			write = math.Max(write, 1)
+		}
+	}
+	return math.Min(search, 1), math.Min(write, 1)
+}
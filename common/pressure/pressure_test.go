@@ -0,0 +1,93 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package pressure
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScore(t *testing.T) {
+	cfg := DefaultConfig()
+	node := &NodePressure{SearchQueue: 0, HeapPercent: 75, CPUPercent: 80}
+	search, write := score(&cfg, node, nil)
+	assert.Equal(t, 0.0, search, "heap and cpu are not checked by default")
+	assert.Equal(t, 0.0, write)
+
+	cfg.Thresholds.HeapPercent = 90
+	cfg.Thresholds.CPUPercent = 95
+
+	node = &NodePressure{SearchQueue: 250, WriteQueue: 0, HeapPercent: 45, CPUPercent: 19}
+	search, write = score(&cfg, node, nil)
+	assert.InDelta(t, 0.5, search, 0.0001)
+	assert.InDelta(t, 0.5, write, 0.0001, "heap is shared by the pools")
+
+	node = &NodePressure{SearchQueue: 5000, HeapPercent: 10}
+	search, _ = score(&cfg, node, nil)
+	assert.Equal(t, 1.0, search, "capped to 1")
+
+	//new rejections saturate the pool
+	prev := &NodePressure{WriteRejected: 10}
+	node = &NodePressure{WriteRejected: 12}
+	search, write = score(&cfg, node, prev)
+	assert.Equal(t, 0.0, search)
+	assert.Equal(t, 1.0, write)
+}
+
+func TestCollectorUpdate(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Thresholds.HeapPercent = 90
+	c := &collector{cluster: "test", config: cfg, maxAge: 30 * time.Second, nodes: map[string]*NodePressure{}}
+	data := []byte(`{"nodes":{
+		"n1":{"name":"node-1","thread_pool":{"search":{"queue":100,"rejected":0},"write":{"queue":0,"rejected":3}},"jvm":{"mem":{"heap_used_percent":30}},"os":{"cpu":{"percent":20}}},
+		"n2":{"name":"node-2","thread_pool":{"search":{"queue":0,"rejected":0},"bulk":{"queue":2500,"rejected":0}},"jvm":{"mem":{"heap_used_percent":50}},"os":{"cpu":{"percent":10}}},
+		"n3":{"name":"node-3"}
+	}}`)
+	hosts := map[string]string{"n1": "10.0.0.1:9200", "n2": "10.0.0.2:9200"}
+
+	now := time.Now()
+	c.update(data, hosts, now)
+	assert.Equal(t, 2, len(c.nodes), "nodes without http host are ignored")
+
+	n1 := c.nodes["10.0.0.1:9200"]
+	assert.Equal(t, "node-1", n1.Name)
+	assert.InDelta(t, 0.3333, n1.SearchScore, 0.001)
+	assert.Equal(t, int64(3), n1.WriteRejected)
+
+	n2 := c.nodes["10.0.0.2:9200"]
+	assert.Equal(t, int64(2500), n2.WriteQueue, "fallback to the bulk pool")
+	assert.InDelta(t, 0.5556, n2.WriteScore, 0.001)
+
+	//rejections since the last collection
+	data = []byte(`{"nodes":{"n1":{"thread_pool":{"search":{"queue":0,"rejected":1},"write":{"queue":0,"rejected":3}}}}}`)
+	c.update(data, hosts, now.Add(time.Second))
+	assert.Equal(t, 1.0, c.nodes["10.0.0.1:9200"].SearchScore)
+	assert.Equal(t, 0.0, c.nodes["10.0.0.1:9200"].WriteScore)
+
+	//stale nodes are removed
+	c.update([]byte(`{"nodes":{}}`), hosts, now.Add(time.Minute))
+	assert.Equal(t, 0, len(c.nodes))
+}
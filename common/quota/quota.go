@@ -0,0 +1,528 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package quota
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"infini.sh/framework/core/global"
+	"infini.sh/framework/core/kv"
+)
+
+const (
+	WindowHourly  = "hourly"
+	WindowDaily   = "daily"
+	WindowMonthly = "monthly"
+)
+
+var Windows = []string{WindowHourly, WindowDaily, WindowMonthly}
+
+const (
+	MetricRequests = "requests"
+	MetricBytes    = "bytes"
+	MetricCost     = "cost"
+)
+
+const (
+	usageBucket  = "gateway_quota_usage"
+	limitsBucket = "gateway_quota_limits"
+	tenantsKey   = "_tenants"
+)
+
+// Usage is the consumption of a tenant, also used as the limits of a window,
+// zero means unlimited
+type Usage struct {
+	Requests int64 `config:"requests" json:"requests"`
+	Bytes    int64 `config:"bytes" json:"bytes"`
+	Cost     int64 `config:"cost" json:"cost"`
+}
+
+func (u *Usage) get(metric string) int64 {
+	switch metric {
+	case MetricRequests:
+		return u.Requests
+	case MetricBytes:
+		return u.Bytes
+	case MetricCost:
+		return u.Cost
+	}
+	return 0
+}
+
+func (u *Usage) add(delta Usage) {
+	u.Requests = nonNegative(u.Requests + delta.Requests)
+	u.Bytes = nonNegative(u.Bytes + delta.Bytes)
+	u.Cost = nonNegative(u.Cost + delta.Cost)
+}
+
+func nonNegative(v int64) int64 {
+	if v < 0 {
+		return 0
+	}
+	return v
+}
+
+var metrics = []string{MetricRequests, MetricBytes, MetricCost}
+
+type Limits struct {
+	Hourly  Usage `config:"hourly" json:"hourly"`
+	Daily   Usage `config:"daily" json:"daily"`
+	Monthly Usage `config:"monthly" json:"monthly"`
+}
+
+func (l *Limits) Get(window string) Usage {
+	switch window {
+	case WindowHourly:
+		return l.Hourly
+	case WindowDaily:
+		return l.Daily
+	case WindowMonthly:
+		return l.Monthly
+	}
+	return Usage{}
+}
+
+// Merge returns the limits overridden by the non-zero values, a negative
+// value removes the limit
+func (l Limits) Merge(override *Limits) Limits {
+	if override == nil {
+		return l
+	}
+	merge := func(base, o Usage) Usage {
+		pick := func(b, v int64) int64 {
+			if v < 0 {
+				return 0
+			}
+			if v > 0 {
+				return v
+			}
+			return b
+		}
+		return Usage{
+			Requests: pick(base.Requests, o.Requests),
+			Bytes:    pick(base.Bytes, o.Bytes),
+			Cost:     pick(base.Cost, o.Cost),
+		}
+	}
+	return Limits{
+		Hourly:  merge(l.Hourly, override.Hourly),
+		Daily:   merge(l.Daily, override.Daily),
+		Monthly: merge(l.Monthly, override.Monthly),
+	}
+}
+
+func ValidWindow(window string) bool {
+	for _, v := range Windows {
+		if v == window {
+			return true
+		}
+	}
+	return false
+}
+
+// Period returns the id of the window at the time, in UTC
+func Period(window string, t time.Time) string {
+	t = t.UTC()
+	switch window {
+	case WindowHourly:
+		return t.Format("2006010215")
+	case WindowDaily:
+		return t.Format("20060102")
+	default:
+		return t.Format("200601")
+	}
+}
+
+// NextReset returns when the window at the time ends
+func NextReset(window string, t time.Time) time.Time {
+	t = t.UTC()
+	switch window {
+	case WindowHourly:
+		return t.Truncate(time.Hour).Add(time.Hour)
+	case WindowDaily:
+		return time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.UTC)
+	default:
+		return time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+	}
+}
+
+// Result is the outcome of a check, the window and metric are the ones
+// closest to the limit, or the exceeded one
+type Result struct {
+	Allowed   bool
+	Soft      bool //the soft limit was reached
+	Limited   bool //there is a limit on the tenant
+	Window    string
+	Metric    string
+	Limit     int64
+	Remaining int64
+	Reset     time.Time
+}
+
+type kvStore interface {
+	AddValue(bucket string, key []byte, value []byte) error
+	GetValue(bucket string, key []byte) ([]byte, error)
+	DeleteKey(bucket string, key []byte) error
+}
+
+type frameworkKV struct{}
+
+func (frameworkKV) AddValue(bucket string, key []byte, value []byte) error {
+	return kv.AddValue(bucket, key, value)
+}
+
+func (frameworkKV) GetValue(bucket string, key []byte) ([]byte, error) {
+	return kv.GetValue(bucket, key)
+}
+
+func (frameworkKV) DeleteKey(bucket string, key []byte) error {
+	return kv.DeleteKey(bucket, key)
+}
+
+type counter struct {
+	window string
+	period string
+	usage  Usage
+	dirty  bool
+}
+
+// Store keeps the counters in memory and persists them to the kv store
+// periodically, counters of the past periods are kept in the kv store only
+type Store struct {
+	locker       sync.Mutex
+	kv           kvStore
+	counters     map[string]*counter
+	tenants      map[string]bool
+	tenantsDirty bool
+	overrides    map[string]*Limits
+	defaults     map[string]Limits
+}
+
+func newStore(kv kvStore) *Store {
+	return &Store{
+		kv:        kv,
+		counters:  map[string]*counter{},
+		overrides: map[string]*Limits{},
+		defaults:  map[string]Limits{},
+	}
+}
+
+var defaultStore = newStore(frameworkKV{})
+var startOnce = sync.Once{}
+
+// Start persists the counters in the background, and on shutdown
+func Start(flushInterval time.Duration) {
+	startOnce.Do(func() {
+		go func() {
+			for {
+				time.Sleep(flushInterval)
+				defaultStore.Flush(time.Now())
+			}
+		}()
+		global.RegisterShutdownCallback(func() {
+			defaultStore.Flush(time.Now())
+		})
+	})
+}
+
+func Default() *Store {
+	return defaultStore
+}
+
+// TenantID joins the namespace and the key of the tenant
+func TenantID(namespace, key string) string {
+	return namespace + ":" + key
+}
+
+func namespaceOf(tenant string) string {
+	if i := strings.IndexByte(tenant, ':'); i >= 0 {
+		return tenant[:i]
+	}
+	return tenant
+}
+
+func counterKey(tenant, window, period string) string {
+	return fmt.Sprintf("%v/%v/%v", tenant, window, period)
+}
+
+// RegisterDefaultLimits sets the limits of the tenants in the namespace
+func (s *Store) RegisterDefaultLimits(namespace string, limits Limits) {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	s.defaults[namespace] = limits
+}
+
+// lookupCounter returns the existing counter of the current period, loaded
+// from the kv store if absent, nil if the tenant has no usage in the period
+func (s *Store) lookupCounter(tenant, window string, now time.Time) *counter {
+	period := Period(window, now)
+	key := counterKey(tenant, window, period)
+	if c, ok := s.counters[key]; ok {
+		return c
+	}
+	data, err := s.kv.GetValue(usageBucket, []byte(key))
+	if err != nil || len(data) == 0 {
+		return nil
+	}
+	c := &counter{window: window, period: period}
+	if err := json.Unmarshal(data, &c.usage); err != nil {
+		log.Warnf("invalid quota usage of [%v], %v", key, err)
+	}
+	s.counters[key] = c
+	return c
+}
+
+// getCounter returns the counter of the current period, created and the
+// tenant registered if absent
+func (s *Store) getCounter(tenant, window string, now time.Time) *counter {
+	if c := s.lookupCounter(tenant, window, now); c != nil {
+		return c
+	}
+	period := Period(window, now)
+	c := &counter{window: window, period: period}
+	s.counters[counterKey(tenant, window, period)] = c
+	s.loadTenants()
+	if !s.tenants[tenant] {
+		s.tenants[tenant] = true
+		s.tenantsDirty = true
+	}
+	return c
+}
+
+func (s *Store) loadTenants() {
+	if s.tenants != nil {
+		return
+	}
+	s.tenants = map[string]bool{}
+	data, err := s.kv.GetValue(usageBucket, []byte(tenantsKey))
+	if err != nil || len(data) == 0 {
+		return
+	}
+	tenants := []string{}
+	if err := json.Unmarshal(data, &tenants); err != nil {
+		log.Warnf("invalid quota tenants, %v", err)
+		return
+	}
+	for _, v := range tenants {
+		s.tenants[v] = true
+	}
+}
+
+func (s *Store) getOverride(tenant string) *Limits {
+	if v, ok := s.overrides[tenant]; ok {
+		return v
+	}
+	var override *Limits
+	data, err := s.kv.GetValue(limitsBucket, []byte(tenant))
+	if err == nil && len(data) > 0 {
+		override = &Limits{}
+		if err := json.Unmarshal(data, override); err != nil {
+			log.Warnf("invalid quota limits of [%v], %v", tenant, err)
+			override = nil
+		}
+	}
+	s.overrides[tenant] = override
+	return override
+}
+
+func (s *Store) effectiveLimits(tenant string, limits Limits) Limits {
+	return limits.Merge(s.getOverride(tenant))
+}
+
+// Check charges the usage if no hard limit would be exceeded, the soft limit
+// is reached when the usage is over the ratio of any limit
+func (s *Store) Check(tenant string, delta Usage, limits Limits, softRatio float64, now time.Time) Result {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	limits = s.effectiveLimits(tenant, limits)
+	counters := make([]*counter, len(Windows))
+	result := Result{Allowed: true}
+	tightest := 2.0
+
+	for i, window := range Windows {
+		c := s.getCounter(tenant, window, now)
+		counters[i] = c
+		limit := limits.Get(window)
+		for _, metric := range metrics {
+			max := limit.get(metric)
+			if max <= 0 {
+				continue
+			}
+			used := c.usage.get(metric) + delta.get(metric)
+			if used > max {
+				return Result{
+					Limited:   true,
+					Window:    window,
+					Metric:    metric,
+					Limit:     max,
+					Remaining: nonNegative(max - c.usage.get(metric)),
+					Reset:     NextReset(window, now),
+				}
+			}
+			ratio := float64(max-used) / float64(max)
+			if ratio < tightest {
+				tightest = ratio
+				result.Limited = true
+				result.Window = window
+				result.Metric = metric
+				result.Limit = max
+				result.Remaining = max - used
+				result.Reset = NextReset(window, now)
+			}
+			if softRatio > 0 && float64(used) >= float64(max)*softRatio {
+				result.Soft = true
+			}
+		}
+	}
+
+	for _, c := range counters {
+		c.usage.add(delta)
+		c.dirty = true
+	}
+	return result
+}
+
+// GetUsage returns the usage of the current periods
+func (s *Store) GetUsage(tenant string, now time.Time) map[string]Usage {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	usage := map[string]Usage{}
+	for _, window := range Windows {
+		if c := s.lookupCounter(tenant, window, now); c != nil {
+			usage[window] = c.usage
+		} else {
+			usage[window] = Usage{}
+		}
+	}
+	return usage
+}
+
+// GetLimits returns the limits of the tenant, with the override applied
+func (s *Store) GetLimits(tenant string) (Limits, *Limits) {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	override := s.getOverride(tenant)
+	return s.defaults[namespaceOf(tenant)].Merge(override), override
+}
+
+// SetLimits overrides the limits of the tenant, nil removes the override
+func (s *Store) SetLimits(tenant string, override *Limits) error {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	if override == nil {
+		if err := s.kv.DeleteKey(limitsBucket, []byte(tenant)); err != nil {
+			return err
+		}
+		s.overrides[tenant] = nil
+		return nil
+	}
+	data, err := json.Marshal(override)
+	if err != nil {
+		return err
+	}
+	if err := s.kv.AddValue(limitsBucket, []byte(tenant), data); err != nil {
+		return err
+	}
+	s.overrides[tenant] = override
+	return nil
+}
+
+// Reset clears the usage of the current period, of all the windows if the window is empty
+func (s *Store) Reset(tenant, window string, now time.Time) {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	for _, w := range Windows {
+		if window != "" && w != window {
+			continue
+		}
+		//the unknown tenants are not registered by the reset
+		if c := s.lookupCounter(tenant, w, now); c != nil {
+			c.usage = Usage{}
+			c.dirty = true
+		}
+	}
+}
+
+// Adjust adds the delta to the usage of the current period, negative values give credits
+func (s *Store) Adjust(tenant, window string, delta Usage, now time.Time) Usage {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	c := s.getCounter(tenant, window, now)
+	c.usage.add(delta)
+	c.dirty = true
+	return c.usage
+}
+
+// Tenants returns all the tenants that ever used the quota
+func (s *Store) Tenants() []string {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	s.loadTenants()
+	tenants := make([]string, 0, len(s.tenants))
+	for k := range s.tenants {
+		tenants = append(tenants, k)
+	}
+	sort.Strings(tenants)
+	return tenants
+}
+
+// Flush persists the changed counters, and removes the counters of the past periods from memory
+func (s *Store) Flush(now time.Time) {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	for key, c := range s.counters {
+		if c.dirty {
+			data, _ := json.Marshal(c.usage)
+			if err := s.kv.AddValue(usageBucket, []byte(key), data); err != nil {
+				log.Errorf("failed to save quota usage of [%v], %v", key, err)
+				continue
+			}
+			c.dirty = false
+		}
+		if c.period != Period(c.window, now) {
+			delete(s.counters, key)
+		}
+	}
+
+	if s.tenantsDirty {
+		tenants := make([]string, 0, len(s.tenants))
+		for k := range s.tenants {
+			tenants = append(tenants, k)
+		}
+		data, _ := json.Marshal(tenants)
+		if err := s.kv.AddValue(usageBucket, []byte(tenantsKey), data); err != nil {
+			log.Errorf("failed to save quota tenants, %v", err)
+			return
+		}
+		s.tenantsDirty = false
+	}
+}
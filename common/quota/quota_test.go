@@ -0,0 +1,161 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package quota
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type memoryKV struct {
+	locker sync.Mutex
+	data   map[string][]byte
+}
+
+func newMemoryKV() *memoryKV {
+	return &memoryKV{data: map[string][]byte{}}
+}
+
+func (m *memoryKV) AddValue(bucket string, key []byte, value []byte) error {
+	m.locker.Lock()
+	defer m.locker.Unlock()
+	m.data[bucket+"/"+string(key)] = value
+	return nil
+}
+
+func (m *memoryKV) GetValue(bucket string, key []byte) ([]byte, error) {
+	m.locker.Lock()
+	defer m.locker.Unlock()
+	return m.data[bucket+"/"+string(key)], nil
+}
+
+func (m *memoryKV) DeleteKey(bucket string, key []byte) error {
+	m.locker.Lock()
+	defer m.locker.Unlock()
+	delete(m.data, bucket+"/"+string(key))
+	return nil
+}
+
+func TestPeriodAndReset(t *testing.T) {
+	now := time.Date(2023, 12, 31, 23, 30, 0, 0, time.UTC)
+	assert.Equal(t, "2023123123", Period(WindowHourly, now))
+	assert.Equal(t, "20231231", Period(WindowDaily, now))
+	assert.Equal(t, "202312", Period(WindowMonthly, now))
+
+	assert.Equal(t, time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), NextReset(WindowHourly, now))
+	assert.Equal(t, time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), NextReset(WindowDaily, now))
+	assert.Equal(t, time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), NextReset(WindowMonthly, now))
+}
+
+func TestCheckHardAndSoftLimits(t *testing.T) {
+	s := newStore(newMemoryKV())
+	now := time.Date(2023, 6, 1, 10, 0, 0, 0, time.UTC)
+	limits := Limits{Daily: Usage{Requests: 10}, Monthly: Usage{Cost: 1000}}
+
+	for i := 0; i < 7; i++ {
+		r := s.Check("user:medcl", Usage{Requests: 1, Cost: 10}, limits, 0.8, now)
+		assert.True(t, r.Allowed)
+		assert.False(t, r.Soft)
+	}
+
+	r := s.Check("user:medcl", Usage{Requests: 1, Cost: 10}, limits, 0.8, now)
+	assert.True(t, r.Allowed)
+	assert.True(t, r.Soft)
+	assert.Equal(t, WindowDaily, r.Window)
+	assert.Equal(t, MetricRequests, r.Metric)
+	assert.Equal(t, int64(2), r.Remaining)
+
+	s.Check("user:medcl", Usage{Requests: 2}, limits, 0.8, now)
+	r = s.Check("user:medcl", Usage{Requests: 1}, limits, 0.8, now)
+	assert.False(t, r.Allowed)
+	assert.Equal(t, int64(0), r.Remaining)
+
+	//rejected requests are not charged, and the next day starts over
+	assert.Equal(t, int64(10), s.GetUsage("user:medcl", now)[WindowDaily].Requests)
+	r = s.Check("user:medcl", Usage{Requests: 1}, limits, 0.8, now.Add(24*time.Hour))
+	assert.True(t, r.Allowed)
+	assert.Equal(t, int64(11), s.GetUsage("user:medcl", now)[WindowMonthly].Requests)
+}
+
+func TestOverrideLimits(t *testing.T) {
+	s := newStore(newMemoryKV())
+	now := time.Now()
+	limits := Limits{Hourly: Usage{Requests: 1}}
+	s.RegisterDefaultLimits("user", limits)
+
+	assert.True(t, s.Check("user:a", Usage{Requests: 1}, limits, 0, now).Allowed)
+	assert.False(t, s.Check("user:a", Usage{Requests: 1}, limits, 0, now).Allowed)
+
+	assert.Nil(t, s.SetLimits("user:a", &Limits{Hourly: Usage{Requests: -1}, Daily: Usage{Bytes: 100}}))
+	effective, override := s.GetLimits("user:a")
+	assert.NotNil(t, override)
+	assert.Equal(t, int64(0), effective.Hourly.Requests)
+	assert.Equal(t, int64(100), effective.Daily.Bytes)
+	assert.True(t, s.Check("user:a", Usage{Requests: 1}, limits, 0, now).Allowed)
+
+	assert.Nil(t, s.SetLimits("user:a", nil))
+	assert.False(t, s.Check("user:a", Usage{Requests: 1}, limits, 0, now).Allowed)
+}
+
+func TestResetAdjustAndFlush(t *testing.T) {
+	kv := newMemoryKV()
+	s := newStore(kv)
+	now := time.Date(2023, 6, 1, 10, 0, 0, 0, time.UTC)
+
+	s.Check("api_key:k1", Usage{Requests: 5, Bytes: 500}, Limits{}, 0, now)
+	s.Reset("api_key:k1", WindowHourly, now)
+	usage := s.GetUsage("api_key:k1", now)
+	assert.Equal(t, int64(0), usage[WindowHourly].Requests)
+	assert.Equal(t, int64(5), usage[WindowDaily].Requests)
+
+	assert.Equal(t, Usage{Requests: 0, Bytes: 400}, s.Adjust("api_key:k1", WindowDaily, Usage{Requests: -10, Bytes: -100}, now))
+
+	s.Flush(now.Add(2 * time.Hour))
+	assert.Equal(t, 2, len(s.counters), "the counter of the past hour is removed")
+
+	//a new store loads the usage from the kv store
+	s2 := newStore(kv)
+	assert.Equal(t, []string{"api_key:k1"}, s2.Tenants())
+	usage = s2.GetUsage("api_key:k1", now)
+	assert.Equal(t, int64(400), usage[WindowDaily].Bytes)
+	assert.Equal(t, int64(5), usage[WindowMonthly].Requests)
+}
+
+func TestReadsDontRegisterTenants(t *testing.T) {
+	kv := newMemoryKV()
+	s := newStore(kv)
+	now := time.Date(2023, 6, 1, 10, 0, 0, 0, time.UTC)
+
+	usage := s.GetUsage("api_key:unknown", now)
+	assert.Equal(t, Usage{}, usage[WindowDaily])
+	s.Reset("api_key:unknown", "", now)
+	assert.Empty(t, s.Tenants())
+	assert.Empty(t, s.counters)
+
+	s.Flush(now)
+	assert.Empty(t, kv.data)
+}
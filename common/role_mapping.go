@@ -26,10 +26,172 @@
 
 package common
 
-func GetLDAPGroupsMappingRoles(str []string) []string {
-	var roles []string
-	roles = append(roles, "admin")
-	return roles
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"infini.sh/framework/core/orm"
+)
+
+// RoleMappingRule maps the groups to the roles, any of the groups matching
+// any of the conditions applies the rule
+type RoleMappingRule struct {
+	Roles  []string `config:"roles"`
+	Groups []string `config:"groups"` //exact group names or DNs, case insensitive
+	CN     []string `config:"cn"`     //wildcard patterns on the CN of the groups
+	Regex  []string `config:"regex"`  //regular expressions on the whole groups
+}
+
+type RoleMappingConfig struct {
+	DefaultRoles []string          `config:"default_roles"` //roles of all the users
+	Rules        []RoleMappingRule `config:"rules"`
+	Deny         []RoleMappingRule `config:"deny"` //the roles are revoked, or the user is denied if no roles
+}
+
+type roleMappingRule struct {
+	RoleMappingRule
+	groups map[string]bool
+	cn     []string
+	regex  []*regexp.Regexp
+}
+
+func newRoleMappingRule(rule RoleMappingRule) (*roleMappingRule, error) {
+	r := &roleMappingRule{RoleMappingRule: rule, groups: map[string]bool{}}
+	for _, v := range rule.Groups {
+		r.groups[normalizeDN(v)] = true
+	}
+	for _, v := range rule.CN {
+		v = strings.ToLower(v)
+		if _, err := path.Match(v, ""); err != nil {
+			return nil, fmt.Errorf("invalid cn pattern [%v], %v", v, err)
+		}
+		r.cn = append(r.cn, v)
+	}
+	for _, v := range rule.Regex {
+		//anchored, so that `admins` doesn't grant the group `not-admins`
+		re, err := regexp.Compile("^(?:" + v + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex [%v], %v", v, err)
+		}
+		r.regex = append(r.regex, re)
+	}
+	return r, nil
+}
+
+func (r *roleMappingRule) match(group string) bool {
+	if r.groups[normalizeDN(group)] {
+		return true
+	}
+	cn := strings.ToLower(groupCN(group))
+	for _, v := range r.cn {
+		if ok, _ := path.Match(v, cn); ok {
+			return true
+		}
+	}
+	for _, v := range r.regex {
+		if v.MatchString(group) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *roleMappingRule) matchAny(groups []string) bool {
+	for _, v := range groups {
+		if r.match(v) {
+			return true
+		}
+	}
+	return false
+}
+
+// RoleMapping maps the groups of the users, such as the ldap groups, to the
+// roles
+type RoleMapping struct {
+	defaultRoles []string
+	rules        []*roleMappingRule
+	deny         []*roleMappingRule
+}
+
+func NewRoleMapping(cfg RoleMappingConfig) (*RoleMapping, error) {
+	m := &RoleMapping{defaultRoles: cfg.DefaultRoles}
+	for _, v := range cfg.Rules {
+		r, err := newRoleMappingRule(v)
+		if err != nil {
+			return nil, err
+		}
+		m.rules = append(m.rules, r)
+	}
+	for _, v := range cfg.Deny {
+		r, err := newRoleMappingRule(v)
+		if err != nil {
+			return nil, err
+		}
+		m.deny = append(m.deny, r)
+	}
+	return m, nil
+}
+
+// Map returns the sorted roles of the groups, and false if the user is denied
+func (m *RoleMapping) Map(groups []string) ([]string, bool) {
+	roles := map[string]bool{}
+	for _, v := range m.defaultRoles {
+		roles[v] = true
+	}
+	for _, r := range m.rules {
+		if r.matchAny(groups) {
+			for _, v := range r.Roles {
+				roles[v] = true
+			}
+		}
+	}
+	for _, r := range m.deny {
+		if !r.matchAny(groups) {
+			continue
+		}
+		if len(r.Roles) == 0 {
+			return []string{}, false
+		}
+		for _, v := range r.Roles {
+			delete(roles, v)
+		}
+	}
+
+	result := make([]string, 0, len(roles))
+	for k := range roles {
+		result = append(result, k)
+	}
+	sort.Strings(result)
+	return result, true
+}
+
+// normalizeDN lowercases the dn and removes the spaces around the separators
+func normalizeDN(dn string) string {
+	parts := strings.Split(dn, ",")
+	for i, v := range parts {
+		if j := strings.Index(v, "="); j > 0 {
+			v = strings.TrimSpace(v[:j]) + "=" + strings.TrimSpace(v[j+1:])
+		}
+		parts[i] = strings.TrimSpace(v)
+	}
+	return strings.ToLower(strings.Join(parts, ","))
+}
+
+// groupCN returns the value of the first rdn of the group dn, or the group
+// as is if it is not a dn, eg: admins of cn=admins,ou=groups,dc=example,dc=com
+func groupCN(group string) string {
+	rdn := group
+	if i := strings.Index(group, ","); i >= 0 {
+		rdn = group[:i]
+	}
+	if i := strings.Index(rdn, "="); i > 0 {
+		return strings.TrimSpace(rdn[i+1:])
+	}
+	return group
 }
 
 type Roles struct {
@@ -48,14 +210,66 @@ type ClusterPermission struct {
 }
 
 type IndexPermission struct {
-	Name                   []string
-	Privileges             []string
-	FieldSecurity          []string
-	Query                  string
-	AllowRestrictedIndices string
+	Name                   []string          `config:"names" json:"names,omitempty" elastic_mapping:"names: { type: keyword }"`
+	Privileges             []string          `config:"privileges" json:"privileges,omitempty" elastic_mapping:"privileges: { type: keyword }"`
+	FieldSecurity          []FieldPermission `config:"field_security" json:"field_security,omitempty" elastic_mapping:"field_security: { type: object }"`
+	Query                  string            `config:"query" json:"query,omitempty" elastic_mapping:"query: { type: text }"`
+	AllowRestrictedIndices bool              `config:"allow_restricted_indices" json:"allow_restricted_indices,omitempty" elastic_mapping:"allow_restricted_indices: { type: boolean }"`
 }
 
 type FieldPermission struct {
-	Name []string
-	Type string //grant,deny,mask
+	Name   []string `config:"names" json:"names,omitempty" elastic_mapping:"names: { type: keyword }"`
+	Type   string   `config:"type" json:"type,omitempty" elastic_mapping:"type: { type: keyword }"`       //grant,deny,mask
+	Method string   `config:"method" json:"method,omitempty" elastic_mapping:"method: { type: keyword }"` //hash or redact, for the mask
+}
+
+// RoleConfig is the named set of the privileges granted to the users, the
+// cluster privileges are the privilege names or the action patterns
+type RoleConfig struct {
+	orm.ORMObjectBase
+
+	Name        string            `config:"name" json:"name,omitempty" elastic_mapping:"name:{type:keyword,fields:{text: {type: text}}}"`
+	Description string            `config:"description" json:"description,omitempty" elastic_mapping:"description: { type: text }"`
+	Cluster     []string          `config:"cluster" json:"cluster,omitempty" elastic_mapping:"cluster: { type: keyword }"`
+	Indices     []IndexPermission `config:"indices" json:"indices,omitempty" elastic_mapping:"indices: { type: object }"`
+}
+
+var roleLocker = sync.RWMutex{}
+var roleConfigs map[string]RoleConfig = make(map[string]RoleConfig)
+
+// RegisterRoleConfig registers the role by its name, and by its id if any
+func RegisterRoleConfig(role RoleConfig) {
+	if role.Name == "" {
+		role.Name = role.ID
+	}
+	if role.ID == "" {
+		role.ID = role.Name
+	}
+
+	roleLocker.Lock()
+	defer roleLocker.Unlock()
+	roleConfigs[role.ID] = role
+	roleConfigs[role.Name] = role
+}
+
+// RemoveRoleConfig removes the role by its name and its id
+func RemoveRoleConfig(role RoleConfig) {
+	if role.Name == "" {
+		role.Name = role.ID
+	}
+	if role.ID == "" {
+		role.ID = role.Name
+	}
+
+	roleLocker.Lock()
+	defer roleLocker.Unlock()
+	delete(roleConfigs, role.ID)
+	delete(roleConfigs, role.Name)
+}
+
+func GetRoleConfig(name string) (RoleConfig, bool) {
+	roleLocker.RLock()
+	defer roleLocker.RUnlock()
+	v, ok := roleConfigs[name]
+	return v, ok
 }
@@ -0,0 +1,83 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package common
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRoleMapping(t *testing.T) {
+	m, err := NewRoleMapping(RoleMappingConfig{
+		DefaultRoles: []string{"reader"},
+		Rules: []RoleMappingRule{
+			{Roles: []string{"admin"}, Groups: []string{"CN=Admins, OU=Groups, DC=example, DC=com"}},
+			{Roles: []string{"ops"}, CN: []string{"ops-*"}},
+			{Roles: []string{"lead", "writer"}, Regex: []string{`team-.+-leads`}},
+		},
+		Deny: []RoleMappingRule{
+			{Roles: []string{"admin"}, CN: []string{"contractors"}},
+			{Groups: []string{"disabled"}},
+		},
+	})
+	assert.NoError(t, err)
+
+	roles, ok := m.Map(nil)
+	assert.True(t, ok)
+	assert.Equal(t, []string{"reader"}, roles)
+
+	roles, ok = m.Map([]string{"cn=admins,ou=groups,dc=example,dc=com"})
+	assert.True(t, ok)
+	assert.Equal(t, []string{"admin", "reader"}, roles)
+
+	roles, ok = m.Map([]string{"cn=OPS-EU,ou=groups,dc=example,dc=com", "team-search-leads"})
+	assert.True(t, ok)
+	assert.Equal(t, []string{"lead", "ops", "reader", "writer"}, roles)
+
+	roles, ok = m.Map([]string{"cn=admins,ou=groups,dc=example,dc=com", "cn=contractors,ou=groups,dc=example,dc=com"})
+	assert.True(t, ok)
+	assert.Equal(t, []string{"reader"}, roles)
+
+	roles, ok = m.Map([]string{"old-team-search-leads", "team-search-leads-archive"})
+	assert.True(t, ok)
+	assert.Equal(t, []string{"reader"}, roles)
+
+	roles, ok = m.Map([]string{"ops-us", "Disabled"})
+	assert.False(t, ok)
+	assert.Empty(t, roles)
+}
+
+func TestRoleMappingInvalidRule(t *testing.T) {
+	_, err := NewRoleMapping(RoleMappingConfig{Rules: []RoleMappingRule{{Roles: []string{"a"}, Regex: []string{"("}}}})
+	assert.Error(t, err)
+	_, err = NewRoleMapping(RoleMappingConfig{Deny: []RoleMappingRule{{CN: []string{"["}}}})
+	assert.Error(t, err)
+}
+
+func TestGroupCN(t *testing.T) {
+	assert.Equal(t, "admins", groupCN("cn=admins,ou=groups,dc=example,dc=com"))
+	assert.Equal(t, "admins", groupCN("CN = admins"))
+	assert.Equal(t, "admins", groupCN("admins"))
+}
@@ -41,5 +41,6 @@ package common
 
 const CACHEABLE = "request_cacheable"
 const CACHEHASH = "request_cache_hash"
+const QUERYCOST = "elastic_query_cost"
 
 var FaviconPath = []byte("/favicon.ico")
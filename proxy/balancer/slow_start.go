@@ -0,0 +1,54 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package balancer
+
+import "time"
+
+// SlowStartWeight returns the effective weight of a node which joined the
+// upstream at the given time, the weight ramps linearly from 1 to the full
+// weight within the window, zero joined time means the node is already warm
+func SlowStartWeight(weight int, joined time.Time, window time.Duration, now time.Time) int {
+	if weight <= 0 {
+		return 1
+	}
+
+	if window <= 0 || joined.IsZero() {
+		return weight
+	}
+
+	elapsed := now.Sub(joined)
+	if elapsed >= window {
+		return weight
+	}
+
+	if elapsed <= 0 {
+		return 1
+	}
+
+	w := int(int64(weight) * int64(elapsed) / int64(window))
+	if w < 1 {
+		w = 1
+	}
+	return w
+}
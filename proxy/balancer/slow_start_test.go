@@ -0,0 +1,53 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package balancer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSlowStartWeight(t *testing.T) {
+	now := time.Now()
+	window := 100 * time.Second
+
+	assert.Equal(t, 100, SlowStartWeight(100, time.Time{}, window, now))
+	assert.Equal(t, 100, SlowStartWeight(100, now, 0, now))
+	assert.Equal(t, 1, SlowStartWeight(100, now, window, now))
+	assert.Equal(t, 25, SlowStartWeight(100, now.Add(-25*time.Second), window, now))
+	assert.Equal(t, 100, SlowStartWeight(100, now.Add(-200*time.Second), window, now))
+	assert.Equal(t, 1, SlowStartWeight(0, now.Add(-200*time.Second), window, now))
+}
+
+func TestNewBalancerWithScaledWeights(t *testing.T) {
+	b := NewBalancer([]int{100, 1})
+	hits := map[int]int{}
+	for i := 0; i < 101; i++ {
+		hits[b.Distribute()]++
+	}
+	assert.Equal(t, 100, hits[0])
+	assert.Equal(t, 1, hits[1])
+}
@@ -0,0 +1,83 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package balancer
+
+import (
+	"sync"
+
+	"infini.sh/framework/core/errors"
+)
+
+// SmoothBalancer is the smooth weighted round-robin balancer, the picks of a
+// node are spread evenly by its share, and the state is kept while the
+// weights are updated, so the nodes ramping up take their share of traffic
+// even at low request rates
+type SmoothBalancer struct {
+	mutex   sync.Mutex
+	weights []int
+	current []int
+}
+
+func NewSmoothBalancer(ws []int) *SmoothBalancer {
+	if len(ws) == 0 {
+		panic(errors.Errorf("weight %v is invalid", ws))
+	}
+	b := &SmoothBalancer{current: make([]int, len(ws))}
+	b.weights = append([]int{}, ws...)
+	return b
+}
+
+// Update replaces the weights of the same nodes, the accumulated state is kept
+func (b *SmoothBalancer) Update(ws []int) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if len(ws) != len(b.weights) {
+		return false
+	}
+	copy(b.weights, ws)
+	return true
+}
+
+func (b *SmoothBalancer) Distribute() int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	total := 0
+	best := -1
+	for i, w := range b.weights {
+		if w < 0 {
+			w = 0
+		}
+		b.current[i] += w
+		total += w
+		if best < 0 || b.current[i] > b.current[best] {
+			best = i
+		}
+	}
+	if total == 0 {
+		return 0
+	}
+	b.current[best] -= total
+	return best
+}
@@ -0,0 +1,86 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package balancer
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSmoothBalancer(t *testing.T) {
+	b := NewSmoothBalancer([]int{5, 1, 1})
+	picks := []int{}
+	for i := 0; i < 7; i++ {
+		picks = append(picks, b.Distribute())
+	}
+	assert.Equal(t, []int{0, 0, 1, 0, 2, 0, 0}, picks)
+
+	assert.False(t, b.Update([]int{1, 1}))
+	assert.True(t, b.Update([]int{1, 1, 0}))
+	hits := map[int]int{}
+	for i := 0; i < 10; i++ {
+		hits[b.Distribute()]++
+	}
+	assert.Equal(t, 0, hits[2])
+	assert.Equal(t, 5, hits[0])
+}
+
+// the weights are updated every second while a node ramps up, the node takes
+// its share of traffic even with a few requests per update
+func TestSmoothBalancerRampShare(t *testing.T) {
+	window := 30 * time.Second
+	joined := time.Unix(1700000000, 0)
+	b := NewSmoothBalancer([]int{100, 1})
+
+	hits := 0
+	expected := 0.0
+	for tick := 0; tick < 30; tick++ {
+		now := joined.Add(time.Duration(tick) * time.Second)
+		ws := []int{100, SlowStartWeight(100, joined, window, now)}
+		assert.True(t, b.Update(ws))
+		for i := 0; i < 2; i++ {
+			if b.Distribute() == 1 {
+				hits++
+			}
+		}
+		expected += 2 * float64(ws[1]) / float64(ws[0]+ws[1])
+	}
+	assert.True(t, hits > 0)
+	assert.True(t, math.Abs(float64(hits)-expected) <= 2, "hits %v, expected %v", hits, expected)
+
+	//the share of the late window is close to the weights, not full weight
+	late := 0
+	for tick := 0; tick < 10; tick++ {
+		assert.True(t, b.Update([]int{100, 50}))
+		for i := 0; i < 3; i++ {
+			if b.Distribute() == 1 {
+				late++
+			}
+		}
+	}
+	assert.InDelta(t, 10, late, 1)
+}
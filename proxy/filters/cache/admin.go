@@ -0,0 +1,337 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package cache
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/go-redis/redis/v8"
+	"infini.sh/framework/core/util"
+)
+
+// backendCounters are the stats of a backend on this gateway
+type backendCounters struct {
+	hits      int64
+	l2Hits    int64 //hits of redis in the tiered cache
+	misses    int64
+	sets      int64
+	setBytes  int64
+	evictions int64
+}
+
+func (c *backendCounters) hit() {
+	atomic.AddInt64(&c.hits, 1)
+}
+
+func (c *backendCounters) l2Hit() {
+	atomic.AddInt64(&c.l2Hits, 1)
+}
+
+func (c *backendCounters) miss() {
+	atomic.AddInt64(&c.misses, 1)
+}
+
+func (c *backendCounters) set(size int) {
+	atomic.AddInt64(&c.sets, 1)
+	atomic.AddInt64(&c.setBytes, int64(size))
+}
+
+func (c *backendCounters) evicted(n int64) {
+	atomic.AddInt64(&c.evictions, n)
+}
+
+var counters = map[string]*backendCounters{
+	ristrettoCache: {},
+	cacheCCache:    {},
+	cacheRedis:     {},
+	cacheTiered:    {},
+}
+
+// backendName returns the backend of the cache type, unknown types fall back
+// to the default ristretto cache
+func backendName(cacheType string) string {
+	if _, ok := counters[cacheType]; ok {
+		return cacheType
+	}
+	return defaultCacheType
+}
+
+func getCounters(cacheType string) *backendCounters {
+	return counters[backendName(cacheType)]
+}
+
+var backends = map[string]*RequestCache{}
+var backendsLocker = sync.RWMutex{}
+
+// registerBackend keeps the first cache of each backend, for the admin
+// operations
+func registerBackend(p *RequestCache) {
+	backendsLocker.Lock()
+	defer backendsLocker.Unlock()
+	name := backendName(p.config.CacheType)
+	if _, ok := backends[name]; !ok {
+		backends[name] = p
+	}
+}
+
+func getBackends() []*RequestCache {
+	backendsLocker.RLock()
+	defer backendsLocker.RUnlock()
+	names := make([]string, 0, len(backends))
+	for k := range backends {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	result := make([]*RequestCache, 0, len(names))
+	for _, k := range names {
+		result = append(result, backends[k])
+	}
+	return result
+}
+
+// EntryInfo is the metadata of a cached entry
+type EntryInfo struct {
+	Key          string    `json:"key"`
+	Backend      string    `json:"backend"`
+	Size         int       `json:"size"`
+	Path         string    `json:"path,omitempty"`
+	Indices      []string  `json:"indices,omitempty"`
+	Created      time.Time `json:"created,omitempty"`
+	Stale        bool      `json:"stale"`
+	TTLRemaining int64     `json:"ttl_remaining_in_ms"`
+	Hits         int64     `json:"hits"`
+}
+
+// ListKeys returns the keys with the prefix of each backend, the local
+// backends list the entries cached by this gateway, while redis lists all
+func ListKeys(prefix string, size int) map[string][]string {
+	now := time.Now()
+	result := map[string][]string{}
+	for _, p := range getBackends() {
+		name := backendName(p.config.CacheType)
+		if !usesRedis(name) {
+			keys := []string{}
+			for _, k := range registry.list(prefix, 0, now) {
+				if info, ok := registry.get(k); ok && info.backend == name {
+					keys = append(keys, k)
+					if size > 0 && len(keys) >= size {
+						break
+					}
+				}
+			}
+			result[name] = keys
+			continue
+		}
+		keys, err := p.scanRedisKeys(prefix, size)
+		if err != nil {
+			log.Warnf("failed to list cache keys of redis, %v", err)
+		}
+		result[name] = keys
+	}
+	return result
+}
+
+// GetEntry returns the metadata of the entry, without counting as a hit
+func GetEntry(key string) (*EntryInfo, bool) {
+	now := time.Now()
+	for _, p := range getBackends() {
+		data, ttl, found := p.peekCache(key, now)
+		if !found {
+			continue
+		}
+		entry := &EntryInfo{
+			Key:          key,
+			Backend:      backendName(p.config.CacheType),
+			Size:         len(data),
+			TTLRemaining: ttl.Milliseconds(),
+			Hits:         hitCounters.get(key),
+		}
+		if info, ok := registry.get(key); ok {
+			entry.Path = info.path
+			entry.Indices = info.indices
+		}
+		if meta, _ := decodeEntry(data); meta != nil {
+			entry.Path = meta.Path
+			entry.Created = time.Unix(0, meta.Created*int64(time.Millisecond))
+			entry.Stale = meta.stale(now)
+		}
+		return entry, true
+	}
+	return nil, false
+}
+
+// peekCache returns the entry and its remaining ttl
+func (p *RequestCache) peekCache(key string, now time.Time) ([]byte, time.Duration, bool) {
+	switch backendName(p.config.CacheType) {
+	case cacheRedis, cacheTiered:
+		pipe := p.getRedisClient().Pipeline()
+		get := pipe.Get(ctx, p.redisKey(key))
+		ttl := pipe.PTTL(ctx, p.redisKey(key))
+		if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+			log.Warnf("failed to get cache [%v] from redis, %v", key, err)
+			return nil, 0, false
+		}
+		data, err := get.Bytes()
+		if err != nil {
+			return nil, 0, false
+		}
+		if data, err = decompress(data); err != nil {
+			return nil, 0, false
+		}
+		return data, ttl.Val(), true
+	case cacheCCache:
+		item := ccCache.GetOrCreateSecondaryCache("default").Get(key)
+		if item == nil {
+			return nil, 0, false
+		}
+		return item.Value().([]byte), item.TTL(), true
+	default:
+		o, found := cache.Get(key)
+		if !found {
+			return nil, 0, false
+		}
+		var ttl time.Duration
+		if info, ok := registry.get(key); ok {
+			ttl = info.expire.Sub(now)
+		}
+		return o.([]byte), ttl, true
+	}
+}
+
+// PurgeKeys evicts the entries of the keys from all the backends
+func PurgeKeys(keys []string) int {
+	count := evictLocal(registry.takeKeys(keys))
+	for _, p := range getBackends() {
+		if !usesRedis(p.config.CacheType) {
+			continue
+		}
+		n, err := p.deleteRedisKeys(keys)
+		if err != nil {
+			log.Warnf("failed to purge cache of keys %v, %v", keys, err)
+		}
+		getCounters(p.config.CacheType).evicted(int64(n))
+		count += n
+		p.publish(invalidationEvent{Keys: keys})
+	}
+	return count
+}
+
+// PurgePrefix evicts the entries with the prefix from all the backends, all
+// entries if the prefix is empty
+func PurgePrefix(prefix string) int {
+	count := evictLocal(registry.takePrefix(prefix))
+	for _, p := range getBackends() {
+		if !usesRedis(p.config.CacheType) {
+			continue
+		}
+		keys, err := p.scanRedisKeys(prefix, 0)
+		if err == nil {
+			var n int
+			n, err = p.deleteRedisKeys(keys)
+			getCounters(p.config.CacheType).evicted(int64(n))
+			count += n
+		}
+		if err != nil {
+			log.Warnf("failed to purge cache of prefix [%v], %v", prefix, err)
+		}
+		if prefix == "" {
+			p.deleteRedisTags()
+			p.publish(invalidationEvent{All: true})
+		} else {
+			p.publish(invalidationEvent{Prefix: prefix})
+		}
+	}
+	return count
+}
+
+func (p *RequestCache) deleteRedisTags() {
+	client := p.getRedisClient()
+	tags, err := client.ZRange(ctx, redisTagsKey, 0, -1).Result()
+	if err != nil {
+		log.Warnf("failed to purge cache tags, %v", err)
+		return
+	}
+	for _, tag := range tags {
+		client.Del(ctx, p.redisTagKey(tag))
+	}
+	client.Del(ctx, redisTagsKey)
+}
+
+// PurgeIndices evicts the entries of the indices from all the backends
+func PurgeIndices(indices []string) int {
+	count := 0
+	local := false
+	for _, p := range getBackends() {
+		if usesRedis(p.config.CacheType) {
+			count += p.InvalidateIndices(indices)
+		} else if !local {
+			//the local entries of all the local backends are evicted at once
+			count += p.InvalidateIndices(indices)
+			local = true
+		}
+	}
+	return count
+}
+
+// GetStats returns the stats of the backends in use
+func GetStats() util.MapStr {
+	now := time.Now()
+	entries, size := registry.usage(now)
+	result := util.MapStr{}
+	for _, p := range getBackends() {
+		name := backendName(p.config.CacheType)
+		c := getCounters(name)
+		hits := atomic.LoadInt64(&c.hits)
+		misses := atomic.LoadInt64(&c.misses)
+		item := util.MapStr{
+			"hits":      hits,
+			"misses":    misses,
+			"sets":      atomic.LoadInt64(&c.sets),
+			"set_bytes": atomic.LoadInt64(&c.setBytes),
+			"evictions": atomic.LoadInt64(&c.evictions),
+			"entries":   entries[name],
+			"bytes":     size[name],
+		}
+		if hits+misses > 0 {
+			item["hit_ratio"] = float64(hits) / float64(hits+misses)
+		}
+		if name == cacheTiered {
+			item["l2_hits"] = atomic.LoadInt64(&c.l2Hits)
+		}
+		if usesRedis(name) {
+			item["redis_available"] = breaker.allow(now)
+		}
+		if name == ristrettoCache && cache != nil && cache.Metrics != nil {
+			item["keys_evicted"] = cache.Metrics.KeysEvicted()
+			item["cost_added"] = cache.Metrics.CostAdded()
+			item["cost_evicted"] = cache.Metrics.CostEvicted()
+		}
+		result[name] = item
+	}
+	return result
+}
@@ -0,0 +1,93 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package cache
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+const compressionZstd = "zstd"
+const compressionSnappy = "snappy"
+
+// CompressionConfig compresses the large entries stored in redis
+type CompressionConfig struct {
+	Algorithm string `config:"algorithm"` //zstd, snappy or none
+	MinSize   int    `config:"min_size"`  //entries smaller than it are stored as is
+}
+
+var compressedMagic = []byte("\x00GWZ")
+
+var zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest))
+var zstdDecoder, _ = zstd.NewReader(nil)
+
+// compress returns the compressed data with the header, or the data as is if
+// it is small or not compressible
+func compress(data []byte, cfg *CompressionConfig) []byte {
+	if len(data) < cfg.MinSize {
+		return data
+	}
+
+	var flag byte
+	var compressed []byte
+	switch cfg.Algorithm {
+	case compressionZstd:
+		flag = 'z'
+		compressed = zstdEncoder.EncodeAll(data, nil)
+	case compressionSnappy:
+		flag = 's'
+		compressed = snappy.Encode(nil, data)
+	default:
+		return data
+	}
+	if len(compressed)+len(compressedMagic)+1 >= len(data) {
+		return data
+	}
+
+	buffer := bytes.NewBuffer(make([]byte, 0, len(compressedMagic)+1+len(compressed)))
+	buffer.Write(compressedMagic)
+	buffer.WriteByte(flag)
+	buffer.Write(compressed)
+	return buffer.Bytes()
+}
+
+// decompress returns the original data, the data without the header is
+// returned as is, such as the entries stored without compression
+func decompress(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, compressedMagic) || len(data) <= len(compressedMagic) {
+		return data, nil
+	}
+	payload := data[len(compressedMagic)+1:]
+	switch data[len(compressedMagic)] {
+	case 'z':
+		return zstdDecoder.DecodeAll(payload, nil)
+	case 's':
+		return snappy.Decode(nil, payload)
+	default:
+		return nil, fmt.Errorf("unknown compression [%c]", data[len(compressedMagic)])
+	}
+}
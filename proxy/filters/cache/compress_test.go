@@ -0,0 +1,57 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package cache
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompress(t *testing.T) {
+	data := bytes.Repeat([]byte(`{"took":1,"hits":{"total":{"value":0}}}`), 200)
+	for _, algorithm := range []string{compressionZstd, compressionSnappy} {
+		cfg := &CompressionConfig{Algorithm: algorithm, MinSize: 1024}
+		compressed := compress(data, cfg)
+		assert.True(t, bytes.HasPrefix(compressed, compressedMagic), algorithm)
+		assert.Less(t, len(compressed), len(data))
+		v, err := decompress(compressed)
+		assert.NoError(t, err)
+		assert.Equal(t, data, v)
+	}
+
+	//small or disabled
+	small := []byte(`{"took":1}`)
+	assert.Equal(t, small, compress(small, &CompressionConfig{Algorithm: compressionZstd, MinSize: 1024}))
+	assert.Equal(t, data, compress(data, &CompressionConfig{Algorithm: "none"}))
+
+	//stored without compression
+	v, err := decompress(small)
+	assert.NoError(t, err)
+	assert.Equal(t, small, v)
+
+	_, err = decompress(append(append([]byte{}, compressedMagic...), 'x', 1, 2))
+	assert.Error(t, err)
+}
@@ -0,0 +1,691 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package cache
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var defaultSupportedAggregations = []string{"sum", "avg", "min", "max", "value_count", "cardinality"}
+
+var calendarIntervals = map[string]int64{
+	"1m": int64(time.Minute / time.Millisecond), "minute": int64(time.Minute / time.Millisecond),
+	"1h": int64(time.Hour / time.Millisecond), "hour": int64(time.Hour / time.Millisecond),
+	"1d": 24 * int64(time.Hour/time.Millisecond), "day": 24 * int64(time.Hour/time.Millisecond),
+}
+
+var intervalUnits = map[string]int64{
+	"ms": 1,
+	"s":  int64(time.Second / time.Millisecond),
+	"m":  int64(time.Minute / time.Millisecond),
+	"h":  int64(time.Hour / time.Millisecond),
+	"d":  24 * int64(time.Hour/time.Millisecond),
+}
+
+var timeLayouts = []string{time.RFC3339Nano, "2006-01-02T15:04:05.999999999", "2006-01-02T15:04", "2006-01-02"}
+
+var rangeKeys = []string{"gte", "gt", "lte", "lt", "from", "to", "include_lower", "include_upper", "format"}
+
+// histogramSearch is a search with a single date_histogram aggregation over
+// a time range, which can be split by the buckets
+type histogramSearch struct {
+	name           string
+	field          string
+	interval       int64 //milliseconds
+	offset         int64 //offset of the time zone in milliseconds
+	from, to       int64 //inclusive range of the query in milliseconds
+	minDocCount    int64
+	hasBounds      bool
+	boundsMin      int64
+	boundsMax      int64
+	trackTotalHits int64 //-1 means accurate, 0 means disabled
+}
+
+// histogramRequest is the parsed request, the located objects are modified
+// in place to generate the bodies
+type histogramRequest struct {
+	root      map[string]interface{}
+	histogram map[string]interface{}
+	rng       map[string]interface{}
+}
+
+// segment is an inclusive time range to search upstream
+type segment struct {
+	from, to int64
+}
+
+func decodeJSON(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	return decoder.Decode(v)
+}
+
+// parseHistogramRequest locates the date_histogram aggregation and the range
+// query of the histogram field, the error tells why the search can't be split
+func parseHistogramRequest(body []byte, supported []string) (*histogramSearch, *histogramRequest, error) {
+	req := &histogramRequest{}
+	if err := decodeJSON(body, &req.root); err != nil || req.root == nil {
+		return nil, nil, errors.New("invalid json body")
+	}
+	if size, ok := req.root["size"].(json.Number); !ok || size.String() != "0" {
+		return nil, nil, errors.New("size is not 0")
+	}
+	for _, k := range []string{"suggest", "pit", "search_after", "collapse"} {
+		if _, ok := req.root[k]; ok {
+			return nil, nil, fmt.Errorf("[%v] is not supported", k)
+		}
+	}
+
+	aggs, ok := getAggregations(req.root)
+	if !ok || len(aggs) != 1 {
+		return nil, nil, errors.New("not a single aggregation")
+	}
+
+	search := &histogramSearch{trackTotalHits: 10000}
+	var agg map[string]interface{}
+	for k, v := range aggs {
+		search.name = k
+		agg, _ = v.(map[string]interface{})
+	}
+	req.histogram, ok = agg["date_histogram"].(map[string]interface{})
+	if !ok {
+		return nil, nil, errors.New("not a date_histogram aggregation")
+	}
+	for k, v := range agg {
+		switch k {
+		case "date_histogram", "meta":
+		case "aggs", "aggregations":
+			sub, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, nil, errors.New("invalid sub aggregations")
+			}
+			if err := checkAggregations(sub, supported); err != nil {
+				return nil, nil, err
+			}
+		default:
+			return nil, nil, fmt.Errorf("[%v] is not supported", k)
+		}
+	}
+
+	if err := search.parseHistogram(req.histogram); err != nil {
+		return nil, nil, err
+	}
+
+	ranges := findRanges(req.root["query"], search.field)
+	if len(ranges) != 1 {
+		return nil, nil, fmt.Errorf("no single range query of field [%v]", search.field)
+	}
+	req.rng = ranges[0]
+	if err := search.parseRange(req.rng); err != nil {
+		return nil, nil, err
+	}
+
+	offset, err := zoneOffset(getString(req.histogram, "time_zone"), search.from, search.to)
+	if err != nil {
+		return nil, nil, err
+	}
+	search.offset = offset
+
+	if v, ok := req.histogram["extended_bounds"].(map[string]interface{}); ok && len(v) > 0 {
+		search.hasBounds = true
+		if search.boundsMin, err = parseTime(v["min"], getString(req.histogram, "format")); err == nil {
+			search.boundsMax, err = parseTime(v["max"], getString(req.histogram, "format"))
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid extended_bounds, %v", err)
+		}
+		if search.boundsMin < search.align(search.from) || search.boundsMax > search.to {
+			return nil, nil, errors.New("extended_bounds is out of the range")
+		}
+	}
+
+	switch v := req.root["track_total_hits"].(type) {
+	case nil:
+	case bool:
+		if v {
+			search.trackTotalHits = -1
+		} else {
+			search.trackTotalHits = 0
+		}
+	case json.Number:
+		n, err := v.Int64()
+		if err != nil {
+			return nil, nil, errors.New("invalid track_total_hits")
+		}
+		search.trackTotalHits = n
+	default:
+		return nil, nil, errors.New("invalid track_total_hits")
+	}
+
+	return search, req, nil
+}
+
+func getAggregations(obj map[string]interface{}) (map[string]interface{}, bool) {
+	if v, ok := obj["aggs"].(map[string]interface{}); ok {
+		return v, true
+	}
+	v, ok := obj["aggregations"].(map[string]interface{})
+	return v, ok
+}
+
+func getString(obj map[string]interface{}, key string) string {
+	v, _ := obj[key].(string)
+	return v
+}
+
+// checkAggregations makes sure all the sub aggregations are computed within
+// each bucket, such as the metrics, so that the buckets can be searched
+// separately
+func checkAggregations(aggs map[string]interface{}, supported []string) error {
+	for name, v := range aggs {
+		agg, ok := v.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("invalid aggregation [%v]", name)
+		}
+		for k, x := range agg {
+			switch k {
+			case "meta":
+			case "aggs", "aggregations":
+				sub, ok := x.(map[string]interface{})
+				if !ok {
+					return fmt.Errorf("invalid sub aggregations of [%v]", name)
+				}
+				if err := checkAggregations(sub, supported); err != nil {
+					return err
+				}
+			default:
+				if !containsIgnoreCase(supported, k) {
+					return fmt.Errorf("aggregation [%v] of type [%v] is not supported", name, k)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (s *histogramSearch) parseHistogram(histogram map[string]interface{}) error {
+	for k, v := range histogram {
+		switch k {
+		case "field":
+			s.field, _ = v.(string)
+		case "fixed_interval", "calendar_interval", "interval":
+			str, _ := v.(string)
+			interval, ok := calendarIntervals[str]
+			if !ok && k != "calendar_interval" {
+				interval, ok = parseFixedInterval(str)
+			}
+			if !ok {
+				return fmt.Errorf("interval [%v] is not supported", v)
+			}
+			s.interval = interval
+		case "min_doc_count":
+			n, ok := v.(json.Number)
+			if !ok {
+				return errors.New("invalid min_doc_count")
+			}
+			count, err := n.Int64()
+			if err != nil {
+				return errors.New("invalid min_doc_count")
+			}
+			s.minDocCount = count
+		case "order":
+			order, ok := v.(map[string]interface{})
+			if !ok || len(order) != 1 || getString(order, "_key") != "asc" {
+				return errors.New("order is not supported")
+			}
+		case "keyed":
+			if keyed, _ := v.(bool); keyed {
+				return errors.New("keyed is not supported")
+			}
+		case "time_zone", "format", "extended_bounds":
+		default:
+			return fmt.Errorf("[%v] of date_histogram is not supported", k)
+		}
+	}
+	if s.field == "" || s.interval <= 0 {
+		return errors.New("invalid date_histogram")
+	}
+	return nil
+}
+
+func parseFixedInterval(v string) (int64, bool) {
+	for _, unit := range []string{"ms", "s", "m", "h", "d"} {
+		if !strings.HasSuffix(v, unit) {
+			continue
+		}
+		n, err := strconv.ParseInt(strings.TrimSuffix(v, unit), 10, 64)
+		if err != nil || n <= 0 {
+			return 0, false
+		}
+		return n * intervalUnits[unit], true
+	}
+	return 0, false
+}
+
+// findRanges returns the range queries of the field, which must match, the
+// other clauses are not split
+func findRanges(query interface{}, field string) []map[string]interface{} {
+	obj, ok := query.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	result := []map[string]interface{}{}
+	if rng, ok := obj["range"].(map[string]interface{}); ok {
+		if v, ok := rng[field].(map[string]interface{}); ok {
+			result = append(result, v)
+		}
+	}
+	if b, ok := obj["bool"].(map[string]interface{}); ok {
+		for _, clause := range []string{"filter", "must"} {
+			switch v := b[clause].(type) {
+			case []interface{}:
+				for _, x := range v {
+					result = append(result, findRanges(x, field)...)
+				}
+			case map[string]interface{}:
+				result = append(result, findRanges(v, field)...)
+			}
+		}
+	}
+	return result
+}
+
+func (s *histogramSearch) parseRange(rng map[string]interface{}) error {
+	format := getString(rng, "format")
+	if tz := getString(rng, "time_zone"); tz != "" && !isUTC(tz) {
+		return errors.New("time_zone of the range query is not supported")
+	}
+	if _, ok := rng["include_lower"]; ok {
+		return errors.New("include_lower is not supported")
+	}
+	if _, ok := rng["include_upper"]; ok {
+		return errors.New("include_upper is not supported")
+	}
+
+	hasFrom, hasTo := false, false
+	for k, v := range rng {
+		var adjust int64
+		switch k {
+		case "gt":
+			adjust = 1
+			fallthrough
+		case "gte", "from":
+			t, err := parseTime(v, format)
+			if err != nil {
+				return err
+			}
+			s.from, hasFrom = t+adjust, true
+		case "lt":
+			adjust = -1
+			fallthrough
+		case "lte", "to":
+			t, err := parseTime(v, format)
+			if err != nil {
+				return err
+			}
+			s.to, hasTo = t+adjust, true
+		}
+	}
+	if !hasFrom || !hasTo || s.from > s.to {
+		return errors.New("the range is not bounded")
+	}
+	return nil
+}
+
+func isUTC(tz string) bool {
+	switch strings.ToUpper(tz) {
+	case "UTC", "Z", "GMT", "ETC/UTC", "+00:00", "-00:00":
+		return true
+	}
+	return false
+}
+
+// parseTime parses the absolute time in milliseconds, date math such as
+// `now-15m` is not supported
+func parseTime(v interface{}, format string) (int64, error) {
+	switch x := v.(type) {
+	case json.Number:
+		if n, err := x.Int64(); err == nil {
+			return n, nil
+		}
+		f, err := x.Float64()
+		if err != nil {
+			return 0, err
+		}
+		return int64(math.Floor(f)), nil
+	case string:
+		if format != "" && !strings.Contains(format, "epoch_millis") && !strings.Contains(format, "date_optional_time") {
+			return 0, fmt.Errorf("format [%v] is not supported", format)
+		}
+		if n, err := strconv.ParseInt(x, 10, 64); err == nil {
+			return n, nil
+		}
+		for _, layout := range timeLayouts {
+			if t, err := time.Parse(layout, x); err == nil {
+				return t.UnixNano() / int64(time.Millisecond), nil
+			}
+		}
+		return 0, fmt.Errorf("time [%v] is not supported", x)
+	}
+	return 0, fmt.Errorf("time [%v] is not supported", v)
+}
+
+// zoneOffset returns the offset of the time zone, which must not change
+// within the range
+func zoneOffset(tz string, from, to int64) (int64, error) {
+	if tz == "" || isUTC(tz) {
+		return 0, nil
+	}
+	var loc *time.Location
+	if tz[0] == '+' || tz[0] == '-' {
+		t, err := time.Parse("-07:00", tz)
+		if err != nil {
+			return 0, fmt.Errorf("time_zone [%v] is not supported", tz)
+		}
+		loc = t.Location()
+	} else {
+		var err error
+		loc, err = time.LoadLocation(tz)
+		if err != nil {
+			return 0, fmt.Errorf("time_zone [%v] is not supported", tz)
+		}
+	}
+	_, start := time.Unix(0, from*int64(time.Millisecond)).In(loc).Zone()
+	_, end := time.Unix(0, to*int64(time.Millisecond)).In(loc).Zone()
+	if start != end {
+		return 0, fmt.Errorf("offset of time_zone [%v] changes within the range", tz)
+	}
+	return int64(start) * 1000, nil
+}
+
+// align returns the start of the bucket of the time
+func (s *histogramSearch) align(t int64) int64 {
+	r := (t + s.offset) % s.interval
+	if r < 0 {
+		r += s.interval
+	}
+	return t - r
+}
+
+// bucketCount returns the number of the buckets within the range
+func (s *histogramSearch) bucketCount() int64 {
+	return (s.align(s.to)-s.align(s.from))/s.interval + 1
+}
+
+// bucketStarts returns the starts of the buckets within the range
+func (s *histogramSearch) bucketStarts() []int64 {
+	result := make([]int64, 0, s.bucketCount())
+	for t := s.align(s.from); t <= s.to; t += s.interval {
+		result = append(result, t)
+	}
+	return result
+}
+
+// complete returns true if the whole bucket is within the range, so it can
+// be cached once ended
+func (s *histogramSearch) complete(start int64) bool {
+	return start >= s.from && start+s.interval-1 <= s.to
+}
+
+// segments returns the ranges of the buckets missing from the cache
+func (s *histogramSearch) segments(starts []int64, cached map[int64]json.RawMessage) []segment {
+	result := []segment{}
+	var current *segment
+	for _, start := range starts {
+		if _, ok := cached[start]; ok {
+			current = nil
+			continue
+		}
+		from := start
+		if from < s.from {
+			from = s.from
+		}
+		to := start + s.interval - 1
+		if to > s.to {
+			to = s.to
+		}
+		if current != nil {
+			current.to = to
+			continue
+		}
+		result = append(result, segment{from: from, to: to})
+		current = &result[len(result)-1]
+	}
+	return result
+}
+
+// mergeSegments merges the segments separated by at most maxGap, and then
+// the closest ones until there are at most max segments, the cached buckets
+// in the gaps are searched again, in exchange of fewer requests
+func mergeSegments(segments []segment, maxGap int64, max int) []segment {
+	if len(segments) < 2 {
+		return segments
+	}
+	result := []segment{segments[0]}
+	for _, seg := range segments[1:] {
+		last := &result[len(result)-1]
+		if seg.from-last.to-1 <= maxGap {
+			last.to = seg.to
+			continue
+		}
+		result = append(result, seg)
+	}
+	for max > 0 && len(result) > max {
+		closest := 0
+		for i := 1; i < len(result)-1; i++ {
+			if result[i+1].from-result[i].to < result[closest+1].from-result[closest].to {
+				closest = i
+			}
+		}
+		result[closest].to = result[closest+1].to
+		result = append(result[:closest+1], result[closest+2:]...)
+	}
+	return result
+}
+
+// cacheKey returns the request without the range, which is shared by the
+// buckets of the same search
+func (req *histogramRequest) cacheKey() []byte {
+	saved := map[string]interface{}{}
+	for _, k := range rangeKeys {
+		if v, ok := req.rng[k]; ok {
+			saved[k] = v
+			delete(req.rng, k)
+		}
+	}
+	bounds, hasBounds := req.histogram["extended_bounds"]
+	delete(req.histogram, "extended_bounds")
+	minDocCount, hasMinDocCount := req.histogram["min_doc_count"]
+	delete(req.histogram, "min_doc_count")
+	tth, hasTTH := req.root["track_total_hits"]
+	delete(req.root, "track_total_hits")
+
+	data, _ := json.Marshal(canonicalize(req.root))
+
+	for k, v := range saved {
+		req.rng[k] = v
+	}
+	if hasBounds {
+		req.histogram["extended_bounds"] = bounds
+	}
+	if hasMinDocCount {
+		req.histogram["min_doc_count"] = minDocCount
+	}
+	if hasTTH {
+		req.root["track_total_hits"] = tth
+	}
+	return data
+}
+
+// segmentBody returns the body to search the segment, all the buckets of
+// the segment are returned, the min_doc_count is applied on merging
+func (req *histogramRequest) segmentBody(s *histogramSearch, seg segment) ([]byte, error) {
+	for _, k := range rangeKeys {
+		delete(req.rng, k)
+	}
+	req.rng["gte"] = seg.from
+	req.rng["lte"] = seg.to
+	req.rng["format"] = "epoch_millis"
+	req.histogram["min_doc_count"] = 0
+	req.histogram["extended_bounds"] = map[string]interface{}{"min": s.align(seg.from), "max": s.align(seg.to)}
+	return json.Marshal(req.root)
+}
+
+// parseBuckets returns the buckets of the segment from the response
+func (s *histogramSearch) parseBuckets(response []byte, seg segment) (map[int64]json.RawMessage, error) {
+	obj := struct {
+		Aggregations map[string]struct {
+			Buckets []json.RawMessage `json:"buckets"`
+		} `json:"aggregations"`
+	}{}
+	if err := json.Unmarshal(response, &obj); err != nil {
+		return nil, err
+	}
+	agg, ok := obj.Aggregations[s.name]
+	if !ok {
+		return nil, fmt.Errorf("aggregation [%v] is missing", s.name)
+	}
+	result := map[int64]json.RawMessage{}
+	for _, v := range agg.Buckets {
+		bucket := struct {
+			Key json.Number `json:"key"`
+		}{}
+		if err := decodeJSON(v, &bucket); err != nil {
+			return nil, err
+		}
+		key, err := bucket.Key.Int64()
+		if err != nil {
+			return nil, err
+		}
+		if key >= s.align(seg.from) && key <= seg.to {
+			result[key] = v
+		}
+	}
+	return result, nil
+}
+
+func bucketDocCount(bucket json.RawMessage) int64 {
+	obj := struct {
+		DocCount int64 `json:"doc_count"`
+	}{}
+	json.Unmarshal(bucket, &obj)
+	return obj.DocCount
+}
+
+// merge builds the response of the whole range from the buckets, the first
+// response of the segments is the base of the response
+func (s *histogramSearch) merge(buckets map[int64]json.RawMessage, responses [][]byte) ([]byte, error) {
+	if len(responses) == 0 {
+		return nil, errors.New("no response to merge")
+	}
+
+	var base map[string]interface{}
+	var took int64
+	timedOut := false
+	for i, v := range responses {
+		obj := map[string]interface{}{}
+		if err := decodeJSON(v, &obj); err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			base = obj
+		}
+		if n, ok := obj["took"].(json.Number); ok {
+			if x, _ := n.Int64(); x > took {
+				took = x
+			}
+		}
+		if b, _ := obj["timed_out"].(bool); b {
+			timedOut = true
+		}
+	}
+
+	type item struct {
+		key      int64
+		docCount int64
+		data     json.RawMessage
+	}
+	items := []item{}
+	var total int64
+	for _, start := range s.bucketStarts() {
+		data, ok := buckets[start]
+		if !ok {
+			return nil, fmt.Errorf("bucket [%v] is missing", start)
+		}
+		count := bucketDocCount(data)
+		total += count
+		if s.minDocCount > 0 && count < s.minDocCount {
+			continue
+		}
+		items = append(items, item{key: start, docCount: count, data: data})
+	}
+	if s.minDocCount <= 0 {
+		//empty buckets are only returned between the non-empty buckets and the bounds
+		lower, upper := int64(math.MaxInt64), int64(math.MinInt64)
+		if s.hasBounds {
+			lower, upper = s.align(s.boundsMin), s.align(s.boundsMax)
+		}
+		for len(items) > 0 && items[0].docCount == 0 && items[0].key < lower {
+			items = items[1:]
+		}
+		for len(items) > 0 && items[len(items)-1].docCount == 0 && items[len(items)-1].key > upper {
+			items = items[:len(items)-1]
+		}
+	}
+
+	aggs, _ := base["aggregations"].(map[string]interface{})
+	agg, ok := aggs[s.name].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("aggregation [%v] is missing", s.name)
+	}
+	list := make([]json.RawMessage, 0, len(items))
+	for _, v := range items {
+		list = append(list, v.data)
+	}
+	agg["buckets"] = list
+	base["took"] = took
+	base["timed_out"] = timedOut
+
+	if hits, ok := base["hits"].(map[string]interface{}); ok && s.trackTotalHits != 0 {
+		value, relation := total, "eq"
+		if s.trackTotalHits > 0 && total > s.trackTotalHits {
+			value, relation = s.trackTotalHits, "gte"
+		}
+		switch hits["total"].(type) {
+		case map[string]interface{}:
+			hits["total"] = map[string]interface{}{"value": value, "relation": relation}
+		case json.Number:
+			hits["total"] = value
+		}
+	}
+
+	return json.Marshal(base)
+}
@@ -0,0 +1,320 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package cache
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"infini.sh/framework/core/config"
+	"infini.sh/framework/core/global"
+	"infini.sh/framework/core/pipeline"
+	"infini.sh/framework/core/stats"
+	"infini.sh/framework/core/util"
+	"infini.sh/framework/lib/fasthttp"
+	"infini.sh/gateway/common"
+)
+
+// DateHistogramCache splits the date_histogram searches by the buckets, the
+// ended buckets are cached and only the others are searched upstream
+type DateHistogramCache struct {
+	RequestCache
+	Flow                  string   `config:"flow"` //flow to search the missing buckets
+	ContinueAfterMatch    bool     `config:"continue"`
+	SupportedAggregations []string `config:"supported_aggregations"` //sub aggregations computed within each bucket
+	ImmutableAfter        string   `config:"immutable_after"`        //buckets ended before this period are cached
+	BucketTTL             string   `config:"bucket_ttl"`
+	MaxBuckets            int      `config:"max_buckets"`
+	MaxSegments           int      `config:"max_segments"`    //max requests to search the missing buckets
+	MaxConcurrency        int      `config:"max_concurrency"` //max concurrent requests of a search
+	MergeGap              int      `config:"merge_gap"`       //searches the cached buckets between the missing ones, if no more than this
+	AddResponseHeader     bool     `config:"add_response_header"`
+
+	flow           common.FilterFlow
+	immutableAfter time.Duration
+	bucketTTL      time.Duration
+}
+
+func init() {
+	pipeline.RegisterFilterPluginWithConfigMetadata("date_histogram_cache", pipeline.FilterConfigChecked(NewDateHistogramCache, pipeline.RequireFields("flow")), &DateHistogramCache{})
+}
+
+func NewDateHistogramCache(c *config.Config) (pipeline.Filter, error) {
+
+	cfg := defaultConfig
+
+	if err := c.Unpack(&cfg); err != nil {
+		return nil, fmt.Errorf("failed to unpack the filter configuration : %s", err)
+	}
+	if err := cfg.Redis.validate(); err != nil {
+		return nil, err
+	}
+
+	runner := DateHistogramCache{
+		SupportedAggregations: defaultSupportedAggregations,
+		ImmutableAfter:        "1m",
+		BucketTTL:             "24h",
+		MaxBuckets:            10000,
+		MaxSegments:           10,
+		MaxConcurrency:        4,
+		MergeGap:              2,
+		AddResponseHeader:     true,
+	}
+	if err := c.Unpack(&runner); err != nil {
+		return nil, fmt.Errorf("failed to unpack the filter configuration : %s", err)
+	}
+	runner.RequestCache.config = &cfg
+	runner.flow = common.MustGetFlow(runner.Flow)
+	runner.immutableAfter = util.GetDurationOrDefault(runner.ImmutableAfter, time.Minute)
+	runner.bucketTTL = util.GetDurationOrDefault(runner.BucketTTL, 24*time.Hour)
+	if runner.MaxConcurrency <= 0 {
+		runner.MaxConcurrency = 1
+	}
+
+	runner.initCache()
+
+	return &runner, nil
+}
+
+func (filter *DateHistogramCache) Name() string {
+	return "date_histogram_cache"
+}
+
+func (filter *DateHistogramCache) process(ctx *fasthttp.RequestCtx) {
+	ctx.Resume()
+	filter.flow.Process(ctx)
+	if !filter.ContinueAfterMatch {
+		ctx.Finished()
+	}
+}
+
+// parse returns the date_histogram search of the request, or the reason to
+// process the request as usual
+func (filter *DateHistogramCache) parse(ctx *fasthttp.RequestCtx) (*histogramSearch, *histogramRequest, error) {
+	method := ctx.Request.Header.Method()
+	if !util.CompareStringAndBytes(method, fasthttp.MethodGet) && !util.CompareStringAndBytes(method, fasthttp.MethodPost) {
+		return nil, nil, fmt.Errorf("method [%s] is not supported", method)
+	}
+	path := strings.TrimRight(string(ctx.Request.PhantomURI().Path()), "/")
+	if !strings.HasSuffix(path, "/_search") {
+		return nil, nil, fmt.Errorf("path [%v] is not a search", path)
+	}
+	search, req, err := parseHistogramRequest(ctx.Request.GetRawBody(), filter.SupportedAggregations)
+	if err != nil {
+		return nil, nil, err
+	}
+	if filter.MaxBuckets > 0 && search.bucketCount() > int64(filter.MaxBuckets) {
+		return nil, nil, fmt.Errorf("too many buckets, %v", search.bucketCount())
+	}
+	return search, req, nil
+}
+
+// keyPrefix returns the prefix of the bucket keys, the buckets are shared by
+// the requests differing only in the range
+func (filter *DateHistogramCache) keyPrefix(ctx *fasthttp.RequestCtx, search *histogramSearch, req *histogramRequest) string {
+	buffer := bytes.Buffer{}
+	buffer.Write(ctx.Request.Header.PeekAny(fasthttp.AuthHeaderKeys))
+	buffer.Write(newLine)
+	buffer.Write(userIdentity(ctx))
+	uri := ctx.Request.PhantomURI()
+	buffer.Write(uri.Host())
+	buffer.Write(uri.Path())
+	buffer.Write(newLine)
+	args := []string{}
+	uri.QueryArgs().VisitAll(func(key, value []byte) {
+		args = append(args, string(key)+"="+string(value))
+	})
+	sort.Strings(args)
+	buffer.WriteString(strings.Join(args, "&"))
+	buffer.Write(newLine)
+	buffer.WriteString(fmt.Sprintf("%v,%v", search.interval, search.offset))
+	buffer.Write(newLine)
+	buffer.Write(req.cacheKey())
+	return "date_histogram:" + util.MD5digestString(buffer.Bytes()) + ":"
+}
+
+type segmentResult struct {
+	status int
+	body   []byte
+}
+
+// searchSegments searches the segments through the flow, with at most
+// max_concurrency requests at the same time
+func (filter *DateHistogramCache) searchSegments(ctx *fasthttp.RequestCtx, search *histogramSearch, req *histogramRequest, segments []segment) ([]segmentResult, error) {
+	bodies := make([][]byte, 0, len(segments))
+	for _, seg := range segments {
+		body, err := req.segmentBody(search, seg)
+		if err != nil {
+			return nil, err
+		}
+		bodies = append(bodies, body)
+	}
+
+	data := ctx.Request.Encode()
+	results := make([]segmentResult, len(segments))
+	wg := sync.WaitGroup{}
+	tokens := make(chan struct{}, filter.MaxConcurrency)
+	for i := range bodies {
+		wg.Add(1)
+		tokens <- struct{}{}
+		go func(i int) {
+			defer func() {
+				if r := recover(); r != nil {
+					log.Errorf("error on searching the segment of date_histogram, %v", r)
+				}
+				<-tokens
+				wg.Done()
+			}()
+			c := &fasthttp.RequestCtx{EnrichedMetadata: true}
+			if err := c.Request.Decode(data); err != nil {
+				log.Errorf("failed to decode the request of date_histogram, %v", err)
+				return
+			}
+			c.Request.SetRawBody(bodies[i])
+			filter.flow.Process(c)
+			results[i] = segmentResult{status: c.Response.StatusCode(), body: c.Response.GetRawBody()}
+		}(i)
+	}
+	wg.Wait()
+	return results, nil
+}
+
+func (filter *DateHistogramCache) Filter(ctx *fasthttp.RequestCtx) {
+	search, req, err := filter.parse(ctx)
+	if err != nil {
+		if global.Env().IsDebug {
+			log.Tracef("request [%v] is not split, %v", ctx.PhantomURI().String(), err)
+		}
+		stats.Increment("date_histogram_cache", "skipped")
+		filter.process(ctx)
+		return
+	}
+
+	//the buckets are evicted with the indices, by the writes or the purges
+	path := string(ctx.Request.PhantomURI().Path())
+	indices := getPathIndices(path)
+
+	prefix := filter.keyPrefix(ctx, search, req)
+	immutableBefore := time.Now().Add(-filter.immutableAfter).UnixNano() / int64(time.Millisecond)
+	starts := search.bucketStarts()
+	buckets := map[int64]json.RawMessage{}
+	cacheable := map[int64]bool{}
+	for _, start := range starts {
+		if !search.complete(start) || start+search.interval > immutableBefore {
+			continue
+		}
+		cacheable[start] = true
+		if data, ok := filter.getTaggedCache(fmt.Sprintf("%v%v", prefix, start), path, indices); ok {
+			buckets[start] = data
+		}
+	}
+	cached := len(buckets)
+
+	segments := search.segments(starts, buckets)
+	if len(segments) == 0 {
+		//the last bucket is searched anyway, for the metadata of the response
+		last := starts[len(starts)-1]
+		delete(buckets, last)
+		segments = search.segments(starts, buckets)
+		cached--
+	}
+	segments = mergeSegments(segments, int64(filter.MergeGap)*search.interval, filter.MaxSegments)
+
+	results, err := filter.searchSegments(ctx, search, req, segments)
+	if err != nil {
+		log.Errorf("failed to split the date_histogram search, %v", err)
+		filter.process(ctx)
+		return
+	}
+
+	tagged := map[string]int{}
+
+	responses := make([][]byte, 0, len(results))
+	for i, v := range results {
+		if v.status == 0 {
+			filter.process(ctx)
+			return
+		}
+		if v.status != fasthttp.StatusOK {
+			//the failure is returned as is
+			ctx.Response.SetStatusCode(v.status)
+			ctx.Response.SetBody(v.body)
+			ctx.SetContentType(util.ContentTypeJson)
+			stats.Increment("date_histogram_cache", "failed")
+			if !filter.ContinueAfterMatch {
+				ctx.Finished()
+			}
+			return
+		}
+		fetched, err := search.parseBuckets(v.body, segments[i])
+		if err != nil {
+			log.Errorf("failed to parse the buckets of date_histogram, %v", err)
+			filter.process(ctx)
+			return
+		}
+		for start, data := range fetched {
+			buckets[start] = data
+			if cacheable[start] {
+				key := fmt.Sprintf("%v%v", prefix, start)
+				filter.SetCache(key, data, filter.bucketTTL)
+				tagged[key] = len(data)
+			}
+		}
+		responses = append(responses, v.body)
+	}
+
+	if len(tagged) > 0 {
+		filter.tagEntries(tagged, path, indices, filter.bucketTTL)
+	}
+
+	body, err := search.merge(buckets, responses)
+	if err != nil {
+		log.Errorf("failed to merge the date_histogram search, %v", err)
+		filter.process(ctx)
+		return
+	}
+
+	stats.IncrementBy("date_histogram_cache", "cached_buckets", int64(cached))
+	stats.IncrementBy("date_histogram_cache", "searched_buckets", int64(len(starts)-cached))
+	if global.Env().IsDebug {
+		log.Tracef("date_histogram search [%v] merged, %v of %v buckets cached, %v segments", ctx.PhantomURI().String(), cached, len(starts), len(segments))
+	}
+
+	ctx.Response.SetStatusCode(fasthttp.StatusOK)
+	ctx.Response.SetBody(body)
+	ctx.SetContentType(util.ContentTypeJson)
+	if filter.AddResponseHeader {
+		ctx.Response.Header.Set("X-Cached-Buckets", fmt.Sprintf("%v/%v", cached, len(starts)))
+	}
+	ctx.SetDestination("date_histogram_cache")
+	if !filter.ContinueAfterMatch {
+		ctx.Finished()
+	}
+}
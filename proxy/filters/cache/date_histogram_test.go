@@ -0,0 +1,245 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const hour = int64(3600000)
+
+func histogramBody(from, to string, sub string) []byte {
+	return []byte(fmt.Sprintf(`{"size":0,"track_total_hits":true,"query":{"bool":{"filter":[{"match_all":{}},{"range":{"@timestamp":{"gte":"%v","lte":"%v","format":"strict_date_optional_time"}}}]}},"aggs":{"2":{"date_histogram":{"field":"@timestamp","fixed_interval":"1h","time_zone":"Asia/Shanghai","min_doc_count":1,"extended_bounds":{"min":%v,"max":%v}}%v}}}`,
+		from, to, mustParseTime(from), mustParseTime(to), sub))
+}
+
+func mustParseTime(v string) int64 {
+	t, err := parseTime(v, "")
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func TestParseHistogramRequest(t *testing.T) {
+	body := histogramBody("2023-06-01T10:30:00.000Z", "2023-06-01T15:29:59.999Z", `,"aggs":{"1":{"sum":{"field":"bytes"}}}`)
+	search, req, err := parseHistogramRequest(body, defaultSupportedAggregations)
+	assert.NoError(t, err)
+	assert.Equal(t, "2", search.name)
+	assert.Equal(t, "@timestamp", search.field)
+	assert.Equal(t, hour, search.interval)
+	assert.Equal(t, 8*hour, search.offset)
+	assert.Equal(t, int64(1), search.minDocCount)
+	assert.Equal(t, int64(-1), search.trackTotalHits)
+	assert.True(t, search.hasBounds)
+	assert.NotNil(t, req.rng)
+
+	starts := search.bucketStarts()
+	assert.Equal(t, 6, len(starts))
+	assert.Equal(t, mustParseTime("2023-06-01T10:00:00Z"), starts[0])
+	assert.False(t, search.complete(starts[0]))
+	assert.True(t, search.complete(starts[1]))
+	assert.False(t, search.complete(starts[5]))
+
+	//unsupported
+	for _, v := range []string{
+		`{"size":10,"aggs":{}}`,
+		string(histogramBody("2023-06-01T10:30:00.000Z", "2023-06-01T15:29:59.999Z", `,"aggs":{"1":{"derivative":{"buckets_path":"_count"}}}`)),
+		`{"size":0,"query":{"range":{"@timestamp":{"gte":"now-15m","lte":"now"}}},"aggs":{"2":{"date_histogram":{"field":"@timestamp","fixed_interval":"1m"}}}}`,
+		`{"size":0,"query":{"range":{"@timestamp":{"gte":1,"lte":2}}},"aggs":{"2":{"date_histogram":{"field":"@timestamp","calendar_interval":"1M"}}}}`,
+		`{"size":0,"query":{"range":{"@timestamp":{"gte":1,"lte":2}}},"aggs":{"2":{"date_histogram":{"field":"@timestamp","fixed_interval":"1m"}},"3":{"max":{"field":"a"}}}}`,
+		`{"size":0,"query":{"bool":{"should":[{"range":{"@timestamp":{"gte":1,"lte":2}}}]}},"aggs":{"2":{"date_histogram":{"field":"@timestamp","fixed_interval":"1m"}}}}`,
+	} {
+		_, _, err := parseHistogramRequest([]byte(v), defaultSupportedAggregations)
+		assert.Error(t, err, v)
+	}
+
+	//the offset changes within the range
+	_, _, err = parseHistogramRequest([]byte(`{"size":0,"query":{"range":{"@timestamp":{"gte":"2023-03-01T00:00:00Z","lte":"2023-04-01T00:00:00Z"}}},"aggs":{"2":{"date_histogram":{"field":"@timestamp","fixed_interval":"1h","time_zone":"Europe/Berlin"}}}}`), defaultSupportedAggregations)
+	assert.Error(t, err)
+}
+
+func TestHistogramSegments(t *testing.T) {
+	search, _, err := parseHistogramRequest(histogramBody("2023-06-01T10:30:00.000Z", "2023-06-01T15:29:59.999Z", ""), defaultSupportedAggregations)
+	assert.NoError(t, err)
+	starts := search.bucketStarts()
+
+	segments := search.segments(starts, map[int64]json.RawMessage{})
+	assert.Equal(t, []segment{{from: search.from, to: search.to}}, segments)
+
+	cached := map[int64]json.RawMessage{starts[1]: nil, starts[2]: nil, starts[4]: nil}
+	segments = search.segments(starts, cached)
+	assert.Equal(t, []segment{
+		{from: search.from, to: starts[1] - 1},
+		{from: starts[3], to: starts[4] - 1},
+		{from: starts[5], to: search.to},
+	}, segments)
+}
+
+func TestMergeSegments(t *testing.T) {
+	segments := []segment{{from: 0, to: 9}, {from: 20, to: 29}, {from: 50, to: 59}, {from: 100, to: 109}, {from: 115, to: 119}}
+	assert.Equal(t, segments, mergeSegments(segments, 0, 0))
+
+	//the gaps of no more than 10 are merged
+	assert.Equal(t, []segment{{from: 0, to: 29}, {from: 50, to: 59}, {from: 100, to: 119}}, mergeSegments(append([]segment{}, segments...), 10, 0))
+
+	//the closest ones are merged until the max
+	assert.Equal(t, []segment{{from: 0, to: 59}, {from: 100, to: 119}}, mergeSegments(append([]segment{}, segments...), 0, 2))
+	assert.Equal(t, []segment{{from: 0, to: 119}}, mergeSegments(append([]segment{}, segments...), 0, 1))
+}
+
+func TestHistogramCacheKey(t *testing.T) {
+	_, a, err := parseHistogramRequest(histogramBody("2023-06-01T10:30:00.000Z", "2023-06-01T15:29:59.999Z", ""), defaultSupportedAggregations)
+	assert.NoError(t, err)
+	_, b, err := parseHistogramRequest(histogramBody("2023-06-01T10:31:00.000Z", "2023-06-01T15:30:59.999Z", ""), defaultSupportedAggregations)
+	assert.NoError(t, err)
+	assert.Equal(t, string(a.cacheKey()), string(b.cacheKey()))
+
+	//restored
+	assert.Equal(t, "2023-06-01T10:30:00.000Z", a.rng["gte"])
+	assert.NotNil(t, a.histogram["extended_bounds"])
+
+	_, c, err := parseHistogramRequest(histogramBody("2023-06-01T10:30:00.000Z", "2023-06-01T15:29:59.999Z", `,"aggs":{"1":{"sum":{"field":"bytes"}}}`), defaultSupportedAggregations)
+	assert.NoError(t, err)
+	assert.NotEqual(t, string(a.cacheKey()), string(c.cacheKey()))
+}
+
+// searchHistogram simulates the search of the range, each bucket has the
+// documents of its hour, and none for the empty hours
+func searchHistogram(search *histogramSearch, body []byte, empty map[int64]bool) []byte {
+	_, req, err := parseHistogramRequest(body, defaultSupportedAggregations)
+	if err != nil {
+		panic(err)
+	}
+	from := mustParseTime(fmt.Sprint(req.rng["gte"]))
+	to := mustParseTime(fmt.Sprint(req.rng["lte"]))
+	bounds := req.histogram["extended_bounds"].(map[string]interface{})
+	min, _ := bounds["min"].(json.Number).Int64()
+	max, _ := bounds["max"].(json.Number).Int64()
+	buckets := []string{}
+	var total int64
+	for start := min; start <= max; start += search.interval {
+		var count int64
+		if !empty[start] {
+			lower, upper := start, start+search.interval-1
+			if lower < from {
+				lower = from
+			}
+			if upper > to {
+				upper = to
+			}
+			count = (upper - lower + 1) / 60000
+		}
+		total += count
+		buckets = append(buckets, fmt.Sprintf(`{"key":%v,"doc_count":%v}`, start, count))
+	}
+	return []byte(fmt.Sprintf(`{"took":3,"timed_out":false,"_shards":{"total":1,"successful":1,"skipped":0,"failed":0},"hits":{"total":{"value":%v,"relation":"eq"},"max_score":null,"hits":[]},"aggregations":{"2":{"buckets":[%v]}}}`,
+		total, strings.Join(buckets, ",")))
+}
+
+func TestHistogramMerge(t *testing.T) {
+	body := histogramBody("2023-06-01T10:30:00.000Z", "2023-06-01T15:29:59.999Z", "")
+	search, req, err := parseHistogramRequest(body, defaultSupportedAggregations)
+	assert.NoError(t, err)
+	starts := search.bucketStarts()
+	empty := map[int64]bool{starts[3]: true, starts[5]: true}
+
+	//the whole range in one search
+	whole, err := req.segmentBody(search, segment{from: search.from, to: search.to})
+	assert.NoError(t, err)
+	expected, err := search.parseBuckets(searchHistogram(search, whole, empty), segment{from: search.from, to: search.to})
+	assert.NoError(t, err)
+	assert.Equal(t, 6, len(expected))
+
+	//half of the buckets cached
+	cached := map[int64]json.RawMessage{starts[1]: expected[starts[1]], starts[2]: expected[starts[2]], starts[4]: expected[starts[4]]}
+	buckets := map[int64]json.RawMessage{}
+	for k, v := range cached {
+		buckets[k] = v
+	}
+	responses := [][]byte{}
+	for _, seg := range search.segments(starts, cached) {
+		segBody, err := req.segmentBody(search, seg)
+		assert.NoError(t, err)
+		response := searchHistogram(search, segBody, empty)
+		fetched, err := search.parseBuckets(response, seg)
+		assert.NoError(t, err)
+		for k, v := range fetched {
+			buckets[k] = v
+		}
+		responses = append(responses, response)
+	}
+	assert.Equal(t, 3, len(responses))
+
+	merged, err := search.merge(buckets, responses)
+	assert.NoError(t, err)
+	result := struct {
+		Took int64 `json:"took"`
+		Hits struct {
+			Total struct {
+				Value    int64  `json:"value"`
+				Relation string `json:"relation"`
+			} `json:"total"`
+		} `json:"hits"`
+		Aggregations map[string]struct {
+			Buckets []struct {
+				Key      int64 `json:"key"`
+				DocCount int64 `json:"doc_count"`
+			} `json:"buckets"`
+		} `json:"aggregations"`
+	}{}
+	assert.NoError(t, json.Unmarshal(merged, &result))
+	assert.Equal(t, int64(3), result.Took)
+	assert.Equal(t, int64(30+60+60+60), result.Hits.Total.Value)
+	assert.Equal(t, "eq", result.Hits.Total.Relation)
+	//min_doc_count 1 excludes the empty buckets
+	keys := []int64{}
+	for _, v := range result.Aggregations["2"].Buckets {
+		keys = append(keys, v.Key)
+	}
+	assert.Equal(t, []int64{starts[0], starts[1], starts[2], starts[4]}, keys)
+
+	//min_doc_count 0 keeps the empty buckets within the bounds, trailing ones are trimmed without bounds
+	search.minDocCount = 0
+	search.hasBounds = false
+	merged, err = search.merge(buckets, responses)
+	assert.NoError(t, err)
+	assert.NoError(t, json.Unmarshal(merged, &result))
+	assert.Equal(t, 5, len(result.Aggregations["2"].Buckets))
+	search.hasBounds = true
+	merged, err = search.merge(buckets, responses)
+	assert.NoError(t, err)
+	assert.NoError(t, json.Unmarshal(merged, &result))
+	assert.Equal(t, 6, len(result.Aggregations["2"].Buckets))
+
+	//missing bucket
+	delete(buckets, starts[2])
+	_, err = search.merge(buckets, responses)
+	assert.Error(t, err)
+}
@@ -0,0 +1,230 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package cache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"infini.sh/framework/core/global"
+	"infini.sh/framework/core/stats"
+	"infini.sh/framework/core/util"
+	"infini.sh/framework/lib/fasthttp"
+	"infini.sh/gateway/common"
+)
+
+var entryMagic = []byte("\x00GWC")
+
+// entryMeta is stored ahead of the cached response
+type entryMeta struct {
+	Created int64  `json:"created"`            //unix time in milliseconds
+	SoftTTL int64  `json:"soft_ttl,omitempty"` //milliseconds, stale but still servable after it
+	Path    string `json:"path,omitempty"`     //path of the request
+}
+
+func (m *entryMeta) age(now time.Time) time.Duration {
+	return now.Sub(time.Unix(0, m.Created*int64(time.Millisecond)))
+}
+
+func (m *entryMeta) stale(now time.Time) bool {
+	return m.SoftTTL > 0 && m.age(now) > time.Duration(m.SoftTTL)*time.Millisecond
+}
+
+// encodeEntry wraps the encoded response with the meta
+func encodeEntry(meta *entryMeta, response []byte) []byte {
+	metaBytes := util.MustToJSONBytes(meta)
+	buffer := bytes.NewBuffer(make([]byte, 0, len(entryMagic)+4+len(metaBytes)+len(response)))
+	buffer.Write(entryMagic)
+	size := make([]byte, 4)
+	binary.BigEndian.PutUint32(size, uint32(len(metaBytes)))
+	buffer.Write(size)
+	buffer.Write(metaBytes)
+	buffer.Write(response)
+	return buffer.Bytes()
+}
+
+// decodeEntry returns the meta and the encoded response, the meta is nil for
+// the entries cached by the previous versions
+func decodeEntry(data []byte) (*entryMeta, []byte) {
+	if !bytes.HasPrefix(data, entryMagic) || len(data) < len(entryMagic)+4 {
+		return nil, data
+	}
+	offset := len(entryMagic) + 4
+	size := int(binary.BigEndian.Uint32(data[len(entryMagic):offset]))
+	if len(data) < offset+size {
+		return nil, data
+	}
+	meta := &entryMeta{}
+	if err := util.FromJSONBytes(data[offset:offset+size], meta); err != nil {
+		return nil, data
+	}
+	return meta, data[offset+size:]
+}
+
+// refreshTracker makes sure only one request refreshes an entry at a time
+type refreshTracker struct {
+	locker   sync.Mutex
+	inflight map[string]time.Time //key -> deadline
+}
+
+func newRefreshTracker() *refreshTracker {
+	return &refreshTracker{inflight: map[string]time.Time{}}
+}
+
+// begin returns true if the caller should refresh the key, the claim is
+// released by end or after the timeout, in case the refresh failed silently
+func (t *refreshTracker) begin(key string, timeout time.Duration, now time.Time) bool {
+	t.locker.Lock()
+	defer t.locker.Unlock()
+	if deadline, ok := t.inflight[key]; ok && now.Before(deadline) {
+		return false
+	}
+	t.inflight[key] = now.Add(timeout)
+	return true
+}
+
+func (t *refreshTracker) end(key string) {
+	t.locker.Lock()
+	defer t.locker.Unlock()
+	delete(t.inflight, key)
+}
+
+// hitCounter counts the hits of each cached entry, reset once the entry is
+// replaced
+type hitCounter struct {
+	locker    sync.Mutex
+	entries   map[string]*entryHits
+	lastPrune time.Time
+}
+
+type entryHits struct {
+	created int64
+	hits    int64
+	expire  time.Time
+}
+
+func newHitCounter() *hitCounter {
+	return &hitCounter{entries: map[string]*entryHits{}}
+}
+
+// hit returns the hits of the entry, including this one
+func (c *hitCounter) hit(key string, meta *entryMeta, now time.Time) int64 {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+
+	if now.Sub(c.lastPrune) > time.Minute {
+		c.lastPrune = now
+		for k, v := range c.entries {
+			if now.After(v.expire) {
+				delete(c.entries, k)
+			}
+		}
+	}
+
+	v, ok := c.entries[key]
+	if !ok || v.created != meta.Created {
+		v = &entryHits{created: meta.Created}
+		c.entries[key] = v
+	}
+	v.hits++
+	v.expire = now.Add(10 * time.Minute)
+	return v.hits
+}
+
+// get returns the hits of the current entry of the key
+func (c *hitCounter) get(key string) int64 {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+	if v, ok := c.entries[key]; ok {
+		return v.hits
+	}
+	return 0
+}
+
+var refreshes = newRefreshTracker()
+var hitCounters = newHitCounter()
+
+const refreshTimeout = 30 * time.Second
+
+// refreshContext copies the context values of the request, such as the user
+// and the roles set by the auth filters, so that the refresh request is
+// authorized and filtered the same as the original one
+func (filter *RequestCacheGet) refreshContext(ctx *fasthttp.RequestCtx) map[string]interface{} {
+	values := map[string]interface{}{}
+	for _, key := range filter.config.RefreshContext {
+		if v := ctx.Get(key); v != nil {
+			values[key] = v
+		}
+	}
+	return values
+}
+
+// backgroundRefresh refreshes the entry through the refresh flow with a copy
+// of the request and its context, false if the entry is being refreshed or
+// too many refreshes are running
+func (filter *RequestCacheGet) backgroundRefresh(ctx *fasthttp.RequestCtx, hash string) bool {
+	if filter.refreshFlow == nil || !refreshes.begin(hash, refreshTimeout, time.Now()) {
+		return false
+	}
+
+	select {
+	case filter.refreshTokens <- struct{}{}:
+	default:
+		refreshes.end(hash)
+		stats.Increment("cache", "refresh_skipped")
+		return false
+	}
+
+	data := ctx.Request.Encode()
+	values := filter.refreshContext(ctx)
+	go func() {
+		defer func() {
+			<-filter.refreshTokens
+			refreshes.end(hash)
+			if r := recover(); r != nil {
+				log.Errorf("error on refreshing cache [%v], %v", hash, r)
+			}
+		}()
+
+		c := &fasthttp.RequestCtx{EnrichedMetadata: true}
+		if err := c.Request.Decode(data); err != nil {
+			log.Errorf("failed to decode the request of cache [%v], %v", hash, err)
+			return
+		}
+		for k, v := range values {
+			c.Set(k, v)
+		}
+		c.Set(common.CACHEABLE, true)
+		c.Set(common.CACHEHASH, hash)
+		filter.refreshFlow(c)
+		stats.Increment("cache", "refreshed")
+		if global.Env().IsDebug {
+			log.Tracef("cache [%v] refreshed, status: %v", hash, c.Response.StatusCode())
+		}
+	}()
+	return true
+}
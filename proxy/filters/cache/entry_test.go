@@ -0,0 +1,84 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package cache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"infini.sh/framework/lib/fasthttp"
+)
+
+func TestEncodeDecodeEntry(t *testing.T) {
+	now := time.Now()
+	meta := &entryMeta{Created: now.Add(-5*time.Second).UnixNano() / int64(time.Millisecond), SoftTTL: 3000}
+	data := encodeEntry(meta, []byte("HTTP/1.1 200 OK\r\n\r\n{}"))
+
+	decoded, response := decodeEntry(data)
+	assert.NotNil(t, decoded)
+	assert.Equal(t, meta.Created, decoded.Created)
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n\r\n{}", string(response))
+	assert.True(t, decoded.stale(now))
+	assert.Equal(t, int64(5), int64(decoded.age(now).Seconds()))
+
+	//entries cached without the meta
+	decoded, response = decodeEntry([]byte("HTTP/1.1 200 OK\r\n\r\n{}"))
+	assert.Nil(t, decoded)
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n\r\n{}", string(response))
+}
+
+func TestRefreshTracker(t *testing.T) {
+	tracker := newRefreshTracker()
+	now := time.Now()
+	assert.True(t, tracker.begin("k", time.Second, now))
+	assert.False(t, tracker.begin("k", time.Second, now))
+	assert.True(t, tracker.begin("k", time.Second, now.Add(2*time.Second)), "the claim is expired")
+	tracker.end("k")
+	assert.True(t, tracker.begin("k", time.Second, now))
+}
+
+func TestHitCounter(t *testing.T) {
+	counter := newHitCounter()
+	now := time.Now()
+	meta := &entryMeta{Created: 1}
+	assert.Equal(t, int64(1), counter.hit("k", meta, now))
+	assert.Equal(t, int64(2), counter.hit("k", meta, now))
+	assert.Equal(t, int64(1), counter.hit("k", &entryMeta{Created: 2}, now), "reset once the entry is replaced")
+}
+
+func TestRefreshContext(t *testing.T) {
+	cfg := defaultConfig
+	filter := &RequestCacheGet{config: &cfg}
+
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Set("user_name", "alice")
+	ctx.Set("user_roles", []string{"reader"})
+	ctx.Set("tenant", "acme")
+	assert.Equal(t, map[string]interface{}{"user_name": "alice", "user_roles": []string{"reader"}}, filter.refreshContext(ctx))
+
+	//the custom keys, such as the claims of jwt_auth
+	cfg.RefreshContext = append(cfg.RefreshContext, "tenant")
+	assert.Equal(t, "acme", filter.refreshContext(ctx)["tenant"])
+}
@@ -0,0 +1,422 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package cache
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/go-redis/redis/v8"
+	"infini.sh/framework/core/config"
+	"infini.sh/framework/core/elastic"
+	"infini.sh/framework/core/global"
+	"infini.sh/framework/core/pipeline"
+	"infini.sh/framework/core/stats"
+	"infini.sh/framework/core/util"
+	"infini.sh/framework/lib/fasthttp"
+)
+
+const allIndices = "_all"
+const redisTagsKey = "gateway_cache_tags"
+
+// matchAnyIndex checks whether the cached tag is affected by the written
+// indices, both of them may be wildcard patterns
+func matchAnyIndex(tag string, indices []string) bool {
+	for _, index := range indices {
+		if tag == index || tag == allIndices || index == allIndices || tag == "*" || index == "*" {
+			return true
+		}
+		if ok, _ := path.Match(tag, index); ok {
+			return true
+		}
+		if ok, _ := path.Match(index, tag); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// getPathIndices returns the indices in the url path, or _all if the
+// request is not index specific
+func getPathIndices(pathStr string) []string {
+	pathStr = strings.TrimLeft(pathStr, "/")
+	first := pathStr
+	if i := strings.Index(pathStr, "/"); i >= 0 {
+		first = pathStr[:i]
+	}
+	if first == "" || util.PrefixStr(first, "_") {
+		return []string{allIndices}
+	}
+	indices := []string{}
+	for _, v := range strings.Split(first, ",") {
+		//exclusions are not tracked, the included indices are enough
+		if v == "" || util.PrefixStr(v, "-") {
+			continue
+		}
+		indices = append(indices, v)
+	}
+	if len(indices) == 0 {
+		return []string{allIndices}
+	}
+	return indices
+}
+
+// invalidationEvent is published to the peers sharing the redis cache, the
+// entries of the indices, the keys, the prefix or all of them are evicted
+type invalidationEvent struct {
+	Node    string   `json:"node"`
+	Indices []string `json:"indices,omitempty"`
+	Keys    []string `json:"keys,omitempty"`
+	Prefix  string   `json:"prefix,omitempty"`
+	All     bool     `json:"all,omitempty"`
+}
+
+var registry = newEntryRegistry()
+var nodeID = util.GetUUID()
+var subscribeOnce = sync.Once{}
+
+func (p *RequestCache) redisTagKey(index string) string {
+	return redisTagsKey + ":" + index
+}
+
+// tagCache records the entry and its indices
+func (p *RequestCache) tagCache(key string, size int, source string, indices []string, ttl time.Duration) {
+	p.tagEntries(map[string]int{key: size}, source, indices, ttl)
+}
+
+// tagEntries records the entries of the same indices, the keys are mapped to
+// their sizes, the tags in redis are updated in one pipeline
+func (p *RequestCache) tagEntries(entries map[string]int, source string, indices []string, ttl time.Duration) {
+	now := time.Now()
+	expire := now.Add(ttl)
+	for key, size := range entries {
+		registry.add(key, &entryInfo{backend: backendName(p.config.CacheType), size: size, path: source, indices: indices, expire: expire}, now)
+	}
+
+	if !usesRedis(p.config.CacheType) {
+		return
+	}
+
+	score := float64(expire.Unix())
+	min := strconv.FormatInt(now.Unix(), 10)
+	pipe := p.getRedisClient().Pipeline()
+	for _, index := range indices {
+		tag := p.redisTagKey(index)
+		for key := range entries {
+			pipe.ZAdd(ctx, tag, &redis.Z{Score: score, Member: key})
+		}
+		pipe.ZRemRangeByScore(ctx, tag, "-inf", "("+min)
+		pipe.Expire(ctx, tag, 2*ttl)
+		pipe.ZAdd(ctx, redisTagsKey, &redis.Z{Score: score, Member: index})
+	}
+	pipe.ZRemRangeByScore(ctx, redisTagsKey, "-inf", "("+min)
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Warnf("failed to tag %v cache entries with indices %v, %v", len(entries), indices, err)
+	}
+}
+
+// InvalidateIndices evicts the cached entries of the indices, the peers
+// sharing the redis cache are notified as well
+func (p *RequestCache) InvalidateIndices(indices []string) int {
+	count := evictLocal(registry.take(indices))
+
+	if usesRedis(p.config.CacheType) {
+		n, err := p.invalidateRedis(indices)
+		if err != nil {
+			log.Warnf("failed to invalidate cache of indices %v, %v", indices, err)
+		}
+		count = n
+		getCounters(p.config.CacheType).evicted(int64(n))
+		p.publish(invalidationEvent{Indices: indices})
+	}
+
+	if count > 0 {
+		stats.IncrementBy("cache", "invalidated", int64(count))
+	}
+	if global.Env().IsDebug {
+		log.Debugf("invalidated %v cache entries of indices %v", count, indices)
+	}
+	return count
+}
+
+// evictLocal removes the keys from the local stores, the keys are mapped to
+// their backends, returns the number of the local entries
+func evictLocal(keys map[string]string) int {
+	count := 0
+	for key, backend := range keys {
+		ccCache.GetOrCreateSecondaryCache("default").Delete(key)
+		cache.Del(key)
+		if backend != "" && !usesRedis(backend) {
+			getCounters(backend).evicted(1)
+			count++
+		}
+	}
+	return count
+}
+
+func (p *RequestCache) invalidateRedis(indices []string) (int, error) {
+	client := p.getRedisClient()
+	tags, err := client.ZRange(ctx, redisTagsKey, 0, -1).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, tag := range tags {
+		if !matchAnyIndex(tag, indices) {
+			continue
+		}
+		tagKey := p.redisTagKey(tag)
+		keys, err := client.ZRange(ctx, tagKey, 0, -1).Result()
+		if err != nil {
+			return count, err
+		}
+		n, err := p.deleteRedisKeys(keys)
+		count += n
+		if err != nil {
+			return count, err
+		}
+		client.Del(ctx, tagKey)
+		client.ZRem(ctx, redisTagsKey, tag)
+	}
+	return count, nil
+}
+
+// deleteRedisKeys deletes the entries in batches, one key per command, as
+// the keys may belong to different slots in the cluster mode
+func (p *RequestCache) deleteRedisKeys(keys []string) (int, error) {
+	count := 0
+	for len(keys) > 0 {
+		batch := keys
+		if len(batch) > 1000 {
+			batch = keys[:1000]
+		}
+		keys = keys[len(batch):]
+		pipe := p.getRedisClient().Pipeline()
+		cmds := make([]*redis.IntCmd, len(batch))
+		for i, k := range batch {
+			cmds[i] = pipe.Del(ctx, p.redisKey(k))
+		}
+		_, err := pipe.Exec(ctx)
+		for _, cmd := range cmds {
+			count += int(cmd.Val())
+		}
+		if err != nil {
+			return count, err
+		}
+	}
+	return count, nil
+}
+
+func (p *RequestCache) publish(event invalidationEvent) {
+	event.Node = nodeID
+	msg := util.MustToJSONBytes(event)
+	if err := p.getRedisClient().Publish(ctx, p.config.InvalidationChannel, msg).Err(); err != nil {
+		log.Warnf("failed to publish cache invalidation %v, %v", string(msg), err)
+	}
+}
+
+// evictEvent evicts the local entries of the event
+func evictEvent(event *invalidationEvent) int {
+	switch {
+	case event.All:
+		return evictLocal(registry.takePrefix(""))
+	case event.Prefix != "":
+		return evictLocal(registry.takePrefix(event.Prefix))
+	case len(event.Keys) > 0:
+		return evictLocal(registry.takeKeys(event.Keys))
+	default:
+		return evictLocal(registry.take(event.Indices))
+	}
+}
+
+// subscribeInvalidation evicts the local entries invalidated by the peers
+func (p *RequestCache) subscribeInvalidation() {
+	if !usesRedis(p.config.CacheType) {
+		return
+	}
+	subscribeOnce.Do(func() {
+		pubsub := p.getRedisClient().Subscribe(context.Background(), p.config.InvalidationChannel)
+		global.RegisterShutdownCallback(func() {
+			pubsub.Close()
+		})
+		go func() {
+			defer func() {
+				if r := recover(); r != nil {
+					log.Errorf("error on handling cache invalidation, %v", r)
+				}
+			}()
+			for msg := range pubsub.Channel() {
+				event := invalidationEvent{}
+				if err := util.FromJSONBytes([]byte(msg.Payload), &event); err != nil {
+					log.Warnf("invalid cache invalidation message: %v", msg.Payload)
+					continue
+				}
+				if event.Node == nodeID {
+					continue
+				}
+				n := evictEvent(&event)
+				if global.Env().IsDebug {
+					log.Debugf("evicted %v local cache entries of %v from peer [%v]", n, msg.Payload, event.Node)
+				}
+			}
+		}()
+	})
+}
+
+// RequestCacheInvalidation evicts the cached entries of the indices written
+// by the passing requests
+type RequestCacheInvalidation struct {
+	RequestCache
+	WriteActions []string `config:"write_actions"` //path segments of the write requests
+	RefreshDelay string   `config:"refresh_delay"` //invalidate again after the refresh interval
+
+	refreshDelay time.Duration
+}
+
+var defaultWriteActions = []string{"_bulk", "_doc", "_create", "_update", "_delete_by_query", "_update_by_query", "_refresh"}
+
+func init() {
+	pipeline.RegisterFilterPluginWithConfigMetadata("cache_invalidation", NewInvalidation, &RequestCacheInvalidation{})
+}
+
+func NewInvalidation(c *config.Config) (pipeline.Filter, error) {
+
+	cfg := defaultConfig
+
+	if err := c.Unpack(&cfg); err != nil {
+		return nil, fmt.Errorf("failed to unpack the filter configuration : %s", err)
+	}
+	if err := cfg.Redis.validate(); err != nil {
+		return nil, err
+	}
+
+	runner := RequestCacheInvalidation{
+		WriteActions: defaultWriteActions,
+		RefreshDelay: "1s",
+	}
+	if err := c.Unpack(&runner); err != nil {
+		return nil, fmt.Errorf("failed to unpack the filter configuration : %s", err)
+	}
+	runner.RequestCache.config = &cfg
+	if runner.RefreshDelay != "0" {
+		runner.refreshDelay = util.GetDurationOrDefault(runner.RefreshDelay, time.Second)
+	}
+
+	runner.initCache()
+	runner.subscribeInvalidation()
+
+	return &runner, nil
+}
+
+func (filter *RequestCacheInvalidation) Name() string {
+	return "cache_invalidation"
+}
+
+// getWrittenIndices returns the indices written by the request, false if
+// the request is not a write
+func (filter *RequestCacheInvalidation) getWrittenIndices(ctx *fasthttp.RequestCtx) ([]string, bool) {
+	method := string(ctx.Request.Header.Method())
+	if method == fasthttp.MethodGet || method == fasthttp.MethodHead {
+		return nil, false
+	}
+
+	pathStr := string(ctx.Request.PhantomURI().Path())
+	segments := strings.Split(strings.Trim(pathStr, "/"), "/")
+
+	action := ""
+	for _, v := range segments {
+		for _, x := range filter.WriteActions {
+			if v == x {
+				action = v
+				break
+			}
+		}
+		if action != "" {
+			break
+		}
+	}
+
+	//deleting the index
+	if action == "" && method == fasthttp.MethodDelete && len(segments) == 1 && segments[0] != "" && !util.PrefixStr(segments[0], "_") {
+		return getPathIndices(pathStr), true
+	}
+
+	if action == "" {
+		return nil, false
+	}
+
+	if action != "_bulk" {
+		return getPathIndices(pathStr), true
+	}
+
+	indices := map[string]struct{}{}
+	_, err := elastic.WalkBulkRequests(pathStr, ctx.Request.GetRawBody(), func(eachLine []byte) (skipNextLine bool) {
+		return false
+	}, func(metaBytes []byte, actionStr, index, typeName, id, routing string, offset int) (err error) {
+		indices[index] = struct{}{}
+		return nil
+	}, func(payloadBytes []byte, actionStr, index, typeName, id, routing string) {
+	}, nil)
+	if err != nil || len(indices) == 0 {
+		//not sure which indices are written
+		return []string{allIndices}, true
+	}
+	result := make([]string, 0, len(indices))
+	for k := range indices {
+		if k == "" {
+			k = allIndices
+		}
+		result = append(result, k)
+	}
+	return result, true
+}
+
+func (filter *RequestCacheInvalidation) Filter(ctx *fasthttp.RequestCtx) {
+	indices, ok := filter.getWrittenIndices(ctx)
+	if !ok {
+		return
+	}
+
+	stats.Increment("cache", "invalidation")
+	filter.InvalidateIndices(indices)
+
+	//the entries cached before the write became visible are stale too
+	if filter.refreshDelay > 0 {
+		time.AfterFunc(filter.refreshDelay, func() {
+			defer func() {
+				if r := recover(); r != nil {
+					log.Errorf("error on invalidating cache of indices %v, %v", indices, r)
+				}
+			}()
+			filter.InvalidateIndices(indices)
+		})
+	}
+}
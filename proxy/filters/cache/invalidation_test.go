@@ -0,0 +1,47 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package cache
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetPathIndices(t *testing.T) {
+	assert.Equal(t, []string{"logs"}, getPathIndices("/logs/_search"))
+	assert.Equal(t, []string{"logs-*", "metrics"}, getPathIndices("/logs-*,metrics,-logs-old/_search"))
+	assert.Equal(t, []string{allIndices}, getPathIndices("/_search"))
+	assert.Equal(t, []string{allIndices}, getPathIndices("/"))
+}
+
+func TestMatchAnyIndex(t *testing.T) {
+	assert.True(t, matchAnyIndex("logs", []string{"logs"}))
+	assert.True(t, matchAnyIndex("logs-*", []string{"logs-2023"}))
+	assert.True(t, matchAnyIndex("logs-2023", []string{"logs-*"}))
+	assert.True(t, matchAnyIndex(allIndices, []string{"metrics"}))
+	assert.True(t, matchAnyIndex("metrics", []string{allIndices}))
+	assert.False(t, matchAnyIndex("logs-*", []string{"metrics"}))
+	assert.False(t, matchAnyIndex("logs", []string{"logs-2023"}))
+}
@@ -0,0 +1,164 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package cache
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/cihub/seelog"
+	"infini.sh/framework/core/global"
+	"infini.sh/framework/core/util"
+	"infini.sh/framework/lib/fasthttp"
+)
+
+// NormalizationConfig makes the semantically identical requests share the
+// same cache key
+type NormalizationConfig struct {
+	Enabled         bool     `config:"enabled"`
+	IgnoreQueryArgs []string `config:"ignore_query_args"`
+	IgnoreHeaders   []string `config:"ignore_headers"` //eg: Authorization, to share the entries between users
+}
+
+// getCanonicalHash returns the digest of the normalized request
+func getCanonicalHash(ctx *fasthttp.RequestCtx, cfg *NormalizationConfig) string {
+	buffer := bytes.Buffer{}
+	buffer.Write(ctx.Request.Header.Method())
+	buffer.Write(newLine)
+
+	//the user is shared as well if the auth header is ignored
+	key, auth := ctx.Request.Header.PeekAnyKey(fasthttp.AuthHeaderKeys)
+	if !containsIgnoreCase(cfg.IgnoreHeaders, key) && !containsIgnoreCase(cfg.IgnoreHeaders, "Authorization") {
+		buffer.Write(auth)
+		buffer.Write(userIdentity(ctx))
+	}
+	buffer.Write(newLine)
+
+	uri := ctx.Request.PhantomURI()
+	buffer.Write(uri.Host())
+	buffer.Write(uri.Path())
+	buffer.Write(newLine)
+
+	args := []string{}
+	uri.QueryArgs().VisitAll(func(key, value []byte) {
+		k := string(key)
+		if containsIgnoreCase(cfg.IgnoreQueryArgs, k) {
+			return
+		}
+		args = append(args, k+"="+string(value))
+	})
+	sort.Strings(args)
+	buffer.WriteString(strings.Join(args, "&"))
+	buffer.Write(newLine)
+
+	buffer.Write(canonicalizeBody(ctx.Request.GetRawBody()))
+
+	if global.Env().IsDebug {
+		log.Trace("canonical cache key: ", buffer.String())
+	}
+	return util.MD5digestString(buffer.Bytes())
+}
+
+func containsIgnoreCase(items []string, v string) bool {
+	for _, x := range items {
+		if strings.EqualFold(x, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// canonicalizeBody sorts the keys and normalizes the numbers of the json
+// body, each line of the ndjson body separately, the body is returned as is
+// if it is not json
+func canonicalizeBody(body []byte) []byte {
+	body = bytes.TrimSpace(body)
+	if len(body) == 0 {
+		return body
+	}
+
+	lines := bytes.Split(body, newLine)
+	buffer := bytes.Buffer{}
+	for _, line := range lines {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		decoder := json.NewDecoder(bytes.NewReader(line))
+		decoder.UseNumber()
+		var obj interface{}
+		if err := decoder.Decode(&obj); err != nil || decoder.More() {
+			return body
+		}
+		obj = canonicalize(obj)
+		data, err := json.Marshal(obj)
+		if err != nil {
+			return body
+		}
+		buffer.Write(data)
+		buffer.Write(newLine)
+	}
+	return buffer.Bytes()
+}
+
+// canonicalize normalizes the numbers, the keys are sorted by json.Marshal
+func canonicalize(obj interface{}) interface{} {
+	switch v := obj.(type) {
+	case map[string]interface{}:
+		for k, x := range v {
+			v[k] = canonicalize(x)
+		}
+		return v
+	case []interface{}:
+		for i, x := range v {
+			v[i] = canonicalize(x)
+		}
+		return v
+	case json.Number:
+		return normalizeNumber(v)
+	default:
+		return v
+	}
+}
+
+// normalizeNumber formats the number in the shortest form, integers are kept
+// as is to avoid losing precision
+func normalizeNumber(n json.Number) json.Number {
+	s := string(n)
+	if !strings.ContainsAny(s, ".eE") {
+		return n
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return n
+	}
+	if f == math.Trunc(f) && math.Abs(f) < 1<<53 {
+		return json.Number(strconv.FormatInt(int64(f), 10))
+	}
+	return json.Number(strconv.FormatFloat(f, 'g', -1, 64))
+}
@@ -0,0 +1,90 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package cache
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"infini.sh/framework/lib/fasthttp"
+)
+
+func TestCanonicalizeBody(t *testing.T) {
+	a := canonicalizeBody([]byte(`{"size":10,"query":{"match_all":{}},"from":0}`))
+	b := canonicalizeBody([]byte(`{ "from": 0.0, "query": { "match_all": {} }, "size": 1e1 }`))
+	assert.Equal(t, string(a), string(b))
+	assert.Equal(t, "{\"from\":0,\"query\":{\"match_all\":{}},\"size\":10}\n", string(a))
+
+	//numbers beyond the float precision are kept
+	assert.Equal(t, "{\"id\":12345678901234567890,\"score\":1.5}\n", string(canonicalizeBody([]byte(`{"score":1.50,"id":12345678901234567890}`))))
+
+	//ndjson
+	a = canonicalizeBody([]byte("{\"index\":\"test\"}\n{\"size\":0,\"query\":{\"match_all\":{}}}\n"))
+	b = canonicalizeBody([]byte("{ \"index\" : \"test\" }\n\n{\"query\":{\"match_all\":{}},\"size\":0}"))
+	assert.Equal(t, string(a), string(b))
+
+	//not json
+	assert.Equal(t, "q=abc", string(canonicalizeBody([]byte(" q=abc\n"))))
+	assert.Equal(t, "{\"a\":1}{\"b\":2}", string(canonicalizeBody([]byte("{\"a\":1}{\"b\":2}"))))
+}
+
+func TestCanonicalizeRange(t *testing.T) {
+	//the times are sent to the upstream as is, so they are kept in the key,
+	//round them by date_range_precision_tuning before the cache
+	body := `{"query":{"bool":{"filter":[{"range":{"@timestamp":{"gte":"2019-09-26T08:21:12.152Z","lte":"2020-09-26T08:21:59.999Z"}}}]}}}`
+	other := `{"query":{"bool":{"filter":[{"range":{"@timestamp":{"lte":"2020-09-26T08:21:03.000Z","gte":"2019-09-26T08:21:45.001Z"}}}]}}}`
+	assert.Contains(t, string(canonicalizeBody([]byte(body))), "2019-09-26T08:21:12.152Z")
+	assert.NotEqual(t, string(canonicalizeBody([]byte(body))), string(canonicalizeBody([]byte(other))))
+}
+
+func TestNormalizeNumber(t *testing.T) {
+	assert.Equal(t, "10", string(normalizeNumber("10")))
+	assert.Equal(t, "10", string(normalizeNumber("10.00")))
+	assert.Equal(t, "100", string(normalizeNumber("1e2")))
+	assert.Equal(t, "0.5", string(normalizeNumber("5e-1")))
+	assert.Equal(t, "1e+20", string(normalizeNumber("1.0E20")))
+}
+
+func TestCanonicalHashUser(t *testing.T) {
+	//the auth header is removed by the auth filters, such as jwt_auth
+	request := func(user string, roles []string) *fasthttp.RequestCtx {
+		ctx := &fasthttp.RequestCtx{}
+		ctx.Request.SetRequestURI("/orders/_search")
+		ctx.Request.Header.SetMethod(fasthttp.MethodPost)
+		ctx.Request.SetBody([]byte(`{"size":0}`))
+		ctx.Set("user_name", user)
+		ctx.Set("user_roles", roles)
+		return ctx
+	}
+	cfg := &NormalizationConfig{Enabled: true}
+	alice := getCanonicalHash(request("alice", []string{"admin"}), cfg)
+	assert.Equal(t, alice, getCanonicalHash(request("alice", []string{"admin"}), cfg))
+	assert.NotEqual(t, alice, getCanonicalHash(request("bob", []string{"admin"}), cfg))
+	assert.NotEqual(t, alice, getCanonicalHash(request("alice", []string{"reader"}), cfg))
+	assert.NotEqual(t, getRequestHash(request("alice", nil)), getRequestHash(request("bob", nil)))
+
+	//shared between the users if the auth is ignored
+	cfg.IgnoreHeaders = []string{"Authorization"}
+	assert.Equal(t, getCanonicalHash(request("alice", nil), cfg), getCanonicalHash(request("bob", nil), cfg))
+}
@@ -0,0 +1,320 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package cache
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/go-redis/redis/v8"
+	"infini.sh/framework/core/api"
+	"infini.sh/framework/core/config"
+	"infini.sh/framework/core/stats"
+	"infini.sh/framework/core/util"
+)
+
+const redisStandalone = "standalone"
+const redisSentinel = "sentinel"
+const redisCluster = "cluster"
+
+// RedisConfig is the connection to the redis of the cache, redis_host and
+// redis_port are used if no addrs configured
+type RedisConfig struct {
+	Mode             string            `config:"mode"`  //standalone, sentinel or cluster
+	Addrs            []string          `config:"addrs"` //addresses of the nodes, or the sentinels
+	MasterName       string            `config:"master_name"`
+	Username         string            `config:"username"`
+	Password         string            `config:"password"`
+	SentinelPassword string            `config:"sentinel_password"`
+	Db               int               `config:"db"`
+	PoolSize         int               `config:"pool_size"`
+	Timeout          string            `config:"timeout"`
+	TLSConfig        *config.TLSConfig `config:"tls"`
+
+	FailureThreshold int    `config:"failure_threshold"` //consecutive failures to stop using redis
+	RetryInterval    string `config:"retry_interval"`    //how long to stop using redis
+}
+
+func (cfg *RedisConfig) validate() error {
+	switch cfg.Mode {
+	case "", redisStandalone, redisCluster:
+	case redisSentinel:
+		if cfg.MasterName == "" {
+			return fmt.Errorf("master_name is required for redis sentinel")
+		}
+	default:
+		return fmt.Errorf("unknown redis mode [%v]", cfg.Mode)
+	}
+	return nil
+}
+
+func usesRedis(cacheType string) bool {
+	return cacheType == cacheRedis || cacheType == cacheTiered
+}
+
+func newRedisClient(cfg *Config) redis.UniversalClient {
+	addrs := cfg.Redis.Addrs
+	if len(addrs) == 0 {
+		host, port := cfg.RedisHost, cfg.RedisPort
+		if host == "" {
+			host = "localhost"
+		}
+		if port <= 0 {
+			port = 6379
+		}
+		addrs = []string{fmt.Sprintf("%s:%v", host, port)}
+	}
+
+	timeout := util.GetDurationOrDefault(cfg.Redis.Timeout, 500*time.Millisecond)
+	var tlsConfig *tls.Config
+	if cfg.Redis.TLSConfig != nil && cfg.Redis.TLSConfig.TLSEnabled {
+		tlsConfig = api.SimpleGetTLSConfig(cfg.Redis.TLSConfig)
+	}
+
+	switch cfg.Redis.Mode {
+	case redisSentinel:
+		return redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:       cfg.Redis.MasterName,
+			SentinelAddrs:    addrs,
+			SentinelPassword: cfg.Redis.SentinelPassword,
+			Username:         cfg.Redis.Username,
+			Password:         cfg.Redis.Password,
+			DB:               cfg.Redis.Db,
+			PoolSize:         cfg.Redis.PoolSize,
+			DialTimeout:      time.Second,
+			ReadTimeout:      timeout,
+			WriteTimeout:     timeout,
+			TLSConfig:        tlsConfig,
+		})
+	case redisCluster:
+		return redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:        addrs,
+			Username:     cfg.Redis.Username,
+			Password:     cfg.Redis.Password,
+			PoolSize:     cfg.Redis.PoolSize,
+			DialTimeout:  time.Second,
+			ReadTimeout:  timeout,
+			WriteTimeout: timeout,
+			TLSConfig:    tlsConfig,
+		})
+	default:
+		return redis.NewClient(&redis.Options{
+			Addr:         addrs[0],
+			Username:     cfg.Redis.Username,
+			Password:     cfg.Redis.Password,
+			DB:           cfg.Redis.Db,
+			PoolSize:     cfg.Redis.PoolSize,
+			DialTimeout:  time.Second,
+			ReadTimeout:  timeout,
+			WriteTimeout: timeout,
+			TLSConfig:    tlsConfig,
+		})
+	}
+}
+
+// circuitBreaker stops using redis after the consecutive failures, until the
+// retry interval passes, the cache falls back to the local tier meanwhile
+type circuitBreaker struct {
+	locker        sync.Mutex
+	threshold     int
+	retryInterval time.Duration
+	failures      int
+	openUntil     time.Time
+}
+
+func newCircuitBreaker(threshold int, retryInterval time.Duration) *circuitBreaker {
+	b := &circuitBreaker{}
+	b.configure(threshold, retryInterval)
+	return b
+}
+
+func (b *circuitBreaker) configure(threshold int, retryInterval time.Duration) {
+	b.locker.Lock()
+	defer b.locker.Unlock()
+	if threshold <= 0 {
+		threshold = 1
+	}
+	b.threshold = threshold
+	b.retryInterval = retryInterval
+}
+
+// allow returns true if redis should be tried, it is tried again once the
+// retry interval passed, and stopped again on the next failure
+func (b *circuitBreaker) allow(now time.Time) bool {
+	b.locker.Lock()
+	defer b.locker.Unlock()
+	return b.failures < b.threshold || !now.Before(b.openUntil)
+}
+
+func (b *circuitBreaker) success() {
+	b.locker.Lock()
+	defer b.locker.Unlock()
+	b.failures = 0
+}
+
+// failure returns true if the breaker is opened by this failure
+func (b *circuitBreaker) failure(now time.Time) bool {
+	b.locker.Lock()
+	defer b.locker.Unlock()
+	b.failures++
+	if b.failures < b.threshold || now.Before(b.openUntil) {
+		return false
+	}
+	b.openUntil = now.Add(b.retryInterval)
+	return true
+}
+
+var breaker = newCircuitBreaker(3, 10*time.Second)
+
+func (p *RequestCache) getRedisClient() redis.UniversalClient {
+
+	if client != nil {
+		return client
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	if client != nil {
+		return client
+	}
+
+	breaker.configure(p.config.Redis.FailureThreshold, util.GetDurationOrDefault(p.config.Redis.RetryInterval, 10*time.Second))
+	client = newRedisClient(p.config)
+
+	return client
+}
+
+// redisFailed records the failure, redis is skipped for a while after too
+// many failures
+func (p *RequestCache) redisFailed(op, key string, err error) {
+	stats.Increment("cache", "redis_errors")
+	if breaker.failure(time.Now()) {
+		log.Warnf("redis cache is not available, skipped for a while, %v", err)
+		stats.Increment("cache", "redis_unavailable")
+		return
+	}
+	log.Debugf("failed to %v cache [%v] in redis, %v", op, key, err)
+}
+
+// getRedis returns the entry and its remaining ttl if required
+func (p *RequestCache) getRedis(key string, withTTL bool) ([]byte, time.Duration, bool) {
+	client := p.getRedisClient()
+	if !breaker.allow(time.Now()) {
+		return nil, 0, false
+	}
+
+	var data []byte
+	var ttl time.Duration
+	var err error
+	if withTTL {
+		pipe := client.Pipeline()
+		get := pipe.Get(ctx, p.redisKey(key))
+		pttl := pipe.PTTL(ctx, p.redisKey(key))
+		if _, err = pipe.Exec(ctx); err == nil {
+			data, err = get.Bytes()
+			ttl = pttl.Val()
+		}
+	} else {
+		data, err = client.Get(ctx, p.redisKey(key)).Bytes()
+	}
+	if err == redis.Nil {
+		breaker.success()
+		return nil, 0, false
+	}
+	if err != nil {
+		p.redisFailed("get", key, err)
+		return nil, 0, false
+	}
+	breaker.success()
+
+	data, err = decompress(data)
+	if err != nil {
+		log.Warnf("failed to decompress cache [%v], %v", key, err)
+		return nil, 0, false
+	}
+	return data, ttl, true
+}
+
+func (p *RequestCache) setRedis(key string, data []byte, ttl time.Duration) {
+	client := p.getRedisClient()
+	if !breaker.allow(time.Now()) {
+		stats.Increment("cache", "redis_skipped")
+		return
+	}
+	if err := client.Set(ctx, p.redisKey(key), compress(data, &p.config.Compression), ttl).Err(); err != nil {
+		p.redisFailed("set", key, err)
+		return
+	}
+	breaker.success()
+}
+
+// scanRedisKeys returns the keys with the prefix, up to the size, all if the
+// size is 0, all the masters are scanned in the cluster mode
+func (p *RequestCache) scanRedisKeys(prefix string, size int) ([]string, error) {
+	cluster, ok := p.getRedisClient().(*redis.ClusterClient)
+	if !ok {
+		return p.scanNode(p.getRedisClient(), prefix, size)
+	}
+
+	keys := []string{}
+	locker := sync.Mutex{}
+	err := cluster.ForEachMaster(ctx, func(c context.Context, node *redis.Client) error {
+		result, err := p.scanNode(node, prefix, size)
+		locker.Lock()
+		keys = append(keys, result...)
+		locker.Unlock()
+		return err
+	})
+	if size > 0 && len(keys) > size {
+		keys = keys[:size]
+	}
+	return keys, err
+}
+
+func (p *RequestCache) scanNode(node redis.Cmdable, prefix string, size int) ([]string, error) {
+	keys := []string{}
+	var cursor uint64
+	for {
+		batch, next, err := node.Scan(ctx, cursor, p.redisKey(prefix)+"*", 1000).Result()
+		if err != nil {
+			return keys, err
+		}
+		for _, k := range batch {
+			keys = append(keys, strings.TrimPrefix(k, p.config.RedisKeyPrefix))
+			if size > 0 && len(keys) >= size {
+				return keys, nil
+			}
+		}
+		cursor = next
+		if cursor == 0 {
+			return keys, nil
+		}
+	}
+}
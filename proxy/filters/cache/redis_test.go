@@ -0,0 +1,57 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package cache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	b := newCircuitBreaker(2, 10*time.Second)
+	now := time.Now()
+	assert.True(t, b.allow(now))
+
+	assert.False(t, b.failure(now))
+	assert.True(t, b.allow(now))
+	b.success()
+	assert.False(t, b.failure(now))
+	assert.True(t, b.failure(now))
+	assert.False(t, b.allow(now))
+	assert.False(t, b.allow(now.Add(9*time.Second)))
+
+	//tried again after the retry interval, and opened again on failure
+	now = now.Add(10 * time.Second)
+	assert.True(t, b.allow(now))
+	assert.True(t, b.failure(now))
+	assert.False(t, b.allow(now.Add(time.Second)))
+	assert.False(t, b.failure(now.Add(time.Second)))
+
+	now = now.Add(10 * time.Second)
+	assert.True(t, b.allow(now))
+	b.success()
+	assert.True(t, b.allow(now))
+}
@@ -0,0 +1,202 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package cache
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// entryInfo is tracked for each entry cached by this gateway
+type entryInfo struct {
+	backend string
+	size    int
+	path    string
+	indices []string
+	expire  time.Time
+}
+
+// entryRegistry tracks the entries cached by this gateway by key and by
+// index, or index pattern, so that they can be listed, and evicted when the
+// index is written
+type entryRegistry struct {
+	locker    sync.Mutex
+	entries   map[string]*entryInfo
+	tags      map[string]map[string]struct{} //index -> keys
+	lastPrune time.Time
+}
+
+func newEntryRegistry() *entryRegistry {
+	return &entryRegistry{
+		entries: map[string]*entryInfo{},
+		tags:    map[string]map[string]struct{}{},
+	}
+}
+
+func (r *entryRegistry) add(key string, info *entryInfo, now time.Time) {
+	r.locker.Lock()
+	defer r.locker.Unlock()
+
+	r.removeLocked(key)
+	r.entries[key] = info
+	for _, index := range info.indices {
+		keys, ok := r.tags[index]
+		if !ok {
+			keys = map[string]struct{}{}
+			r.tags[index] = keys
+		}
+		keys[key] = struct{}{}
+	}
+
+	//entries are evicted by the cache silently, forget them once expired
+	if now.Sub(r.lastPrune) > time.Minute {
+		r.lastPrune = now
+		for k, v := range r.entries {
+			if now.After(v.expire) {
+				r.removeLocked(k)
+			}
+		}
+	}
+}
+
+func (r *entryRegistry) removeLocked(key string) *entryInfo {
+	info, ok := r.entries[key]
+	if !ok {
+		return nil
+	}
+	delete(r.entries, key)
+	for _, index := range info.indices {
+		if keys, ok := r.tags[index]; ok {
+			delete(keys, key)
+			if len(keys) == 0 {
+				delete(r.tags, index)
+			}
+		}
+	}
+	return info
+}
+
+func (r *entryRegistry) get(key string) (entryInfo, bool) {
+	r.locker.Lock()
+	defer r.locker.Unlock()
+	info, ok := r.entries[key]
+	if !ok {
+		return entryInfo{}, false
+	}
+	return *info, true
+}
+
+// take removes the entries of the tags matching the indices, returns the
+// keys and their backends
+func (r *entryRegistry) take(indices []string) map[string]string {
+	r.locker.Lock()
+	defer r.locker.Unlock()
+
+	keys := []string{}
+	for tag, v := range r.tags {
+		if !matchAnyIndex(tag, indices) {
+			continue
+		}
+		for k := range v {
+			keys = append(keys, k)
+		}
+	}
+	return r.takeLocked(keys)
+}
+
+// takePrefix removes the entries with the prefix, all entries if the prefix
+// is empty
+func (r *entryRegistry) takePrefix(prefix string) map[string]string {
+	r.locker.Lock()
+	defer r.locker.Unlock()
+
+	keys := []string{}
+	for k := range r.entries {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	return r.takeLocked(keys)
+}
+
+// takeKeys removes the entries of the keys, unknown keys are mapped to no
+// backend, as they may be cached by the peers
+func (r *entryRegistry) takeKeys(keys []string) map[string]string {
+	r.locker.Lock()
+	defer r.locker.Unlock()
+	result := r.takeLocked(keys)
+	for _, k := range keys {
+		if _, ok := result[k]; !ok {
+			result[k] = ""
+		}
+	}
+	return result
+}
+
+func (r *entryRegistry) takeLocked(keys []string) map[string]string {
+	result := make(map[string]string, len(keys))
+	for _, k := range keys {
+		if info := r.removeLocked(k); info != nil {
+			result[k] = info.backend
+		}
+	}
+	return result
+}
+
+// list returns the sorted live keys with the prefix, up to the size
+func (r *entryRegistry) list(prefix string, size int, now time.Time) []string {
+	r.locker.Lock()
+	defer r.locker.Unlock()
+
+	keys := []string{}
+	for k, v := range r.entries {
+		if strings.HasPrefix(k, prefix) && !now.After(v.expire) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	if size > 0 && len(keys) > size {
+		keys = keys[:size]
+	}
+	return keys
+}
+
+// usage returns the number and the bytes of the live entries by backend
+func (r *entryRegistry) usage(now time.Time) (map[string]int64, map[string]int64) {
+	r.locker.Lock()
+	defer r.locker.Unlock()
+
+	count := map[string]int64{}
+	size := map[string]int64{}
+	for _, v := range r.entries {
+		if now.After(v.expire) {
+			continue
+		}
+		count[v.backend]++
+		size[v.backend] += int64(v.size)
+	}
+	return count, size
+}
@@ -0,0 +1,85 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package cache
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func sortedKeys(keys map[string]string) []string {
+	result := []string{}
+	for k := range keys {
+		result = append(result, k)
+	}
+	sort.Strings(result)
+	return result
+}
+
+func TestEntryRegistryTake(t *testing.T) {
+	r := newEntryRegistry()
+	now := time.Now()
+	expire := now.Add(time.Minute)
+	r.add("k1", &entryInfo{backend: ristrettoCache, indices: []string{"logs-*"}, expire: expire}, now)
+	r.add("k2", &entryInfo{backend: ristrettoCache, indices: []string{"logs-2023", "metrics"}, expire: expire}, now)
+	r.add("k3", &entryInfo{backend: cacheRedis, indices: []string{"metrics"}, expire: expire}, now)
+
+	assert.Equal(t, []string{"k1", "k2"}, sortedKeys(r.take([]string{"logs-2023"})))
+	taken := r.take([]string{"metrics"})
+	assert.Equal(t, map[string]string{"k3": cacheRedis}, taken, "k2 was removed with its tags")
+	assert.Equal(t, 0, len(r.take([]string{"metrics"})))
+	assert.Equal(t, 0, len(r.tags))
+}
+
+func TestEntryRegistryListAndPrefix(t *testing.T) {
+	r := newEntryRegistry()
+	now := time.Now()
+	r.add("abc", &entryInfo{backend: ristrettoCache, size: 10, indices: []string{"a"}, expire: now.Add(time.Minute)}, now)
+	r.add("abd", &entryInfo{backend: cacheCCache, size: 20, indices: []string{"a"}, expire: now.Add(time.Minute)}, now)
+	r.add("xyz", &entryInfo{backend: ristrettoCache, size: 30, indices: []string{"b"}, expire: now.Add(time.Second)}, now)
+
+	assert.Equal(t, []string{"abc", "abd", "xyz"}, r.list("", 0, now))
+	assert.Equal(t, []string{"abc"}, r.list("ab", 1, now))
+	assert.Equal(t, []string{"abc", "abd"}, r.list("", 0, now.Add(2*time.Second)), "expired entries are not listed")
+
+	entries, size := r.usage(now)
+	assert.Equal(t, int64(2), entries[ristrettoCache])
+	assert.Equal(t, int64(40), size[ristrettoCache])
+
+	//re-adding the entry replaces its tags
+	r.add("abc", &entryInfo{backend: ristrettoCache, indices: []string{"c"}, expire: now.Add(time.Minute)}, now)
+	assert.Equal(t, []string{"abd"}, sortedKeys(r.take([]string{"a"})))
+
+	assert.Equal(t, []string{"abc"}, sortedKeys(r.takePrefix("ab")))
+	assert.Equal(t, map[string]string{"xyz": ristrettoCache, "unknown": ""}, r.takeKeys([]string{"xyz", "unknown"}))
+
+	//expired entries are pruned
+	r.add("k", &entryInfo{indices: []string{"d"}, expire: now.Add(time.Second)}, now)
+	r.add("k2", &entryInfo{indices: []string{"e"}, expire: now.Add(time.Hour)}, now.Add(2*time.Minute))
+	_, ok := r.get("k")
+	assert.False(t, ok)
+}
@@ -56,8 +56,16 @@ type Config struct {
 	MinResponseSize int      `config:"min_response_size"`
 	MaxResponseSize int      `config:"max_response_size"`
 
-	RedisHost string `config:"redis_host"`
-	RedisPort int    `config:"redis_port"`
+	RedisHost      string            `config:"redis_host"`
+	RedisPort      int               `config:"redis_port"`
+	RedisKeyPrefix string            `config:"redis_key_prefix"`
+	Redis          RedisConfig       `config:"redis"`
+	Compression    CompressionConfig `config:"compression"` //compression of the entries in redis
+
+	L1TTL string `config:"l1_ttl"` //max ttl of the local entries of the tiered cache
+	l1TTL time.Duration
+
+	InvalidationChannel string `config:"invalidation_channel"` //redis channel to notify the peers of the invalidation
 
 	MaxCachedSize int64 `config:"max_cached_size"`
 	MaxCachedItem int64 `config:"max_cached_item"`
@@ -66,6 +74,16 @@ type Config struct {
 	CacheTTL            string `config:"cache_ttl"`
 	asyncSearchCacheTTL time.Duration
 	cacheTTL            time.Duration
+
+	StaleWhileRevalidate string   `config:"stale_while_revalidate"` //period after cache_ttl to serve the stale response while refreshing
+	RefreshFlow          string   `config:"refresh_flow"`           //flow to refresh the stale entries in background
+	RefreshConcurrency   int      `config:"refresh_concurrency"`
+	RefreshHits          int      `config:"refresh_hits"`    //entries with enough hits are refreshed ahead of expiration
+	RefreshAhead         float64  `config:"refresh_ahead"`   //ratio of cache_ttl to refresh the popular entries
+	RefreshContext       []string `config:"refresh_context"` //context keys copied to the refresh requests, such as the user set by the auth filters
+	staleWhileRevalidate time.Duration
+
+	Normalization NormalizationConfig `config:"normalization"` //normalize the request to generate the cache key
 }
 
 var defaultConfig = Config{
@@ -78,6 +96,21 @@ var defaultConfig = Config{
 	MaxCachedSize:       1000000000,
 	MaxCachedItem:       1000000,
 	CacheType:           defaultCacheType,
+	InvalidationChannel: "gateway_cache_invalidation",
+	RedisKeyPrefix:      "gateway_cache:",
+	L1TTL:               "1m",
+	RefreshConcurrency:  10,
+	RefreshAhead:        0.8,
+	RefreshContext:      []string{"user_id", "user_name", "user_roles", "user_groups"},
+	Redis: RedisConfig{
+		Mode:             redisStandalone,
+		FailureThreshold: 3,
+		RetryInterval:    "10s",
+	},
+	Compression: CompressionConfig{
+		Algorithm: compressionZstd,
+		MinSize:   4096,
+	},
 }
 
 func init() {
@@ -92,6 +125,9 @@ func NewGet(c *config.Config) (pipeline.Filter, error) {
 	if err := c.Unpack(&cfg); err != nil {
 		return nil, fmt.Errorf("failed to unpack the filter configuration : %s", err)
 	}
+	if err := cfg.Redis.validate(); err != nil {
+		return nil, err
+	}
 
 	cfg.asyncSearchCacheTTL = util.GetDurationOrDefault(cfg.AsyncSearchCacheTTL, 10*time.Minute)
 	cfg.cacheTTL = util.GetDurationOrDefault(cfg.CacheTTL, 10*time.Second)
@@ -99,7 +135,16 @@ func NewGet(c *config.Config) (pipeline.Filter, error) {
 	runner := RequestCacheGet{config: &cfg}
 	runner.RequestCache.config = &cfg
 
+	if cfg.RefreshFlow != "" {
+		runner.refreshFlow = common.GetFlowProcess(cfg.RefreshFlow)
+		if cfg.RefreshConcurrency <= 0 {
+			cfg.RefreshConcurrency = 1
+		}
+		runner.refreshTokens = make(chan struct{}, cfg.RefreshConcurrency)
+	}
+
 	runner.initCache()
+	runner.subscribeInvalidation()
 
 	return &runner, nil
 }
@@ -111,19 +156,27 @@ func NewSet(c *config.Config) (pipeline.Filter, error) {
 	if err := c.Unpack(&cfg); err != nil {
 		return nil, fmt.Errorf("failed to unpack the filter configuration : %s", err)
 	}
+	if err := cfg.Redis.validate(); err != nil {
+		return nil, err
+	}
 
 	cfg.asyncSearchCacheTTL = util.GetDurationOrDefault(cfg.AsyncSearchCacheTTL, 10*time.Minute)
 	cfg.cacheTTL = util.GetDurationOrDefault(cfg.CacheTTL, 10*time.Second)
+	if cfg.StaleWhileRevalidate != "" {
+		cfg.staleWhileRevalidate = util.GetDurationOrDefault(cfg.StaleWhileRevalidate, 0)
+	}
 
 	runner := RequestCacheSet{config: &cfg}
 	runner.RequestCache.config = &cfg
 
 	runner.initCache()
+	runner.subscribeInvalidation()
 
 	return &runner, nil
 }
 
 const cacheRedis = "redis"
+const cacheTiered = "tiered"
 const cacheCCache = "ccache"
 const ristrettoCache = "ristretto"
 const defaultCacheType = "ristretto"
@@ -132,7 +185,7 @@ var ccCache *ccache.LayeredCache
 var l sync.RWMutex
 var colon = []byte(": ")
 var newLine = []byte("\n")
-var client *redis.Client
+var client redis.UniversalClient
 var cache *ristretto.Cache
 var inited bool
 var ctx = context.Background()
@@ -143,36 +196,14 @@ var bytesBufferPool = &sync.Pool{
 	},
 }
 
-func (p *RequestCache) getRedisClient() *redis.Client {
-
-	if client != nil {
-		return client
-	}
-
-	l.Lock()
-	defer l.Unlock()
-
-	if client != nil {
-		return client
-	}
-
-	client = redis.NewClient(&redis.Options{
-		Addr: fmt.Sprintf("%s:%v", p.config.RedisHost, p.config.RedisPort),
-		//Password: handler.config.RedisConfig.Password,
-		//DB:       handler.config.RedisConfig.DB,
-		Password: "",
-		DB:       0,
-	})
-
-	_, err := client.Ping(ctx).Result()
-	if err != nil {
-		panic(err)
-	}
-
-	return client
+func (p *RequestCache) redisKey(key string) string {
+	return p.config.RedisKeyPrefix + key
 }
 
 func (p *RequestCache) initCache() {
+	registerBackend(p)
+	p.config.l1TTL = util.GetDurationOrDefault(p.config.L1TTL, 0)
+
 	if inited {
 		return
 	}
@@ -189,7 +220,7 @@ func (p *RequestCache) initCache() {
 		NumCounters: 1e7,                    // Num keys to track frequency of (10M).
 		MaxCost:     p.config.MaxCachedSize, // Maximum cost of cache (1GB).
 		BufferItems: 64,                     // Number of keys per Get buffer.
-		Metrics:     false,
+		Metrics:     true,
 	})
 	if err != nil {
 		panic(err)
@@ -199,7 +230,15 @@ func (p *RequestCache) initCache() {
 	inited = true
 }
 
+// GetCache returns the cached entry, the entry read through from redis is
+// tagged with _all, as its indices are unknown
 func (p *RequestCache) GetCache(key string) ([]byte, bool) {
+	return p.getTaggedCache(key, "", []string{allIndices})
+}
+
+// getTaggedCache returns the cached entry, the entry read through from redis
+// is registered with the indices, so it is evicted along with the others
+func (p *RequestCache) getTaggedCache(key, source string, indices []string) ([]byte, bool) {
 	item := ccCache.GetOrCreateSecondaryCache("default").Get(key)
 	if item != nil {
 		data := item.Value().([]byte)
@@ -207,17 +246,31 @@ func (p *RequestCache) GetCache(key string) ([]byte, bool) {
 			stats.Increment("cache", "expired")
 			ccCache.GetOrCreateSecondaryCache("default").Delete(key)
 		}
+		getCounters(cacheCCache).hit()
 		return data, true
 	}
+	counters := getCounters(p.config.CacheType)
 	switch p.config.CacheType {
 	case cacheRedis:
-		b, err := p.getRedisClient().Get(ctx, key).Result()
-		if err == redis.Nil {
-			return nil, false
-		} else if err != nil {
-			return nil, false
+		if data, _, ok := p.getRedis(key, false); ok {
+			counters.hit()
+			return data, true
+		}
+	case cacheTiered:
+		if o, found := cache.Get(key); found {
+			counters.hit()
+			return o.([]byte), true
+		}
+		if data, ttl, ok := p.getRedis(key, true); ok {
+			//read through, the local entry expires no later than the one in redis
+			ttl = p.localTTL(ttl)
+			cache.SetWithTTL(key, data, int64(len(data)), ttl)
+			now := time.Now()
+			registry.add(key, &entryInfo{backend: backendName(p.config.CacheType), size: len(data), path: source, indices: indices, expire: now.Add(ttl)}, now)
+			counters.hit()
+			counters.l2Hit()
+			return data, true
 		}
-		return []byte(b), true
 	case cacheCCache:
 
 		item := ccCache.GetOrCreateSecondaryCache("default").Get(key)
@@ -227,14 +280,17 @@ func (p *RequestCache) GetCache(key string) ([]byte, bool) {
 				stats.Increment("cache", "expired")
 				ccCache.GetOrCreateSecondaryCache("default").Delete(key)
 			}
+			counters.hit()
 			return data, true
 		}
 	default:
 		o, found := cache.Get(key)
 		if found {
+			counters.hit()
 			return o.([]byte), true
 		}
 	}
+	counters.miss()
 	return nil, false
 }
 
@@ -252,12 +308,15 @@ func (p *RequestCache) SetCache(key string, data []byte, ttl time.Duration) {
 		return
 	}
 
+	getCounters(p.config.CacheType).set(dataLen)
+
 	switch p.config.CacheType {
 	case cacheRedis:
-		err := p.getRedisClient().Set(ctx, key, data, ttl).Err()
-		if err != nil {
-			panic(err)
-		}
+		p.setRedis(key, data, ttl)
+		return
+	case cacheTiered:
+		cache.SetWithTTL(key, data, int64(dataLen), p.localTTL(ttl))
+		p.setRedis(key, data, ttl)
 		return
 	case cacheCCache:
 		ccCache.GetOrCreateSecondaryCache("default").Set(key, data, ttl)
@@ -267,7 +326,41 @@ func (p *RequestCache) SetCache(key string, data []byte, ttl time.Duration) {
 	}
 }
 
+// localTTL returns the ttl of the local entry of the tiered cache
+func (p *RequestCache) localTTL(ttl time.Duration) time.Duration {
+	if ttl <= 0 {
+		ttl = p.config.cacheTTL
+	}
+	if p.config.l1TTL > 0 && ttl > p.config.l1TTL {
+		return p.config.l1TTL
+	}
+	return ttl
+}
+
 func (p *RequestCache) getHash(ctx *fasthttp.RequestCtx) string {
+	if p.config.Normalization.Enabled {
+		return getCanonicalHash(ctx, &p.config.Normalization)
+	}
+	return getRequestHash(ctx)
+}
+
+// userIdentity returns the user and the roles set by the auth filters, as the
+// auth filters may remove the auth header of the authenticated requests
+func userIdentity(ctx *fasthttp.RequestCtx) []byte {
+	buffer := bytes.Buffer{}
+	if v := ctx.Get("user_name"); v != nil {
+		buffer.WriteString(fmt.Sprint(v))
+	}
+	buffer.Write(newLine)
+	if v := ctx.Get("user_roles"); v != nil {
+		buffer.WriteString(fmt.Sprint(v))
+	}
+	buffer.Write(newLine)
+	return buffer.Bytes()
+}
+
+// getRequestHash returns the digest of the method, auth, user, uri and body of the request
+func getRequestHash(ctx *fasthttp.RequestCtx) string {
 
 	//TODO configure, remove keys from hash factor
 	//ctx.Request.URI().QueryArgs().Del("preference")
@@ -284,6 +377,7 @@ func (p *RequestCache) getHash(ctx *fasthttp.RequestCtx) string {
 	buffer.Write(ctx.Request.Header.Method())
 	//TODO enable configure for this feature, may filter by user or share, add/remove Authorization header to hash factor
 	buffer.Write(ctx.Request.Header.PeekAny(fasthttp.AuthHeaderKeys))
+	buffer.Write(userIdentity(ctx))
 	buffer.Write(ctx.Request.PhantomURI().FullURI())
 	buffer.Write(ctx.Request.GetRawBody())
 	str := util.MD5digestString(buffer.Bytes())
@@ -296,7 +390,9 @@ func (p *RequestCache) getHash(ctx *fasthttp.RequestCtx) string {
 
 type RequestCacheGet struct {
 	RequestCache
-	config *Config
+	config        *Config
+	refreshFlow   func(ctx *fasthttp.RequestCtx)
+	refreshTokens chan struct{}
 }
 
 func (filter *RequestCacheGet) Name() string {
@@ -376,7 +472,8 @@ func (filter *RequestCacheGet) Filter(ctx *fasthttp.RequestCtx) {
 		hash := filter.getHash(ctx)
 		ctx.Set(common.CACHEHASH, hash)
 
-		item, found := filter.GetCache(hash)
+		source := string(ctx.Request.PhantomURI().Path())
+		item, found := filter.getTaggedCache(hash, source, getPathIndices(source))
 
 		if global.Env().IsDebug {
 			log.Trace("check cache:", hash, ", found:", found)
@@ -384,9 +481,37 @@ func (filter *RequestCacheGet) Filter(ctx *fasthttp.RequestCtx) {
 
 		ctx.Response.Header.Set("X-Cache-Hash", hash)
 
+		var meta *entryMeta
+		var stale bool
+		now := time.Now()
+		if found {
+			meta, item = decodeEntry(item)
+			stale = meta != nil && meta.stale(now)
+			if stale && filter.refreshFlow == nil && refreshes.begin(hash, refreshTimeout, now) {
+				//revalidated by this request, the others are served with the stale response meanwhile
+				stats.Increment("cache", "revalidate")
+				found = false
+			}
+		}
+
 		if found {
 
-			stats.Increment("cache", "hit")
+			if stale {
+				stats.Increment("cache", "stale")
+				filter.backgroundRefresh(ctx, hash)
+			} else {
+				stats.Increment("cache", "hit")
+			}
+
+			if meta != nil {
+				hitCount := hitCounters.hit(hash, meta, now)
+				if !stale && filter.config.RefreshHits > 0 && hitCount >= int64(filter.config.RefreshHits) &&
+					float64(meta.age(now)) >= filter.config.RefreshAhead*float64(time.Duration(meta.SoftTTL)*time.Millisecond) {
+					//popular entries are refreshed ahead, so they never go stale
+					filter.backgroundRefresh(ctx, hash)
+				}
+			}
+
 			err := ctx.Response.Decode(item)
 			if err != nil {
 				log.Error(err)
@@ -394,6 +519,14 @@ func (filter *RequestCacheGet) Filter(ctx *fasthttp.RequestCtx) {
 			}
 			ctx.Response.Cached = true
 			ctx.Response.Header.Set("X-Cache-Hit", "true")
+			if stale {
+				ctx.Response.Header.Set("X-Cache", "STALE")
+			} else {
+				ctx.Response.Header.Set("X-Cache", "HIT")
+			}
+			if meta != nil {
+				ctx.Response.Header.Set("Age", fmt.Sprintf("%v", int64(meta.age(now).Seconds())))
+			}
 			ctx.SetDestination("cache")
 
 			if global.Env().IsDebug {
@@ -403,6 +536,7 @@ func (filter *RequestCacheGet) Filter(ctx *fasthttp.RequestCtx) {
 			ctx.Finished()
 		} else {
 			ctx.Response.Header.Set("X-Cache-Hit", "false")
+			ctx.Response.Header.Set("X-Cache", "MISS")
 			stats.Increment("cache", "miss")
 		}
 	} else {
@@ -430,6 +564,19 @@ func (filter *RequestCacheSet) Name() string {
 	return "set_cache"
 }
 
+// storeEntry caches the response with the meta, the entry is kept for extra
+// stale_while_revalidate after it becomes stale
+func (filter *RequestCacheSet) storeEntry(key string, response []byte, source string, indices []string) {
+	ttl := filter.GetChaosTTLDuration()
+	now := time.Now()
+	meta := &entryMeta{Created: now.UnixNano() / int64(time.Millisecond), SoftTTL: ttl.Milliseconds(), Path: source}
+	hardTTL := ttl + filter.config.staleWhileRevalidate
+	data := encodeEntry(meta, response)
+	filter.SetCache(key, data, hardTTL)
+	filter.tagCache(key, len(data), source, indices, hardTTL)
+	refreshes.end(key)
+}
+
 func (filter *RequestCacheSet) Filter(ctx *fasthttp.RequestCtx) {
 	method := string(ctx.Request.Header.Method())
 	url := string(ctx.RequestURI())
@@ -462,6 +609,10 @@ func (filter *RequestCacheSet) Filter(ctx *fasthttp.RequestCtx) {
 
 		var id string
 
+		//the async search results are tagged with _all, as the path has no index
+		source := string(ctx.Request.PhantomURI().Path())
+		indices := getPathIndices(source)
+
 		cacheBytes := ctx.Response.Encode()
 
 		if len(cacheBytes) == 0 {
@@ -513,7 +664,7 @@ func (filter *RequestCacheSet) Filter(ctx *fasthttp.RequestCtx) {
 							if global.Env().IsDebug {
 								log.Trace("found request hash, set cache:", id, ": ", string(item))
 							}
-							filter.SetCache(string(item), cacheBytes, filter.GetChaosTTLDuration())
+							filter.storeEntry(string(item), cacheBytes, source, indices)
 						} else {
 							if global.Env().IsDebug {
 								log.Trace("async search request hash was lost:", id)
@@ -524,7 +675,7 @@ func (filter *RequestCacheSet) Filter(ctx *fasthttp.RequestCtx) {
 			}
 		}
 
-		filter.SetCache(hash, cacheBytes, filter.GetChaosTTLDuration())
+		filter.storeEntry(hash, cacheBytes, source, indices)
 		if global.Env().IsDebug {
 			log.Trace("cache was stored")
 		}
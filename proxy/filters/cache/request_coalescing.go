@@ -0,0 +1,209 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package cache
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"infini.sh/framework/core/config"
+	"infini.sh/framework/core/global"
+	"infini.sh/framework/core/pipeline"
+	"infini.sh/framework/core/stats"
+	"infini.sh/framework/core/util"
+	"infini.sh/framework/lib/fasthttp"
+	"infini.sh/gateway/common"
+)
+
+// RequestCoalescing sends only the first of the identical concurrent
+// requests upstream, the others wait for and share its response
+type RequestCoalescing struct {
+	Flow               string   `config:"flow"` //flow to process the leading request
+	ContinueAfterMatch bool     `config:"continue"`
+	PathKeywords       []string `config:"path_keywords"` //POST requests to these paths are coalesced, GET requests are always coalesced
+	WaitTimeout        string   `config:"wait_timeout"`  //followers process the request themselves after the timeout
+	AddResponseHeader  bool     `config:"add_response_header"`
+
+	flow        common.FilterFlow
+	waitTimeout time.Duration
+	group       *coalescingGroup
+}
+
+func init() {
+	pipeline.RegisterFilterPluginWithConfigMetadata("request_coalescing", pipeline.FilterConfigChecked(NewRequestCoalescing, pipeline.RequireFields("flow")), &RequestCoalescing{})
+}
+
+func NewRequestCoalescing(c *config.Config) (pipeline.Filter, error) {
+	runner := RequestCoalescing{
+		PathKeywords:      []string{"_search", "_msearch", "_count", "_mget"},
+		WaitTimeout:       "5s",
+		AddResponseHeader: true,
+	}
+	if err := c.Unpack(&runner); err != nil {
+		return nil, fmt.Errorf("failed to unpack the filter configuration : %s", err)
+	}
+
+	runner.flow = common.MustGetFlow(runner.Flow)
+	runner.waitTimeout = util.GetDurationOrDefault(runner.WaitTimeout, 5*time.Second)
+	runner.group = newCoalescingGroup()
+
+	stats.RegisterStats(fmt.Sprintf("request_coalescing.%v.inflight", runner.Flow), func() interface{} {
+		return runner.group.inflight()
+	})
+
+	return &runner, nil
+}
+
+func (filter *RequestCoalescing) Name() string {
+	return "request_coalescing"
+}
+
+func (filter *RequestCoalescing) coalescable(ctx *fasthttp.RequestCtx) bool {
+	method := ctx.Request.Header.Method()
+	if util.CompareStringAndBytes(method, fasthttp.MethodGet) {
+		return true
+	}
+	if !util.CompareStringAndBytes(method, fasthttp.MethodPost) {
+		return false
+	}
+	return util.ContainsAnyInArray(string(ctx.Request.PhantomURI().Path()), filter.PathKeywords)
+}
+
+func (filter *RequestCoalescing) process(ctx *fasthttp.RequestCtx) {
+	ctx.Resume()
+	filter.flow.Process(ctx)
+	if !filter.ContinueAfterMatch {
+		ctx.Finished()
+	}
+}
+
+func (filter *RequestCoalescing) Filter(ctx *fasthttp.RequestCtx) {
+	if !filter.coalescable(ctx) {
+		filter.process(ctx)
+		return
+	}
+
+	key, ok := ctx.GetString(common.CACHEHASH)
+	if !ok {
+		key = getRequestHash(ctx)
+	}
+
+	call, leader := filter.group.join(key)
+	if leader {
+		var response []byte
+		defer func() {
+			filter.group.finish(key, call, response)
+		}()
+		stats.Increment("request_coalescing", filter.Flow+".leader")
+		filter.process(ctx)
+		response = ctx.Response.Encode()
+		return
+	}
+
+	response, ok := call.wait(filter.waitTimeout)
+	if !ok {
+		stats.Increment("request_coalescing", filter.Flow+".timeout")
+		if global.Env().IsDebug {
+			log.Debugf("request [%v] was not coalesced, the leading request was not finished or failed", ctx.PhantomURI().String())
+		}
+		filter.process(ctx)
+		return
+	}
+
+	if err := ctx.Response.Decode(response); err != nil {
+		log.Errorf("failed to decode the coalesced response, %v", err)
+		filter.process(ctx)
+		return
+	}
+
+	stats.Increment("request_coalescing", filter.Flow+".coalesced")
+	if filter.AddResponseHeader {
+		ctx.Response.Header.Set("X-Coalesced", "true")
+	}
+	if global.Env().IsDebug {
+		log.Tracef("request [%v] coalesced: %v", ctx.PhantomURI().String(), key)
+	}
+	ctx.SetDestination("coalesced")
+	if !filter.ContinueAfterMatch {
+		ctx.Finished()
+	}
+}
+
+type coalescingCall struct {
+	done     chan struct{}
+	response []byte
+}
+
+// wait returns the response of the leading request, false if timed out or
+// the leading request failed
+func (c *coalescingCall) wait(timeout time.Duration) ([]byte, bool) {
+	timer := util.AcquireTimer(timeout)
+	defer util.ReleaseTimer(timer)
+	select {
+	case <-c.done:
+		return c.response, c.response != nil
+	case <-timer.C:
+		return nil, false
+	}
+}
+
+type coalescingGroup struct {
+	locker sync.Mutex
+	calls  map[string]*coalescingCall
+}
+
+func newCoalescingGroup() *coalescingGroup {
+	return &coalescingGroup{calls: map[string]*coalescingCall{}}
+}
+
+// join returns the inflight call of the key, true if the caller is the leader
+func (g *coalescingGroup) join(key string) (*coalescingCall, bool) {
+	g.locker.Lock()
+	defer g.locker.Unlock()
+	if c, ok := g.calls[key]; ok {
+		return c, false
+	}
+	c := &coalescingCall{done: make(chan struct{})}
+	g.calls[key] = c
+	return c, true
+}
+
+// finish releases the followers, requests arriving later start a new call
+func (g *coalescingGroup) finish(key string, c *coalescingCall, response []byte) {
+	g.locker.Lock()
+	if g.calls[key] == c {
+		delete(g.calls, key)
+	}
+	g.locker.Unlock()
+	c.response = response
+	close(c.done)
+}
+
+func (g *coalescingGroup) inflight() int {
+	g.locker.Lock()
+	defer g.locker.Unlock()
+	return len(g.calls)
+}
@@ -0,0 +1,77 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package cache
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCoalescingGroup(t *testing.T) {
+	g := newCoalescingGroup()
+
+	leader, ok := g.join("k")
+	assert.True(t, ok)
+
+	wg := sync.WaitGroup{}
+	results := make([][]byte, 5)
+	for i := 0; i < 5; i++ {
+		c, ok := g.join("k")
+		assert.False(t, ok)
+		assert.Equal(t, leader, c)
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], _ = c.wait(time.Second)
+		}(i)
+	}
+	assert.Equal(t, 1, g.inflight())
+
+	g.finish("k", leader, []byte("response"))
+	wg.Wait()
+	for _, v := range results {
+		assert.Equal(t, "response", string(v))
+	}
+
+	//later requests start a new call
+	_, ok = g.join("k")
+	assert.True(t, ok)
+}
+
+func TestCoalescingFailureAndTimeout(t *testing.T) {
+	g := newCoalescingGroup()
+	leader, _ := g.join("k")
+	follower, _ := g.join("k")
+
+	_, ok := follower.wait(10 * time.Millisecond)
+	assert.False(t, ok, "timed out")
+
+	g.finish("k", leader, nil)
+	_, ok = follower.wait(time.Second)
+	assert.False(t, ok, "the leading request failed")
+	assert.Equal(t, 0, g.inflight())
+}
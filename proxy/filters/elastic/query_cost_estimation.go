@@ -0,0 +1,404 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package elastic
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/buger/jsonparser"
+	log "github.com/cihub/seelog"
+	"infini.sh/framework/core/config"
+	"infini.sh/framework/core/global"
+	"infini.sh/framework/core/pipeline"
+	"infini.sh/framework/core/stats"
+	"infini.sh/framework/core/util"
+	"infini.sh/framework/lib/fasthttp"
+	"infini.sh/gateway/common"
+)
+
+type QueryCostWeights struct {
+	Size             float64 `config:"size"`              //per hit to return
+	From             float64 `config:"from"`              //per hit to skip
+	Aggregation      float64 `config:"aggregation"`       //per aggregation
+	AggregationDepth float64 `config:"aggregation_depth"` //multiplier of the aggregation cost per nesting level
+	Bucket           float64 `config:"bucket"`            //per estimated bucket
+	Wildcard         float64 `config:"wildcard"`
+	LeadingWildcard  float64 `config:"leading_wildcard"`
+	Regexp           float64 `config:"regexp"`
+	Fuzzy            float64 `config:"fuzzy"`
+	Script           float64 `config:"script"`
+	Index            float64 `config:"index"`         //per index after the first one
+	IndexPattern     float64 `config:"index_pattern"` //per wildcard pattern, or all the indices
+}
+
+type QueryCostEstimation struct {
+	PathKeywords      []string         `config:"path_keywords"`
+	BaseCost          float64          `config:"base_cost"`
+	MaxCost           int              `config:"max_cost"`
+	DefaultBuckets    int              `config:"default_buckets"` //buckets of the aggregations without size, eg: date_histogram
+	AddResponseHeader bool             `config:"add_response_header"`
+	Weights           QueryCostWeights `config:"weights"`
+}
+
+var defaultQueryCostEstimation = QueryCostEstimation{
+	PathKeywords:   []string{"_search", "_async_search", "_msearch"},
+	BaseCost:       1,
+	MaxCost:        10000,
+	DefaultBuckets: 10,
+	Weights: QueryCostWeights{
+		Size:             0.01,
+		From:             0.02,
+		Aggregation:      2,
+		AggregationDepth: 2,
+		Bucket:           0.01,
+		Wildcard:         10,
+		LeadingWildcard:  50,
+		Regexp:           20,
+		Fuzzy:            5,
+		Script:           20,
+		Index:            1,
+		IndexPattern:     5,
+	},
+}
+
+func init() {
+	pipeline.RegisterFilterPluginWithConfigMetadata("query_cost_estimation", NewQueryCostEstimation, &defaultQueryCostEstimation)
+}
+
+func NewQueryCostEstimation(c *config.Config) (pipeline.Filter, error) {
+	runner := defaultQueryCostEstimation
+	if err := c.Unpack(&runner); err != nil {
+		return nil, fmt.Errorf("failed to unpack the filter configuration : %s", err)
+	}
+	if runner.MaxCost <= 0 {
+		runner.MaxCost = math.MaxInt32
+	}
+	if runner.DefaultBuckets <= 0 {
+		runner.DefaultBuckets = 1
+	}
+	return &runner, nil
+}
+
+func (filter *QueryCostEstimation) Name() string {
+	return "query_cost_estimation"
+}
+
+const headerQueryCost = "X-Query-Cost"
+
+var msearchSuffix = []byte("/_msearch")
+
+func (filter *QueryCostEstimation) Filter(ctx *fasthttp.RequestCtx) {
+	path := ctx.PhantomURI().Path()
+	if !util.ContainsAnyInArray(string(path), filter.PathKeywords) {
+		return
+	}
+
+	indices := getPathIndices(path)
+	args := ctx.PhantomURI().QueryArgs()
+
+	var cost float64
+	if bytes.HasSuffix(path, msearchSuffix) {
+		cost = filter.estimateMultiSearch(indices, ctx.Request.GetRawBody())
+	} else {
+		cost = filter.estimate(indices, ctx.Request.GetRawBody(), args.Peek("size"), args.Peek("from"))
+	}
+
+	v := filter.normalize(cost)
+	ctx.Set(common.QUERYCOST, v)
+	stats.Timing("query_cost", "estimated", int64(v))
+
+	if global.Env().IsDebug {
+		log.Debugf("estimated cost of [%v]: %v", ctx.PhantomURI().String(), v)
+	}
+
+	if filter.AddResponseHeader {
+		ctx.Response.Header.Set(headerQueryCost, strconv.Itoa(v))
+	}
+}
+
+// normalize rounds the cost up and keeps it in [1, max_cost]
+func (filter *QueryCostEstimation) normalize(cost float64) int {
+	v := math.Ceil(cost)
+	if v < 1 {
+		return 1
+	}
+	if v > float64(filter.MaxCost) {
+		return filter.MaxCost
+	}
+	return int(v)
+}
+
+// estimateMultiSearch sums the cost of each search in the msearch body, the
+// indices in the header lines take precedence over the ones in the path
+func (filter *QueryCostEstimation) estimateMultiSearch(pathIndices []string, body []byte) float64 {
+	var cost float64
+	var header []byte
+	for _, line := range bytes.Split(body, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		if header == nil {
+			header = line
+			continue
+		}
+		indices := getStringOrArray(header, "index")
+		if len(indices) == 0 {
+			indices = pathIndices
+		}
+		cost += filter.estimate(indices, line, nil, nil)
+		header = nil
+	}
+	return cost
+}
+
+// estimate returns the cost of a single search
+func (filter *QueryCostEstimation) estimate(indices []string, body []byte, sizeArg, fromArg []byte) float64 {
+	w := &filter.Weights
+	cost := filter.BaseCost
+
+	size := getIntOrDefault(sizeArg, body, "size", 10)
+	from := getIntOrDefault(fromArg, body, "from", 0)
+	cost += float64(size)*w.Size + float64(from)*w.From
+
+	cost += filter.indicesCost(indices)
+
+	if len(body) > 0 {
+		cost += filter.walk(body)
+	}
+	return cost
+}
+
+func (filter *QueryCostEstimation) indicesCost(indices []string) float64 {
+	if len(indices) == 0 {
+		return filter.Weights.IndexPattern
+	}
+	var cost float64
+	for i, v := range indices {
+		if v == "_all" || strings.Contains(v, "*") {
+			cost += filter.Weights.IndexPattern
+		} else if i > 0 {
+			cost += filter.Weights.Index
+		}
+	}
+	return cost
+}
+
+// walk visits the dsl recursively and charges the expensive features
+func (filter *QueryCostEstimation) walk(data []byte) float64 {
+	w := &filter.Weights
+	var cost float64
+	jsonparser.ObjectEach(data, func(key []byte, value []byte, dataType jsonparser.ValueType, offset int) error {
+		switch string(key) {
+		case "aggs", "aggregations":
+			if dataType == jsonparser.Object {
+				cost += filter.aggregationsCost(value, 1, 1)
+			}
+			return nil
+		case "wildcard":
+			if isLeadingWildcard(getQueryValue(value, "value", "wildcard")) {
+				cost += w.LeadingWildcard
+			} else {
+				cost += w.Wildcard
+			}
+			return nil
+		case "query_string", "simple_query_string":
+			q, _ := jsonparser.GetString(value, "query")
+			if hasLeadingWildcardTerm(q) {
+				cost += w.LeadingWildcard
+			} else if strings.ContainsAny(q, "*?") {
+				cost += w.Wildcard
+			}
+		case "regexp":
+			cost += w.Regexp
+			return nil
+		case "fuzzy":
+			cost += w.Fuzzy
+			return nil
+		case "script":
+			cost += w.Script
+			return nil
+		}
+		cost += filter.walkValue(value, dataType)
+		return nil
+	})
+	return cost
+}
+
+func (filter *QueryCostEstimation) walkValue(value []byte, dataType jsonparser.ValueType) float64 {
+	switch dataType {
+	case jsonparser.Object:
+		return filter.walk(value)
+	case jsonparser.Array:
+		var cost float64
+		jsonparser.ArrayEach(value, func(v []byte, t jsonparser.ValueType, offset int, err error) {
+			cost += filter.walkValue(v, t)
+		})
+		return cost
+	}
+	return 0
+}
+
+// aggregationsCost charges each aggregation by its nesting depth, and the
+// buckets of the sub aggregations are multiplied by the buckets of the parents
+func (filter *QueryCostEstimation) aggregationsCost(aggs []byte, depth int, parentBuckets float64) float64 {
+	w := &filter.Weights
+	var cost float64
+	jsonparser.ObjectEach(aggs, func(name []byte, agg []byte, dataType jsonparser.ValueType, offset int) error {
+		if dataType != jsonparser.Object {
+			return nil
+		}
+		cost += w.Aggregation * math.Pow(w.AggregationDepth, float64(depth-1))
+		buckets := parentBuckets * float64(filter.bucketSize(agg))
+		cost += buckets * w.Bucket
+
+		jsonparser.ObjectEach(agg, func(key []byte, value []byte, t jsonparser.ValueType, offset int) error {
+			switch string(key) {
+			case "aggs", "aggregations":
+				if t == jsonparser.Object {
+					cost += filter.aggregationsCost(value, depth+1, buckets)
+				}
+			case "meta":
+			default:
+				//scripts or queries inside the aggregation
+				cost += filter.walkValue(value, t)
+			}
+			return nil
+		})
+		return nil
+	})
+	return cost
+}
+
+var bucketAggregations = map[string]bool{
+	"terms": true, "significant_terms": true, "rare_terms": true, "multi_terms": true,
+	"composite": true, "date_histogram": true, "histogram": true, "auto_date_histogram": true,
+	"variable_width_histogram": true, "geotile_grid": true, "geohash_grid": true,
+}
+
+// bucketSize returns the requested size of the bucket aggregation, or the
+// default buckets if not specified, metric aggregations have a single bucket
+func (filter *QueryCostEstimation) bucketSize(agg []byte) int {
+	size := 1
+	jsonparser.ObjectEach(agg, func(key []byte, value []byte, dataType jsonparser.ValueType, offset int) error {
+		name := string(key)
+		if !bucketAggregations[name] {
+			return nil
+		}
+		size = filter.DefaultBuckets
+		if v, err := jsonparser.GetInt(value, "size"); err == nil && v > 0 {
+			size = int(v)
+		} else if v, err := jsonparser.GetInt(value, "buckets"); err == nil && v > 0 {
+			size = int(v)
+		}
+		return nil
+	})
+	return size
+}
+
+// getPathIndices returns the indices of the request path, empty for all indices
+func getPathIndices(path []byte) []string {
+	path = bytes.TrimPrefix(path, []byte("/"))
+	i := bytes.IndexByte(path, '/')
+	if i <= 0 || path[0] == '_' {
+		return nil
+	}
+	return strings.Split(string(path[:i]), ",")
+}
+
+func getIntOrDefault(arg []byte, body []byte, key string, defaultValue int) int {
+	if len(arg) > 0 {
+		if v, err := strconv.Atoi(string(arg)); err == nil && v >= 0 {
+			return v
+		}
+	}
+	if len(body) > 0 {
+		if v, err := jsonparser.GetInt(body, key); err == nil && v >= 0 {
+			return int(v)
+		}
+	}
+	return defaultValue
+}
+
+func getStringOrArray(data []byte, key string) []string {
+	v, t, _, err := jsonparser.Get(data, key)
+	if err != nil {
+		return nil
+	}
+	switch t {
+	case jsonparser.String:
+		return strings.Split(string(v), ",")
+	case jsonparser.Array:
+		values := []string{}
+		jsonparser.ArrayEach(v, func(value []byte, dataType jsonparser.ValueType, offset int, err error) {
+			if dataType == jsonparser.String {
+				values = append(values, string(value))
+			}
+		})
+		return values
+	}
+	return nil
+}
+
+// getQueryValue returns the value of a term level query, eg:
+// {"field": "value"} or {"field": {"value": "value"}}
+func getQueryValue(query []byte, keys ...string) string {
+	var result string
+	jsonparser.ObjectEach(query, func(field []byte, value []byte, dataType jsonparser.ValueType, offset int) error {
+		if dataType == jsonparser.String {
+			result = string(value)
+			return nil
+		}
+		for _, k := range keys {
+			if v, err := jsonparser.GetString(value, k); err == nil {
+				result = v
+				return nil
+			}
+		}
+		return nil
+	})
+	return result
+}
+
+func isLeadingWildcard(v string) bool {
+	return strings.HasPrefix(v, "*") || strings.HasPrefix(v, "?")
+}
+
+// hasLeadingWildcardTerm checks the terms of a query string
+func hasLeadingWildcardTerm(q string) bool {
+	for _, term := range strings.Fields(q) {
+		if i := strings.IndexByte(term, ':'); i >= 0 {
+			term = term[i+1:]
+		}
+		term = strings.TrimLeft(term, "(+-\"")
+		if isLeadingWildcard(term) {
+			return true
+		}
+	}
+	return false
+}
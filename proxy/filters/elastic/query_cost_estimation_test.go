@@ -0,0 +1,103 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package elastic
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestQueryCost() *QueryCostEstimation {
+	filter := defaultQueryCostEstimation
+	return &filter
+}
+
+func TestQueryCostSimpleSearch(t *testing.T) {
+	filter := newTestQueryCost()
+	cost := filter.estimate([]string{"test"}, []byte(`{"query":{"match":{"name":"medcl"}}}`), nil, nil)
+	assert.InDelta(t, 1.1, cost, 0.0001)
+	assert.Equal(t, 2, filter.normalize(cost))
+
+	//size and from in the args take precedence
+	cost = filter.estimate([]string{"test"}, []byte(`{"size":1000}`), []byte("100"), []byte("10000"))
+	assert.InDelta(t, 1+1+200, cost, 0.0001)
+}
+
+func TestQueryCostExpensiveQueries(t *testing.T) {
+	filter := newTestQueryCost()
+	body := []byte(`{"size":0,"query":{"bool":{"must":[
+		{"wildcard":{"name":{"value":"*dcl"}}},
+		{"wildcard":{"name":"med*"}},
+		{"regexp":{"name":"m.*"}},
+		{"query_string":{"query":"name:*cl AND age:30"}}
+	],"filter":{"script":{"script":"doc['age'].value > 10"}}}}}`)
+	cost := filter.estimate([]string{"test"}, body, nil, nil)
+	assert.InDelta(t, 1+50+10+20+50+20, cost, 0.0001)
+}
+
+func TestQueryCostAggregations(t *testing.T) {
+	filter := newTestQueryCost()
+	body := []byte(`{"size":0,"aggs":{
+		"by_user":{"terms":{"field":"user","size":100},
+			"aggs":{"by_day":{"date_histogram":{"field":"ts","calendar_interval":"1d"},
+				"aggs":{"max_age":{"max":{"field":"age"}}}}}},
+		"avg_age":{"avg":{"script":"doc['age'].value"}}
+	}}`)
+	cost := filter.estimate([]string{"test"}, body, nil, nil)
+	//aggregations: 2 + 4 + 8 + 2, buckets: 100 + 1000 + 1000 + 1, script: 20
+	expected := 1.0 + (2 + 4 + 8 + 2) + (100+1000+1000+1)*0.01 + 20
+	assert.InDelta(t, expected, cost, 0.0001)
+}
+
+func TestQueryCostIndices(t *testing.T) {
+	filter := newTestQueryCost()
+	assert.Equal(t, []string{"a", "b"}, getPathIndices([]byte("/a,b/_search")))
+	assert.Nil(t, getPathIndices([]byte("/_search")))
+	assert.Nil(t, getPathIndices([]byte("/_msearch")))
+
+	assert.Equal(t, 5.0, filter.indicesCost(nil))
+	assert.Equal(t, 0.0, filter.indicesCost([]string{"a"}))
+	assert.Equal(t, 2.0, filter.indicesCost([]string{"a", "b", "c"}))
+	assert.Equal(t, 5.0, filter.indicesCost([]string{"a", "logs-*"}))
+}
+
+func TestQueryCostMultiSearch(t *testing.T) {
+	filter := newTestQueryCost()
+	body := []byte(`{"index":"a,b"}
+{"query":{"match_all":{}},"size":100}
+{}
+{"query":{"regexp":{"name":"m.*"}}}
+`)
+	cost := filter.estimateMultiSearch([]string{"c"}, body)
+	assert.InDelta(t, (1+1+1)+(1+0.1+20), cost, 0.0001)
+}
+
+func TestQueryCostNormalize(t *testing.T) {
+	filter := newTestQueryCost()
+	filter.MaxCost = 100
+	assert.Equal(t, 1, filter.normalize(0.2))
+	assert.Equal(t, 3, filter.normalize(2.1))
+	assert.Equal(t, 100, filter.normalize(1000))
+}
@@ -82,7 +82,8 @@ func BasicAuth1(h fasthttp.RequestHandler, requiredUser, requiredPassword string
 }
 
 type BasicAuth struct {
-	ValidUsers map[string]string `config:"valid_users"`
+	ValidUsers map[string]string   `config:"valid_users"`
+	UserRoles  map[string][]string `config:"user_roles"` //roles of the users, checked by role_access_control
 }
 
 func (filter *BasicAuth) Name() string {
@@ -96,6 +97,11 @@ func (filter *BasicAuth) Filter(ctx *fasthttp.RequestCtx) {
 		p, ok := filter.ValidUsers[util.UnsafeBytesToString(user)]
 		if ok {
 			if util.UnsafeBytesToString(pass) == p {
+				name := string(user)
+				ctx.Set("user_name", name)
+				if roles, ok := filter.UserRoles[name]; ok {
+					ctx.Set("user_roles", roles)
+				}
 				return
 			}
 		}
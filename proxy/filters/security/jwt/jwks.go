@@ -0,0 +1,322 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package jwt
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+)
+
+// JWKSConfig is the source of the json web key set, the local file or the url
+type JWKSConfig struct {
+	File               string `config:"file"`
+	URL                string `config:"url"`
+	RefreshInterval    string `config:"refresh_interval"`     //reload the keys periodically, default 1h
+	MinRefreshInterval string `config:"min_refresh_interval"` //min interval of the reloads of the unknown kid, default 1m
+	Timeout            string `config:"timeout"`
+}
+
+// jsonWebKey is the key in the json web key set, only the fields of the
+// verification keys are parsed
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	K   string `json:"k"`
+}
+
+// verificationKey is the key to verify the signatures, *rsa.PublicKey,
+// *ecdsa.PublicKey or the []byte secret
+type verificationKey struct {
+	id  string
+	alg string
+	key interface{}
+}
+
+func decodeInt(s string) (*big.Int, error) {
+	data, err := decodeSegment(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, errors.New("empty value")
+	}
+	return new(big.Int).SetBytes(data), nil
+}
+
+var curves = map[string]elliptic.Curve{
+	"P-256": elliptic.P256(),
+	"P-384": elliptic.P384(),
+	"P-521": elliptic.P521(),
+}
+
+func (k *jsonWebKey) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeInt(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("invalid modulus, %v", err)
+		}
+		e, err := decodeInt(k.E)
+		if err != nil || !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, errors.New("invalid exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		curve, ok := curves[k.Crv]
+		if !ok {
+			return nil, fmt.Errorf("unsupported curve [%v]", k.Crv)
+		}
+		x, err := decodeInt(k.X)
+		if err != nil {
+			return nil, fmt.Errorf("invalid x, %v", err)
+		}
+		y, err := decodeInt(k.Y)
+		if err != nil {
+			return nil, fmt.Errorf("invalid y, %v", err)
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point is not on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "oct":
+		secret, err := decodeSegment(k.K)
+		if err != nil || len(secret) == 0 {
+			return nil, errors.New("invalid secret")
+		}
+		return secret, nil
+	}
+	return nil, fmt.Errorf("unsupported key type [%v]", k.Kty)
+}
+
+// parseKeySet parses the json web key set, or a single json web key, the keys
+// not for the signatures and the unsupported keys are skipped
+func parseKeySet(data []byte) ([]verificationKey, error) {
+	set := struct {
+		Keys []jsonWebKey `json:"keys"`
+	}{}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("invalid key set, %v", err)
+	}
+	if set.Keys == nil {
+		key := jsonWebKey{}
+		if err := json.Unmarshal(data, &key); err != nil || key.Kty == "" {
+			return nil, errors.New("invalid key set, no keys found")
+		}
+		set.Keys = []jsonWebKey{key}
+	}
+
+	keys := make([]verificationKey, 0, len(set.Keys))
+	for i := range set.Keys {
+		k := &set.Keys[i]
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		pub, err := k.publicKey()
+		if err != nil {
+			log.Warnf("invalid key [%v] in the key set, %v", k.Kid, err)
+			continue
+		}
+		keys = append(keys, verificationKey{id: k.Kid, alg: k.Alg, key: pub})
+	}
+	return keys, nil
+}
+
+// matchKeys returns the keys able to verify the token, all the keys are tried
+// if the token has no kid
+func matchKeys(keys []verificationKey, kid, alg string) []verificationKey {
+	a, ok := algorithms[alg]
+	if !ok {
+		return nil
+	}
+	matched := []verificationKey{}
+	for _, k := range keys {
+		if kid != "" && k.id != kid {
+			continue
+		}
+		if k.alg != "" && k.alg != alg {
+			continue
+		}
+		if a.accepts(k.key) {
+			matched = append(matched, k)
+		}
+	}
+	return matched
+}
+
+// keyStore holds the keys of the key set, the keys are reloaded after the
+// refresh interval, or when the kid of the token is unknown, such as the keys
+// are rotated
+type keyStore struct {
+	source          func() ([]byte, error)
+	refreshInterval time.Duration
+	minInterval     time.Duration
+	now             func() time.Time
+
+	lock        sync.RWMutex
+	keys        []verificationKey
+	loaded      time.Time
+	lastAttempt time.Time
+}
+
+func (s *keyStore) current() ([]verificationKey, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.keys, s.now().Sub(s.loaded) >= s.refreshInterval
+}
+
+// refresh reloads the keys, the stale keys are kept if the reload failed, and
+// the reloads are limited by the min interval
+func (s *keyStore) refresh(force bool) error {
+	now, ok := s.attempt(force)
+	if !ok {
+		return nil
+	}
+
+	//the keys are loaded without the lock, so the slow key set doesn't block
+	//the verifications with the current keys
+	data, err := s.source()
+	if err != nil {
+		return fmt.Errorf("failed to load the key set, %v", err)
+	}
+	keys, err := parseKeySet(data)
+	if err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if now.Before(s.loaded) {
+		return nil
+	}
+	s.keys = keys
+	s.loaded = now
+	return nil
+}
+
+// attempt checks whether the keys should be reloaded, and records the
+// attempt, so the concurrent reloads are limited by the min interval too
+func (s *keyStore) attempt(force bool) (time.Time, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := s.now()
+	if !force && now.Sub(s.loaded) < s.refreshInterval {
+		return now, false
+	}
+	if !s.lastAttempt.IsZero() && now.Sub(s.lastAttempt) < s.minInterval {
+		return now, false
+	}
+	s.lastAttempt = now
+	return now, true
+}
+
+// lookup returns the keys able to verify the token
+func (s *keyStore) lookup(kid, alg string) []verificationKey {
+	keys, stale := s.current()
+	if stale {
+		if err := s.refresh(false); err != nil {
+			log.Warn(err)
+		}
+		keys, _ = s.current()
+	}
+	matched := matchKeys(keys, kid, alg)
+	if len(matched) == 0 && kid != "" {
+		if err := s.refresh(true); err != nil {
+			log.Warn(err)
+		}
+		keys, _ = s.current()
+		matched = matchKeys(keys, kid, alg)
+	}
+	return matched
+}
+
+func fileSource(file string) func() ([]byte, error) {
+	return func() ([]byte, error) {
+		return ioutil.ReadFile(file)
+	}
+}
+
+func fetch(client *http.Client, url string) ([]byte, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code [%v] of [%v]", resp.StatusCode, url)
+	}
+	return data, nil
+}
+
+func urlSource(client *http.Client, url string) func() ([]byte, error) {
+	return func() ([]byte, error) {
+		return fetch(client, url)
+	}
+}
+
+// discoverySource resolves the jwks_uri by the openid discovery of the issuer
+// before loading the key set, so the moved key set is followed
+func discoverySource(client *http.Client, issuer string) func() ([]byte, error) {
+	url := strings.TrimRight(issuer, "/") + "/.well-known/openid-configuration"
+	return func() ([]byte, error) {
+		data, err := fetch(client, url)
+		if err != nil {
+			return nil, err
+		}
+		doc := struct {
+			JWKSURI string `json:"jwks_uri"`
+		}{}
+		if err := json.Unmarshal(data, &doc); err != nil {
+			return nil, fmt.Errorf("invalid openid configuration of [%v], %v", issuer, err)
+		}
+		if doc.JWKSURI == "" {
+			return nil, fmt.Errorf("jwks_uri not found in the openid configuration of [%v]", issuer)
+		}
+		return fetch(client, doc.JWKSURI)
+	}
+}
@@ -0,0 +1,191 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package jwt
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func encodeInt(i *big.Int) string {
+	return base64.RawURLEncoding.EncodeToString(i.Bytes())
+}
+
+func rsaJWK(kid string, key *rsa.PublicKey) string {
+	return fmt.Sprintf(`{"kty":"RSA","kid":%q,"use":"sig","alg":"RS256","n":%q,"e":%q}`,
+		kid, encodeInt(key.N), encodeInt(big.NewInt(int64(key.E))))
+}
+
+func ecJWK(kid string, key *ecdsa.PublicKey) string {
+	return fmt.Sprintf(`{"kty":"EC","kid":%q,"crv":"P-256","x":%q,"y":%q}`,
+		kid, encodeInt(key.X), encodeInt(key.Y))
+}
+
+func TestParseKeySet(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	set := fmt.Sprintf(`{"keys":[%v,%v,{"kty":"oct","kid":"s1","k":"c2VjcmV0"},{"kty":"RSA","kid":"enc","use":"enc","n":"AQAB","e":"AQAB"},{"kty":"OKP","kid":"ed","crv":"Ed25519","x":"AA"}]}`,
+		rsaJWK("r1", &rsaKey.PublicKey), ecJWK("e1", &ecKey.PublicKey))
+	keys, err := parseKeySet([]byte(set))
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(keys))
+	assert.Equal(t, rsaKey.PublicKey.N, keys[0].key.(*rsa.PublicKey).N)
+	assert.True(t, ecKey.PublicKey.Equal(keys[1].key))
+	assert.Equal(t, []byte("secret"), keys[2].key)
+
+	assert.Equal(t, []verificationKey{keys[0]}, matchKeys(keys, "r1", "RS256"))
+	assert.Empty(t, matchKeys(keys, "r1", "RS512"), "the alg of the key")
+	assert.Empty(t, matchKeys(keys, "r1", "HS256"))
+	assert.Equal(t, []verificationKey{keys[1]}, matchKeys(keys, "", "ES256"))
+	assert.Empty(t, matchKeys(keys, "", "ES384"))
+	assert.Empty(t, matchKeys(keys, "", "none"))
+
+	keys, err = parseKeySet([]byte(ecJWK("e1", &ecKey.PublicKey)))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(keys))
+
+	_, err = parseKeySet([]byte(`{"foo":"bar"}`))
+	assert.Error(t, err)
+	keys, err = parseKeySet([]byte(`{"keys":[{"kty":"EC","crv":"P-256","x":"AQ","y":"AQ"}]}`))
+	assert.NoError(t, err)
+	assert.Empty(t, keys, "the point is not on the curve")
+}
+
+func TestKeyStore(t *testing.T) {
+	key1, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	key2, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	now := time.Unix(1700000000, 0)
+	loads := 0
+	set := fmt.Sprintf(`{"keys":[%v]}`, ecJWK("k1", &key1.PublicKey))
+	var failure error
+	store := &keyStore{
+		source: func() ([]byte, error) {
+			loads++
+			return []byte(set), failure
+		},
+		refreshInterval: time.Hour,
+		minInterval:     time.Minute,
+		now:             func() time.Time { return now },
+	}
+
+	assert.Equal(t, 1, len(store.lookup("k1", "ES256")))
+	assert.Equal(t, 1, loads)
+	assert.Equal(t, 1, len(store.lookup("k1", "ES256")))
+	assert.Equal(t, 1, loads)
+
+	//the keys are rotated, the unknown kid is reloaded after the min interval
+	set = fmt.Sprintf(`{"keys":[%v,%v]}`, ecJWK("k1", &key1.PublicKey), ecJWK("k2", &key2.PublicKey))
+	assert.Empty(t, store.lookup("k2", "ES256"))
+	assert.Equal(t, 1, loads)
+	now = now.Add(2 * time.Minute)
+	assert.Equal(t, 1, len(store.lookup("k2", "ES256")))
+	assert.Equal(t, 2, loads)
+	assert.Empty(t, store.lookup("k3", "ES256"))
+	assert.Equal(t, 2, loads)
+
+	//the stale keys are kept if the reload failed
+	now = now.Add(2 * time.Hour)
+	failure = errors.New("connection refused")
+	assert.Equal(t, 1, len(store.lookup("k1", "ES256")))
+	assert.Equal(t, 3, loads)
+}
+
+func TestKeyStoreSlowSource(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	keys, err := parseKeySet([]byte(ecJWK("k1", &key.PublicKey)))
+	assert.NoError(t, err)
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	store := &keyStore{
+		source: func() ([]byte, error) {
+			close(started)
+			<-release
+			return nil, errors.New("timeout")
+		},
+		refreshInterval: time.Hour,
+		now:             time.Now,
+		keys:            keys,
+		loaded:          time.Now(),
+	}
+
+	//the current keys are verified while the key set is being reloaded
+	done := make(chan error)
+	go func() {
+		done <- store.refresh(true)
+	}()
+	<-started
+	assert.Equal(t, 1, len(store.lookup("k1", "ES256")))
+	close(release)
+	assert.Error(t, <-done)
+	assert.Equal(t, 1, len(store.lookup("k1", "ES256")))
+}
+
+func TestDiscoverySource(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/realms/test/.well-known/openid-configuration":
+			fmt.Fprintf(w, `{"issuer":"%v/realms/test","jwks_uri":"%v/certs"}`, server.URL, server.URL)
+		case "/certs":
+			fmt.Fprintf(w, `{"keys":[%v]}`, ecJWK("k1", &key.PublicKey))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	data, err := discoverySource(server.Client(), server.URL+"/realms/test/")()
+	assert.NoError(t, err)
+	keys, err := parseKeySet(data)
+	assert.NoError(t, err)
+	assert.Equal(t, "k1", keys[0].id)
+
+	_, err = discoverySource(server.Client(), server.URL+"/realms/other")()
+	assert.Error(t, err)
+	_, err = urlSource(server.Client(), server.URL+"/missing")()
+	assert.Error(t, err)
+}
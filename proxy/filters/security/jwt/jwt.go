@@ -0,0 +1,262 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package jwt
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"infini.sh/framework/core/config"
+	"infini.sh/framework/core/global"
+	"infini.sh/framework/core/pipeline"
+	"infini.sh/framework/core/stats"
+	"infini.sh/framework/core/util"
+	"infini.sh/framework/lib/fasthttp"
+)
+
+type ClaimsConfig struct {
+	UserID   string            `config:"user_id"`   //claim of the user id, default sub
+	UserName string            `config:"user_name"` //claim of the user name, default preferred_username, or the user id if missing
+	Roles    string            `config:"roles"`     //claim of the roles, default roles
+	Context  map[string]string `config:"context"`   //context key to the claim
+}
+
+// JWTAuth authenticates the requests by the bearer tokens, the tokens are
+// verified by the secret or the keys of the json web key set
+type JWTAuth struct {
+	Header         string       `config:"header"`
+	Algorithms     []string     `config:"algorithms"`
+	Secret         string       `config:"secret"` //secret of the HS algorithms
+	JWKS           JWKSConfig   `config:"jwks"`
+	OIDCDiscovery  bool         `config:"oidc_discovery"` //load the jwks by the openid discovery of the issuer
+	Issuer         []string     `config:"issuer"`
+	Audience       []string     `config:"audience"`
+	RequiredClaims []string     `config:"required_claims"`
+	ClockSkew      string       `config:"clock_skew"`
+	Claims         ClaimsConfig `config:"claims"`
+	ForwardToken   bool         `config:"forward_token"` //keep the token header in the request to the upstream
+	Realm          string       `config:"realm"`
+
+	secrets   []verificationKey
+	keyStore  *keyStore
+	validator *claimsValidator
+}
+
+func init() {
+	pipeline.RegisterFilterPluginWithConfigMetadata("jwt_auth", NewJWTAuthFilter, &JWTAuth{})
+}
+
+func NewJWTAuthFilter(c *config.Config) (pipeline.Filter, error) {
+
+	runner := JWTAuth{
+		Header:         "Authorization",
+		RequiredClaims: []string{"exp"},
+		ClockSkew:      "60s",
+		Realm:          "Restricted",
+		Claims: ClaimsConfig{
+			UserID:   "sub",
+			UserName: "preferred_username",
+			Roles:    "roles",
+		},
+	}
+
+	if err := c.Unpack(&runner); err != nil {
+		return nil, fmt.Errorf("failed to unpack the filter configuration : %s", err)
+	}
+
+	if len(runner.Algorithms) == 0 {
+		runner.Algorithms = []string{"RS256", "RS384", "RS512", "ES256", "ES384", "ES512"}
+		if runner.Secret != "" {
+			runner.Algorithms = append(runner.Algorithms, "HS256", "HS384", "HS512")
+		}
+	}
+	for _, v := range runner.Algorithms {
+		if _, ok := algorithms[v]; !ok {
+			return nil, fmt.Errorf("unsupported algorithm [%v]", v)
+		}
+	}
+	if runner.Secret != "" {
+		runner.secrets = []verificationKey{{key: []byte(runner.Secret)}}
+	}
+
+	//the keys of the provider sign the tokens of all its clients
+	if len(runner.Audience) == 0 {
+		if runner.OIDCDiscovery {
+			return nil, errors.New("audience is required by the oidc discovery")
+		}
+		log.Warn("audience of jwt_auth is not configured, the tokens of any audience are accepted")
+	}
+
+	client := &http.Client{Timeout: util.GetDurationOrDefault(runner.JWKS.Timeout, 10*time.Second)}
+	var source func() ([]byte, error)
+	switch {
+	case runner.JWKS.File != "":
+		source = fileSource(runner.JWKS.File)
+	case runner.JWKS.URL != "":
+		source = urlSource(client, runner.JWKS.URL)
+	case runner.OIDCDiscovery:
+		if len(runner.Issuer) == 0 {
+			return nil, errors.New("issuer is required by the oidc discovery")
+		}
+		source = discoverySource(client, runner.Issuer[0])
+	}
+	if source == nil && runner.Secret == "" {
+		return nil, errors.New("either secret or jwks is required to verify the tokens")
+	}
+
+	if source != nil {
+		runner.keyStore = &keyStore{
+			source:          source,
+			refreshInterval: util.GetDurationOrDefault(runner.JWKS.RefreshInterval, time.Hour),
+			minInterval:     util.GetDurationOrDefault(runner.JWKS.MinRefreshInterval, time.Minute),
+			now:             time.Now,
+		}
+		if err := runner.keyStore.refresh(true); err != nil {
+			//the local key set should be valid, the remote key set is reloaded later
+			if runner.JWKS.File != "" {
+				return nil, err
+			}
+			log.Warn(err)
+		}
+	}
+
+	runner.validator = &claimsValidator{
+		issuers:   runner.Issuer,
+		audiences: runner.Audience,
+		required:  runner.RequiredClaims,
+		clockSkew: util.GetDurationOrDefault(runner.ClockSkew, 60*time.Second),
+		now:       time.Now,
+	}
+
+	return &runner, nil
+}
+
+func (filter *JWTAuth) Name() string {
+	return "jwt_auth"
+}
+
+// verify parses and verifies the token, returns the claims
+func (filter *JWTAuth) verify(raw string) (map[string]interface{}, error) {
+	t, err := parseToken(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	alg := t.alg()
+	allowed := false
+	for _, v := range filter.Algorithms {
+		if v == alg {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return nil, fmt.Errorf("algorithm [%v] is not allowed", alg)
+	}
+
+	keys := matchKeys(filter.secrets, "", alg)
+	if filter.keyStore != nil {
+		keys = append(keys, filter.keyStore.lookup(t.kid(), alg)...)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no key found for kid [%v] and algorithm [%v]", t.kid(), alg)
+	}
+
+	err = errors.New("invalid signature")
+	for _, k := range keys {
+		if err = verifySignature(alg, k.key, t.signed, t.signature); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := filter.validator.validate(t.claims); err != nil {
+		return nil, err
+	}
+	return t.claims, nil
+}
+
+func (filter *JWTAuth) Filter(ctx *fasthttp.RequestCtx) {
+
+	raw := bearerToken(string(ctx.Request.Header.Peek(filter.Header)))
+	if raw == "" {
+		stats.Increment("jwt_auth", "missing")
+		filter.unauthorized(ctx, "")
+		return
+	}
+
+	claims, err := filter.verify(raw)
+	if err != nil {
+		log.Debug("invalid token, ", err)
+		stats.Increment("jwt_auth", "invalid")
+		filter.unauthorized(ctx, err.Error())
+		return
+	}
+
+	id := ""
+	if v, ok := claimValue(claims, filter.Claims.UserID); ok {
+		id = fmt.Sprint(contextValue(v))
+	}
+	name := id
+	if v, ok := claimValue(claims, filter.Claims.UserName); ok {
+		name = fmt.Sprint(contextValue(v))
+	}
+	roles := []string{}
+	if v, ok := claimValue(claims, filter.Claims.Roles); ok {
+		roles = claimStrings(v)
+	}
+
+	if global.Env().IsDebug {
+		log.Debugf("user %s authenticated by token, roles: %v", name, roles)
+	}
+
+	ctx.Set("user_id", id)
+	ctx.Set("user_name", name)
+	ctx.Set("user_roles", roles)
+	for key, claim := range filter.Claims.Context {
+		if v, ok := claimValue(claims, claim); ok {
+			ctx.Set(key, contextValue(v))
+		}
+	}
+	if !filter.ForwardToken {
+		ctx.Request.Header.Del(filter.Header)
+	}
+	stats.Increment("jwt_auth", "authenticated")
+}
+
+// unauthorized requests the bearer token, with the error of the invalid token
+func (filter *JWTAuth) unauthorized(ctx *fasthttp.RequestCtx, reason string) {
+	challenge := fmt.Sprintf("Bearer realm=%q", filter.Realm)
+	if reason != "" {
+		challenge += fmt.Sprintf(", error=\"invalid_token\", error_description=%q", reason)
+	}
+	ctx.Error(fasthttp.StatusMessage(fasthttp.StatusUnauthorized), fasthttp.StatusUnauthorized)
+	ctx.Response.Header.Set("WWW-Authenticate", challenge)
+	ctx.Finished()
+}
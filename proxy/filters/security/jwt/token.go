@@ -0,0 +1,347 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package jwt
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// bearerToken returns the token of the header, the bearer scheme is optional
+// for the custom headers
+func bearerToken(value string) string {
+	value = strings.TrimSpace(value)
+	if len(value) > 7 && strings.EqualFold(value[:7], "bearer ") {
+		return strings.TrimSpace(value[7:])
+	}
+	if strings.Contains(value, " ") {
+		return ""
+	}
+	return value
+}
+
+// token is the parsed json web token in the compact serialization
+type token struct {
+	header    map[string]interface{}
+	claims    map[string]interface{}
+	signed    []byte //the header and the payload, signed by the signature
+	signature []byte
+}
+
+func (t *token) alg() string {
+	v, _ := t.header["alg"].(string)
+	return v
+}
+
+func (t *token) kid() string {
+	v, _ := t.header["kid"].(string)
+	return v
+}
+
+func decodeSegment(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+func decodeObject(data []byte) (map[string]interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	obj := map[string]interface{}{}
+	if err := decoder.Decode(&obj); err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
+
+// parseToken parses the token without verifying it
+func parseToken(raw string) (*token, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("token should have three parts")
+	}
+
+	data, err := decodeSegment(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid token header, %v", err)
+	}
+	header, err := decodeObject(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid token header, %v", err)
+	}
+
+	data, err = decodeSegment(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid token payload, %v", err)
+	}
+	claims, err := decodeObject(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid token payload, %v", err)
+	}
+
+	signature, err := decodeSegment(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid token signature, %v", err)
+	}
+
+	return &token{
+		header:    header,
+		claims:    claims,
+		signed:    []byte(parts[0] + "." + parts[1]),
+		signature: signature,
+	}, nil
+}
+
+// algorithm is the signing algorithm of the tokens
+type algorithm struct {
+	family string //HS, RS or ES
+	hash   crypto.Hash
+	curve  elliptic.Curve
+}
+
+var algorithms = map[string]algorithm{
+	"HS256": {family: "HS", hash: crypto.SHA256},
+	"HS384": {family: "HS", hash: crypto.SHA384},
+	"HS512": {family: "HS", hash: crypto.SHA512},
+	"RS256": {family: "RS", hash: crypto.SHA256},
+	"RS384": {family: "RS", hash: crypto.SHA384},
+	"RS512": {family: "RS", hash: crypto.SHA512},
+	"ES256": {family: "ES", hash: crypto.SHA256, curve: elliptic.P256()},
+	"ES384": {family: "ES", hash: crypto.SHA384, curve: elliptic.P384()},
+	"ES512": {family: "ES", hash: crypto.SHA512, curve: elliptic.P521()},
+}
+
+// accepts checks whether the key can verify the algorithm, the keys are never
+// shared across the families, such as using the RSA public key as the secret
+func (alg algorithm) accepts(key interface{}) bool {
+	switch k := key.(type) {
+	case []byte:
+		return alg.family == "HS"
+	case *rsa.PublicKey:
+		return alg.family == "RS"
+	case *ecdsa.PublicKey:
+		return alg.family == "ES" && k.Curve == alg.curve
+	}
+	return false
+}
+
+// verifySignature verifies the signature of the signed data with the key
+func verifySignature(name string, key interface{}, signed, signature []byte) error {
+	alg, ok := algorithms[name]
+	if !ok {
+		return fmt.Errorf("unsupported algorithm [%v]", name)
+	}
+	if !alg.accepts(key) {
+		return fmt.Errorf("key can't verify algorithm [%v]", name)
+	}
+
+	if alg.family == "HS" {
+		mac := hmac.New(alg.hash.New, key.([]byte))
+		mac.Write(signed)
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	}
+
+	h := alg.hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if err := rsa.VerifyPKCS1v15(k, alg.hash, digest, signature); err != nil {
+			return errors.New("invalid signature")
+		}
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return errors.New("invalid signature")
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(k, digest, r, s) {
+			return errors.New("invalid signature")
+		}
+	}
+	return nil
+}
+
+// claimsValidator validates the registered claims of the tokens
+type claimsValidator struct {
+	issuers   []string
+	audiences []string
+	required  []string
+	clockSkew time.Duration
+	now       func() time.Time
+}
+
+func numericDate(v interface{}) (time.Time, bool) {
+	var f float64
+	switch x := v.(type) {
+	case json.Number:
+		var err error
+		if f, err = x.Float64(); err != nil {
+			return time.Time{}, false
+		}
+	case float64:
+		f = x
+	default:
+		return time.Time{}, false
+	}
+	sec, frac := math.Modf(f)
+	return time.Unix(int64(sec), int64(frac*1e9)), true
+}
+
+func stringValues(v interface{}) []string {
+	switch x := v.(type) {
+	case string:
+		return []string{x}
+	case []string:
+		return x
+	case []interface{}:
+		values := make([]string, 0, len(x))
+		for _, item := range x {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+func containsAny(values []string, expected []string) bool {
+	for _, v := range values {
+		for _, e := range expected {
+			if v == e {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (v *claimsValidator) validate(claims map[string]interface{}) error {
+	for _, name := range v.required {
+		if _, ok := claims[name]; !ok {
+			return fmt.Errorf("claim [%v] is required", name)
+		}
+	}
+
+	now := v.now()
+	for _, name := range []string{"exp", "nbf", "iat"} {
+		value, ok := claims[name]
+		if !ok {
+			continue
+		}
+		t, ok := numericDate(value)
+		if !ok {
+			return fmt.Errorf("claim [%v] should be a numeric date", name)
+		}
+		switch name {
+		case "exp":
+			if !now.Before(t.Add(v.clockSkew)) {
+				return errors.New("token is expired")
+			}
+		case "nbf":
+			if now.Add(v.clockSkew).Before(t) {
+				return errors.New("token is not valid yet")
+			}
+		case "iat":
+			if now.Add(v.clockSkew).Before(t) {
+				return errors.New("token is issued in the future")
+			}
+		}
+	}
+
+	if len(v.issuers) > 0 {
+		iss, _ := claims["iss"].(string)
+		if !containsAny([]string{iss}, v.issuers) {
+			return fmt.Errorf("issuer [%v] is not allowed", iss)
+		}
+	}
+	if len(v.audiences) > 0 && !containsAny(stringValues(claims["aud"]), v.audiences) {
+		return fmt.Errorf("audience %v is not allowed", stringValues(claims["aud"]))
+	}
+	return nil
+}
+
+// claimValue returns the value of the claim, the name is looked up as is
+// first, as the names of the claims may contain dots, such as the namespaced
+// claims, and then as the path of the nested claims, eg: realm_access.roles
+func claimValue(claims map[string]interface{}, name string) (interface{}, bool) {
+	if v, ok := claims[name]; ok {
+		return v, true
+	}
+	var current interface{} = claims
+	for _, part := range strings.Split(name, ".") {
+		obj, ok := current.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if current, ok = obj[part]; !ok {
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+// contextValue converts the value of the claim to the value in the context,
+// the list of strings is converted to []string, as the roles
+func contextValue(v interface{}) interface{} {
+	switch x := v.(type) {
+	case json.Number:
+		return x.String()
+	case []interface{}:
+		values := stringValues(x)
+		if len(values) == len(x) {
+			return values
+		}
+	}
+	return v
+}
+
+// claimStrings returns the values of the claim, the string is split by the
+// commas or the spaces, such as the scope claim
+func claimStrings(v interface{}) []string {
+	if s, ok := v.(string); ok {
+		return strings.FieldsFunc(s, func(r rune) bool {
+			return r == ',' || r == ' '
+		})
+	}
+	return stringValues(v)
+}
@@ -0,0 +1,225 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package jwt
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func encodeSegment(t *testing.T, v interface{}) string {
+	data, err := json.Marshal(v)
+	assert.NoError(t, err)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// signToken signs the claims with the key, *rsa.PrivateKey,
+// *ecdsa.PrivateKey or the []byte secret
+func signToken(t *testing.T, alg, kid string, key interface{}, claims map[string]interface{}) string {
+	header := map[string]interface{}{"alg": alg, "typ": "JWT"}
+	if kid != "" {
+		header["kid"] = kid
+	}
+	signed := encodeSegment(t, header) + "." + encodeSegment(t, claims)
+
+	a := algorithms[alg]
+	var signature []byte
+	switch k := key.(type) {
+	case []byte:
+		mac := hmac.New(a.hash.New, k)
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	default:
+		h := a.hash.New()
+		h.Write([]byte(signed))
+		digest := h.Sum(nil)
+		switch k := key.(type) {
+		case *rsa.PrivateKey:
+			var err error
+			signature, err = rsa.SignPKCS1v15(rand.Reader, k, a.hash, digest)
+			assert.NoError(t, err)
+		case *ecdsa.PrivateKey:
+			r, s, err := ecdsa.Sign(rand.Reader, k, digest)
+			assert.NoError(t, err)
+			size := (k.Curve.Params().BitSize + 7) / 8
+			signature = make([]byte, 2*size)
+			r.FillBytes(signature[:size])
+			s.FillBytes(signature[size:])
+		}
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func verifyToken(raw string, key interface{}) error {
+	tok, err := parseToken(raw)
+	if err != nil {
+		return err
+	}
+	return verifySignature(tok.alg(), key, tok.signed, tok.signature)
+}
+
+func TestVerifySignature(t *testing.T) {
+	claims := map[string]interface{}{"sub": "bob"}
+
+	secret := []byte("secret")
+	assert.NoError(t, verifyToken(signToken(t, "HS256", "", secret, claims), secret))
+	assert.NoError(t, verifyToken(signToken(t, "HS512", "", secret, claims), secret))
+	assert.Error(t, verifyToken(signToken(t, "HS256", "", secret, claims), []byte("other")))
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	raw := signToken(t, "RS256", "k1", rsaKey, claims)
+	assert.NoError(t, verifyToken(raw, &rsaKey.PublicKey))
+	tok, err := parseToken(raw)
+	assert.NoError(t, err)
+	assert.Equal(t, "k1", tok.kid())
+	assert.Equal(t, "bob", tok.claims["sub"])
+
+	//tampered payload
+	tampered := signToken(t, "RS256", "k1", rsaKey, map[string]interface{}{"sub": "alice"})
+	tampered = tampered[:strings.LastIndex(tampered, ".")] + raw[strings.LastIndex(raw, "."):]
+	assert.Error(t, verifyToken(tampered, &rsaKey.PublicKey))
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	assert.NoError(t, verifyToken(signToken(t, "ES256", "", ecKey, claims), &ecKey.PublicKey))
+	ec384, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	assert.NoError(t, err)
+	assert.NoError(t, verifyToken(signToken(t, "ES384", "", ec384, claims), &ec384.PublicKey))
+	assert.Error(t, verifyToken(signToken(t, "ES256", "", ecKey, claims), &ec384.PublicKey))
+
+	//the public key can't be used as the secret of the HS algorithms
+	assert.Error(t, verifyToken(signToken(t, "HS256", "", []byte("public"), claims), &rsaKey.PublicKey))
+	assert.Error(t, verifySignature("none", secret, []byte("a.b"), nil))
+
+	_, err = parseToken("a.b")
+	assert.Error(t, err)
+	_, err = parseToken("e30.!!.e30")
+	assert.Error(t, err)
+}
+
+func TestClaimsValidator(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	v := &claimsValidator{
+		issuers:   []string{"https://sso.example.com"},
+		audiences: []string{"gateway"},
+		required:  []string{"exp"},
+		clockSkew: time.Minute,
+		now:       func() time.Time { return now },
+	}
+	valid := func() map[string]interface{} {
+		return map[string]interface{}{
+			"iss": "https://sso.example.com",
+			"aud": []interface{}{"other", "gateway"},
+			"exp": json.Number("1700000100"),
+			"nbf": json.Number("1700000000"),
+			"iat": 1699999990.5,
+		}
+	}
+	assert.NoError(t, v.validate(valid()))
+
+	claims := valid()
+	claims["exp"] = json.Number("1699999950")
+	assert.NoError(t, v.validate(claims), "within the clock skew")
+	claims["exp"] = json.Number("1699999900")
+	assert.EqualError(t, v.validate(claims), "token is expired")
+
+	claims = valid()
+	claims["nbf"] = json.Number("1700000100")
+	assert.EqualError(t, v.validate(claims), "token is not valid yet")
+
+	claims = valid()
+	claims["iat"] = json.Number("1700000100")
+	assert.Error(t, v.validate(claims))
+
+	claims = valid()
+	claims["iss"] = "https://evil.example.com"
+	assert.Error(t, v.validate(claims))
+
+	claims = valid()
+	claims["aud"] = "other"
+	assert.Error(t, v.validate(claims))
+
+	claims = valid()
+	delete(claims, "exp")
+	assert.EqualError(t, v.validate(claims), "claim [exp] is required")
+
+	claims = valid()
+	claims["exp"] = "tomorrow"
+	assert.Error(t, v.validate(claims))
+}
+
+func TestClaimValue(t *testing.T) {
+	tok, err := parseToken(encodeSegment(t, map[string]string{"alg": "HS256"}) + "." +
+		encodeSegment(t, map[string]interface{}{
+			"sub":                        "u1",
+			"https://example.com/tenant": "t1",
+			"realm_access":               map[string]interface{}{"roles": []string{"admin", "dev"}},
+			"scope":                      "read write",
+			"level":                      3,
+			"mixed":                      []interface{}{"a", 1},
+		}) + ".")
+	assert.NoError(t, err)
+
+	v, ok := claimValue(tok.claims, "https://example.com/tenant")
+	assert.True(t, ok)
+	assert.Equal(t, "t1", v)
+
+	v, ok = claimValue(tok.claims, "realm_access.roles")
+	assert.True(t, ok)
+	assert.Equal(t, []string{"admin", "dev"}, contextValue(v))
+	assert.Equal(t, []string{"admin", "dev"}, claimStrings(v))
+
+	v, _ = claimValue(tok.claims, "scope")
+	assert.Equal(t, []string{"read", "write"}, claimStrings(v))
+
+	v, _ = claimValue(tok.claims, "level")
+	assert.Equal(t, "3", contextValue(v))
+
+	v, _ = claimValue(tok.claims, "mixed")
+	assert.Equal(t, []interface{}{"a", json.Number("1")}, contextValue(v))
+
+	_, ok = claimValue(tok.claims, "realm_access.groups")
+	assert.False(t, ok)
+	_, ok = claimValue(tok.claims, "sub.name")
+	assert.False(t, ok)
+}
+
+func TestBearerToken(t *testing.T) {
+	assert.Equal(t, "abc", bearerToken("Bearer abc"))
+	assert.Equal(t, "abc", bearerToken("bearer  abc "))
+	assert.Equal(t, "abc", bearerToken("abc"))
+	assert.Equal(t, "", bearerToken("Basic YTpi"))
+	assert.Equal(t, "", bearerToken(""))
+}
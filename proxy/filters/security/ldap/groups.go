@@ -0,0 +1,250 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package ldap
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+	"sync"
+
+	goldap "github.com/go-ldap/ldap/v3"
+	"github.com/shaj13/libcache"
+	"infini.sh/framework/core/util"
+)
+
+// NestedGroupsConfig resolves the groups which the groups of the user are
+// members of, recursively up to the max depth
+type NestedGroupsConfig struct {
+	Enabled      bool   `config:"enabled"`
+	MaxDepth     int    `config:"max_depth"`
+	GroupFilter  string `config:"group_filter"`  //finds the dn of the group by its name
+	MemberFilter string `config:"member_filter"` //finds the parent groups by the dn of the group
+}
+
+// resolveNestedGroups returns the groups and their ancestors, the cycles are
+// visited once
+func resolveNestedGroups(groups []string, depth int, parents func(string) ([]string, error)) ([]string, error) {
+	seen := map[string]bool{}
+	result := []string{}
+	current := []string{}
+	for _, v := range groups {
+		if !seen[v] {
+			seen[v] = true
+			result = append(result, v)
+			current = append(current, v)
+		}
+	}
+
+	for level := 0; level < depth && len(current) > 0; level++ {
+		next := []string{}
+		for _, group := range current {
+			items, err := parents(group)
+			if err != nil {
+				return result, err
+			}
+			for _, v := range items {
+				if !seen[v] {
+					seen[v] = true
+					result = append(result, v)
+					next = append(next, v)
+				}
+			}
+		}
+		current = next
+	}
+	return result, nil
+}
+
+// directory searches the groups in ldap, the parents of the groups are cached
+type directory struct {
+	filter  *LDAPFilter
+	parents libcache.Cache
+}
+
+func (d *directory) dial() (*goldap.Conn, error) {
+	scheme := "ldap"
+	opts := []goldap.DialOpt{}
+	if d.filter.Tls {
+		scheme = "ldaps"
+		opts = append(opts, goldap.DialWithTLSConfig(&tls.Config{InsecureSkipVerify: true}))
+	}
+	conn, err := goldap.DialURL(fmt.Sprintf("%s://%s:%d", scheme, d.filter.Host, d.filter.Port), opts...)
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.Bind(d.filter.BindDn, d.filter.BindPassword); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (d *directory) search(conn *goldap.Conn, filter string, attributes []string) ([]*goldap.Entry, error) {
+	req := goldap.NewSearchRequest(d.filter.BaseDn, goldap.ScopeWholeSubtree, goldap.NeverDerefAliases,
+		0, 0, false, filter, attributes, nil)
+	res, err := conn.Search(req)
+	if err != nil {
+		return nil, err
+	}
+	return res.Entries, nil
+}
+
+// groupNames returns the group attribute of the entries, the dn is used if
+// the group attribute is dn
+func (d *directory) groupNames(entries []*goldap.Entry) []string {
+	names := []string{}
+	for _, e := range entries {
+		if strings.EqualFold(d.filter.GroupAttribute, "dn") {
+			names = append(names, e.DN)
+			continue
+		}
+		names = append(names, e.GetAttributeValues(d.filter.GroupAttribute)...)
+	}
+	return names
+}
+
+// userGroups returns the groups of the user by the group_filter, without
+// authenticating the user
+func (d *directory) userGroups(conn *goldap.Conn, user string) ([]string, error) {
+	entries, err := d.search(conn, fmt.Sprintf(d.filter.GroupFilter, goldap.EscapeFilter(user)), []string{d.filter.GroupAttribute})
+	if err != nil {
+		return nil, err
+	}
+	return d.groupNames(entries), nil
+}
+
+// parentGroups returns the groups which the group is a member of
+func (d *directory) parentGroups(conn *goldap.Conn, group string) ([]string, error) {
+	dns := []string{group}
+	if !strings.Contains(group, "=") {
+		entries, err := d.search(conn, fmt.Sprintf(d.filter.NestedGroups.GroupFilter, goldap.EscapeFilter(group)), []string{"dn"})
+		if err != nil {
+			return nil, err
+		}
+		dns = dns[:0]
+		for _, e := range entries {
+			dns = append(dns, e.DN)
+		}
+	}
+
+	parents := []string{}
+	for _, dn := range dns {
+		entries, err := d.search(conn, fmt.Sprintf(d.filter.NestedGroups.MemberFilter, goldap.EscapeFilter(dn)), []string{d.filter.GroupAttribute})
+		if err != nil {
+			return nil, err
+		}
+		parents = append(parents, d.groupNames(entries)...)
+	}
+	return parents, nil
+}
+
+// resolve returns the groups with the nested groups, ldap is only connected
+// if any group is not cached
+func (d *directory) resolve(conn *goldap.Conn, groups []string) ([]string, error) {
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+	if !d.filter.NestedGroups.Enabled {
+		return groups, nil
+	}
+	return resolveNestedGroups(groups, d.filter.NestedGroups.MaxDepth, func(group string) ([]string, error) {
+		if v, ok := d.parents.Load(group); ok {
+			return v.([]string), nil
+		}
+		if conn == nil {
+			c, err := d.dial()
+			if err != nil {
+				return nil, err
+			}
+			conn = c
+		}
+		parents, err := d.parentGroups(conn, group)
+		if err != nil {
+			return nil, err
+		}
+		d.parents.Store(group, parents)
+		return parents, nil
+	})
+}
+
+// mapRoles returns the groups with the nested groups and their roles, and
+// false if the user is denied, the connection is closed if any
+func (filter *LDAPFilter) mapRoles(conn *goldap.Conn, groups []string) ([]string, []string, bool, error) {
+	all, err := filter.directory.resolve(conn, groups)
+	if err != nil {
+		return all, nil, false, err
+	}
+	roles, ok := filter.roleMapping.Map(all)
+	return all, roles, ok, nil
+}
+
+var filters = sync.Map{}
+
+func registerFilter(filter *LDAPFilter) {
+	filters.Store(fmt.Sprintf("%v:%v/%v", filter.Host, filter.Port, filter.BaseDn), filter)
+}
+
+// TestRoleMapping returns the groups and the roles of the user by each of the
+// ldap_auth filters, the groups of the user are searched in ldap if no groups
+// provided
+func TestRoleMapping(user string, groups []string) []util.MapStr {
+	results := []util.MapStr{}
+	filters.Range(func(key, value interface{}) bool {
+		filter := value.(*LDAPFilter)
+		result := util.MapStr{"ldap": key}
+		results = append(results, result)
+
+		var conn *goldap.Conn
+		direct := groups
+		if len(direct) == 0 {
+			var err error
+			conn, err = filter.directory.dial()
+			if err == nil {
+				direct, err = filter.directory.userGroups(conn, user)
+			}
+			if err != nil {
+				if conn != nil {
+					conn.Close()
+				}
+				result["error"] = err.Error()
+				return true
+			}
+		}
+
+		all, roles, allowed, err := filter.mapRoles(conn, direct)
+		if err != nil {
+			result["error"] = err.Error()
+			return true
+		}
+		result["groups"] = direct
+		result["nested_groups"] = all
+		result["roles"] = roles
+		result["denied"] = !allowed
+		return true
+	})
+	return results
+}
@@ -0,0 +1,64 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package ldap
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolveNestedGroups(t *testing.T) {
+	tree := map[string][]string{
+		"dev":       {"engineers"},
+		"ops":       {"engineers", "oncall"},
+		"engineers": {"staff"},
+		"staff":     {"everyone"},
+		"everyone":  {"staff"}, //cycle
+	}
+	calls := 0
+	parents := func(group string) ([]string, error) {
+		calls++
+		return tree[group], nil
+	}
+
+	groups, err := resolveNestedGroups([]string{"dev", "ops", "dev"}, 5, parents)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"dev", "ops", "engineers", "oncall", "staff", "everyone"}, groups)
+	assert.Equal(t, 6, calls)
+
+	groups, err = resolveNestedGroups([]string{"dev"}, 1, parents)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"dev", "engineers"}, groups)
+
+	groups, err = resolveNestedGroups([]string{"dev"}, 0, parents)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"dev"}, groups)
+
+	_, err = resolveNestedGroups([]string{"dev"}, 5, func(string) ([]string, error) {
+		return nil, errors.New("ldap is down")
+	})
+	assert.Error(t, err)
+}
@@ -61,7 +61,13 @@ type LDAPFilter struct {
 	CacheTTL       string   `config:"cache_ttl"`
 
 	BypassAPIKey bool `config:"bypass_api_key"`
-	ldapQuery    auth.Strategy
+
+	RoleMapping  common.RoleMappingConfig `config:"role_mapping"`
+	NestedGroups NestedGroupsConfig       `config:"nested_groups"`
+
+	ldapQuery   auth.Strategy
+	roleMapping *common.RoleMapping
+	directory   *directory
 }
 
 func (filter *LDAPFilter) Name() string {
@@ -106,9 +112,29 @@ func (filter *LDAPFilter) Filter(ctx *fasthttp.RequestCtx) {
 		}
 	}
 
+	groups, roles, allowed, err := filter.mapRoles(nil, user.GetGroups())
+	if err != nil {
+		log.Error("failed to resolve the nested groups, ", err)
+		ctx.Error(fasthttp.StatusMessage(fasthttp.StatusServiceUnavailable), fasthttp.StatusServiceUnavailable)
+		ctx.Finished()
+		return
+	}
+	if !allowed {
+		log.Debug(user.GetUserName(), " is denied by the role mapping")
+		ctx.SetStatusCode(http.StatusForbidden)
+		ctx.SetBody([]byte("user is denied by the role mapping"))
+		ctx.Finished()
+		return
+	}
+
+	if global.Env().IsDebug {
+		log.Debugf("user %s mapped to roles %v, groups: %v", user.GetUserName(), roles, groups)
+	}
+
 	ctx.Set("user_id", user.GetID())
 	ctx.Set("user_name", user.GetUserName())
-	ctx.Set("user_roles", common.GetLDAPGroupsMappingRoles(user.GetGroups()))
+	ctx.Set("user_groups", groups)
+	ctx.Set("user_roles", roles)
 
 }
 
@@ -127,6 +153,11 @@ func NewLDAPFilter(c *config.Config) (pipeline.Filter, error) {
 		GroupFilter:    "(memberUid=%s)",
 		UidAttribute:   "uid",
 		GroupAttribute: "cn",
+		NestedGroups: NestedGroupsConfig{
+			MaxDepth:     5,
+			GroupFilter:  "(cn=%s)",
+			MemberFilter: "(member=%s)",
+		},
 	}
 	if err := c.Unpack(&runner); err != nil {
 		return nil, fmt.Errorf("failed to unpack the filter configuration : %s", err)
@@ -162,5 +193,16 @@ func NewLDAPFilter(c *config.Config) (pipeline.Filter, error) {
 
 	runner.ldapQuery = ldap.NewCached(&cfg, cacheObj)
 
+	roleMapping, err := common.NewRoleMapping(runner.RoleMapping)
+	if err != nil {
+		return nil, err
+	}
+	runner.roleMapping = roleMapping
+
+	parents := libcache.LRU.New(runner.MaxCacheItems)
+	parents.SetTTL(util.GetDurationOrDefault(runner.CacheTTL, time.Minute*5))
+	runner.directory = &directory{filter: &runner, parents: parents}
+	registerFilter(&runner)
+
 	return &runner, nil
 }
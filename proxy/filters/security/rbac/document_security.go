@@ -0,0 +1,276 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package rbac
+
+import (
+	"errors"
+	"fmt"
+
+	log "github.com/cihub/seelog"
+	"infini.sh/framework/core/config"
+	"infini.sh/framework/core/elastic"
+	"infini.sh/framework/core/global"
+	"infini.sh/framework/core/pipeline"
+	"infini.sh/framework/core/stats"
+	"infini.sh/framework/core/util"
+	"infini.sh/framework/lib/fasthttp"
+)
+
+// DocumentSecurityRequest wraps the queries of the searches with the query of
+// the user roles, so only the documents matching the query are searched
+type DocumentSecurityRequest struct {
+	DefaultRoles      []string `config:"default_roles"`
+	RestrictedIndices []string `config:"restricted_indices"`
+
+	authorizer *authorizer
+}
+
+// DocumentSecurity verifies the documents in the responses of the get apis
+// against the query of the user roles, the documents not matching are
+// returned as not found
+type DocumentSecurity struct {
+	DefaultRoles      []string `config:"default_roles"`
+	RestrictedIndices []string `config:"restricted_indices"`
+	Elasticsearch     string   `config:"elasticsearch"` //the cluster to verify the documents
+
+	authorizer *authorizer
+}
+
+func init() {
+	pipeline.RegisterFilterPluginWithConfigMetadata("document_security", NewDocumentSecurity, &DocumentSecurity{})
+	pipeline.RegisterFilterPluginWithConfigMetadata("document_security_request", NewDocumentSecurityRequest, &DocumentSecurityRequest{})
+}
+
+func NewDocumentSecurity(c *config.Config) (pipeline.Filter, error) {
+
+	runner := DocumentSecurity{
+		RestrictedIndices: []string{".security*"},
+	}
+
+	if err := c.Unpack(&runner); err != nil {
+		return nil, fmt.Errorf("failed to unpack the filter configuration : %s", err)
+	}
+	if runner.Elasticsearch == "" {
+		return nil, errors.New("elasticsearch is required to verify the documents")
+	}
+	runner.authorizer = &authorizer{restrictedIndices: runner.RestrictedIndices}
+
+	return &runner, nil
+}
+
+func NewDocumentSecurityRequest(c *config.Config) (pipeline.Filter, error) {
+
+	runner := DocumentSecurityRequest{
+		RestrictedIndices: []string{".security*"},
+	}
+
+	if err := c.Unpack(&runner); err != nil {
+		return nil, fmt.Errorf("failed to unpack the filter configuration : %s", err)
+	}
+	runner.authorizer = &authorizer{restrictedIndices: runner.RestrictedIndices}
+
+	return &runner, nil
+}
+
+func (filter *DocumentSecurity) Name() string {
+	return "document_security"
+}
+
+func (filter *DocumentSecurityRequest) Name() string {
+	return "document_security_request"
+}
+
+// contextLookup returns the variables of the queries from the context, such
+// as user_name and the keys set by the auth filters
+func contextLookup(ctx *fasthttp.RequestCtx) func(string) (interface{}, bool) {
+	return func(key string) (interface{}, bool) {
+		if v := ctx.Get(key); v != nil {
+			return v, true
+		}
+		v, err := ctx.GetValue(key)
+		return v, err == nil && v != nil
+	}
+}
+
+func (filter *DocumentSecurityRequest) Filter(ctx *fasthttp.RequestCtx) {
+	method := string(ctx.Request.Header.Method())
+	path := string(ctx.Request.PhantomURI().Path())
+	kind, indices := queryAPI(method, path)
+	if kind == "" {
+		return
+	}
+
+	user, _, roles := getRoles(ctx, filter.DefaultRoles)
+	render := queryRenderer(contextLookup(ctx))
+	queryOf := func(indices []string) (interface{}, error) {
+		return filter.authorizer.scopedQuery(roles, indices, render)
+	}
+	body := ctx.Request.GetRawBody()
+
+	if kind == kindMSearch {
+		data, changed, err := filterMultiSearch(body, indices, queryOf)
+		if err != nil {
+			filter.deny(ctx, user, err)
+			return
+		}
+		if changed {
+			ctx.Request.SetRawBody(data)
+			stats.Increment("document_security", "filtered")
+		}
+		return
+	}
+
+	dls, err := queryOf(indices)
+	if err != nil {
+		filter.deny(ctx, user, err)
+		return
+	}
+	if dls == nil {
+		return
+	}
+	if kind == kindTemplate {
+		filter.deny(ctx, user, errors.New("the search templates are not allowed with the document level security"))
+		return
+	}
+	if kind == kindUnfiltered {
+		filter.deny(ctx, user, fmt.Errorf("the request [%v] is not allowed with the document level security", path))
+		return
+	}
+
+	uri := ctx.Request.CloneURI()
+	defer fasthttp.ReleaseURI(uri)
+	args := uri.QueryArgs()
+	override := uriQuery(args)
+	data, err := filterQuery(body, dls, override)
+	if _, ok := err.(unfilteredError); ok {
+		filter.deny(ctx, user, err)
+		return
+	}
+	if err != nil {
+		stats.Increment("document_security", "invalid")
+		writeError(ctx, fasthttp.StatusBadRequest, "parse_exception", fmt.Sprintf("failed to parse the request body, %v", err))
+		return
+	}
+	if override != nil {
+		uri.SetQueryString(args.String())
+		ctx.Request.SetURI(uri)
+	}
+	ctx.Request.SetRawBody(data)
+	ctx.Request.Header.SetContentType(util.ContentTypeJson)
+	stats.Increment("document_security", "filtered")
+}
+
+func (filter *DocumentSecurityRequest) deny(ctx *fasthttp.RequestCtx, user string, err error) {
+	reason := fmt.Sprintf("failed to apply the document level security of user [%v], %v", user, err)
+	if global.Env().IsDebug {
+		log.Debugf("request [%v] denied, %v", ctx.PhantomURI().String(), reason)
+	}
+	stats.Increment("document_security", "denied")
+	writeError(ctx, fasthttp.StatusForbidden, "security_exception", reason)
+}
+
+func (filter *DocumentSecurity) Filter(ctx *fasthttp.RequestCtx) {
+	if ctx.Response.StatusCode() != fasthttp.StatusOK {
+		return
+	}
+	path := string(ctx.Request.PhantomURI().Path())
+	kind, indices := documentAPI(string(ctx.Request.Header.Method()), path)
+	user, _, roles := getRoles(ctx, filter.DefaultRoles)
+
+	var resp interface{}
+	var docs []docRef
+	switch kind {
+	case kindSource:
+		docs = []docRef{{index: indices[0], id: documentID(path)}}
+	case kindDoc, kindMGet:
+		body := ctx.Response.GetRawBody()
+		if len(body) == 0 {
+			return
+		}
+		var err error
+		resp, err = decodeJSON(body)
+		if err != nil {
+			filter.fail(ctx, user, fmt.Errorf("failed to parse the response, %v", err))
+			return
+		}
+		docs = foundDocuments(kind, resp)
+	}
+	if len(docs) == 0 {
+		return
+	}
+
+	queryOf := queryResolver(filter.authorizer, roles, indices, queryRenderer(contextLookup(ctx)))
+	hidden, err := hiddenDocuments(docs, queryOf, filter.search)
+	if err != nil {
+		filter.fail(ctx, user, err)
+		return
+	}
+	if len(hidden) == 0 {
+		return
+	}
+	stats.Increment("document_security", "hidden")
+
+	switch kind {
+	case kindSource:
+		writeError(ctx, fasthttp.StatusNotFound, "resource_not_found_exception",
+			fmt.Sprintf("Document not found [%v]/[%v]", docs[0].index, docs[0].id))
+	case kindDoc:
+		ctx.Response.SetStatusCode(fasthttp.StatusNotFound)
+		ctx.Response.SetRawBody(util.MustToJSONBytes(util.MapStr{
+			"_index": docs[0].index,
+			"_id":    docs[0].id,
+			"found":  false,
+		}))
+	case kindMGet:
+		hideDocuments(resp, hidden)
+		data, err := encodeJSON(resp)
+		if err != nil {
+			filter.fail(ctx, user, fmt.Errorf("failed to encode the response, %v", err))
+			return
+		}
+		ctx.Response.SetRawBody(data)
+	}
+}
+
+// fail replaces the response which is failed to verify, so the documents are
+// never returned unverified
+func (filter *DocumentSecurity) fail(ctx *fasthttp.RequestCtx, user string, err error) {
+	log.Errorf("failed to verify the documents of [%v], %v", ctx.PhantomURI().String(), err)
+	stats.Increment("document_security", "error")
+	writeError(ctx, fasthttp.StatusInternalServerError, "security_exception",
+		fmt.Sprintf("failed to verify the document level security of user [%v], %v", user, err))
+}
+
+// search searches the documents with the client of the gateway, as the
+// documents should be verified regardless of the privileges of the user
+func (filter *DocumentSecurity) search(index string, dsl []byte) ([]byte, error) {
+	res, err := elastic.GetClient(filter.Elasticsearch).SearchWithRawQueryDSL(index, dsl)
+	if err != nil {
+		return nil, err
+	}
+	if res == nil || res.RawResult == nil {
+		return nil, errors.New("empty search response")
+	}
+	return res.RawResult.Body, nil
+}
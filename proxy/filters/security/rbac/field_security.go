@@ -0,0 +1,266 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package rbac
+
+import (
+	"bytes"
+	"fmt"
+
+	log "github.com/cihub/seelog"
+	"infini.sh/framework/core/config"
+	"infini.sh/framework/core/global"
+	"infini.sh/framework/core/pipeline"
+	"infini.sh/framework/core/stats"
+	"infini.sh/framework/core/util"
+	"infini.sh/framework/lib/fasthttp"
+	"infini.sh/gateway/common"
+)
+
+// FieldSecurity removes or masks the fields of the documents in the
+// responses, by the field_security of the user roles
+type FieldSecurity struct {
+	DefaultRoles      []string `config:"default_roles"`
+	RestrictedIndices []string `config:"restricted_indices"`
+	Redaction         string   `config:"redaction"` //value of the redacted fields
+	HashSalt          string   `config:"hash_salt"`
+
+	authorizer  *authorizer
+	fieldFilter *fieldFilter
+}
+
+// FieldSecurityRequest injects the _source filtering of the field_security
+// into the requests, so the denied fields are not fetched
+type FieldSecurityRequest struct {
+	DefaultRoles      []string `config:"default_roles"`
+	RestrictedIndices []string `config:"restricted_indices"`
+
+	authorizer *authorizer
+}
+
+func init() {
+	pipeline.RegisterFilterPluginWithConfigMetadata("field_security", NewFieldSecurity, &FieldSecurity{})
+	pipeline.RegisterFilterPluginWithConfigMetadata("field_security_request", NewFieldSecurityRequest, &FieldSecurityRequest{})
+}
+
+func NewFieldSecurity(c *config.Config) (pipeline.Filter, error) {
+
+	runner := FieldSecurity{
+		RestrictedIndices: []string{".security*"},
+		Redaction:         "****",
+	}
+
+	if err := c.Unpack(&runner); err != nil {
+		return nil, fmt.Errorf("failed to unpack the filter configuration : %s", err)
+	}
+	runner.authorizer = &authorizer{restrictedIndices: runner.RestrictedIndices}
+	runner.fieldFilter = &fieldFilter{masker: &masker{redaction: runner.Redaction, salt: []byte(runner.HashSalt)}}
+
+	return &runner, nil
+}
+
+func NewFieldSecurityRequest(c *config.Config) (pipeline.Filter, error) {
+
+	runner := FieldSecurityRequest{
+		RestrictedIndices: []string{".security*"},
+	}
+
+	if err := c.Unpack(&runner); err != nil {
+		return nil, fmt.Errorf("failed to unpack the filter configuration : %s", err)
+	}
+	runner.authorizer = &authorizer{restrictedIndices: runner.RestrictedIndices}
+
+	return &runner, nil
+}
+
+func (filter *FieldSecurity) Name() string {
+	return "field_security"
+}
+
+func (filter *FieldSecurityRequest) Name() string {
+	return "field_security_request"
+}
+
+func (filter *FieldSecurity) Filter(ctx *fasthttp.RequestCtx) {
+	if ctx.Response.StatusCode() != fasthttp.StatusOK {
+		return
+	}
+	kind, indices := documentAPI(string(ctx.Request.Header.Method()), string(ctx.Request.PhantomURI().Path()))
+	if kind == "" {
+		return
+	}
+
+	body := ctx.Response.GetRawBody()
+	if len(body) == 0 {
+		return
+	}
+	user, _, roles := getRoles(ctx, filter.DefaultRoles)
+	resp, err := decodeJSON(body)
+	if err != nil {
+		filter.fail(ctx, user, fmt.Errorf("failed to parse the response, %v", err))
+		return
+	}
+
+	filter.fieldFilter.filterResponse(kind, resp, policyResolver(filter.authorizer, roles, indices))
+
+	data, err := encodeJSON(resp)
+	if err != nil {
+		filter.fail(ctx, user, fmt.Errorf("failed to encode the response, %v", err))
+		return
+	}
+	ctx.Response.SetRawBody(data)
+	stats.Increment("field_security", "filtered")
+}
+
+// fail replaces the response which is failed to filter, so the fields are
+// never returned unfiltered
+func (filter *FieldSecurity) fail(ctx *fasthttp.RequestCtx, user string, err error) {
+	log.Errorf("failed to filter the response of [%v], %v", ctx.PhantomURI().String(), err)
+	stats.Increment("field_security", "error")
+	writeError(ctx, fasthttp.StatusInternalServerError, "security_exception",
+		fmt.Sprintf("failed to apply the field level security of user [%v], %v", user, err))
+}
+
+func (filter *FieldSecurityRequest) Filter(ctx *fasthttp.RequestCtx) {
+	method := string(ctx.Request.Header.Method())
+	path := string(ctx.Request.PhantomURI().Path())
+	kind, indices := documentAPI(method, path)
+	if kind == "" || bytes.Contains(ctx.Request.PhantomURI().Path(), []byte("/scroll")) {
+		return
+	}
+	//the results of the async searches are filtered in the responses
+	if kind == kindAsyncSearch {
+		if method != fasthttp.MethodPost {
+			return
+		}
+		kind = kindSearch
+	}
+
+	user, _, roles := getRoles(ctx, filter.DefaultRoles)
+	body := ctx.Request.GetRawBody()
+
+	switch kind {
+	case kindMSearch:
+		data, ok, err := filter.injectMultiSearch(body, indices, roles)
+		if err != nil {
+			filter.reject(ctx, user, err)
+			return
+		}
+		if ok {
+			ctx.Request.SetRawBody(data)
+			stats.Increment("field_security", "injected")
+		}
+		return
+	case kindSearch:
+		if err := filter.authorizer.checkSearch(roles, indices, body, ctx.Request.PhantomURI().QueryArgs()); err != nil {
+			filter.reject(ctx, user, err)
+			return
+		}
+	case kindMGet:
+		requests, err := parseMultiGet(body, indices, "indices:data/read/get")
+		if err != nil || len(requests) == 0 {
+			return
+		}
+		indices = requests[0].indices
+	}
+
+	p, ok := filter.authorizer.sharedFieldPolicy(roles, indices)
+	if !ok || p == nil {
+		return
+	}
+	includes, excludes := p.sourceFilter()
+
+	uri := ctx.Request.CloneURI()
+	defer fasthttp.ReleaseURI(uri)
+	args := uri.QueryArgs()
+	if kind != kindSearch || hasSourceArgs(args) {
+		if injectSourceArgs(args, includes, excludes) {
+			uri.SetQueryString(args.String())
+			ctx.Request.SetURI(uri)
+			stats.Increment("field_security", "injected")
+		}
+		return
+	}
+
+	data, changed, err := injectSource(body, includes, excludes)
+	if err != nil {
+		filter.reject(ctx, user, err)
+		return
+	}
+	if changed {
+		ctx.Request.SetRawBody(data)
+		ctx.Request.Header.SetContentType(util.ContentTypeJson)
+		stats.Increment("field_security", "injected")
+	}
+}
+
+// reject rejects the request which can't be filtered, forbidden if the
+// search refers to the fields not fully granted
+func (filter *FieldSecurityRequest) reject(ctx *fasthttp.RequestCtx, user string, err error) {
+	if global.Env().IsDebug {
+		log.Debugf("request [%v] rejected, %v", ctx.PhantomURI().String(), err)
+	}
+	if _, ok := err.(deniedFieldError); ok {
+		stats.Increment("field_security", "denied")
+		writeError(ctx, fasthttp.StatusForbidden, "security_exception",
+			fmt.Sprintf("failed to apply the field level security of user [%v], %v", user, err))
+		return
+	}
+	stats.Increment("field_security", "invalid")
+	writeError(ctx, fasthttp.StatusBadRequest, "parse_exception", fmt.Sprintf("failed to parse the request body, %v", err))
+}
+
+// injectMultiSearch injects the _source filtering into each of the searches
+func (filter *FieldSecurityRequest) injectMultiSearch(body []byte, indices []string, roles []common.RoleConfig) ([]byte, bool, error) {
+	lines, err := multiSearchLines(body)
+	if err != nil {
+		return nil, false, err
+	}
+	changed := false
+	for i := 0; i < len(lines); i += 2 {
+		searched, err := multiSearchIndices(lines[i], indices)
+		if err != nil {
+			return nil, false, fmt.Errorf("invalid msearch header at line [%v]", i+1)
+		}
+		if i+1 >= len(lines) {
+			break
+		}
+		if err := filter.authorizer.checkSearch(roles, searched, lines[i+1], nil); err != nil {
+			return nil, false, err
+		}
+		p, ok := filter.authorizer.sharedFieldPolicy(roles, searched)
+		if !ok || p == nil {
+			continue
+		}
+		includes, excludes := p.sourceFilter()
+		data, ok, err := injectSource(lines[i+1], includes, excludes)
+		if err != nil {
+			return nil, false, fmt.Errorf("invalid msearch body at line [%v], %v", i+2, err)
+		}
+		if ok {
+			lines[i+1] = data
+			changed = true
+		}
+	}
+	return joinMultiSearch(lines, body), changed, nil
+}
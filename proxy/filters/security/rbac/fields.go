@@ -0,0 +1,799 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package rbac
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"infini.sh/framework/lib/fasthttp"
+	"infini.sh/gateway/common"
+)
+
+const fieldTypeDeny = "deny"
+const fieldTypeMask = "mask"
+const maskHash = "hash"
+const maskRedact = "redact"
+
+type fieldMask struct {
+	patterns []string
+	method   string
+}
+
+// fieldPolicy is the field level security on an index, all the fields are
+// granted if there are no grant rules
+type fieldPolicy struct {
+	grants []string
+	denies []string
+	masks  []fieldMask
+}
+
+var denyAllFields = &fieldPolicy{denies: []string{"*"}}
+
+func canRead(perm *common.IndexPermission) bool {
+	return grants(indexPrivileges, perm.Privileges, "indices:data/read/search") ||
+		grants(indexPrivileges, perm.Privileges, "indices:data/read/get")
+}
+
+// fieldPolicy returns the merged field rules of the permissions granting the
+// reads on the index, nil if any of them has no field rules, and false if no
+// permission covers the index
+func (a *authorizer) fieldPolicy(roles []common.RoleConfig, index string) (*fieldPolicy, bool) {
+	policy := &fieldPolicy{}
+	matched := false
+	for i := range roles {
+		for j := range roles[i].Indices {
+			perm := &roles[i].Indices[j]
+			if !a.permits(perm, normalizeIndex(index)) || !canRead(perm) {
+				continue
+			}
+			matched = true
+			if len(perm.FieldSecurity) == 0 {
+				return nil, true
+			}
+			for _, v := range perm.FieldSecurity {
+				switch v.Type {
+				case fieldTypeDeny:
+					policy.denies = append(policy.denies, v.Name...)
+				case fieldTypeMask:
+					method := v.Method
+					if method != maskRedact {
+						method = maskHash
+					}
+					policy.masks = append(policy.masks, fieldMask{patterns: v.Name, method: method})
+				default:
+					policy.grants = append(policy.grants, v.Name...)
+				}
+			}
+		}
+	}
+	return policy, matched
+}
+
+// sharedFieldPolicy returns the policy of the indices, false if the indices
+// have different policies, the indices not covered deny all the fields
+func (a *authorizer) sharedFieldPolicy(roles []common.RoleConfig, indices []string) (*fieldPolicy, bool) {
+	var result *fieldPolicy
+	for i, index := range indices {
+		p, ok := a.fieldPolicy(roles, index)
+		if !ok {
+			p = denyAllFields
+		}
+		if i == 0 {
+			result = p
+			continue
+		}
+		if !reflect.DeepEqual(result, p) {
+			return nil, false
+		}
+	}
+	return result, true
+}
+
+// policyResolver returns the policy of the index, cached per request, the
+// policy of the requested indices is used for the unknown indices, such as
+// the indices behind the aliases
+func policyResolver(a *authorizer, roles []common.RoleConfig, indices []string) func(string) *fieldPolicy {
+	fallback, ok := a.sharedFieldPolicy(roles, indices)
+	if !ok {
+		fallback = denyAllFields
+	}
+	policies := map[string]*fieldPolicy{}
+	return func(index string) *fieldPolicy {
+		if p, ok := policies[index]; ok {
+			return p
+		}
+		p := fallback
+		if index != "" {
+			if v, ok := a.fieldPolicy(roles, index); ok {
+				p = v
+			}
+		}
+		policies[index] = p
+		return p
+	}
+}
+
+// decide returns whether the field is removed, the mask method if the field
+// is masked, and whether the field is granted, the objects not granted are
+// kept only for their granted fields
+func (p *fieldPolicy) decide(path string, granted bool) (bool, string, bool) {
+	if matchAny(p.denies, path) {
+		return true, "", false
+	}
+	for _, m := range p.masks {
+		if matchAny(m.patterns, path) {
+			return false, m.method, true
+		}
+	}
+	if granted || len(p.grants) == 0 || matchAny(p.grants, path) {
+		return false, "", true
+	}
+	return !p.grantsBelow(path), "", false
+}
+
+// decidePath decides the path from its top level field, as the ancestors
+// granted grant the path too
+func (p *fieldPolicy) decidePath(path string) (bool, string, bool) {
+	if path == "" {
+		return false, "", false
+	}
+	granted := false
+	current := ""
+	for _, v := range strings.Split(path, ".") {
+		current = joinPath(current, v)
+		removed, method, g := p.decide(current, granted)
+		if removed || method != "" {
+			return removed, method, g
+		}
+		granted = g
+	}
+	return false, "", granted
+}
+
+// grantsBelow checks whether any field under the path may be granted
+func (p *fieldPolicy) grantsBelow(path string) bool {
+	for _, v := range p.grants {
+		i := strings.IndexAny(v, "*?")
+		prefix := v
+		if i >= 0 {
+			prefix = v[:i]
+		}
+		if strings.HasPrefix(prefix, path+".") || (i >= 0 && strings.HasPrefix(path+".", prefix)) {
+			return true
+		}
+	}
+	return false
+}
+
+// sourceFilter returns the _source includes and excludes of the policy, the
+// masked fields are included as their values are required to mask them
+func (p *fieldPolicy) sourceFilter() ([]string, []string) {
+	var includes []string
+	if len(p.grants) > 0 {
+		includes = append(includes, p.grants...)
+		for _, m := range p.masks {
+			includes = append(includes, m.patterns...)
+		}
+	}
+	return includes, p.denies
+}
+
+// deniedFieldError is the field of the search denied by the policies, empty
+// for the scripts and the query strings which may read any of the fields
+type deniedFieldError string
+
+func (e deniedFieldError) Error() string {
+	if e == "" {
+		return "the scripts, the runtime fields and the query strings without the fields are not allowed with the field level security"
+	}
+	return fmt.Sprintf("the search on the field [%v] is not allowed by the field level security", string(e))
+}
+
+// fieldQueries are the queries keyed by the fields, eg: {"term":{"ssn":"1"}}
+var fieldQueries = map[string]bool{
+	"term": true, "terms": true, "terms_set": true, "match": true, "match_phrase": true,
+	"match_phrase_prefix": true, "match_bool_prefix": true, "prefix": true, "wildcard": true,
+	"regexp": true, "fuzzy": true, "range": true, "intervals": true, "span_term": true,
+	"geo_distance": true, "geo_bounding_box": true, "geo_polygon": true, "geo_shape": true,
+	"shape": true, "distance_feature": true,
+}
+
+// fieldQueryParams are the parameters of the queries keyed by the fields,
+// and of the _geo_distance sort
+var fieldQueryParams = map[string]bool{
+	"boost": true, "_name": true, "distance": true, "distance_type": true,
+	"validation_method": true, "ignore_unmapped": true, "type": true,
+	"order": true, "unit": true, "mode": true, "nested": true,
+}
+
+// fieldsQueries are the queries on the list of the fields, all the fields
+// are queried if the fields are missing
+var fieldsQueries = map[string]bool{
+	"multi_match": true, "combined_fields": true, "query_string": true,
+	"simple_query_string": true, "more_like_this": true,
+}
+
+// skippedSearchKeys fetch the fields, which are filtered in the responses
+var skippedSearchKeys = map[string]bool{
+	"_source": true, "fields": true, "docvalue_fields": true, "stored_fields": true, "highlight": true,
+}
+
+// searchFields returns the fields which the search body sorts, collapses,
+// queries and aggregates on, as their values leak by the sort values, the
+// buckets or the matched documents, an empty field for each script, runtime
+// field and query on all the fields
+func searchFields(body []byte) ([]string, error) {
+	if len(bytes.TrimSpace(body)) == 0 {
+		return nil, nil
+	}
+	v, err := decodeJSON(body)
+	if err != nil {
+		return nil, err
+	}
+	fields := []string{}
+	var walk, walkNamed, walkSort func(v interface{})
+	walk = func(v interface{}) {
+		switch x := v.(type) {
+		case map[string]interface{}:
+			for k, item := range x {
+				switch {
+				case skippedSearchKeys[k]:
+				case k == "script" || k == "script_fields" || k == "runtime_mappings" || k == "wrapper":
+					fields = append(fields, "")
+				case k == "field":
+					if s, ok := item.(string); ok {
+						fields = append(fields, s)
+					} else {
+						walk(item)
+					}
+				case k == "sort":
+					walkSort(item)
+				case k == "aggs" || k == "aggregations" || k == "suggest":
+					walkNamed(item)
+				case fieldsQueries[k]:
+					q, _ := item.(map[string]interface{})
+					list := toList(q["fields"])
+					if f, ok := q["default_field"].(string); ok {
+						list = append(list, f)
+					}
+					text, _ := q["query"].(string)
+					if len(list) == 0 || (k == "query_string" && strings.Contains(text, ":")) {
+						fields = append(fields, "")
+					}
+					for _, f := range list {
+						if s, ok := f.(string); ok {
+							fields = append(fields, strings.Split(s, "^")[0])
+						}
+					}
+					walk(item)
+				case k == "sources":
+					//the sources of the composite aggregations
+					for _, source := range toList(item) {
+						walkNamed(source)
+					}
+				case fieldQueries[k]:
+					q, ok := item.(map[string]interface{})
+					if !ok {
+						//the terms of the multi_terms aggregations
+						walk(item)
+						continue
+					}
+					for f := range q {
+						if !fieldQueryParams[f] {
+							fields = append(fields, f)
+						}
+					}
+				default:
+					walk(item)
+				}
+			}
+		case []interface{}:
+			for _, item := range x {
+				walk(item)
+			}
+		}
+	}
+	//the aggregations and the suggesters are keyed by their names and types,
+	//the types such as terms and range are not the queries
+	walkNamed = func(v interface{}) {
+		named, _ := v.(map[string]interface{})
+		for _, item := range named {
+			def, _ := item.(map[string]interface{})
+			for k, body := range def {
+				switch k {
+				case "aggs", "aggregations":
+					walkNamed(body)
+				case "meta", "text", "prefix", "regex":
+				default:
+					walk(body)
+				}
+			}
+		}
+	}
+	walkSort = func(v interface{}) {
+		switch x := v.(type) {
+		case string:
+			if x != "_score" && x != "_doc" && x != "_shard_doc" {
+				fields = append(fields, x)
+			}
+		case []interface{}:
+			for _, item := range x {
+				walkSort(item)
+			}
+		case map[string]interface{}:
+			for k, item := range x {
+				switch k {
+				case "_script":
+					fields = append(fields, "")
+				case "_geo_distance":
+					walk(map[string]interface{}{"geo_distance": item})
+				default:
+					walkSort(k)
+					walk(item)
+				}
+			}
+		}
+	}
+	walk(v)
+	return fields, nil
+}
+
+// uriFields returns the fields of the sort and the query string parameters
+func uriFields(args *fasthttp.Args) []string {
+	fields := []string{}
+	if args == nil {
+		return fields
+	}
+	if args.Has("q") {
+		fields = append(fields, "")
+	}
+	for _, v := range strings.Split(string(args.Peek("sort")), ",") {
+		if v = strings.TrimSpace(strings.Split(v, ":")[0]); v != "" {
+			fields = append(fields, v)
+		}
+	}
+	return fields
+}
+
+// checkSearch returns the error if any of the fields of the search is not
+// fully granted on any of the indices, the wildcard fields are only allowed
+// if the policy denies or masks nothing
+func (a *authorizer) checkSearch(roles []common.RoleConfig, indices []string, body []byte, args *fasthttp.Args) error {
+	fields, err := searchFields(body)
+	if err != nil {
+		return err
+	}
+	fields = append(fields, uriFields(args)...)
+	if len(fields) == 0 {
+		return nil
+	}
+	for _, index := range indices {
+		p, ok := a.fieldPolicy(roles, index)
+		if !ok {
+			p = denyAllFields
+		}
+		if p == nil {
+			continue
+		}
+		for _, v := range fields {
+			if v == "" {
+				return deniedFieldError(v)
+			}
+			if strings.ContainsAny(v, "*?") && (len(p.denies) > 0 || len(p.masks) > 0) {
+				return deniedFieldError(v)
+			}
+			removed, method, granted := p.decidePath(v)
+			if removed || method != "" || !granted {
+				return deniedFieldError(v)
+			}
+		}
+	}
+	return nil
+}
+
+type masker struct {
+	redaction string
+	salt      []byte
+}
+
+func (m *masker) mask(value interface{}, method string) interface{} {
+	if method == maskRedact {
+		return m.redaction
+	}
+	data, _ := json.Marshal(value)
+	h := sha256.New()
+	h.Write(m.salt)
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func joinPath(prefix, field string) string {
+	if prefix == "" {
+		return field
+	}
+	return prefix + "." + field
+}
+
+// fieldFilter rewrites the documents in the responses by the field policies
+type fieldFilter struct {
+	masker *masker
+}
+
+func (f *fieldFilter) filterObject(obj map[string]interface{}, p *fieldPolicy, prefix string, granted bool) {
+	for k, v := range obj {
+		path := joinPath(prefix, k)
+		removed, method, g := p.decide(path, granted)
+		if removed {
+			delete(obj, k)
+			continue
+		}
+		if method != "" {
+			obj[k] = f.masker.mask(v, method)
+			continue
+		}
+		value, ok := f.filterValue(v, p, path, g)
+		if !ok {
+			delete(obj, k)
+			continue
+		}
+		obj[k] = value
+	}
+}
+
+// filterValue returns the filtered value, and false if nothing is left
+func (f *fieldFilter) filterValue(v interface{}, p *fieldPolicy, path string, granted bool) (interface{}, bool) {
+	switch x := v.(type) {
+	case map[string]interface{}:
+		f.filterObject(x, p, path, granted)
+		return x, granted || len(x) > 0
+	case []interface{}:
+		items := x[:0]
+		for _, item := range x {
+			if value, ok := f.filterValue(item, p, path, granted); ok {
+				items = append(items, value)
+			}
+		}
+		return items, granted || len(items) > 0
+	default:
+		return v, granted
+	}
+}
+
+// filterFlat filters the fields keyed by the full path, such as the fields
+// and the highlight of the hits, the masked fields are removed if dropMasked
+func (f *fieldFilter) filterFlat(obj map[string]interface{}, p *fieldPolicy, dropMasked bool) {
+	for k, v := range obj {
+		removed, method, granted := p.decide(k, false)
+		switch {
+		case removed || (method != "" && dropMasked):
+			delete(obj, k)
+		case method != "":
+			if arr, ok := v.([]interface{}); ok {
+				for i := range arr {
+					arr[i] = f.masker.mask(arr[i], method)
+				}
+			} else {
+				obj[k] = f.masker.mask(v, method)
+			}
+		default:
+			value, ok := f.filterValue(v, p, k, granted)
+			if !ok {
+				delete(obj, k)
+				continue
+			}
+			obj[k] = value
+		}
+	}
+}
+
+// nestedPath returns the path of the nested inner hit
+func nestedPath(hit map[string]interface{}) string {
+	parts := []string{}
+	nested, _ := hit["_nested"].(map[string]interface{})
+	for nested != nil {
+		if field, ok := nested["field"].(string); ok {
+			parts = append(parts, field)
+		}
+		nested, _ = nested["_nested"].(map[string]interface{})
+	}
+	return strings.Join(parts, ".")
+}
+
+func (f *fieldFilter) filterHit(hit map[string]interface{}, p *fieldPolicy) {
+	if source, ok := hit["_source"].(map[string]interface{}); ok {
+		prefix := nestedPath(hit)
+		removed, method, granted := p.decidePath(prefix)
+		switch {
+		case removed:
+			delete(hit, "_source")
+		case method != "":
+			hit["_source"] = f.masker.mask(source, method)
+		default:
+			f.filterObject(source, p, prefix, granted)
+		}
+	}
+	if fields, ok := hit["fields"].(map[string]interface{}); ok {
+		f.filterFlat(fields, p, false)
+	}
+	if highlight, ok := hit["highlight"].(map[string]interface{}); ok {
+		f.filterFlat(highlight, p, true)
+	}
+	if inner, ok := hit["inner_hits"].(map[string]interface{}); ok {
+		for _, v := range inner {
+			if result, ok := v.(map[string]interface{}); ok {
+				f.filterSearch(result, func(string) *fieldPolicy { return p })
+			}
+		}
+	}
+}
+
+// filterSearch filters the hits of the search response, the policy of each
+// hit is decided by its index
+func (f *fieldFilter) filterSearch(resp map[string]interface{}, policyOf func(string) *fieldPolicy) {
+	hits, _ := resp["hits"].(map[string]interface{})
+	list, _ := hits["hits"].([]interface{})
+	for _, v := range list {
+		f.filterDoc(v, policyOf)
+	}
+	f.filterAggregations(resp["aggregations"], policyOf)
+}
+
+// filterAggregations filters the hits of the top_hits aggregations, which
+// may be nested in the buckets of any depth
+func (f *fieldFilter) filterAggregations(v interface{}, policyOf func(string) *fieldPolicy) {
+	switch x := v.(type) {
+	case map[string]interface{}:
+		if hits, ok := x["hits"].(map[string]interface{}); ok {
+			if _, ok := hits["hits"].([]interface{}); ok {
+				f.filterSearch(x, policyOf)
+				return
+			}
+		}
+		for _, item := range x {
+			f.filterAggregations(item, policyOf)
+		}
+	case []interface{}:
+		for _, item := range x {
+			f.filterAggregations(item, policyOf)
+		}
+	}
+}
+
+func (f *fieldFilter) filterDoc(v interface{}, policyOf func(string) *fieldPolicy) {
+	hit, ok := v.(map[string]interface{})
+	if !ok {
+		return
+	}
+	index, _ := hit["_index"].(string)
+	if p := policyOf(index); p != nil {
+		f.filterHit(hit, p)
+	}
+}
+
+const (
+	kindSearch      = "search"
+	kindAsyncSearch = "async_search"
+	kindMSearch     = "msearch"
+	kindDoc         = "doc"
+	kindSource      = "source"
+	kindMGet        = "mget"
+)
+
+// documentAPI returns the kind of the apis returning the documents, and the
+// indices in the path
+func documentAPI(method, path string) (string, []string) {
+	segments := []string{}
+	for _, v := range strings.Split(path, "/") {
+		if v != "" {
+			segments = append(segments, v)
+		}
+	}
+	if len(segments) == 0 {
+		return "", nil
+	}
+	indices := []string{allIndices}
+	if !strings.HasPrefix(segments[0], "_") {
+		indices = splitIndices(segments[0])
+	}
+
+	api := ""
+	for _, v := range segments {
+		if strings.HasPrefix(v, "_") {
+			api = v
+			break
+		}
+	}
+	switch api {
+	case "_search":
+		return kindSearch, indices
+	case "_async_search":
+		if method == fasthttp.MethodGet || method == fasthttp.MethodPost {
+			return kindAsyncSearch, indices
+		}
+	case "_msearch":
+		return kindMSearch, indices
+	case "_mget":
+		return kindMGet, indices
+	case "_doc":
+		if method == fasthttp.MethodGet {
+			return kindDoc, indices
+		}
+	case "_source":
+		if method == fasthttp.MethodGet {
+			return kindSource, indices
+		}
+	case "":
+		//the typed document, eg: /index/type/id
+		if method == fasthttp.MethodGet && len(segments) == 3 {
+			return kindDoc, indices
+		}
+	}
+	return "", nil
+}
+
+// filterResponse rewrites the documents of the response
+func (f *fieldFilter) filterResponse(kind string, resp interface{}, policyOf func(string) *fieldPolicy) {
+	obj, ok := resp.(map[string]interface{})
+	if !ok {
+		return
+	}
+	switch kind {
+	case kindSearch:
+		f.filterSearch(obj, policyOf)
+	case kindAsyncSearch:
+		if result, ok := obj["response"].(map[string]interface{}); ok {
+			f.filterSearch(result, policyOf)
+		}
+	case kindMSearch:
+		responses, _ := obj["responses"].([]interface{})
+		for _, v := range responses {
+			if result, ok := v.(map[string]interface{}); ok {
+				f.filterSearch(result, policyOf)
+			}
+		}
+	case kindDoc:
+		f.filterDoc(obj, policyOf)
+	case kindMGet:
+		docs, _ := obj["docs"].([]interface{})
+		for _, v := range docs {
+			f.filterDoc(v, policyOf)
+		}
+	case kindSource:
+		if p := policyOf(""); p != nil {
+			f.filterObject(obj, p, "", false)
+		}
+	}
+}
+
+func decodeJSON(data []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var obj interface{}
+	err := decoder.Decode(&obj)
+	return obj, err
+}
+
+// encodeJSON encodes the object without escaping the html characters, such
+// as the tags of the highlight
+func encodeJSON(v interface{}) ([]byte, error) {
+	buffer := bytes.Buffer{}
+	encoder := json.NewEncoder(&buffer)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimRight(buffer.Bytes(), "\n"), nil
+}
+
+func toList(v interface{}) []interface{} {
+	switch x := v.(type) {
+	case string:
+		return []interface{}{x}
+	case []interface{}:
+		return x
+	}
+	return nil
+}
+
+func stringList(items []string) []interface{} {
+	result := make([]interface{}, 0, len(items))
+	for _, v := range items {
+		result = append(result, v)
+	}
+	return result
+}
+
+// injectSource merges the source filtering into the search body, false if
+// the body is not changed, such as the _source is disabled
+func injectSource(body []byte, includes, excludes []string) ([]byte, bool, error) {
+	obj := map[string]interface{}{}
+	if len(bytes.TrimSpace(body)) > 0 {
+		v, err := decodeJSON(body)
+		if err != nil {
+			return body, false, err
+		}
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return body, false, nil
+		}
+		obj = m
+	}
+
+	source := map[string]interface{}{}
+	switch v := obj["_source"].(type) {
+	case bool:
+		if !v {
+			return body, false, nil
+		}
+	case string, []interface{}:
+		source["includes"] = toList(v)
+	case map[string]interface{}:
+		source = v
+	}
+
+	if len(excludes) > 0 {
+		merged := append(toList(source["excludes"]), toList(source["exclude"])...)
+		delete(source, "exclude")
+		source["excludes"] = append(merged, stringList(excludes)...)
+	}
+	if len(includes) > 0 && len(toList(source["includes"]))+len(toList(source["include"])) == 0 {
+		source["includes"] = stringList(includes)
+	}
+	obj["_source"] = source
+
+	data, err := encodeJSON(obj)
+	if err != nil {
+		return body, false, err
+	}
+	return data, true, nil
+}
+
+// injectSourceArgs merges the source filtering into the query args, false if
+// the _source is disabled
+func injectSourceArgs(args *fasthttp.Args, includes, excludes []string) bool {
+	if string(args.Peek("_source")) == "false" {
+		return false
+	}
+	if len(excludes) > 0 {
+		list := excludes
+		if existing := string(args.Peek("_source_excludes")); existing != "" {
+			list = append([]string{existing}, excludes...)
+		}
+		args.Set("_source_excludes", strings.Join(list, ","))
+	}
+	if len(includes) > 0 && len(args.Peek("_source_includes")) == 0 && len(args.Peek("_source")) == 0 {
+		args.Set("_source_includes", strings.Join(includes, ","))
+	}
+	return true
+}
+
+func hasSourceArgs(args *fasthttp.Args) bool {
+	return args.Has("_source") || args.Has("_source_includes") || args.Has("_source_excludes")
+}
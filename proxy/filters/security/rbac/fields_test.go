@@ -0,0 +1,267 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package rbac
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"infini.sh/framework/lib/fasthttp"
+	"infini.sh/gateway/common"
+)
+
+func fieldRoles() []common.RoleConfig {
+	return []common.RoleConfig{{
+		Name: "analyst",
+		Indices: []common.IndexPermission{
+			{
+				Name:       []string{"customers"},
+				Privileges: []string{"read"},
+				FieldSecurity: []common.FieldPermission{
+					{Name: []string{"name", "address.*", "orders", "email", "phone"}, Type: "grant"},
+					{Name: []string{"address.street"}, Type: "deny"},
+					{Name: []string{"email"}, Type: "mask", Method: "redact"},
+					{Name: []string{"phone"}, Type: "mask"},
+				},
+			},
+			{Name: []string{"logs-*"}, Privileges: []string{"read"}},
+		},
+	}}
+}
+
+func mustJSON(t *testing.T, v interface{}) string {
+	data, err := encodeJSON(v)
+	assert.NoError(t, err)
+	return string(data)
+}
+
+func TestFieldPolicy(t *testing.T) {
+	a := &authorizer{}
+	p, ok := a.fieldPolicy(fieldRoles(), "customers")
+	assert.True(t, ok)
+	assert.NotNil(t, p)
+
+	removed, method, granted := p.decide("name", false)
+	assert.Equal(t, []interface{}{false, "", true}, []interface{}{removed, method, granted})
+	removed, _, granted = p.decide("address", false)
+	assert.False(t, removed)
+	assert.False(t, granted)
+	removed, _, _ = p.decide("address.street", false)
+	assert.True(t, removed)
+	_, method, _ = p.decide("email", false)
+	assert.Equal(t, maskRedact, method)
+	_, method, _ = p.decide("phone", false)
+	assert.Equal(t, maskHash, method)
+	removed, _, _ = p.decide("ssn", false)
+	assert.True(t, removed)
+
+	p, ok = a.fieldPolicy(fieldRoles(), "logs-1")
+	assert.True(t, ok)
+	assert.Nil(t, p)
+	_, ok = a.fieldPolicy(fieldRoles(), "metrics")
+	assert.False(t, ok)
+
+	_, ok = a.sharedFieldPolicy(fieldRoles(), []string{"customers", "logs-1"})
+	assert.False(t, ok)
+	p, ok = a.sharedFieldPolicy(fieldRoles(), []string{"logs-1", "logs-2"})
+	assert.True(t, ok)
+	assert.Nil(t, p)
+	p, ok = a.sharedFieldPolicy(fieldRoles(), []string{"metrics"})
+	assert.True(t, ok)
+	assert.Equal(t, denyAllFields, p)
+
+	p, _ = a.fieldPolicy(fieldRoles(), "customers")
+	includes, excludes := p.sourceFilter()
+	assert.Equal(t, []string{"name", "address.*", "orders", "email", "phone", "email", "phone"}, includes)
+	assert.Equal(t, []string{"address.street"}, excludes)
+}
+
+func TestFilterSearchResponse(t *testing.T) {
+	a := &authorizer{}
+	f := &fieldFilter{masker: &masker{redaction: "****"}}
+	body := `{"took":1,"hits":{"total":{"value":3},"hits":[
+{"_index":"customers","_id":"1","_source":{"name":"alice","ssn":"123","email":"a@x.com","phone":"555",
+ "address":{"street":"main","city":"paris"},"orders":[{"id":1,"total":10}],"notes":{"text":"vip"}},
+ "fields":{"name":["alice"],"ssn":["123"],"phone":["555"]},
+ "highlight":{"name":["<em>alice</em>"],"email":["<em>a@x.com</em>"],"ssn":["<em>123</em>"]},
+ "inner_hits":{"orders":{"hits":{"hits":[{"_index":"customers","_nested":{"field":"orders","offset":0},"_source":{"id":1,"total":10}}]}}}},
+{"_index":"logs-1","_id":"2","_source":{"message":"hello","ssn":"456"}},
+{"_index":"metrics","_id":"3","_source":{"value":1}}
+]}}`
+	resp, err := decodeJSON([]byte(body))
+	assert.NoError(t, err)
+	f.filterResponse(kindSearch, resp, policyResolver(a, fieldRoles(), []string{"customers", "logs-1", "metrics"}))
+
+	hits := resp.(map[string]interface{})["hits"].(map[string]interface{})["hits"].([]interface{})
+	first := hits[0].(map[string]interface{})
+	assert.Equal(t, `{"address":{"city":"paris"},"email":"****","name":"alice","orders":[{"id":1,"total":10}],"phone":"`+f.masker.mask("555", maskHash).(string)+`"}`, mustJSON(t, first["_source"]))
+	assert.Equal(t, `{"name":["alice"],"phone":["`+f.masker.mask("555", maskHash).(string)+`"]}`, mustJSON(t, first["fields"]))
+	assert.Equal(t, `{"name":["<em>alice</em>"]}`, mustJSON(t, first["highlight"]))
+	inner := first["inner_hits"].(map[string]interface{})["orders"].(map[string]interface{})["hits"].(map[string]interface{})["hits"].([]interface{})
+	assert.Equal(t, `{"id":1,"total":10}`, mustJSON(t, inner[0].(map[string]interface{})["_source"]))
+
+	assert.Equal(t, `{"message":"hello","ssn":"456"}`, mustJSON(t, hits[1].(map[string]interface{})["_source"]))
+	assert.Equal(t, `{}`, mustJSON(t, hits[2].(map[string]interface{})["_source"]))
+}
+
+func TestFilterAggregationHits(t *testing.T) {
+	a := &authorizer{}
+	f := &fieldFilter{masker: &masker{redaction: "****"}}
+	body := `{"is_running":false,"response":{"hits":{"hits":[]},"aggregations":{"by_city":{"buckets":[
+{"key":"paris","doc_count":1,"latest":{"hits":{"total":{"value":1},"hits":[{"_index":"customers","_id":"1","_source":{"name":"alice","ssn":"123"}}]}}}
+]}}}}`
+	resp, err := decodeJSON([]byte(body))
+	assert.NoError(t, err)
+	f.filterResponse(kindAsyncSearch, resp, policyResolver(a, fieldRoles(), []string{"customers"}))
+	assert.Equal(t, `{"is_running":false,"response":{"aggregations":{"by_city":{"buckets":[{"doc_count":1,"key":"paris","latest":{"hits":{"hits":[{"_id":"1","_index":"customers","_source":{"name":"alice"}}],"total":{"value":1}}}}]}},"hits":{"hits":[]}}}`, mustJSON(t, resp))
+}
+
+func TestCheckSearch(t *testing.T) {
+	a := &authorizer{}
+	check := func(indices []string, body string) error {
+		return a.checkSearch(fieldRoles(), indices, []byte(body), nil)
+	}
+	assert.NoError(t, a.checkSearch(fieldRoles(), []string{"customers"}, nil, nil))
+	assert.NoError(t, check([]string{"customers"}, `{"aggs":{"cities":{"terms":{"field":"address.city"}}}}`))
+	assert.NoError(t, check([]string{"logs-1"}, `{"aggs":{"ssn":{"terms":{"field":"ssn"}}},"sort":["ssn"]}`))
+	assert.NoError(t, check([]string{"customers"}, `{"query":{"bool":{"must":[{"match":{"name":"alice"}}],"filter":[{"range":{"address.city":{"gte":"a"}}}]}},
+		"sort":[{"name":{"order":"asc"}},"_score"],"collapse":{"field":"name"},"fields":["*"],"_source":["ssn"],"highlight":{"fields":{"ssn":{}}},
+		"aggs":{"range":{"range":{"field":"orders.total","ranges":[{"to":10}]}},"c":{"composite":{"sources":[{"n":{"terms":{"field":"name"}}}]}}}}`))
+
+	denied := []struct {
+		field, body string
+	}{
+		{"ssn", `{"aggs":{"by_city":{"terms":{"field":"address.city"},"aggs":{"ssn":{"terms":{"field":"ssn"}}}}}}`},
+		{"email", `{"aggregations":{"emails":{"cardinality":{"field":"email"}}}}`},
+		{"ssn", `{"aggs":{"m":{"multi_terms":{"terms":[{"field":"name"},{"field":"ssn"}]}}}}`},
+		{"ssn", `{"aggs":{"c":{"composite":{"sources":[{"s":{"terms":{"field":"ssn"}}}]}}}}`},
+		{"ssn", `{"aggs":{"top":{"top_hits":{"sort":[{"ssn":"asc"}]}}}}`},
+		{"ssn", `{"sort":[{"ssn":"asc"}]}`},
+		{"phone", `{"sort":"phone"}`},
+		{"ssn", `{"collapse":{"field":"ssn"}}`},
+		{"ssn", `{"query":{"bool":{"filter":[{"term":{"ssn":"123"}}]}}}`},
+		{"address.street", `{"query":{"exists":{"field":"address.street"}}}`},
+		{"ssn", `{"query":{"multi_match":{"query":"123","fields":["name","ssn^2"]}}}`},
+		{"n*", `{"query":{"multi_match":{"query":"123","fields":["n*"]}}}`},
+		{"", `{"query":{"multi_match":{"query":"123"}}}`},
+		{"", `{"query":{"query_string":{"query":"ssn:123","fields":["name"]}}}`},
+		{"", `{"script_fields":{"s":{"script":"doc['ssn'].value"}}}`},
+		{"", `{"runtime_mappings":{"s":{"type":"keyword"}}}`},
+		{"", `{"aggs":{"s":{"sum":{"script":"doc['ssn'].value"}}}}`},
+	}
+	for _, c := range denied {
+		assert.Equal(t, deniedFieldError(c.field), check([]string{"logs-1", "customers"}, c.body), c.body)
+	}
+
+	args := &fasthttp.Args{}
+	args.Set("sort", "name:asc,ssn:desc")
+	assert.Equal(t, deniedFieldError("ssn"), a.checkSearch(fieldRoles(), []string{"customers"}, nil, args))
+	args = &fasthttp.Args{}
+	args.Set("q", "ssn:123")
+	assert.Equal(t, deniedFieldError(""), a.checkSearch(fieldRoles(), []string{"customers"}, nil, args))
+
+	err := check([]string{"customers"}, `{`)
+	assert.Error(t, err)
+	_, ok := err.(deniedFieldError)
+	assert.False(t, ok)
+}
+
+func TestInjectMultiSearch(t *testing.T) {
+	filter := &FieldSecurityRequest{authorizer: &authorizer{}}
+	body := "{\"index\":\"logs-1\"}\n{}\n\n{\"query\":{\"match_all\":{}}}\n"
+	data, changed, err := filter.injectMultiSearch([]byte(body), []string{"customers"}, fieldRoles())
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, "{\"index\":\"logs-1\"}\n{}\n\n{\"_source\":{\"excludes\":[\"address.street\"],\"includes\":[\"name\",\"address.*\",\"orders\",\"email\",\"phone\",\"email\",\"phone\"]},\"query\":{\"match_all\":{}}}\n", string(data))
+
+	_, _, err = filter.injectMultiSearch([]byte("{}\n{\"aggs\":{\"ssn\":{\"terms\":{\"field\":\"ssn\"}}}}\n"), []string{"customers"}, fieldRoles())
+	assert.Equal(t, deniedFieldError("ssn"), err)
+	_, _, err = filter.injectMultiSearch([]byte("\n{}\n"), []string{"customers"}, fieldRoles())
+	assert.Error(t, err)
+}
+
+func TestFilterDocumentResponses(t *testing.T) {
+	a := &authorizer{}
+	f := &fieldFilter{masker: &masker{redaction: "****"}}
+
+	resp, _ := decodeJSON([]byte(`{"docs":[{"_index":"customers","_id":"1","found":true,"_source":{"name":"alice","ssn":"1"}},{"_index":"logs-1","_id":"2","found":true,"_source":{"ssn":"2"}}]}`))
+	f.filterResponse(kindMGet, resp, policyResolver(a, fieldRoles(), []string{"_all"}))
+	assert.Equal(t, `{"docs":[{"_id":"1","_index":"customers","_source":{"name":"alice"},"found":true},{"_id":"2","_index":"logs-1","_source":{"ssn":"2"},"found":true}]}`, mustJSON(t, resp))
+
+	resp, _ = decodeJSON([]byte(`{"name":"alice","ssn":"1","email":"a@x.com"}`))
+	f.filterResponse(kindSource, resp, policyResolver(a, fieldRoles(), []string{"customers"}))
+	assert.Equal(t, `{"email":"****","name":"alice"}`, mustJSON(t, resp))
+}
+
+func TestDocumentAPI(t *testing.T) {
+	cases := []struct {
+		method, path, kind string
+		indices            []string
+	}{
+		{"GET", "/customers/_search", kindSearch, []string{"customers"}},
+		{"POST", "/_search/scroll", kindSearch, []string{"_all"}},
+		{"POST", "/a,b/_msearch", kindMSearch, []string{"a", "b"}},
+		{"POST", "/customers/_async_search", kindAsyncSearch, []string{"customers"}},
+		{"GET", "/_async_search/abc", kindAsyncSearch, []string{"_all"}},
+		{"POST", "/_mget", kindMGet, []string{"_all"}},
+		{"GET", "/customers/_doc/1", kindDoc, []string{"customers"}},
+		{"GET", "/customers/_source/1", kindSource, []string{"customers"}},
+		{"GET", "/customers/doc/1", kindDoc, []string{"customers"}},
+	}
+	for _, c := range cases {
+		kind, indices := documentAPI(c.method, c.path)
+		assert.Equal(t, c.kind, kind, c.path)
+		assert.Equal(t, c.indices, indices, c.path)
+	}
+	kind, _ := documentAPI("PUT", "/customers/_doc/1")
+	assert.Equal(t, "", kind)
+	kind, _ = documentAPI("DELETE", "/_async_search/abc")
+	assert.Equal(t, "", kind)
+	kind, _ = documentAPI("GET", "/_cluster/health")
+	assert.Equal(t, "", kind)
+}
+
+func TestInjectSource(t *testing.T) {
+	data, changed, err := injectSource(nil, []string{"name"}, []string{"ssn"})
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, `{"_source":{"excludes":["ssn"],"includes":["name"]}}`, string(data))
+
+	data, changed, err = injectSource([]byte(`{"_source":["name","ssn"],"size":10}`), []string{"name"}, []string{"ssn"})
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, `{"_source":{"excludes":["ssn"],"includes":["name","ssn"]},"size":10}`, string(data))
+
+	data, changed, err = injectSource([]byte(`{"_source":{"exclude":"notes"}}`), nil, []string{"ssn"})
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, `{"_source":{"excludes":["notes","ssn"]}}`, string(data))
+
+	_, changed, err = injectSource([]byte(`{"_source":false}`), nil, []string{"ssn"})
+	assert.NoError(t, err)
+	assert.False(t, changed)
+
+	_, _, err = injectSource([]byte(`{`), nil, []string{"ssn"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,187 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package rbac
+
+import (
+	"sort"
+	"strings"
+
+	"infini.sh/gateway/common"
+)
+
+// clusterPrivileges are the action patterns granted by the cluster privileges
+var clusterPrivileges = map[string][]string{
+	"all":                    {"cluster:*", "indices:admin/template/*", unknownActionPrefix + "*"},
+	"manage":                 {"cluster:*", "indices:admin/template/*"},
+	"monitor":                {"cluster:monitor/*"},
+	"manage_index_templates": {"indices:admin/template/*"},
+	"manage_pipeline":        {"cluster:admin/ingest/pipeline/*"},
+	"read_pipeline":          {"cluster:admin/ingest/pipeline/get"},
+	"manage_ilm":             {"cluster:admin/ilm/*"},
+	"read_ilm":               {"cluster:admin/ilm/get"},
+	"manage_slm":             {"cluster:admin/slm/*"},
+	"read_slm":               {"cluster:admin/slm/get"},
+	"create_snapshot":        {"cluster:admin/snapshot/put"},
+	"monitor_snapshot":       {"cluster:admin/snapshot/get"},
+}
+
+// indexPrivileges are the action patterns granted by the index privileges
+var indexPrivileges = map[string][]string{
+	"all":                 {"indices:*"},
+	"read":                {"indices:data/read/*"},
+	"write":               {"indices:data/write/*"},
+	"index":               {"indices:data/write/index", "indices:data/write/update", "indices:data/write/bulk*"},
+	"create":              {"indices:data/write/index", "indices:data/write/bulk*"},
+	"create_doc":          {"indices:data/write/index", "indices:data/write/bulk*"},
+	"delete":              {"indices:data/write/delete*", "indices:data/write/bulk*"},
+	"create_index":        {"indices:admin/create", "indices:admin/auto_create"},
+	"delete_index":        {"indices:admin/delete"},
+	"manage":              {"indices:admin/*", "indices:monitor/*"},
+	"monitor":             {"indices:monitor/*"},
+	"maintenance":         {"indices:admin/refresh", "indices:admin/flush", "indices:admin/forcemerge"},
+	"view_index_metadata": {"indices:admin/get", "indices:admin/mappings/get", "indices:admin/aliases/get", "indices:monitor/settings/get", "indices:admin/validate/query", "indices:data/read/field_caps"},
+}
+
+// wildcardMatch matches the value with the pattern, `*` matches any
+// characters, including the `/` of the action names, and `?` matches one,
+// the wildcards in the value are literals that only `*` matches, so that
+// `logs-?` doesn't grant `logs-*`
+func wildcardMatch(pattern, value string) bool {
+	p, v := 0, 0
+	star, next := -1, 0
+	for v < len(value) {
+		switch {
+		case p < len(pattern) && pattern[p] == '*':
+			star, next = p, v
+			p++
+		case p < len(pattern) && (pattern[p] == '?' || pattern[p] == value[v]) && value[v] != '*' && value[v] != '?':
+			p++
+			v++
+		case star >= 0:
+			p = star + 1
+			next++
+			v = next
+		default:
+			return false
+		}
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+func matchAny(patterns []string, value string) bool {
+	for _, v := range patterns {
+		if wildcardMatch(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// grants checks whether any of the privileges grants the action, the
+// privileges are the names in the table or the action patterns
+func grants(table map[string][]string, privileges []string, action string) bool {
+	for _, v := range privileges {
+		patterns, ok := table[v]
+		if !ok && strings.Contains(v, ":") {
+			patterns = []string{v}
+		}
+		if matchAny(patterns, action) {
+			return true
+		}
+	}
+	return false
+}
+
+// grantingPrivileges returns the names of the privileges granting the action
+func grantingPrivileges(table map[string][]string, action string) []string {
+	names := []string{}
+	for name, patterns := range table {
+		if matchAny(patterns, action) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// authorizer checks the actions against the privileges of the roles
+type authorizer struct {
+	restrictedIndices []string
+}
+
+func normalizeIndex(index string) string {
+	if index == allIndices {
+		return "*"
+	}
+	return index
+}
+
+// permits checks whether the permission covers the index, the restricted
+// indices are covered only if the permission explicitly allows
+func (a *authorizer) permits(perm *common.IndexPermission, index string) bool {
+	if !matchAny(perm.Name, index) {
+		return false
+	}
+	return perm.AllowRestrictedIndices || !matchAny(a.restrictedIndices, index)
+}
+
+func (a *authorizer) allowIndex(roles []common.RoleConfig, action, index string) bool {
+	for i := range roles {
+		for j := range roles[i].Indices {
+			perm := &roles[i].Indices[j]
+			if (index == "" || a.permits(perm, index)) && grants(indexPrivileges, perm.Privileges, action) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// check returns the indices the action is denied on, and whether the action
+// is allowed
+func (a *authorizer) check(roles []common.RoleConfig, req *actionRequest) ([]string, bool) {
+	if req.cluster {
+		for i := range roles {
+			if grants(clusterPrivileges, roles[i].Cluster, req.action) {
+				return nil, true
+			}
+		}
+		return nil, false
+	}
+
+	if len(req.indices) == 0 {
+		return nil, a.allowIndex(roles, req.action, "")
+	}
+
+	denied := []string{}
+	for _, index := range req.indices {
+		if !a.allowIndex(roles, req.action, normalizeIndex(index)) {
+			denied = append(denied, index)
+		}
+	}
+	return denied, len(denied) == 0
+}
@@ -0,0 +1,126 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package rbac
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"infini.sh/gateway/common"
+)
+
+func TestWildcardMatch(t *testing.T) {
+	assert.True(t, wildcardMatch("*", "logs"))
+	assert.True(t, wildcardMatch("logs-*", "logs-2023.01"))
+	assert.True(t, wildcardMatch("logs-*", "logs-*"))
+	assert.True(t, wildcardMatch("indices:data/read/*", "indices:data/read/scroll/clear"))
+	assert.True(t, wildcardMatch("log?", "logs"))
+	assert.True(t, wildcardMatch("a*b*c", "axxbyyc"))
+	assert.False(t, wildcardMatch("logs-*", "metrics"))
+	assert.False(t, wildcardMatch("logs", "logs-1"))
+	assert.False(t, wildcardMatch("a*b*c", "axxbyy"))
+	assert.True(t, wildcardMatch("*", "**"))
+	assert.False(t, wildcardMatch("logs-?", "logs-*"))
+	assert.False(t, wildcardMatch("logs-?", "logs-?"))
+	assert.False(t, wildcardMatch("logs-1*", "logs-*"))
+}
+
+func TestAuthorizerCheck(t *testing.T) {
+	a := &authorizer{restrictedIndices: []string{".security*"}}
+	reader := common.RoleConfig{
+		Name:    "reader",
+		Cluster: []string{"monitor"},
+		Indices: []common.IndexPermission{{Name: []string{"logs-*"}, Privileges: []string{"read", "view_index_metadata"}}},
+	}
+	writer := common.RoleConfig{
+		Name:    "writer",
+		Indices: []common.IndexPermission{{Name: []string{"logs-*", "metrics"}, Privileges: []string{"index", "indices:admin/refresh"}}},
+	}
+	admin := common.RoleConfig{
+		Name:    "admin",
+		Cluster: []string{"all"},
+		Indices: []common.IndexPermission{{Name: []string{"*"}, Privileges: []string{"all"}}},
+	}
+
+	check := func(roles []common.RoleConfig, method, path, body string) ([]string, bool) {
+		requests, err := parseRequest(method, path, []byte(body))
+		assert.NoError(t, err)
+		for i := range requests {
+			if denied, ok := a.check(roles, &requests[i]); !ok {
+				return denied, false
+			}
+		}
+		return nil, true
+	}
+
+	_, ok := check([]common.RoleConfig{reader}, "GET", "/_cluster/health", "")
+	assert.True(t, ok)
+	_, ok = check([]common.RoleConfig{reader}, "PUT", "/_cluster/settings", "")
+	assert.False(t, ok)
+	_, ok = check([]common.RoleConfig{reader}, "GET", "/logs-2023/_search", "")
+	assert.True(t, ok)
+	_, ok = check([]common.RoleConfig{reader}, "GET", "/logs-*/_search", "")
+	assert.True(t, ok)
+	_, ok = check([]common.RoleConfig{reader}, "POST", "/_search/scroll", "")
+	assert.True(t, ok)
+	_, ok = check([]common.RoleConfig{reader}, "GET", "/logs-2023/_mapping", "")
+	assert.True(t, ok)
+
+	denied, ok := check([]common.RoleConfig{reader}, "GET", "/logs-2023,metrics/_search", "")
+	assert.False(t, ok)
+	assert.Equal(t, []string{"metrics"}, denied)
+	denied, ok = check([]common.RoleConfig{reader}, "GET", "/_search", "")
+	assert.False(t, ok)
+	assert.Equal(t, []string{"_all"}, denied)
+	_, ok = check([]common.RoleConfig{reader}, "PUT", "/logs-2023/_doc/1", "{}")
+	assert.False(t, ok)
+
+	bulk := "{\"index\":{\"_index\":\"logs-1\"}}\n{}\n{\"update\":{\"_index\":\"metrics\",\"_id\":\"1\"}}\n{\"doc\":{}}\n"
+	_, ok = check([]common.RoleConfig{writer}, "POST", "/_bulk", bulk)
+	assert.True(t, ok)
+	_, ok = check([]common.RoleConfig{reader, writer}, "POST", "/_bulk", bulk+"{\"delete\":{\"_index\":\"logs-1\",\"_id\":\"1\"}}\n")
+	assert.False(t, ok)
+	_, ok = check([]common.RoleConfig{writer}, "POST", "/metrics/_refresh", "")
+	assert.True(t, ok)
+	_, ok = check([]common.RoleConfig{writer}, "POST", "/metrics/_delete_by_query", "")
+	assert.False(t, ok)
+
+	_, ok = check([]common.RoleConfig{admin}, "PUT", "/_index_template/logs", "")
+	assert.True(t, ok)
+	_, ok = check([]common.RoleConfig{admin}, "GET", "/_search", "")
+	assert.True(t, ok)
+	_, ok = check([]common.RoleConfig{admin}, "GET", "/.security-7/_search", "")
+	assert.False(t, ok)
+	admin.Indices[0].AllowRestrictedIndices = true
+	_, ok = check([]common.RoleConfig{admin}, "GET", "/.security-7/_search", "")
+	assert.True(t, ok)
+
+	_, ok = check(nil, "GET", "/", "")
+	assert.False(t, ok)
+}
+
+func TestGrantingPrivileges(t *testing.T) {
+	assert.Equal(t, []string{"all", "read"}, grantingPrivileges(indexPrivileges, "indices:data/read/search"))
+	assert.Equal(t, []string{"all", "manage", "monitor"}, grantingPrivileges(clusterPrivileges, "cluster:monitor/health"))
+}
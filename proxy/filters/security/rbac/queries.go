@@ -0,0 +1,656 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package rbac
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+
+	"github.com/valyala/fasttemplate"
+	"infini.sh/framework/lib/fasthttp"
+	"infini.sh/gateway/common"
+)
+
+const (
+	kindCount      = "count"
+	kindByQuery    = "by_query"
+	kindTemplate   = "template"
+	kindUnfiltered = "unfiltered"
+)
+
+// unfilteredAPIs read the documents or their terms without the query, so
+// they are not allowed with the document level security
+var unfilteredAPIs = map[string]bool{
+	"_async_search":  true,
+	"_knn_search":    true,
+	"_terms_enum":    true,
+	"_explain":       true,
+	"_termvectors":   true,
+	"_mtermvectors":  true,
+	"_field_caps":    true,
+	"_rank_eval":     true,
+	"_mvt":           true,
+	"_eql":           true,
+	"_graph":         true,
+	"_rollup_search": true,
+	"_sql":           true,
+	"_query":         true,
+}
+
+// unfilteredError is the part of the search which the query can't filter
+type unfilteredError string
+
+func (e unfilteredError) Error() string {
+	return fmt.Sprintf("the %v are not allowed with the document level security", string(e))
+}
+
+var matchNone = map[string]interface{}{"match_none": map[string]interface{}{}}
+
+// renderQuery renders the variables of the query, such as {{user_name}}, the
+// query is parsed before the rendering, so the values can't change the
+// structure of the query
+func renderQuery(query string, lookup func(string) (interface{}, bool)) (interface{}, error) {
+	v, err := decodeJSON([]byte(query))
+	if err != nil {
+		return nil, fmt.Errorf("invalid query [%v], %v", query, err)
+	}
+	if _, ok := v.(map[string]interface{}); !ok {
+		return nil, fmt.Errorf("invalid query [%v], the query should be an object", query)
+	}
+	return renderValue(v, lookup)
+}
+
+func renderValue(v interface{}, lookup func(string) (interface{}, bool)) (interface{}, error) {
+	switch x := v.(type) {
+	case map[string]interface{}:
+		for k, item := range x {
+			result, err := renderValue(item, lookup)
+			if err != nil {
+				return nil, err
+			}
+			x[k] = result
+		}
+	case []interface{}:
+		for i, item := range x {
+			result, err := renderValue(item, lookup)
+			if err != nil {
+				return nil, err
+			}
+			x[i] = result
+		}
+	case string:
+		return renderString(x, lookup)
+	}
+	return v, nil
+}
+
+// renderString renders the variables of the string, the string of a single
+// variable is replaced by the value, so the values such as the roles can be
+// used in the terms query
+func renderString(s string, lookup func(string) (interface{}, bool)) (interface{}, error) {
+	if !strings.Contains(s, "{{") {
+		return s, nil
+	}
+	if strings.HasPrefix(s, "{{") && strings.HasSuffix(s, "}}") && strings.Count(s, "{{") == 1 {
+		tag := strings.TrimSpace(s[2 : len(s)-2])
+		v, ok := lookup(tag)
+		if !ok {
+			return nil, fmt.Errorf("variable [%v] of the query is not found", tag)
+		}
+		if items, ok := v.([]string); ok {
+			return stringList(items), nil
+		}
+		return v, nil
+	}
+
+	buffer := bytes.Buffer{}
+	_, err := fasttemplate.ExecuteFunc(s, "{{", "}}", &buffer, func(w io.Writer, tag string) (int, error) {
+		tag = strings.TrimSpace(tag)
+		v, ok := lookup(tag)
+		if !ok {
+			return 0, fmt.Errorf("variable [%v] of the query is not found", tag)
+		}
+		return w.Write([]byte(fmt.Sprint(v)))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return buffer.String(), nil
+}
+
+// queryRenderer renders the queries of the roles, cached per request
+func queryRenderer(lookup func(string) (interface{}, bool)) func(string) (interface{}, error) {
+	queries := map[string]interface{}{}
+	return func(query string) (interface{}, error) {
+		if v, ok := queries[query]; ok {
+			return v, nil
+		}
+		v, err := renderQuery(query, lookup)
+		if err != nil {
+			return nil, err
+		}
+		queries[query] = v
+		return v, nil
+	}
+}
+
+func boolShould(clauses []interface{}) interface{} {
+	return map[string]interface{}{
+		"bool": map[string]interface{}{
+			"should":               clauses,
+			"minimum_should_match": 1,
+		},
+	}
+}
+
+// documentQuery returns the query of the documents visible on the index, the
+// queries of the permissions are combined by should, nil if any of the
+// permissions has no query, and false if no permission covers the index
+func (a *authorizer) documentQuery(roles []common.RoleConfig, index string, render func(string) (interface{}, error)) (interface{}, bool, error) {
+	queries := []string{}
+	matched := false
+	for i := range roles {
+		for j := range roles[i].Indices {
+			perm := &roles[i].Indices[j]
+			if !a.permits(perm, normalizeIndex(index)) || !canRead(perm) {
+				continue
+			}
+			matched = true
+			query := strings.TrimSpace(perm.Query)
+			if query == "" {
+				return nil, true, nil
+			}
+			exists := false
+			for _, v := range queries {
+				if v == query {
+					exists = true
+					break
+				}
+			}
+			if !exists {
+				queries = append(queries, query)
+			}
+		}
+	}
+	if !matched {
+		return nil, false, nil
+	}
+
+	clauses := make([]interface{}, 0, len(queries))
+	for _, v := range queries {
+		q, err := render(v)
+		if err != nil {
+			return nil, true, err
+		}
+		clauses = append(clauses, q)
+	}
+	if len(clauses) == 1 {
+		return clauses[0], true, nil
+	}
+	return boolShould(clauses), true, nil
+}
+
+// scopedQuery returns the query of the documents visible on the indices, the
+// queries are scoped by the _index if the indices have different queries, and
+// the indices not covered match no documents
+func (a *authorizer) scopedQuery(roles []common.RoleConfig, indices []string, render func(string) (interface{}, error)) (interface{}, error) {
+	queries := make([]interface{}, len(indices))
+	shared := true
+	for i, index := range indices {
+		q, ok, err := a.documentQuery(roles, index, render)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			q = matchNone
+		}
+		queries[i] = q
+		if i > 0 && !reflect.DeepEqual(queries[0], q) {
+			shared = false
+		}
+	}
+	if len(queries) == 0 {
+		return nil, nil
+	}
+	if shared {
+		return queries[0], nil
+	}
+
+	clauses := make([]interface{}, 0, len(indices))
+	for i, index := range indices {
+		scope := map[string]interface{}{
+			"wildcard": map[string]interface{}{
+				"_index": map[string]interface{}{"value": normalizeIndex(index)},
+			},
+		}
+		if queries[i] == nil {
+			clauses = append(clauses, scope)
+			continue
+		}
+		clauses = append(clauses, map[string]interface{}{
+			"bool": map[string]interface{}{"filter": []interface{}{scope, queries[i]}},
+		})
+	}
+	return boolShould(clauses), nil
+}
+
+// queryResolver returns the query of the index, cached per request, the query
+// of the requested indices is used for the unknown indices, such as the
+// indices behind the aliases
+func queryResolver(a *authorizer, roles []common.RoleConfig, indices []string, render func(string) (interface{}, error)) func(string) (interface{}, error) {
+	queries := map[string]interface{}{}
+	return func(index string) (interface{}, error) {
+		if q, ok := queries[index]; ok {
+			return q, nil
+		}
+		q, ok, err := a.documentQuery(roles, index, render)
+		if err == nil && !ok {
+			q, err = a.scopedQuery(roles, indices, render)
+		}
+		if err != nil {
+			return nil, err
+		}
+		queries[index] = q
+		return q, nil
+	}
+}
+
+// queryAPI returns the kind of the apis searching the documents by query, and
+// the indices in the path
+func queryAPI(method, path string) (string, []string) {
+	segments := []string{}
+	for _, v := range strings.Split(path, "/") {
+		if v != "" {
+			segments = append(segments, v)
+		}
+	}
+	if len(segments) == 0 {
+		return "", nil
+	}
+	indices := []string{allIndices}
+	if !strings.HasPrefix(segments[0], "_") {
+		indices = splitIndices(segments[0])
+	}
+
+	pos := -1
+	for i, v := range segments {
+		if strings.HasPrefix(v, "_") {
+			pos = i
+			break
+		}
+	}
+	if pos < 0 {
+		return "", nil
+	}
+	api := segments[pos]
+	next := ""
+	if pos+1 < len(segments) {
+		next = segments[pos+1]
+	}
+	last := pos == len(segments)-1
+
+	switch api {
+	case "_search":
+		if next == "template" {
+			return kindTemplate, indices
+		}
+		if last {
+			return kindSearch, indices
+		}
+	case "_msearch":
+		if next == "template" {
+			return kindTemplate, indices
+		}
+		if last {
+			return kindMSearch, indices
+		}
+	case "_count":
+		if last {
+			return kindCount, indices
+		}
+	case "_delete_by_query", "_update_by_query":
+		if last && method == fasthttp.MethodPost {
+			return kindByQuery, indices
+		}
+	default:
+		//deleting the async searches reads nothing
+		if unfilteredAPIs[api] && !(api == "_async_search" && method == fasthttp.MethodDelete) {
+			return kindUnfiltered, indices
+		}
+	}
+	return "", nil
+}
+
+// uriQuery converts the q parameter to the query_string query, as the q
+// parameter overrides the query of the body, nil if there is no q parameter
+func uriQuery(args *fasthttp.Args) interface{} {
+	if !args.Has("q") {
+		return nil
+	}
+	query := map[string]interface{}{"query": string(args.Peek("q"))}
+	args.Del("q")
+	params := map[string]string{
+		"df":               "default_field",
+		"default_operator": "default_operator",
+		"analyzer":         "analyzer",
+		"analyze_wildcard": "analyze_wildcard",
+		"lenient":          "lenient",
+	}
+	for k, v := range params {
+		if !args.Has(k) {
+			continue
+		}
+		value := string(args.Peek(k))
+		args.Del(k)
+		switch k {
+		case "analyze_wildcard", "lenient":
+			query[v] = value == "" || value == "true"
+		default:
+			query[v] = value
+		}
+	}
+	return map[string]interface{}{"query_string": query}
+}
+
+// filterQuery wraps the query of the body in a bool query, with the document
+// level security query as the filter, the query is overridden if not nil
+func filterQuery(body []byte, dls interface{}, override interface{}) ([]byte, error) {
+	obj := map[string]interface{}{}
+	if len(bytes.TrimSpace(body)) > 0 {
+		v, err := decodeJSON(body)
+		if err != nil {
+			return nil, err
+		}
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("the request body should be an object")
+		}
+		obj = m
+	}
+	if hasGlobalAggregation(obj["aggs"]) || hasGlobalAggregation(obj["aggregations"]) {
+		return nil, unfilteredError("global aggregations")
+	}
+	if obj["suggest"] != nil {
+		return nil, unfilteredError("suggesters")
+	}
+
+	query := obj["query"]
+	if override != nil {
+		query = override
+	}
+	clauses := map[string]interface{}{"filter": []interface{}{dls}}
+	if query != nil {
+		clauses["must"] = []interface{}{query}
+	}
+	obj["query"] = map[string]interface{}{"bool": clauses}
+
+	//the knn search is not filtered by the query
+	switch knn := obj["knn"].(type) {
+	case map[string]interface{}:
+		filterKnn(knn, dls)
+	case []interface{}:
+		for _, v := range knn {
+			if item, ok := v.(map[string]interface{}); ok {
+				filterKnn(item, dls)
+			}
+		}
+	}
+	return encodeJSON(obj)
+}
+
+// filterKnn adds the document level security query to the filter of the knn
+// search
+func filterKnn(knn map[string]interface{}, dls interface{}) {
+	switch v := knn["filter"].(type) {
+	case nil:
+		knn["filter"] = dls
+	case []interface{}:
+		knn["filter"] = append(v, dls)
+	default:
+		knn["filter"] = []interface{}{v, dls}
+	}
+}
+
+// hasGlobalAggregation checks whether any of the aggregations is a global
+// aggregation, which ignores the query
+func hasGlobalAggregation(aggs interface{}) bool {
+	items, _ := aggs.(map[string]interface{})
+	for _, v := range items {
+		agg, ok := v.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if _, ok := agg["global"]; ok {
+			return true
+		}
+		if hasGlobalAggregation(agg["aggs"]) || hasGlobalAggregation(agg["aggregations"]) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterMultiSearch wraps the query of each search, false if no search is
+// changed
+func filterMultiSearch(body []byte, indices []string, queryOf func([]string) (interface{}, error)) ([]byte, bool, error) {
+	lines, err := multiSearchLines(body)
+	if err != nil {
+		return nil, false, err
+	}
+	changed := false
+	for i := 0; i < len(lines); i += 2 {
+		searched, err := multiSearchIndices(lines[i], indices)
+		if err != nil {
+			return nil, false, fmt.Errorf("invalid msearch header at line [%v]", i+1)
+		}
+		dls, err := queryOf(searched)
+		if err != nil {
+			return nil, false, err
+		}
+		if dls == nil {
+			continue
+		}
+		search := []byte{}
+		if i+1 < len(lines) {
+			search = lines[i+1]
+		} else {
+			lines = append(lines, nil)
+		}
+		data, err := filterQuery(search, dls, nil)
+		if err != nil {
+			if _, ok := err.(unfilteredError); ok {
+				return nil, false, err
+			}
+			return nil, false, fmt.Errorf("invalid msearch body at line [%v], %v", i+2, err)
+		}
+		lines[i+1] = data
+		changed = true
+	}
+	return joinMultiSearch(lines, body), changed, nil
+}
+
+type docRef struct {
+	index string
+	id    string
+}
+
+// documentID returns the id of the document in the path of the get apis
+func documentID(path string) string {
+	segments := []string{}
+	for _, v := range strings.Split(path, "/") {
+		if v != "" {
+			segments = append(segments, v)
+		}
+	}
+	for i, v := range segments {
+		if v == "_doc" || v == "_source" {
+			if i+1 < len(segments) {
+				return segments[i+1]
+			}
+			//the typed source, eg: /index/type/id/_source
+			if i > 0 {
+				return segments[i-1]
+			}
+		}
+	}
+	if len(segments) > 0 {
+		return segments[len(segments)-1]
+	}
+	return ""
+}
+
+func foundDocument(v interface{}) (docRef, bool) {
+	doc, ok := v.(map[string]interface{})
+	if !ok {
+		return docRef{}, false
+	}
+	found, _ := doc["found"].(bool)
+	index, _ := doc["_index"].(string)
+	id, _ := doc["_id"].(string)
+	return docRef{index: index, id: id}, found && index != "" && id != ""
+}
+
+// foundDocuments returns the documents found in the response of the get or
+// the mget
+func foundDocuments(kind string, resp interface{}) []docRef {
+	docs := []docRef{}
+	switch kind {
+	case kindDoc:
+		if doc, ok := foundDocument(resp); ok {
+			docs = append(docs, doc)
+		}
+	case kindMGet:
+		obj, _ := resp.(map[string]interface{})
+		items, _ := obj["docs"].([]interface{})
+		for _, v := range items {
+			if doc, ok := foundDocument(v); ok {
+				docs = append(docs, doc)
+			}
+		}
+	}
+	return docs
+}
+
+// hideDocuments replaces the hidden documents of the mget response by the
+// documents not found
+func hideDocuments(resp interface{}, hidden map[docRef]bool) {
+	obj, _ := resp.(map[string]interface{})
+	items, _ := obj["docs"].([]interface{})
+	for i, v := range items {
+		if doc, ok := foundDocument(v); ok && hidden[doc] {
+			items[i] = map[string]interface{}{"_index": doc.index, "_id": doc.id, "found": false}
+		}
+	}
+}
+
+// hiddenDocuments returns the documents not matching the queries of their
+// indices, the documents are verified by searching their ids with the queries
+func hiddenDocuments(docs []docRef, queryOf func(string) (interface{}, error), search func(string, []byte) ([]byte, error)) (map[docRef]bool, error) {
+	groups := map[string][]string{}
+	order := []string{}
+	for _, doc := range docs {
+		ids, ok := groups[doc.index]
+		if !ok {
+			order = append(order, doc.index)
+		}
+		exists := false
+		for _, v := range ids {
+			if v == doc.id {
+				exists = true
+				break
+			}
+		}
+		if !exists {
+			groups[doc.index] = append(ids, doc.id)
+		}
+	}
+
+	hidden := map[docRef]bool{}
+	for _, index := range order {
+		q, err := queryOf(index)
+		if err != nil {
+			return nil, err
+		}
+		if q == nil {
+			continue
+		}
+		ids := groups[index]
+		dsl, err := encodeJSON(map[string]interface{}{
+			"size":    len(ids),
+			"_source": false,
+			"query": map[string]interface{}{
+				"bool": map[string]interface{}{
+					"filter": []interface{}{
+						map[string]interface{}{"ids": map[string]interface{}{"values": stringList(ids)}},
+						q,
+					},
+				},
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+		data, err := search(index, dsl)
+		if err != nil {
+			return nil, err
+		}
+		visible, err := searchedIDs(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to verify the documents of index [%v], %v", index, err)
+		}
+		for _, id := range ids {
+			if !visible[id] {
+				hidden[docRef{index: index, id: id}] = true
+			}
+		}
+	}
+	return hidden, nil
+}
+
+func searchedIDs(data []byte) (map[string]bool, error) {
+	v, err := decodeJSON(data)
+	if err != nil {
+		return nil, err
+	}
+	resp, _ := v.(map[string]interface{})
+	if e, ok := resp["error"]; ok {
+		return nil, fmt.Errorf("%v", e)
+	}
+	hits, ok := resp["hits"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid search response")
+	}
+	ids := map[string]bool{}
+	items, _ := hits["hits"].([]interface{})
+	for _, item := range items {
+		hit, _ := item.(map[string]interface{})
+		if id, ok := hit["_id"].(string); ok {
+			ids[id] = true
+		}
+	}
+	return ids, nil
+}
@@ -0,0 +1,267 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package rbac
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"infini.sh/framework/lib/fasthttp"
+	"infini.sh/gateway/common"
+)
+
+func tenantRoles() []common.RoleConfig {
+	return []common.RoleConfig{
+		{
+			Name: "tenant",
+			Indices: []common.IndexPermission{
+				{Name: []string{"orders-*"}, Privileges: []string{"read"}, Query: `{"term":{"tenant":"{{tenant_id}}"}}`},
+				{Name: []string{"notes"}, Privileges: []string{"read"}, Query: `{"terms":{"owner":"{{user_roles}}"}}`},
+			},
+		},
+		{
+			Name: "auditor",
+			Indices: []common.IndexPermission{
+				{Name: []string{"orders-*"}, Privileges: []string{"read"}, Query: `{"term":{"audited":true}}`},
+				{Name: []string{"logs"}, Privileges: []string{"read"}},
+			},
+		},
+	}
+}
+
+func lookupOf(values map[string]interface{}) func(string) (interface{}, bool) {
+	return func(key string) (interface{}, bool) {
+		v, ok := values[key]
+		return v, ok
+	}
+}
+
+func TestRenderQuery(t *testing.T) {
+	lookup := lookupOf(map[string]interface{}{
+		"user_name":  `bob"}},{"match_all":{`,
+		"user_roles": []string{"a", "b"},
+	})
+
+	q, err := renderQuery(`{"term":{"owner":"{{user_name}}"}}`, lookup)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"term":{"owner":"bob\"}},{\"match_all\":{"}}`, mustJSON(t, q))
+
+	q, err = renderQuery(`{"terms":{"group":"{{ user_roles }}"}}`, lookup)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"terms":{"group":["a","b"]}}`, mustJSON(t, q))
+
+	q, err = renderQuery(`{"prefix":{"path":"/home/{{user_roles}}/"}}`, lookup)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"prefix":{"path":"/home/[a b]/"}}`, mustJSON(t, q))
+
+	_, err = renderQuery(`{"term":{"tenant":"{{tenant_id}}"}}`, lookup)
+	assert.Error(t, err)
+	_, err = renderQuery(`[{"match_all":{}}]`, lookup)
+	assert.Error(t, err)
+}
+
+func TestDocumentQuery(t *testing.T) {
+	a := &authorizer{}
+	render := queryRenderer(lookupOf(map[string]interface{}{"tenant_id": "t1", "user_roles": []string{"tenant"}}))
+
+	q, ok, err := a.documentQuery(tenantRoles(), "orders-2024", render)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, `{"bool":{"minimum_should_match":1,"should":[{"term":{"tenant":"t1"}},{"term":{"audited":true}}]}}`, mustJSON(t, q))
+
+	q, ok, err = a.documentQuery(tenantRoles(), "logs", render)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Nil(t, q)
+
+	_, ok, _ = a.documentQuery(tenantRoles(), "secrets", render)
+	assert.False(t, ok)
+
+	q, err = a.scopedQuery(tenantRoles()[:1], []string{"orders-1", "orders-2"}, render)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"term":{"tenant":"t1"}}`, mustJSON(t, q))
+
+	q, err = a.scopedQuery(tenantRoles(), []string{"logs", "secrets"}, render)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"bool":{"minimum_should_match":1,"should":[{"wildcard":{"_index":{"value":"logs"}}},{"bool":{"filter":[{"wildcard":{"_index":{"value":"secrets"}}},{"match_none":{}}]}}]}}`, mustJSON(t, q))
+
+	_, err = a.scopedQuery(tenantRoles(), []string{"orders-1"}, queryRenderer(lookupOf(nil)))
+	assert.Error(t, err)
+}
+
+func TestQueryAPI(t *testing.T) {
+	cases := []struct {
+		method, path, kind string
+		indices            []string
+	}{
+		{"GET", "/orders-*/_search", kindSearch, []string{"orders-*"}},
+		{"POST", "/_search", kindSearch, []string{allIndices}},
+		{"POST", "/_search/scroll", "", nil},
+		{"GET", "/a,b/_count", kindCount, []string{"a", "b"}},
+		{"POST", "/a/_msearch", kindMSearch, []string{"a"}},
+		{"POST", "/a/_delete_by_query", kindByQuery, []string{"a"}},
+		{"POST", "/a/_update_by_query", kindByQuery, []string{"a"}},
+		{"POST", "/_delete_by_query/task1/_rethrottle", "", nil},
+		{"POST", "/a/_search/template", kindTemplate, []string{"a"}},
+		{"POST", "/_msearch/template", kindTemplate, []string{allIndices}},
+		{"GET", "/a/_doc/1", "", nil},
+		{"POST", "/a/_async_search", kindUnfiltered, []string{"a"}},
+		{"GET", "/_async_search/id1", kindUnfiltered, []string{allIndices}},
+		{"DELETE", "/_async_search/id1", "", nil},
+		{"POST", "/a/_knn_search", kindUnfiltered, []string{"a"}},
+		{"POST", "/a/_terms_enum", kindUnfiltered, []string{"a"}},
+		{"GET", "/a/_explain/1", kindUnfiltered, []string{"a"}},
+		{"GET", "/a/_termvectors/1", kindUnfiltered, []string{"a"}},
+		{"GET", "/a/_field_caps", kindUnfiltered, []string{"a"}},
+		{"POST", "/_sql", kindUnfiltered, []string{allIndices}},
+	}
+	for _, c := range cases {
+		kind, indices := queryAPI(c.method, c.path)
+		assert.Equal(t, c.kind, kind, c.path)
+		assert.Equal(t, c.indices, indices, c.path)
+	}
+}
+
+func TestFilterQuery(t *testing.T) {
+	dls := map[string]interface{}{"term": map[string]interface{}{"tenant": "t1"}}
+
+	data, err := filterQuery([]byte(`{"query":{"match":{"title":"<b>"}},"size":1}`), dls, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"query":{"bool":{"filter":[{"term":{"tenant":"t1"}}],"must":[{"match":{"title":"<b>"}}]}},"size":1}`, string(data))
+
+	data, err = filterQuery(nil, dls, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"query":{"bool":{"filter":[{"term":{"tenant":"t1"}}]}}}`, string(data))
+
+	override := map[string]interface{}{"query_string": map[string]interface{}{"query": "title:x"}}
+	data, err = filterQuery([]byte(`{"query":{"match_all":{}}}`), dls, override)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"query":{"bool":{"filter":[{"term":{"tenant":"t1"}}],"must":[{"query_string":{"query":"title:x"}}]}}}`, string(data))
+
+	data, err = filterQuery([]byte(`{"knn":[{"field":"v","filter":{"term":{"a":1}}},{"field":"w"}]}`), dls, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"knn":[{"field":"v","filter":[{"term":{"a":1}},{"term":{"tenant":"t1"}}]},{"field":"w","filter":{"term":{"tenant":"t1"}}}],"query":{"bool":{"filter":[{"term":{"tenant":"t1"}}]}}}`, string(data))
+
+	_, err = filterQuery([]byte(`[]`), dls, nil)
+	assert.Error(t, err)
+
+	_, err = filterQuery([]byte(`{"aggs":{"by_tenant":{"terms":{"field":"tenant"},"aggs":{"all":{"global":{}}}}}}`), dls, nil)
+	assert.Equal(t, unfilteredError("global aggregations"), err)
+	_, err = filterQuery([]byte(`{"suggest":{"s":{"text":"x","term":{"field":"title"}}}}`), dls, nil)
+	assert.Equal(t, unfilteredError("suggesters"), err)
+	_, err = filterQuery([]byte(`{"aggs":{"global":{"terms":{"field":"tenant"}}}}`), dls, nil)
+	assert.NoError(t, err)
+}
+
+func TestURIQuery(t *testing.T) {
+	args := &fasthttp.Args{}
+	assert.Nil(t, uriQuery(args))
+
+	args.Set("q", "title:x")
+	args.Set("df", "body")
+	args.Set("lenient", "true")
+	args.Set("size", "1")
+	assert.Equal(t, `{"query_string":{"default_field":"body","lenient":true,"query":"title:x"}}`, mustJSON(t, uriQuery(args)))
+	assert.False(t, args.Has("q"))
+	assert.False(t, args.Has("df"))
+	assert.True(t, args.Has("size"))
+}
+
+func TestFilterMultiSearch(t *testing.T) {
+	queryOf := func(indices []string) (interface{}, error) {
+		if indices[0] == "logs" {
+			return nil, nil
+		}
+		return map[string]interface{}{"term": map[string]interface{}{"index": indices[0]}}, nil
+	}
+	body := "{}\n{\"query\":{\"match_all\":{}}}\n{\"index\":\"logs\"}\n{}\n"
+	data, changed, err := filterMultiSearch([]byte(body), []string{"orders"}, queryOf)
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, "{}\n{\"query\":{\"bool\":{\"filter\":[{\"term\":{\"index\":\"orders\"}}],\"must\":[{\"match_all\":{}}]}}}\n{\"index\":\"logs\"}\n{}\n", string(data))
+
+	_, _, err = filterMultiSearch([]byte("invalid\n{}\n"), []string{"orders"}, queryOf)
+	assert.Error(t, err)
+
+	//an empty line is an empty header, so the next search is still filtered
+	body = "{\"index\":\"logs\"}\n{}\n\n{}\n{\"index\":\"secret\"}\n{\"query\":{\"match_all\":{}}}\n"
+	data, changed, err = filterMultiSearch([]byte(body), []string{"logs"}, queryOf)
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, "{\"index\":\"logs\"}\n{}\n\n{}\n{\"index\":\"secret\"}\n{\"query\":{\"bool\":{\"filter\":[{\"term\":{\"index\":\"secret\"}}],\"must\":[{\"match_all\":{}}]}}}\n", string(data))
+
+	_, _, err = filterMultiSearch([]byte("{}\n{\"aggs\":{\"all\":{\"global\":{}}}}\n"), []string{"orders"}, queryOf)
+	assert.Equal(t, unfilteredError("global aggregations"), err)
+}
+
+func TestHiddenDocuments(t *testing.T) {
+	resp, err := decodeJSON([]byte(`{"docs":[
+		{"_index":"orders-1","_id":"1","found":true,"_source":{}},
+		{"_index":"orders-1","_id":"2","found":true,"_source":{}},
+		{"_index":"logs","_id":"3","found":true,"_source":{}},
+		{"_index":"orders-1","_id":"4","found":false}
+	]}`))
+	assert.NoError(t, err)
+	docs := foundDocuments(kindMGet, resp)
+	assert.Equal(t, []docRef{{"orders-1", "1"}, {"orders-1", "2"}, {"logs", "3"}}, docs)
+
+	a := &authorizer{}
+	render := queryRenderer(lookupOf(map[string]interface{}{"tenant_id": "t1"}))
+	queryOf := queryResolver(a, tenantRoles()[:1], []string{"orders-1", "logs"}, render)
+
+	searched := []string{}
+	search := func(index string, dsl []byte) ([]byte, error) {
+		searched = append(searched, index+" "+string(dsl))
+		if index == "logs" {
+			return []byte(`{"hits":{"hits":[]}}`), nil
+		}
+		return []byte(`{"hits":{"hits":[{"_index":"orders-1","_id":"1"}]}}`), nil
+	}
+	hidden, err := hiddenDocuments(docs, queryOf, search)
+	assert.NoError(t, err)
+	assert.Equal(t, map[docRef]bool{{"orders-1", "2"}: true, {"logs", "3"}: true}, hidden)
+	assert.Equal(t, `orders-1 {"_source":false,"query":{"bool":{"filter":[{"ids":{"values":["1","2"]}},{"term":{"tenant":"t1"}}]}},"size":2}`, searched[0])
+	assert.True(t, strings.Contains(searched[1], `"match_none":{}`), searched[1])
+
+	hideDocuments(resp, hidden)
+	assert.Equal(t, `{"docs":[{"_id":"1","_index":"orders-1","_source":{},"found":true},{"_id":"2","_index":"orders-1","found":false},{"_id":"3","_index":"logs","found":false},{"_id":"4","_index":"orders-1","found":false}]}`, mustJSON(t, resp))
+
+	_, err = hiddenDocuments(docs, queryOf, func(string, []byte) ([]byte, error) {
+		return []byte(`{"error":{"type":"index_not_found_exception"}}`), nil
+	})
+	assert.Error(t, err)
+	_, err = hiddenDocuments(docs, queryOf, func(string, []byte) ([]byte, error) {
+		return nil, fmt.Errorf("connection refused")
+	})
+	assert.Error(t, err)
+}
+
+func TestDocumentID(t *testing.T) {
+	assert.Equal(t, "1", documentID("/orders/_doc/1"))
+	assert.Equal(t, "1", documentID("/orders/_source/1"))
+	assert.Equal(t, "1", documentID("/orders/type/1/_source"))
+	assert.Equal(t, "1", documentID("/orders/type/1"))
+}
@@ -0,0 +1,511 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package rbac
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"infini.sh/framework/lib/fasthttp"
+)
+
+const allIndices = "_all"
+
+// unknownActionPrefix is the prefix of the actions of the unknown root apis
+const unknownActionPrefix = "unknown:"
+
+// actionRequest is an elasticsearch action on the indices, the cluster
+// actions are checked against the cluster privileges, the index actions
+// without indices, such as the scrolls, are allowed by any index permission
+// granting the action
+type actionRequest struct {
+	action  string
+	indices []string
+	cluster bool
+}
+
+func clusterAction(action string) []actionRequest {
+	return []actionRequest{{action: action, cluster: true}}
+}
+
+func indexAction(action string, indices []string) []actionRequest {
+	return []actionRequest{{action: action, indices: indices}}
+}
+
+func isRead(method string) bool {
+	return method == fasthttp.MethodGet || method == fasthttp.MethodHead
+}
+
+// splitIndices returns the indices of the index expression, the exclusions
+// are skipped as the included indices are checked
+func splitIndices(expr string) []string {
+	indices := []string{}
+	for _, v := range strings.Split(expr, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" || strings.HasPrefix(v, "-") {
+			continue
+		}
+		indices = append(indices, v)
+	}
+	return indices
+}
+
+// parseRequest returns the actions of the request, the bodies of _bulk,
+// _msearch and _mget are parsed for the indices of each item
+func parseRequest(method, path string, body []byte) ([]actionRequest, error) {
+	segments := []string{}
+	for _, v := range strings.Split(path, "/") {
+		if v != "" {
+			segments = append(segments, v)
+		}
+	}
+	if len(segments) == 0 {
+		return clusterAction("cluster:monitor/main"), nil
+	}
+
+	if strings.HasPrefix(segments[0], "_") {
+		return parseRootRequest(method, segments, body)
+	}
+
+	indices := splitIndices(segments[0])
+	if len(indices) == 0 {
+		indices = []string{allIndices}
+	}
+	if len(segments) == 1 {
+		switch method {
+		case fasthttp.MethodPut:
+			return indexAction("indices:admin/create", indices), nil
+		case fasthttp.MethodDelete:
+			return indexAction("indices:admin/delete", indices), nil
+		default:
+			return indexAction("indices:admin/get", indices), nil
+		}
+	}
+
+	api := segments[1]
+	if !strings.HasPrefix(api, "_") {
+		//the typed apis, eg: /index/type/_search or /index/type/id
+		if len(segments) > 2 && strings.HasPrefix(segments[2], "_") {
+			api = segments[2]
+		} else {
+			api = "_doc"
+		}
+	}
+	return parseIndexRequest(method, api, segments, indices, body)
+}
+
+func parseIndexRequest(method, api string, segments []string, indices []string, body []byte) ([]actionRequest, error) {
+	switch api {
+	case "_search", "_count", "_async_search", "_knn_search", "_terms_enum":
+		return indexAction("indices:data/read/search", indices), nil
+	case "_sql", "_query", "_eql", "_rank_eval", "_mvt", "_graph", "_rollup_search":
+		//the indices in the body of sql and esql are not parsed, so all the
+		//indices are required
+		return indexAction("indices:data/read/"+strings.TrimPrefix(api, "_"), indices), nil
+	case "_msearch":
+		return parseMultiSearch(body, indices)
+	case "_mget":
+		return parseMultiGet(body, indices, "indices:data/read/get")
+	case "_bulk":
+		return parseBulk(body, indices)
+	case "_doc", "_source":
+		switch {
+		case isRead(method):
+			return indexAction("indices:data/read/get", indices), nil
+		case method == fasthttp.MethodDelete:
+			return indexAction("indices:data/write/delete", indices), nil
+		default:
+			return indexAction("indices:data/write/index", indices), nil
+		}
+	case "_create":
+		return indexAction("indices:data/write/index", indices), nil
+	case "_update":
+		return indexAction("indices:data/write/update", indices), nil
+	case "_delete_by_query":
+		return indexAction("indices:data/write/delete/byquery", indices), nil
+	case "_update_by_query":
+		return indexAction("indices:data/write/update/byquery", indices), nil
+	case "_explain":
+		return indexAction("indices:data/read/explain", indices), nil
+	case "_field_caps":
+		return indexAction("indices:data/read/field_caps", indices), nil
+	case "_termvectors":
+		return indexAction("indices:data/read/tv", indices), nil
+	case "_mtermvectors":
+		return parseMultiGet(body, indices, "indices:data/read/tv")
+	case "_pit":
+		return indexAction("indices:data/read/open_point_in_time", indices), nil
+	case "_validate":
+		return indexAction("indices:admin/validate/query", indices), nil
+	case "_mapping", "_mappings":
+		if isRead(method) {
+			return indexAction("indices:admin/mappings/get", indices), nil
+		}
+		return indexAction("indices:admin/mapping/put", indices), nil
+	case "_settings":
+		if isRead(method) {
+			return indexAction("indices:monitor/settings/get", indices), nil
+		}
+		return indexAction("indices:admin/settings/update", indices), nil
+	case "_alias", "_aliases":
+		if isRead(method) {
+			return indexAction("indices:admin/aliases/get", indices), nil
+		}
+		//the alias is managed as an index too
+		if len(segments) > 2 && segments[1] == api {
+			indices = append(indices, splitIndices(segments[2])...)
+		}
+		return indexAction("indices:admin/aliases", indices), nil
+	case "_stats", "_segments", "_recovery", "_shard_stores":
+		return indexAction("indices:monitor/"+strings.TrimPrefix(api, "_"), indices), nil
+	case "_refresh", "_flush", "_forcemerge", "_open", "_close", "_analyze", "_rollover", "_shrink", "_split", "_clone":
+		return indexAction("indices:admin/"+strings.TrimPrefix(api, "_"), indices), nil
+	default:
+		if isRead(method) {
+			return indexAction("indices:monitor/"+strings.TrimPrefix(api, "_"), indices), nil
+		}
+		return indexAction("indices:admin/"+strings.TrimPrefix(api, "_"), indices), nil
+	}
+}
+
+// parseRootRequest parses the requests without the index in the path
+func parseRootRequest(method string, segments []string, body []byte) ([]actionRequest, error) {
+	api := segments[0]
+	sub := ""
+	if len(segments) > 1 {
+		sub = segments[1]
+	}
+
+	switch api {
+	case "_search":
+		if sub == "scroll" {
+			if method == fasthttp.MethodDelete {
+				return indexAction("indices:data/read/scroll/clear", nil), nil
+			}
+			return indexAction("indices:data/read/scroll", nil), nil
+		}
+		if hasPointInTime(body) {
+			//the indices are resolved from the point in time
+			return indexAction("indices:data/read/search", nil), nil
+		}
+		return parseIndexRequest(method, api, segments, []string{allIndices}, body)
+	case "_pit":
+		return indexAction("indices:data/read/close_point_in_time", nil), nil
+	case "_analyze":
+		return indexAction("indices:admin/analyze", nil), nil
+	case "_aliases":
+		if isRead(method) {
+			return indexAction("indices:admin/aliases/get", []string{allIndices}), nil
+		}
+		return parseAliasActions(body)
+	case "_count", "_async_search", "_msearch", "_mget", "_mtermvectors", "_bulk", "_field_caps", "_validate",
+		"_sql", "_query", "_eql", "_rank_eval",
+		"_mapping", "_mappings", "_settings", "_alias", "_stats", "_segments", "_recovery",
+		"_refresh", "_flush", "_forcemerge", "_all":
+		if api == "_all" {
+			if sub == "" {
+				return indexAction("indices:admin/get", []string{allIndices}), nil
+			}
+			api = sub
+		}
+		return parseIndexRequest(method, api, segments, []string{allIndices}, body)
+	case "_xpack", "_license", "_remote":
+		if isRead(method) {
+			return clusterAction("cluster:monitor/" + strings.TrimPrefix(api, "_")), nil
+		}
+		return clusterAction("cluster:admin/" + strings.TrimPrefix(api, "_")), nil
+	case "_resolve":
+		indices := []string{allIndices}
+		if len(segments) > 2 {
+			indices = splitIndices(segments[2])
+		}
+		return indexAction("indices:admin/resolve/index", indices), nil
+	case "_cluster":
+		switch sub {
+		case "health", "state", "stats", "pending_tasks":
+			return clusterAction("cluster:monitor/" + sub), nil
+		case "settings":
+			if isRead(method) {
+				return clusterAction("cluster:monitor/settings"), nil
+			}
+			return clusterAction("cluster:admin/settings/update"), nil
+		case "allocation":
+			return clusterAction("cluster:monitor/allocation/explain"), nil
+		}
+	case "_nodes":
+		for _, v := range segments[1:] {
+			switch v {
+			case "stats", "hot_threads", "usage":
+				return clusterAction("cluster:monitor/nodes/" + v), nil
+			case "reload_secure_settings":
+				return clusterAction("cluster:admin/nodes/reload_secure_settings"), nil
+			}
+		}
+		return clusterAction("cluster:monitor/nodes/info"), nil
+	case "_cat":
+		return clusterAction("cluster:monitor/cat/" + sub), nil
+	case "_tasks":
+		if isRead(method) {
+			return clusterAction("cluster:monitor/tasks/lists"), nil
+		}
+		return clusterAction("cluster:admin/tasks/cancel"), nil
+	case "_template", "_index_template", "_component_template":
+		switch {
+		case isRead(method):
+			return clusterAction("indices:admin/template/get"), nil
+		case method == fasthttp.MethodDelete:
+			return clusterAction("indices:admin/template/delete"), nil
+		default:
+			return clusterAction("indices:admin/template/put"), nil
+		}
+	case "_ingest":
+		switch {
+		case segments[len(segments)-1] == "_simulate":
+			return clusterAction("cluster:admin/ingest/pipeline/simulate"), nil
+		case isRead(method):
+			return clusterAction("cluster:admin/ingest/pipeline/get"), nil
+		case method == fasthttp.MethodDelete:
+			return clusterAction("cluster:admin/ingest/pipeline/delete"), nil
+		default:
+			return clusterAction("cluster:admin/ingest/pipeline/put"), nil
+		}
+	case "_snapshot", "_ilm", "_slm":
+		name := strings.TrimPrefix(api, "_")
+		switch {
+		case isRead(method):
+			return clusterAction("cluster:admin/" + name + "/get"), nil
+		case method == fasthttp.MethodDelete:
+			return clusterAction("cluster:admin/" + name + "/delete"), nil
+		default:
+			return clusterAction("cluster:admin/" + name + "/put"), nil
+		}
+	}
+
+	//the unknown apis may read the documents, such as the new search apis, so
+	//they are only granted by the `all` privilege or the explicit patterns
+	return clusterAction(unknownActionPrefix + strings.TrimPrefix(api, "_")), nil
+}
+
+func hasPointInTime(body []byte) bool {
+	if !bytes.Contains(body, []byte(`"pit"`)) {
+		return false
+	}
+	obj := struct {
+		Pit json.RawMessage `json:"pit"`
+	}{}
+	return json.Unmarshal(body, &obj) == nil && len(obj.Pit) > 0
+}
+
+// indexNames is the index or the indices of the items, either a string or
+// an array of strings
+type indexNames []string
+
+func (n *indexNames) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*n = splitIndices(s)
+		return nil
+	}
+	var arr []string
+	if err := json.Unmarshal(data, &arr); err != nil {
+		return err
+	}
+	*n = arr
+	return nil
+}
+
+// actionsOf returns the actions sorted by the name, the indices are
+// deduplicated
+func actionsOf(items map[string][]string, cluster bool) []actionRequest {
+	result := []actionRequest{}
+	for action, indices := range items {
+		seen := map[string]bool{}
+		unique := []string{}
+		for _, v := range indices {
+			if !seen[v] {
+				seen[v] = true
+				unique = append(unique, v)
+			}
+		}
+		result = append(result, actionRequest{action: action, indices: unique, cluster: cluster})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].action < result[j].action
+	})
+	return result
+}
+
+func defaultIndices(indices []string, defaults []string) []string {
+	if len(indices) == 0 {
+		return defaults
+	}
+	return indices
+}
+
+// parseBulk returns the actions of the bulk items, the index of the item
+// falls back to the index in the path
+func parseBulk(body []byte, indices []string) ([]actionRequest, error) {
+	items := map[string][]string{}
+	lines := bytes.Split(body, []byte("\n"))
+	for i := 0; i < len(lines); i++ {
+		line := bytes.TrimSpace(lines[i])
+		if len(line) == 0 {
+			continue
+		}
+		meta := map[string]struct {
+			Index indexNames `json:"_index"`
+		}{}
+		if err := json.Unmarshal(line, &meta); err != nil || len(meta) != 1 {
+			return nil, fmt.Errorf("invalid bulk action at line [%v]", i+1)
+		}
+		for op, v := range meta {
+			var action string
+			switch op {
+			case "index", "create":
+				action = "indices:data/write/index"
+				i++
+			case "update":
+				action = "indices:data/write/update"
+				i++
+			case "delete":
+				action = "indices:data/write/delete"
+			default:
+				return nil, fmt.Errorf("unknown bulk action [%v] at line [%v]", op, i+1)
+			}
+			items[action] = append(items[action], defaultIndices(v.Index, indices)...)
+		}
+	}
+	return actionsOf(items, false), nil
+}
+
+// multiSearchLines splits the msearch body into the lines, each search has a
+// header line and a body line, the headers are always at the even lines as
+// elasticsearch treats an empty line as an empty header
+func multiSearchLines(body []byte) ([][]byte, error) {
+	if len(body) > 0 && body[0] == '\n' {
+		return nil, fmt.Errorf("invalid msearch header at line [1]")
+	}
+	lines := bytes.Split(body, []byte("\n"))
+	if len(lines[len(lines)-1]) == 0 {
+		lines = lines[:len(lines)-1]
+	}
+	return lines, nil
+}
+
+// joinMultiSearch joins the lines split by multiSearchLines
+func joinMultiSearch(lines [][]byte, body []byte) []byte {
+	data := bytes.Join(lines, []byte("\n"))
+	if bytes.HasSuffix(body, []byte("\n")) {
+		data = append(data, '\n')
+	}
+	return data
+}
+
+// multiSearchIndices returns the indices of the msearch header, an empty
+// header searches the indices in the path
+func multiSearchIndices(line []byte, indices []string) ([]string, error) {
+	header := struct {
+		Index indexNames `json:"index"`
+	}{}
+	if len(bytes.TrimSpace(line)) > 0 {
+		if err := json.Unmarshal(line, &header); err != nil {
+			return nil, err
+		}
+	}
+	return defaultIndices(header.Index, indices), nil
+}
+
+// parseMultiSearch returns the indices of the searches
+func parseMultiSearch(body []byte, indices []string) ([]actionRequest, error) {
+	lines, err := multiSearchLines(body)
+	if err != nil {
+		return nil, err
+	}
+	searched := []string{}
+	for i := 0; i < len(lines); i += 2 {
+		v, err := multiSearchIndices(lines[i], indices)
+		if err != nil {
+			return nil, fmt.Errorf("invalid msearch header at line [%v]", i+1)
+		}
+		searched = append(searched, v...)
+	}
+	if len(searched) == 0 {
+		searched = indices
+	}
+	return actionsOf(map[string][]string{"indices:data/read/search": searched}, false), nil
+}
+
+// parseMultiGet returns the indices of the docs of _mget and _mtermvectors,
+// the ids are got from the index in the path
+func parseMultiGet(body []byte, indices []string, action string) ([]actionRequest, error) {
+	req := struct {
+		Docs []struct {
+			Index indexNames `json:"_index"`
+		} `json:"docs"`
+	}{}
+	if len(bytes.TrimSpace(body)) > 0 {
+		if err := json.Unmarshal(body, &req); err != nil {
+			return nil, fmt.Errorf("invalid body of [%v], %v", action, err)
+		}
+	}
+	got := []string{}
+	for _, v := range req.Docs {
+		got = append(got, defaultIndices(v.Index, indices)...)
+	}
+	if len(got) == 0 {
+		got = indices
+	}
+	return actionsOf(map[string][]string{action: got}, false), nil
+}
+
+// parseAliasActions returns the indices and the aliases of the alias actions
+func parseAliasActions(body []byte) ([]actionRequest, error) {
+	req := struct {
+		Actions []map[string]struct {
+			Index   indexNames `json:"index"`
+			Indices indexNames `json:"indices"`
+			Alias   indexNames `json:"alias"`
+			Aliases indexNames `json:"aliases"`
+		} `json:"actions"`
+	}{}
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, fmt.Errorf("invalid aliases body, %v", err)
+	}
+	indices := []string{}
+	for _, action := range req.Actions {
+		for _, v := range action {
+			indices = append(indices, v.Index...)
+			indices = append(indices, v.Indices...)
+			indices = append(indices, v.Alias...)
+			indices = append(indices, v.Aliases...)
+		}
+	}
+	if len(indices) == 0 {
+		indices = []string{allIndices}
+	}
+	return actionsOf(map[string][]string{"indices:admin/aliases": indices}, false), nil
+}
@@ -0,0 +1,185 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package rbac
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRequest(t *testing.T) {
+	cases := []struct {
+		method  string
+		path    string
+		action  string
+		indices []string
+		cluster bool
+	}{
+		{"GET", "/", "cluster:monitor/main", nil, true},
+		{"GET", "/_cluster/health", "cluster:monitor/health", nil, true},
+		{"PUT", "/_cluster/settings", "cluster:admin/settings/update", nil, true},
+		{"GET", "/_nodes/node1/stats", "cluster:monitor/nodes/stats", nil, true},
+		{"GET", "/_cat/indices", "cluster:monitor/cat/indices", nil, true},
+		{"PUT", "/_index_template/logs", "indices:admin/template/put", nil, true},
+		{"GET", "/_ingest/pipeline/p1", "cluster:admin/ingest/pipeline/get", nil, true},
+		{"GET", "/_search", "indices:data/read/search", []string{"_all"}, false},
+		{"POST", "/_search/scroll", "indices:data/read/scroll", nil, false},
+		{"DELETE", "/_search/scroll", "indices:data/read/scroll/clear", nil, false},
+		{"GET", "/_all/_mapping", "indices:admin/mappings/get", []string{"_all"}, false},
+		{"GET", "/logs-*,metrics,-logs-old/_search", "indices:data/read/search", []string{"logs-*", "metrics"}, false},
+		{"POST", "/logs/_count", "indices:data/read/search", []string{"logs"}, false},
+		{"GET", "/logs/_doc/1", "indices:data/read/get", []string{"logs"}, false},
+		{"PUT", "/logs/_doc/1", "indices:data/write/index", []string{"logs"}, false},
+		{"DELETE", "/logs/_doc/1", "indices:data/write/delete", []string{"logs"}, false},
+		{"POST", "/logs/_update/1", "indices:data/write/update", []string{"logs"}, false},
+		{"POST", "/logs/_delete_by_query", "indices:data/write/delete/byquery", []string{"logs"}, false},
+		{"GET", "/logs/doc/1", "indices:data/read/get", []string{"logs"}, false},
+		{"GET", "/logs/doc/_search", "indices:data/read/search", []string{"logs"}, false},
+		{"PUT", "/logs", "indices:admin/create", []string{"logs"}, false},
+		{"DELETE", "/logs", "indices:admin/delete", []string{"logs"}, false},
+		{"GET", "/logs", "indices:admin/get", []string{"logs"}, false},
+		{"PUT", "/logs/_mapping", "indices:admin/mapping/put", []string{"logs"}, false},
+		{"PUT", "/logs/_alias/current", "indices:admin/aliases", []string{"logs", "current"}, false},
+		{"POST", "/logs/_refresh", "indices:admin/refresh", []string{"logs"}, false},
+		{"GET", "/_sql", "indices:data/read/sql", []string{"_all"}, false},
+		{"POST", "/_query", "indices:data/read/query", []string{"_all"}, false},
+		{"GET", "/logs/_eql/search", "indices:data/read/eql", []string{"logs"}, false},
+		{"POST", "/_rank_eval", "indices:data/read/rank_eval", []string{"_all"}, false},
+		{"GET", "/_mtermvectors", "indices:data/read/tv", []string{"_all"}, false},
+		{"GET", "/_resolve/index/logs-*", "indices:admin/resolve/index", []string{"logs-*"}, false},
+		{"GET", "/_xpack", "cluster:monitor/xpack", nil, true},
+		{"GET", "/_unknown", "unknown:unknown", nil, true},
+	}
+	for _, c := range cases {
+		requests, err := parseRequest(c.method, c.path, nil)
+		assert.NoError(t, err, c.path)
+		assert.Equal(t, []actionRequest{{action: c.action, indices: c.indices, cluster: c.cluster}}, requests, c.method+" "+c.path)
+	}
+}
+
+func TestParseUnknownRequest(t *testing.T) {
+	//the unknown apis are not granted by monitor, as they may read the documents
+	requests, err := parseRequest("GET", "/_new_search", nil)
+	assert.NoError(t, err)
+	assert.False(t, grants(clusterPrivileges, []string{"monitor", "manage"}, requests[0].action))
+	assert.True(t, grants(clusterPrivileges, []string{"all"}, requests[0].action))
+
+	requests, err = parseRequest("GET", "/_sql", []byte(`{"query":"SELECT * FROM secret"}`))
+	assert.NoError(t, err)
+	assert.False(t, grants(clusterPrivileges, []string{"monitor"}, requests[0].action))
+	assert.False(t, requests[0].cluster)
+}
+
+func TestParseMultiTermVectors(t *testing.T) {
+	body := `{"docs":[{"_index":"secret","_id":"1"},{"_id":"2"}]}`
+	requests, err := parseRequest("POST", "/public/_mtermvectors", []byte(body))
+	assert.NoError(t, err)
+	assert.Equal(t, []actionRequest{{action: "indices:data/read/tv", indices: []string{"secret", "public"}}}, requests)
+
+	requests, err = parseRequest("GET", "/_mtermvectors", []byte(`{"docs":[{"_index":"secret","_id":"1"}]}`))
+	assert.NoError(t, err)
+	assert.Equal(t, []actionRequest{{action: "indices:data/read/tv", indices: []string{"secret"}}}, requests)
+
+	_, err = parseRequest("POST", "/public/_mtermvectors", []byte(`{"docs":`))
+	assert.Error(t, err)
+}
+
+func TestParseRequestWithPointInTime(t *testing.T) {
+	requests, err := parseRequest("POST", "/_search", []byte(`{"pit":{"id":"abc"},"query":{"match_all":{}}}`))
+	assert.NoError(t, err)
+	assert.Equal(t, []actionRequest{{action: "indices:data/read/search"}}, requests)
+}
+
+func TestParseBulk(t *testing.T) {
+	body := `{"index":{"_index":"logs","_id":"1"}}
+{"message":"hello"}
+{"delete":{"_id":"2"}}
+{"create":{"_index":"metrics"}}
+{"value":1}
+{"update":{"_index":"logs","_id":"1"}}
+{"doc":{"message":"world"}}
+`
+	requests, err := parseRequest("POST", "/default/_bulk", []byte(body))
+	assert.NoError(t, err)
+	assert.Equal(t, []actionRequest{
+		{action: "indices:data/write/delete", indices: []string{"default"}},
+		{action: "indices:data/write/index", indices: []string{"logs", "metrics"}},
+		{action: "indices:data/write/update", indices: []string{"logs"}},
+	}, requests)
+
+	_, err = parseRequest("POST", "/_bulk", []byte(`{"upsert":{"_index":"logs"}}`))
+	assert.Error(t, err)
+	_, err = parseRequest("POST", "/_bulk", []byte(`not json`))
+	assert.Error(t, err)
+}
+
+func TestParseMultiSearch(t *testing.T) {
+	body := `{"index":"logs"}
+{"query":{"match_all":{}}}
+{}
+{"query":{"match_all":{}}}
+{"index":["metrics","logs"]}
+{"query":{"match_all":{}}}
+`
+	requests, err := parseRequest("POST", "/default/_msearch", []byte(body))
+	assert.NoError(t, err)
+	assert.Equal(t, []actionRequest{{action: "indices:data/read/search", indices: []string{"logs", "default", "metrics"}}}, requests)
+
+	requests, err = parseRequest("POST", "/_msearch", []byte("{}\n{}\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, []actionRequest{{action: "indices:data/read/search", indices: []string{"_all"}}}, requests)
+
+	//an empty line is an empty header, the search after it is not hidden
+	requests, err = parseRequest("POST", "/public/_msearch", []byte("{}\n{}\n\n{}\n{\"index\":\"secret\"}\n{\"query\":{\"match_all\":{}}}\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, []actionRequest{{action: "indices:data/read/search", indices: []string{"public", "secret"}}}, requests)
+
+	_, err = parseRequest("POST", "/public/_msearch", []byte("\n{}\n{\"index\":\"secret\"}\n{}\n"))
+	assert.Error(t, err)
+
+	//the templates have the same headers
+	requests, err = parseRequest("POST", "/_msearch/template", []byte("{\"index\":\"secret\"}\n{\"id\":\"t1\"}\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, []actionRequest{{action: "indices:data/read/search", indices: []string{"secret"}}}, requests)
+	requests, err = parseRequest("POST", "/public/_msearch/template", []byte("{\"index\":\"secret\"}\n{\"id\":\"t1\"}\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, []actionRequest{{action: "indices:data/read/search", indices: []string{"secret"}}}, requests)
+}
+
+func TestParseMultiGet(t *testing.T) {
+	requests, err := parseRequest("POST", "/_mget", []byte(`{"docs":[{"_index":"logs","_id":"1"},{"_index":"metrics","_id":"2"}]}`))
+	assert.NoError(t, err)
+	assert.Equal(t, []actionRequest{{action: "indices:data/read/get", indices: []string{"logs", "metrics"}}}, requests)
+
+	requests, err = parseRequest("POST", "/logs/_mget", []byte(`{"ids":["1","2"]}`))
+	assert.NoError(t, err)
+	assert.Equal(t, []actionRequest{{action: "indices:data/read/get", indices: []string{"logs"}}}, requests)
+}
+
+func TestParseAliasActions(t *testing.T) {
+	requests, err := parseRequest("POST", "/_aliases", []byte(`{"actions":[{"add":{"index":"logs-1","alias":"logs"}},{"remove":{"indices":["logs-0"],"alias":"logs"}}]}`))
+	assert.NoError(t, err)
+	assert.Equal(t, []actionRequest{{action: "indices:admin/aliases", indices: []string{"logs-1", "logs", "logs-0"}}}, requests)
+}
@@ -0,0 +1,166 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package rbac
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/cihub/seelog"
+	"infini.sh/framework/core/config"
+	"infini.sh/framework/core/global"
+	"infini.sh/framework/core/pipeline"
+	"infini.sh/framework/core/stats"
+	"infini.sh/framework/core/util"
+	"infini.sh/framework/lib/fasthttp"
+	"infini.sh/gateway/common"
+)
+
+// RoleAccessControl checks the privileges of the user roles, which are set
+// by the auth filters, such as basic_auth and ldap_auth
+type RoleAccessControl struct {
+	DefaultRoles      []string `config:"default_roles"`      //roles of the requests without any role
+	RestrictedIndices []string `config:"restricted_indices"` //only allowed by the permissions with allow_restricted_indices
+
+	authorizer *authorizer
+}
+
+func init() {
+	pipeline.RegisterFilterPluginWithConfigMetadata("role_access_control", NewRoleAccessControl, &RoleAccessControl{})
+}
+
+func NewRoleAccessControl(c *config.Config) (pipeline.Filter, error) {
+
+	runner := RoleAccessControl{
+		RestrictedIndices: []string{".security*"},
+	}
+
+	if err := c.Unpack(&runner); err != nil {
+		return nil, fmt.Errorf("failed to unpack the filter configuration : %s", err)
+	}
+	runner.authorizer = &authorizer{restrictedIndices: runner.RestrictedIndices}
+
+	return &runner, nil
+}
+
+func (filter *RoleAccessControl) Name() string {
+	return "role_access_control"
+}
+
+// getUserRoles returns the role names in the context
+func getUserRoles(ctx *fasthttp.RequestCtx) []string {
+	switch v := ctx.Get("user_roles").(type) {
+	case []string:
+		return v
+	case string:
+		return splitIndices(v)
+	}
+	return nil
+}
+
+// getRoles returns the user, the role names and the registered roles, the
+// default roles are used if the context has no roles
+func getRoles(ctx *fasthttp.RequestCtx, defaultRoles []string) (string, []string, []common.RoleConfig) {
+	user, _ := ctx.GetString("user_name")
+	if user == "" {
+		user = "_anonymous"
+	}
+	names := getUserRoles(ctx)
+	if len(names) == 0 {
+		names = defaultRoles
+	}
+
+	roles := make([]common.RoleConfig, 0, len(names))
+	for _, v := range names {
+		role, ok := common.GetRoleConfig(v)
+		if !ok {
+			log.Debugf("role [%v] of user [%v] not found", v, user)
+			continue
+		}
+		roles = append(roles, role)
+	}
+	return user, names, roles
+}
+
+func (filter *RoleAccessControl) Filter(ctx *fasthttp.RequestCtx) {
+
+	user, names, roles := getRoles(ctx, filter.DefaultRoles)
+
+	method := string(ctx.Request.Header.Method())
+	path := string(ctx.Request.PhantomURI().Path())
+	requests, err := parseRequest(method, path, ctx.Request.GetRawBody())
+	if err != nil {
+		stats.Increment("role_access_control", "invalid")
+		writeError(ctx, fasthttp.StatusBadRequest, "parse_exception", err.Error())
+		return
+	}
+
+	for i := range requests {
+		req := &requests[i]
+		denied, ok := filter.authorizer.check(roles, req)
+		if ok {
+			continue
+		}
+
+		reason := fmt.Sprintf("action [%v] is unauthorized for user [%v] with roles [%v]", req.action, user, strings.Join(names, ","))
+		if len(denied) > 0 {
+			reason += fmt.Sprintf(" on indices [%v]", strings.Join(denied, ","))
+		}
+		if req.cluster {
+			if privileges := grantingPrivileges(clusterPrivileges, req.action); len(privileges) > 0 {
+				reason += fmt.Sprintf(", this action is granted by the cluster privileges [%v]", strings.Join(privileges, ","))
+			}
+		} else if privileges := grantingPrivileges(indexPrivileges, req.action); len(privileges) > 0 {
+			reason += fmt.Sprintf(", this action is granted by the index privileges [%v]", strings.Join(privileges, ","))
+		}
+
+		if global.Env().IsDebug {
+			log.Debugf("request [%v %v] denied, %v", method, path, reason)
+		}
+		stats.Increment("role_access_control", "denied")
+		writeError(ctx, fasthttp.StatusForbidden, "security_exception", reason)
+		return
+	}
+
+	stats.Increment("role_access_control", "allowed")
+}
+
+// writeError returns the error in the format of elasticsearch
+func writeError(ctx *fasthttp.RequestCtx, status int, errorType, reason string) {
+	cause := util.MapStr{
+		"type":   errorType,
+		"reason": reason,
+	}
+	ctx.Response.SetStatusCode(status)
+	ctx.Response.SetBody(util.MustToJSONBytes(util.MapStr{
+		"error": util.MapStr{
+			"root_cause": []util.MapStr{cause},
+			"type":       errorType,
+			"reason":     reason,
+		},
+		"status": status,
+	}))
+	ctx.SetContentType(util.ContentTypeJson)
+	ctx.Finished()
+}
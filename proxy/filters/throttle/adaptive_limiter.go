@@ -0,0 +1,366 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package throttle
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"infini.sh/framework/core/config"
+	"infini.sh/framework/core/global"
+	"infini.sh/framework/core/pipeline"
+	"infini.sh/framework/core/stats"
+	"infini.sh/framework/core/util"
+	"infini.sh/framework/lib/fasthttp"
+	"infini.sh/gateway/common"
+)
+
+const (
+	algorithmGradient = "gradient"
+	algorithmAIMD     = "aimd"
+)
+
+type AdaptiveConcurrencyLimiter struct {
+	Elasticsearch      string `config:"elasticsearch"` //limiters of the same cluster share the limit
+	Flow               string `config:"flow"`          //flow to process the request within the limit
+	ContinueAfterMatch bool   `config:"continue"`
+
+	Algorithm    string  `config:"algorithm"` //gradient or aimd
+	InitialLimit int     `config:"initial_limit"`
+	MinLimit     int     `config:"min_limit"`
+	MaxLimit     int     `config:"max_limit"`
+	BackoffRatio float64 `config:"backoff_ratio"` //multiplicative decrease on rejections
+
+	Gradient struct {
+		Tolerance  float64 `config:"tolerance"`   //latency growth tolerated before decreasing the limit
+		Smoothing  float64 `config:"smoothing"`   //weight of the new limit
+		LongWindow int     `config:"long_window"` //number of samples of the baseline latency
+	} `config:"gradient"`
+
+	AIMD struct {
+		Timeout string `config:"timeout"` //decrease the limit when the latency is over it
+	} `config:"aimd"`
+
+	Action  string `config:"action"`   //drop or queue
+	MaxWait string `config:"max_wait"` //max time to wait in the queue
+	Status  int    `config:"status"`
+	Message string `config:"message"`
+
+	flow    common.FilterFlow
+	limiter *adaptiveLimiter
+	maxWait time.Duration
+}
+
+func init() {
+	pipeline.RegisterFilterPluginWithConfigMetadata("adaptive_concurrency_limiter", pipeline.FilterConfigChecked(NewAdaptiveConcurrencyLimiter, pipeline.RequireFields("elasticsearch", "flow")), &AdaptiveConcurrencyLimiter{})
+}
+
+func NewAdaptiveConcurrencyLimiter(c *config.Config) (pipeline.Filter, error) {
+	runner := AdaptiveConcurrencyLimiter{
+		Algorithm:    algorithmGradient,
+		InitialLimit: 20,
+		MinLimit:     5,
+		MaxLimit:     1000,
+		BackoffRatio: 0.9,
+		Action:       "drop",
+		MaxWait:      "100ms",
+		Status:       429,
+		Message:      "Reach concurrency limit!",
+	}
+	runner.Gradient.Tolerance = 1.5
+	runner.Gradient.Smoothing = 0.2
+	runner.Gradient.LongWindow = 600
+	runner.AIMD.Timeout = "5s"
+
+	if err := c.Unpack(&runner); err != nil {
+		return nil, fmt.Errorf("failed to unpack the filter configuration : %s", err)
+	}
+
+	if runner.MinLimit < 1 {
+		runner.MinLimit = 1
+	}
+	if runner.MaxLimit < runner.MinLimit {
+		runner.MaxLimit = runner.MinLimit
+	}
+
+	var algorithm limitAlgorithm
+	switch runner.Algorithm {
+	case algorithmGradient:
+		algorithm = newGradientAlgorithm(runner.Gradient.Tolerance, runner.Gradient.Smoothing, runner.Gradient.LongWindow)
+	case algorithmAIMD:
+		algorithm = &aimdAlgorithm{timeout: util.GetDurationOrDefault(runner.AIMD.Timeout, 5*time.Second)}
+	default:
+		return nil, fmt.Errorf("invalid algorithm [%v], only support: %v, %v", runner.Algorithm, algorithmGradient, algorithmAIMD)
+	}
+
+	runner.maxWait = util.GetDurationOrDefault(runner.MaxWait, 100*time.Millisecond)
+	runner.flow = common.MustGetFlow(runner.Flow)
+	runner.limiter = getAdaptiveLimiter(runner.Elasticsearch, func() *adaptiveLimiter {
+		return newAdaptiveLimiter(algorithm, float64(runner.InitialLimit), float64(runner.MinLimit), float64(runner.MaxLimit), runner.BackoffRatio)
+	})
+
+	return &runner, nil
+}
+
+func (filter *AdaptiveConcurrencyLimiter) Name() string {
+	return "adaptive_concurrency_limiter"
+}
+
+func (filter *AdaptiveConcurrencyLimiter) Filter(ctx *fasthttp.RequestCtx) {
+	var maxWait time.Duration
+	if filter.Action == "queue" {
+		maxWait = filter.maxWait
+	}
+
+	if !filter.limiter.acquire(maxWait) {
+		stats.Increment("adaptive_limiter", filter.Elasticsearch+".rejected")
+		if global.Env().IsDebug {
+			log.Debugf("request [%v] throttled, concurrency limit of [%v]: %v", ctx.PhantomURI().String(), filter.Elasticsearch, filter.limiter.currentLimit())
+		}
+		ctx.SetStatusCode(filter.Status)
+		ctx.WriteString(filter.Message)
+		ctx.Finished()
+		return
+	}
+
+	start := time.Now()
+	rejected := false
+	defer func() {
+		filter.limiter.release(time.Since(start), rejected)
+	}()
+
+	ctx.Resume()
+	filter.flow.Process(ctx)
+	rejected = isRejectedResponse(&ctx.Response)
+	if !filter.ContinueAfterMatch {
+		ctx.Finished()
+	}
+}
+
+var rejectedExecution = []byte("es_rejected_execution_exception")
+
+// isRejectedResponse returns true if elasticsearch is overloaded
+func isRejectedResponse(res *fasthttp.Response) bool {
+	if res.StatusCode() == fasthttp.StatusTooManyRequests {
+		return true
+	}
+	if res.StatusCode() >= 500 {
+		return bytes.Contains(res.GetRawBody(), rejectedExecution)
+	}
+	return false
+}
+
+var adaptiveLimiters = map[string]*adaptiveLimiter{}
+var adaptiveLimitersLocker = sync.Mutex{}
+
+func getAdaptiveLimiter(key string, create func() *adaptiveLimiter) *adaptiveLimiter {
+	adaptiveLimitersLocker.Lock()
+	defer adaptiveLimitersLocker.Unlock()
+
+	if v, ok := adaptiveLimiters[key]; ok {
+		return v
+	}
+
+	l := create()
+	adaptiveLimiters[key] = l
+	stats.RegisterStats(fmt.Sprintf("adaptive_limiter.%v.limit", key), func() interface{} {
+		return l.currentLimit()
+	})
+	stats.RegisterStats(fmt.Sprintf("adaptive_limiter.%v.inflight", key), func() interface{} {
+		return l.currentInflight()
+	})
+	return l
+}
+
+type limitAlgorithm interface {
+	//update returns the new limit by the latency of a successful request
+	update(limit float64, rtt time.Duration, inflight int) float64
+}
+
+// gradientAlgorithm compares the latency with the long term baseline, the
+// limit decreases when the latency grows, and probes up by sqrt(limit) otherwise
+type gradientAlgorithm struct {
+	tolerance float64
+	smoothing float64
+	alpha     float64
+	longRtt   float64
+}
+
+func newGradientAlgorithm(tolerance, smoothing float64, window int) *gradientAlgorithm {
+	if tolerance < 1 {
+		tolerance = 1
+	}
+	if smoothing <= 0 || smoothing > 1 {
+		smoothing = 0.2
+	}
+	if window <= 0 {
+		window = 600
+	}
+	return &gradientAlgorithm{tolerance: tolerance, smoothing: smoothing, alpha: 2 / float64(window+1)}
+}
+
+func (g *gradientAlgorithm) update(limit float64, rtt time.Duration, inflight int) float64 {
+	short := float64(rtt)
+	if short <= 0 {
+		return limit
+	}
+	if g.longRtt == 0 {
+		g.longRtt = short
+	} else {
+		g.longRtt = g.longRtt*(1-g.alpha) + short*g.alpha
+	}
+
+	//the baseline is much higher than now, let it catch up
+	if g.longRtt/short > 2 {
+		g.longRtt = g.longRtt * 0.95
+	}
+
+	//don't grow the limit if it is not used
+	if float64(inflight) < limit/2 {
+		return limit
+	}
+
+	gradient := math.Max(0.5, math.Min(1, g.tolerance*g.longRtt/short))
+	newLimit := limit*gradient + math.Sqrt(limit)
+	return limit*(1-g.smoothing) + newLimit*g.smoothing
+}
+
+// aimdAlgorithm increases the limit by one, and backs off on slow requests
+type aimdAlgorithm struct {
+	timeout time.Duration
+}
+
+func (a *aimdAlgorithm) update(limit float64, rtt time.Duration, inflight int) float64 {
+	if rtt > a.timeout {
+		return limit * 0.9
+	}
+	if float64(inflight)*2 >= limit {
+		return limit + 1
+	}
+	return limit
+}
+
+// adaptiveLimiter tracks the in-flight requests, waiters are granted in FIFO order
+type adaptiveLimiter struct {
+	locker       sync.Mutex
+	algorithm    limitAlgorithm
+	limit        float64
+	minLimit     float64
+	maxLimit     float64
+	backoffRatio float64
+	inflight     int
+	waiters      *list.List
+}
+
+func newAdaptiveLimiter(algorithm limitAlgorithm, initial, min, max, backoffRatio float64) *adaptiveLimiter {
+	if backoffRatio <= 0 || backoffRatio >= 1 {
+		backoffRatio = 0.9
+	}
+	l := &adaptiveLimiter{
+		algorithm:    algorithm,
+		minLimit:     min,
+		maxLimit:     max,
+		backoffRatio: backoffRatio,
+		waiters:      list.New(),
+	}
+	l.limit = l.clamp(initial)
+	return l
+}
+
+func (l *adaptiveLimiter) clamp(limit float64) float64 {
+	return math.Max(l.minLimit, math.Min(l.maxLimit, limit))
+}
+
+// acquire takes a slot, or waits up to maxWait for a released one
+func (l *adaptiveLimiter) acquire(maxWait time.Duration) bool {
+	l.locker.Lock()
+	if l.inflight < int(l.limit) {
+		l.inflight++
+		l.locker.Unlock()
+		return true
+	}
+	if maxWait <= 0 {
+		l.locker.Unlock()
+		return false
+	}
+	ch := make(chan struct{})
+	elem := l.waiters.PushBack(ch)
+	l.locker.Unlock()
+
+	timer := util.AcquireTimer(maxWait)
+	defer util.ReleaseTimer(timer)
+
+	select {
+	case <-ch:
+		return true
+	case <-timer.C:
+		l.locker.Lock()
+		defer l.locker.Unlock()
+		select {
+		case <-ch:
+			//granted right before the timeout
+			return true
+		default:
+			l.waiters.Remove(elem)
+			return false
+		}
+	}
+}
+
+// release returns the slot and updates the limit by the result of the request
+func (l *adaptiveLimiter) release(rtt time.Duration, rejected bool) {
+	l.locker.Lock()
+	defer l.locker.Unlock()
+
+	if rejected {
+		l.limit = l.clamp(l.limit * l.backoffRatio)
+	} else {
+		l.limit = l.clamp(l.algorithm.update(l.limit, rtt, l.inflight))
+	}
+	l.inflight--
+
+	//hand over the free slots to the waiters
+	for l.inflight < int(l.limit) && l.waiters.Len() > 0 {
+		ch := l.waiters.Remove(l.waiters.Front()).(chan struct{})
+		l.inflight++
+		close(ch)
+	}
+}
+
+func (l *adaptiveLimiter) currentLimit() int {
+	l.locker.Lock()
+	defer l.locker.Unlock()
+	return int(l.limit)
+}
+
+func (l *adaptiveLimiter) currentInflight() int {
+	l.locker.Lock()
+	defer l.locker.Unlock()
+	return l.inflight
+}
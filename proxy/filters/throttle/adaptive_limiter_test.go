@@ -0,0 +1,93 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package throttle
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdaptiveLimiterBackoff(t *testing.T) {
+	l := newAdaptiveLimiter(&aimdAlgorithm{timeout: time.Second}, 10, 2, 20, 0.5)
+	for i := 0; i < 10; i++ {
+		assert.True(t, l.acquire(0))
+	}
+	assert.False(t, l.acquire(0))
+
+	l.release(10*time.Millisecond, true)
+	assert.Equal(t, 5, l.currentLimit())
+
+	//additive increase when the limit is used
+	l.release(10*time.Millisecond, false)
+	assert.Equal(t, 6, l.currentLimit())
+
+	for i := 0; i < 8; i++ {
+		l.release(10*time.Millisecond, true)
+	}
+	assert.Equal(t, 2, l.currentLimit())
+	assert.Equal(t, 0, l.currentInflight())
+}
+
+func TestAdaptiveLimiterQueue(t *testing.T) {
+	l := newAdaptiveLimiter(&aimdAlgorithm{timeout: time.Second}, 1, 1, 1, 0.9)
+	assert.True(t, l.acquire(0))
+
+	//timed out in the queue
+	assert.False(t, l.acquire(10*time.Millisecond))
+
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		assert.True(t, l.acquire(time.Second))
+	}()
+	time.Sleep(20 * time.Millisecond)
+	l.release(time.Millisecond, false)
+	wg.Wait()
+	assert.Equal(t, 1, l.currentInflight())
+}
+
+func TestGradientAlgorithm(t *testing.T) {
+	g := newGradientAlgorithm(1.5, 1, 10)
+	limit := 100.0
+
+	//stable latency probes up
+	for i := 0; i < 10; i++ {
+		limit = g.update(limit, 10*time.Millisecond, int(limit))
+	}
+	assert.True(t, limit > 100)
+
+	//latency grows
+	increased := limit
+	for i := 0; i < 5; i++ {
+		limit = g.update(limit, 100*time.Millisecond, int(limit))
+	}
+	assert.True(t, limit < increased)
+
+	//not used, keep the limit
+	assert.Equal(t, limit, g.update(limit, 10*time.Millisecond, 1))
+}
@@ -0,0 +1,246 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package throttle
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/go-redis/redis/v8"
+	"infini.sh/framework/core/rate"
+	"infini.sh/framework/core/stats"
+	"infini.sh/framework/core/util"
+)
+
+const (
+	onFailureLocal = "local"
+	onFailureAllow = "allow"
+	onFailureDeny  = "deny"
+)
+
+// DistributedConfig shares the limits across gateway instances through redis
+type DistributedConfig struct {
+	Enabled   bool   `config:"enabled"`
+	Namespace string `config:"namespace"` //limiters with the same namespace share the counters
+	KeyPrefix string `config:"key_prefix"`
+	Timeout   string `config:"timeout"`
+
+	Redis struct {
+		Host     string `config:"host"`
+		Port     int    `config:"port"`
+		Password string `config:"password"`
+		Db       int    `config:"db"`
+	} `config:"redis"`
+
+	OnFailure     string  `config:"on_failure"`     //local, allow or deny
+	FallbackRatio float64 `config:"fallback_ratio"` //ratio of the limits for the local fallback, eg: 1/N of N gateways
+	RetryInterval string  `config:"retry_interval"` //how long to stay on the fallback before trying redis again
+}
+
+var defaultDistributedConfig = DistributedConfig{
+	Namespace:     "default",
+	KeyPrefix:     "gateway:rate_limit:",
+	Timeout:       "50ms",
+	OnFailure:     onFailureLocal,
+	FallbackRatio: 1,
+	RetryInterval: "5s",
+}
+
+// gcraScript implements the generic cell rate algorithm, only the theoretical
+// arrival time is stored, the time of redis is used to avoid clock skew between gateways.
+// the emission is in nanoseconds and may be fractional, such as the limits of
+// the bytes, the arrival time is stored as "<second>:<nanoseconds to the second>"
+// to keep the precision of the lua numbers
+var gcraScript = redis.NewScript(`
+pcall(redis.replicate_commands)
+local emission = tonumber(ARGV[1])
+local tolerance = tonumber(ARGV[2])
+local cost = tonumber(ARGV[3])
+local t = redis.call("TIME")
+local sec = tonumber(t[1])
+local now = tonumber(t[2]) * 1000
+local tat = now
+local v = redis.call("GET", KEYS[1])
+if v then
+  local base, offset = string.match(v, "^(%d+):(.+)$")
+  if base and tonumber(offset) then
+    local stored = tonumber(offset) + (tonumber(base) - sec) * 1000000000
+    if stored > now then
+      tat = stored
+    end
+  end
+end
+local new_tat = tat + emission * cost
+if new_tat - tolerance > now then
+  return 0
+end
+redis.call("SET", KEYS[1], sec .. ":" .. string.format("%.17g", new_tat), "PX", math.ceil((new_tat - now) / 1000000) + 1)
+return 1
+`)
+
+type limiterBackend interface {
+	allowN(key string, emission, tolerance float64, n int) (bool, error)
+}
+
+type redisBackend struct {
+	client  *redis.Client
+	timeout time.Duration
+}
+
+func (b *redisBackend) allowN(key string, emission, tolerance float64, n int) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), b.timeout)
+	defer cancel()
+	v, err := gcraScript.Run(ctx, b.client, []string{key}, strconv.FormatFloat(emission, 'g', -1, 64), strconv.FormatFloat(tolerance, 'g', -1, 64), n).Int()
+	if err != nil {
+		return false, err
+	}
+	return v == 1, nil
+}
+
+var redisBackends = map[string]*redisBackend{}
+var redisBackendsLocker = sync.Mutex{}
+
+func getRedisBackend(cfg *DistributedConfig) *redisBackend {
+	addr := fmt.Sprintf("%s:%v", cfg.Redis.Host, cfg.Redis.Port)
+	key := fmt.Sprintf("%v/%v", addr, cfg.Redis.Db)
+
+	redisBackendsLocker.Lock()
+	defer redisBackendsLocker.Unlock()
+
+	if b, ok := redisBackends[key]; ok {
+		return b
+	}
+
+	timeout := util.GetDurationOrDefault(cfg.Timeout, 50*time.Millisecond)
+	b := &redisBackend{
+		client: redis.NewClient(&redis.Options{
+			Addr:         addr,
+			Password:     cfg.Redis.Password,
+			DB:           cfg.Redis.Db,
+			DialTimeout:  time.Second,
+			ReadTimeout:  timeout,
+			WriteTimeout: timeout,
+		}),
+		timeout: timeout,
+	}
+	redisBackends[key] = b
+	return b
+}
+
+type distributedLimiter struct {
+	config        *DistributedConfig
+	uuid          string
+	backend       limiterBackend
+	retryInterval time.Duration
+
+	locker         sync.RWMutex
+	unavailableTil time.Time
+}
+
+func newDistributedLimiter(cfg *DistributedConfig, uuid string) *distributedLimiter {
+	if cfg.Redis.Host == "" {
+		cfg.Redis.Host = "localhost"
+	}
+	if cfg.Redis.Port <= 0 {
+		cfg.Redis.Port = 6379
+	}
+	if cfg.FallbackRatio <= 0 || cfg.FallbackRatio > 1 {
+		cfg.FallbackRatio = 1
+	}
+	return &distributedLimiter{
+		config:        cfg,
+		uuid:          uuid,
+		backend:       getRedisBackend(cfg),
+		retryInterval: util.GetDurationOrDefault(cfg.RetryInterval, 5*time.Second),
+	}
+}
+
+// gcraParams returns the emission interval of each token and the burst
+// tolerance in nanoseconds, they are not rounded, so the high limits such as
+// the bytes per second are kept
+func gcraParams(max, burst int, interval time.Duration) (float64, float64) {
+	if burst <= 0 {
+		burst = max
+	}
+	emission := float64(interval) / float64(max)
+	return emission, emission * float64(burst)
+}
+
+func (l *distributedLimiter) key(tokenType, kind, token string) string {
+	return fmt.Sprintf("%v%v:%v:%v:%v", l.config.KeyPrefix, l.config.Namespace, tokenType, kind, token)
+}
+
+func (l *distributedLimiter) available(now time.Time) bool {
+	l.locker.RLock()
+	defer l.locker.RUnlock()
+	return now.After(l.unavailableTil)
+}
+
+func (l *distributedLimiter) markUnavailable(now time.Time, err error) {
+	l.locker.Lock()
+	l.unavailableTil = now.Add(l.retryInterval)
+	l.locker.Unlock()
+	stats.Increment("rate_limiter", "distributed.errors")
+	if rate.GetRateLimiterPerSecond("distributed_limiter", l.uuid, 1).Allow() {
+		log.Warnf("distributed rate limiter is not available, fallback to [%v] for %v, %v", l.config.OnFailure, l.retryInterval, err)
+	}
+}
+
+// allowN checks the limit in redis, and falls back when redis is not available
+func (l *distributedLimiter) allowN(tokenType, kind, token string, max, burst int, interval time.Duration, n int) bool {
+	now := time.Now()
+	if l.available(now) {
+		emission, tolerance := gcraParams(max, burst, interval)
+		ok, err := l.backend.allowN(l.key(tokenType, kind, token), emission, tolerance, n)
+		if err == nil {
+			return ok
+		}
+		l.markUnavailable(now, err)
+	}
+
+	stats.Increment("rate_limiter", "distributed.fallback")
+	switch l.config.OnFailure {
+	case onFailureAllow:
+		return true
+	case onFailureDeny:
+		return false
+	default:
+		localMax := int(float64(max) * l.config.FallbackRatio)
+		if localMax < 1 {
+			localMax = 1
+		}
+		localBurst := burst
+		if burst > 0 {
+			localBurst = int(float64(burst) * l.config.FallbackRatio)
+			if localBurst < 1 {
+				localBurst = 1
+			}
+		}
+		return rate.GetRateLimiter(l.uuid+"_fallback_"+kind, token, localMax, localBurst, interval).AllowN(now, n)
+	}
+}
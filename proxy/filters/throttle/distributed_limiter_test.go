@@ -0,0 +1,82 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package throttle
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeBackend struct {
+	calls int
+	err   error
+}
+
+func (b *fakeBackend) allowN(key string, emission, tolerance float64, n int) (bool, error) {
+	b.calls++
+	return b.err == nil, b.err
+}
+
+func TestGCRAParams(t *testing.T) {
+	emission, tolerance := gcraParams(100, 0, time.Second)
+	assert.Equal(t, float64(10*time.Millisecond), emission)
+	assert.Equal(t, float64(time.Second), tolerance)
+
+	emission, tolerance = gcraParams(10, 20, time.Second)
+	assert.Equal(t, float64(100*time.Millisecond), emission)
+	assert.Equal(t, float64(2*time.Second), tolerance)
+
+	//limits above 1e9/s are not rounded to a whole nanosecond
+	emission, tolerance = gcraParams(4000000000, 0, time.Second)
+	assert.Equal(t, 0.25, emission)
+	assert.Equal(t, float64(time.Second), tolerance)
+
+	emission, _ = gcraParams(3, 0, time.Second)
+	assert.InDelta(t, 333333333.33, emission, 0.01)
+}
+
+func TestDistributedLimiterFallback(t *testing.T) {
+	cfg := defaultDistributedConfig
+	cfg.OnFailure = onFailureDeny
+	backend := &fakeBackend{err: errors.New("connection refused")}
+	l := &distributedLimiter{config: &cfg, uuid: "test", backend: backend, retryInterval: time.Minute}
+
+	assert.Equal(t, "gateway:rate_limit:default:user:limit_requests:medcl", l.key("user", "limit_requests", "medcl"))
+
+	assert.False(t, l.allowN("user", "limit_requests", "medcl", 10, 10, time.Second, 1))
+	assert.Equal(t, 1, backend.calls)
+
+	//stay on the fallback within the retry interval
+	cfg.OnFailure = onFailureAllow
+	assert.True(t, l.allowN("user", "limit_requests", "medcl", 10, 10, time.Second, 1))
+	assert.Equal(t, 1, backend.calls)
+
+	backend.err = nil
+	l.unavailableTil = time.Time{}
+	assert.True(t, l.allowN("user", "limit_requests", "medcl", 10, 10, time.Second, 1))
+	assert.Equal(t, 2, backend.calls)
+}
@@ -0,0 +1,338 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package throttle
+
+import (
+	"container/list"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"infini.sh/framework/core/config"
+	"infini.sh/framework/core/global"
+	"infini.sh/framework/core/pipeline"
+	"infini.sh/framework/core/stats"
+	"infini.sh/framework/core/util"
+	"infini.sh/framework/lib/fasthttp"
+	"infini.sh/gateway/common"
+)
+
+const (
+	fairQueueRejectQueueFull = "queue_full"
+	fairQueueRejectTimeout   = "timeout"
+)
+
+type WeightedFairQueue struct {
+	Scheduler          string         `config:"scheduler"` //filters with the same scheduler share the slots
+	Flow               string         `config:"flow"`      //flow to process the request within the slot
+	ContinueAfterMatch bool           `config:"continue"`
+	MaxConcurrency     int            `config:"max_concurrency"`
+	KeyType            string         `config:"key_type"` //user, api_key or context
+	Context            []string       `config:"context"`
+	DefaultClass       string         `config:"default_class"` //class of the requests without the key
+	Weights            map[string]int `config:"weights"`
+	DefaultWeight      int            `config:"default_weight"`
+	MaxQueueSize       int            `config:"max_queue_size"` //max waiting requests of each class
+	QueueTimeout       string         `config:"queue_timeout"`
+	Status             int            `config:"status"`
+	Message            string         `config:"message"`
+	WarnMessage        bool           `config:"log_warn_message"`
+
+	flow         common.FilterFlow
+	scheduler    *fairScheduler
+	queueTimeout time.Duration
+}
+
+func init() {
+	pipeline.RegisterFilterPluginWithConfigMetadata("weighted_fair_queue", pipeline.FilterConfigChecked(NewWeightedFairQueue, pipeline.RequireFields("flow", "max_concurrency")), &WeightedFairQueue{})
+}
+
+func NewWeightedFairQueue(c *config.Config) (pipeline.Filter, error) {
+	runner := WeightedFairQueue{
+		Scheduler:     "default",
+		KeyType:       quotaKeyUser,
+		DefaultClass:  "default",
+		DefaultWeight: 1,
+		MaxQueueSize:  100,
+		QueueTimeout:  "1s",
+		Status:        429,
+		Message:       "Too many queued requests!",
+	}
+	if err := c.Unpack(&runner); err != nil {
+		return nil, fmt.Errorf("failed to unpack the filter configuration : %s", err)
+	}
+
+	switch runner.KeyType {
+	case quotaKeyUser, quotaKeyAPIKey:
+	case quotaKeyContext:
+		if len(runner.Context) == 0 {
+			return nil, fmt.Errorf("context is required for key_type [%v]", quotaKeyContext)
+		}
+	default:
+		return nil, fmt.Errorf("invalid key_type [%v], only support: %v, %v, %v", runner.KeyType, quotaKeyUser, quotaKeyAPIKey, quotaKeyContext)
+	}
+
+	if runner.MaxConcurrency <= 0 {
+		return nil, fmt.Errorf("max_concurrency should be greater than 0")
+	}
+	if runner.DefaultWeight <= 0 {
+		runner.DefaultWeight = 1
+	}
+	if runner.MaxQueueSize < 0 {
+		runner.MaxQueueSize = 0
+	}
+
+	runner.queueTimeout = util.GetDurationOrDefault(runner.QueueTimeout, time.Second)
+	runner.flow = common.MustGetFlow(runner.Flow)
+	runner.scheduler = getFairScheduler(runner.Scheduler, runner.MaxConcurrency)
+
+	return &runner, nil
+}
+
+func (filter *WeightedFairQueue) Name() string {
+	return "weighted_fair_queue"
+}
+
+// getClass returns the tenant or the priority of the request
+func (filter *WeightedFairQueue) getClass(ctx *fasthttp.RequestCtx) string {
+	var class string
+	switch filter.KeyType {
+	case quotaKeyUser:
+		if exists, user, _ := ctx.Request.ParseBasicAuth(); exists {
+			class = string(user)
+		}
+	case quotaKeyAPIKey:
+		if exists, apiID, _ := ctx.ParseAPIKey(); exists {
+			class = string(apiID)
+		}
+	case quotaKeyContext:
+		data := []string{}
+		for _, v := range filter.Context {
+			x, err := ctx.GetValue(v)
+			if err != nil {
+				continue
+			}
+			data = append(data, util.ToString(x))
+		}
+		class = util.JoinArray(data, ",")
+	}
+	if class == "" {
+		return filter.DefaultClass
+	}
+	return class
+}
+
+func (filter *WeightedFairQueue) Filter(ctx *fasthttp.RequestCtx) {
+	class := filter.getClass(ctx)
+	weight := filter.DefaultWeight
+	if v, ok := filter.Weights[class]; ok && v > 0 {
+		weight = v
+	}
+
+	ok, reason := filter.scheduler.acquire(class, float64(weight), filter.MaxQueueSize, filter.queueTimeout)
+	if !ok {
+		stats.Increment("fair_queue", filter.Scheduler+".rejected."+reason)
+		if filter.WarnMessage {
+			log.Warnf("request [%v] of class [%v] rejected by fair queue [%v]: %v", ctx.PhantomURI().String(), class, filter.Scheduler, reason)
+		}
+		ctx.SetStatusCode(filter.Status)
+		ctx.WriteString(filter.Message)
+		ctx.Finished()
+		return
+	}
+	defer filter.scheduler.release()
+
+	if global.Env().IsDebug {
+		log.Tracef("request [%v] of class [%v] dispatched by fair queue [%v]", ctx.PhantomURI().String(), class, filter.Scheduler)
+	}
+
+	ctx.Resume()
+	filter.flow.Process(ctx)
+	if !filter.ContinueAfterMatch {
+		ctx.Finished()
+	}
+}
+
+var fairSchedulers = map[string]*fairScheduler{}
+var fairSchedulersLocker = sync.Mutex{}
+
+func getFairScheduler(name string, maxConcurrency int) *fairScheduler {
+	fairSchedulersLocker.Lock()
+	defer fairSchedulersLocker.Unlock()
+
+	if v, ok := fairSchedulers[name]; ok {
+		if v.maxConcurrency != maxConcurrency {
+			log.Warnf("fair queue [%v] already exists with max_concurrency: %v, ignore: %v", name, v.maxConcurrency, maxConcurrency)
+		}
+		return v
+	}
+
+	s := newFairScheduler(maxConcurrency)
+	fairSchedulers[name] = s
+	stats.RegisterStats(fmt.Sprintf("fair_queue.%v.inflight", name), func() interface{} {
+		return s.currentInflight()
+	})
+	stats.RegisterStats(fmt.Sprintf("fair_queue.%v.queued", name), func() interface{} {
+		return s.currentQueued()
+	})
+	return s
+}
+
+type fairClass struct {
+	lastFinish float64
+	queue      *list.List
+}
+
+type fairWaiter struct {
+	ch     chan struct{}
+	finish float64
+}
+
+// fairScheduler dispatches the waiting requests by the virtual finish time,
+// each request of a class advances the finish time of the class by 1/weight,
+// so the classes get the slots in proportion to their weights when saturated
+type fairScheduler struct {
+	locker         sync.Mutex
+	maxConcurrency int
+	inflight       int
+	queued         int
+	vtime          float64
+	classes        map[string]*fairClass
+}
+
+func newFairScheduler(maxConcurrency int) *fairScheduler {
+	return &fairScheduler{
+		maxConcurrency: maxConcurrency,
+		classes:        map[string]*fairClass{},
+	}
+}
+
+// acquire takes a slot, or waits in the queue of the class up to the timeout
+func (s *fairScheduler) acquire(class string, weight float64, maxQueueSize int, timeout time.Duration) (bool, string) {
+	s.locker.Lock()
+	if s.inflight < s.maxConcurrency && s.queued == 0 {
+		s.inflight++
+		s.locker.Unlock()
+		return true, ""
+	}
+
+	c, ok := s.classes[class]
+	if !ok {
+		c = &fairClass{queue: list.New()}
+		s.classes[class] = c
+	}
+	if c.queue.Len() >= maxQueueSize || timeout <= 0 {
+		s.removeIfIdle(class, c)
+		s.locker.Unlock()
+		return false, fairQueueRejectQueueFull
+	}
+
+	step := 1 / weight
+	w := &fairWaiter{ch: make(chan struct{}), finish: math.Max(s.vtime, c.lastFinish) + step}
+	c.lastFinish = w.finish
+	elem := c.queue.PushBack(w)
+	s.queued++
+	s.locker.Unlock()
+
+	timer := util.AcquireTimer(timeout)
+	defer util.ReleaseTimer(timer)
+
+	select {
+	case <-w.ch:
+		return true, ""
+	case <-timer.C:
+		s.locker.Lock()
+		defer s.locker.Unlock()
+		select {
+		case <-w.ch:
+			//dispatched right before the timeout
+			return true, ""
+		default:
+		}
+		if elem == c.queue.Back() {
+			//give back the share of the last waiter
+			c.lastFinish -= step
+		}
+		c.queue.Remove(elem)
+		s.queued--
+		s.removeIfIdle(class, c)
+		return false, fairQueueRejectTimeout
+	}
+}
+
+// removeIfIdle forgets the class once its share is used up, so the map
+// doesn't grow with the tenants
+func (s *fairScheduler) removeIfIdle(name string, c *fairClass) {
+	if c.queue.Len() == 0 && c.lastFinish <= s.vtime {
+		delete(s.classes, name)
+	}
+}
+
+// release returns the slot and dispatches the waiter with the smallest finish time
+func (s *fairScheduler) release() {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	s.inflight--
+	for s.inflight < s.maxConcurrency && s.queued > 0 {
+		var next *fairClass
+		var nextName string
+		for name, c := range s.classes {
+			if c.queue.Len() == 0 {
+				continue
+			}
+			if next == nil || c.queue.Front().Value.(*fairWaiter).finish < next.queue.Front().Value.(*fairWaiter).finish {
+				next = c
+				nextName = name
+			}
+		}
+		w := next.queue.Remove(next.queue.Front()).(*fairWaiter)
+		s.queued--
+		s.inflight++
+		if w.finish > s.vtime {
+			s.vtime = w.finish
+		}
+		close(w.ch)
+		s.removeIfIdle(nextName, next)
+	}
+
+	//no contention, the history of the shares is not needed anymore
+	if s.queued == 0 && len(s.classes) > 0 {
+		s.classes = map[string]*fairClass{}
+	}
+}
+
+func (s *fairScheduler) currentInflight() int {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	return s.inflight
+}
+
+func (s *fairScheduler) currentQueued() int {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	return s.queued
+}
@@ -0,0 +1,113 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package throttle
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// enqueue adds a waiter and waits until it is queued, to keep the order
+func enqueue(t *testing.T, s *fairScheduler, class string, weight float64, wg *sync.WaitGroup, order chan string) {
+	queued := s.currentQueued()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ok, _ := s.acquire(class, weight, 100, 5*time.Second)
+		assert.True(t, ok)
+		order <- class
+	}()
+	for s.currentQueued() == queued {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestFairSchedulerWeightedShare(t *testing.T) {
+	s := newFairScheduler(1)
+	ok, _ := s.acquire("busy", 1, 100, 0)
+	assert.True(t, ok)
+
+	wg := sync.WaitGroup{}
+	order := make(chan string, 16)
+	//the noisy tenant queued first
+	for i := 0; i < 8; i++ {
+		enqueue(t, s, "noisy", 1, &wg, order)
+	}
+	for i := 0; i < 6; i++ {
+		enqueue(t, s, "gold", 3, &wg, order)
+	}
+
+	dispatched := []string{}
+	for i := 0; i < 8; i++ {
+		s.release()
+		dispatched = append(dispatched, <-order)
+	}
+
+	gold := 0
+	for _, v := range dispatched {
+		if v == "gold" {
+			gold++
+		}
+	}
+	assert.Equal(t, 6, gold, "gold gets 3 times the share of noisy: %v", dispatched)
+
+	for i := 0; i < 6; i++ {
+		s.release()
+		<-order
+	}
+	wg.Wait()
+	s.release()
+	assert.Equal(t, 0, s.currentInflight())
+	assert.Equal(t, 0, len(s.classes))
+}
+
+func TestFairSchedulerQueueLimits(t *testing.T) {
+	s := newFairScheduler(1)
+	ok, _ := s.acquire("a", 1, 1, 0)
+	assert.True(t, ok)
+
+	//no waiting when the queue is full
+	ok, reason := s.acquire("a", 1, 0, time.Second)
+	assert.False(t, ok)
+	assert.Equal(t, fairQueueRejectQueueFull, reason)
+
+	start := time.Now()
+	ok, reason = s.acquire("a", 1, 1, 20*time.Millisecond)
+	assert.False(t, ok)
+	assert.Equal(t, fairQueueRejectTimeout, reason)
+	assert.True(t, time.Since(start) >= 20*time.Millisecond)
+	assert.Equal(t, 0, s.currentQueued())
+
+	//the slot is handed over to the waiter
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		s.release()
+	}()
+	ok, _ = s.acquire("b", 1, 1, time.Second)
+	assert.True(t, ok)
+	assert.Equal(t, 1, s.currentInflight())
+}
@@ -25,13 +25,11 @@ package throttle
 
 import (
 	"fmt"
-	"github.com/cihub/seelog"
 	"infini.sh/framework/core/config"
-	"infini.sh/framework/core/elastic"
-	"infini.sh/framework/core/global"
 	"infini.sh/framework/core/pipeline"
 	"infini.sh/framework/core/rate"
 	"infini.sh/framework/lib/fasthttp"
+	"infini.sh/gateway/common"
 	"time"
 )
 
@@ -46,16 +44,7 @@ func (filter *ElasticsearchHealthCheckFilter) Name() string {
 
 func (filter *ElasticsearchHealthCheckFilter) Filter(ctx *fasthttp.RequestCtx) {
 	if rate.GetRateLimiter("cluster_check_health", filter.Elasticsearch, 1, 1, time.Second*time.Duration(filter.Interval)).Allow() {
-		result, _ := elastic.GetClient(filter.Elasticsearch).ClusterHealth(nil)
-		if global.Env().IsDebug {
-			seelog.Trace(filter.Elasticsearch, result)
-		}
-		if result.StatusCode == 200 || result.StatusCode == 403 {
-			cfg := elastic.GetMetadata(filter.Elasticsearch)
-			if cfg != nil {
-				cfg.ReportSuccess()
-			}
-		}
+		common.CheckElasticsearchHealth(filter.Elasticsearch)
 	}
 }
 
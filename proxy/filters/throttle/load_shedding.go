@@ -0,0 +1,159 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package throttle
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"infini.sh/framework/core/config"
+	"infini.sh/framework/core/global"
+	"infini.sh/framework/core/pipeline"
+	"infini.sh/framework/core/stats"
+	"infini.sh/framework/core/util"
+	"infini.sh/framework/lib/fasthttp"
+	"infini.sh/gateway/common/pressure"
+)
+
+type LoadShedding struct {
+	Elasticsearch   string          `config:"elasticsearch"`
+	Collector       pressure.Config `config:"collector"`
+	DelayThreshold  float64         `config:"delay_threshold"`  //pressure to start delaying the requests
+	RejectThreshold float64         `config:"reject_threshold"` //pressure to start rejecting the requests
+	Delay           string          `config:"delay"`
+
+	Priority struct {
+		Context   string   `config:"context"`   //context value of the priority, eg: _ctx.request.header.X-Priority
+		Protected []string `config:"protected"` //priorities never shed
+	} `config:"priority"`
+
+	Status      int    `config:"status"`
+	Message     string `config:"message"`
+	RetryAfter  int    `config:"retry_after"` //seconds of the Retry-After header
+	WarnMessage bool   `config:"log_warn_message"`
+
+	delay time.Duration
+}
+
+func init() {
+	pipeline.RegisterFilterPluginWithConfigMetadata("load_shedding", pipeline.FilterConfigChecked(NewLoadShedding, pipeline.RequireFields("elasticsearch")), &LoadShedding{})
+}
+
+func NewLoadShedding(c *config.Config) (pipeline.Filter, error) {
+	runner := LoadShedding{
+		Collector:       pressure.DefaultConfig(),
+		DelayThreshold:  0.8,
+		RejectThreshold: 1,
+		Delay:           "200ms",
+		Status:          429,
+		Message:         "Elasticsearch is overloaded, please retry later!",
+		RetryAfter:      1,
+	}
+	if err := c.Unpack(&runner); err != nil {
+		return nil, fmt.Errorf("failed to unpack the filter configuration : %s", err)
+	}
+
+	if runner.RejectThreshold <= 0 {
+		runner.RejectThreshold = 1
+	}
+	if runner.DelayThreshold <= 0 || runner.DelayThreshold > runner.RejectThreshold {
+		runner.DelayThreshold = runner.RejectThreshold
+	}
+	runner.delay = util.GetDurationOrDefault(runner.Delay, 200*time.Millisecond)
+
+	pressure.Watch(runner.Elasticsearch, runner.Collector)
+
+	return &runner, nil
+}
+
+func (filter *LoadShedding) Name() string {
+	return "load_shedding"
+}
+
+var searchPoolPaths = [][]byte{[]byte("_search"), []byte("_msearch"), []byte("_count"), []byte("_mget"), []byte("_field_caps")}
+
+// getPool returns the thread pool which serves the request
+func getPool(req *fasthttp.Request) string {
+	method := req.Header.Method()
+	if util.CompareStringAndBytes(method, fasthttp.MethodGet) || util.CompareStringAndBytes(method, fasthttp.MethodHead) {
+		return pressure.PoolSearch
+	}
+	path := req.PhantomURI().Path()
+	for _, v := range searchPoolPaths {
+		if bytes.Contains(path, v) {
+			return pressure.PoolSearch
+		}
+	}
+	return pressure.PoolWrite
+}
+
+func (filter *LoadShedding) isProtected(ctx *fasthttp.RequestCtx) bool {
+	if filter.Priority.Context == "" || len(filter.Priority.Protected) == 0 {
+		return false
+	}
+	v, err := ctx.GetValue(filter.Priority.Context)
+	if err != nil {
+		return false
+	}
+	priority := util.ToString(v)
+	for _, x := range filter.Priority.Protected {
+		if x == priority {
+			return true
+		}
+	}
+	return false
+}
+
+func (filter *LoadShedding) Filter(ctx *fasthttp.RequestCtx) {
+	pool := getPool(&ctx.Request)
+	current := pressure.GetClusterPressure(filter.Elasticsearch, pool)
+	if current < filter.DelayThreshold || filter.isProtected(ctx) {
+		return
+	}
+
+	if current < filter.RejectThreshold {
+		stats.Increment("load_shedding", filter.Elasticsearch+"."+pool+".delayed")
+		time.Sleep(filter.delay)
+		current = pressure.GetClusterPressure(filter.Elasticsearch, pool)
+		if current < filter.RejectThreshold {
+			return
+		}
+	}
+
+	stats.Increment("load_shedding", filter.Elasticsearch+"."+pool+".rejected")
+	if filter.WarnMessage {
+		log.Warnf("request [%v] shed, %v pressure of [%v]: %.2f", ctx.PhantomURI().String(), pool, filter.Elasticsearch, current)
+	} else if global.Env().IsDebug {
+		log.Debugf("request [%v] shed, %v pressure of [%v]: %.2f", ctx.PhantomURI().String(), pool, filter.Elasticsearch, current)
+	}
+
+	if filter.RetryAfter > 0 {
+		ctx.Response.Header.Set("Retry-After", fmt.Sprintf("%v", filter.RetryAfter))
+	}
+	ctx.SetStatusCode(filter.Status)
+	ctx.WriteString(filter.Message)
+	ctx.Finished()
+}
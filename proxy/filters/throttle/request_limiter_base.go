@@ -33,6 +33,7 @@ import (
 	"infini.sh/framework/core/rate"
 	"infini.sh/framework/core/util"
 	"infini.sh/framework/lib/fasthttp"
+	"infini.sh/gateway/common"
 	"time"
 )
 
@@ -51,8 +52,13 @@ type GenericLimiter struct {
 	WarnMessage    bool   `config:"log_warn_message"`
 	RetriedMessage string `config:"failed_retry_message"`
 
+	Distributed DistributedConfig `config:"distributed"`
+
+	ChargeByQueryCost bool `config:"charge_by_query_cost"` //charge the estimated query cost instead of one hit per request
+
 	interval       time.Duration
 	retryDeplyInMs time.Duration
+	distributed    *distributedLimiter
 }
 
 var genericLimiter = GenericLimiter{
@@ -67,16 +73,48 @@ var genericLimiter = GenericLimiter{
 	Status:         429,
 	Message:        "Reach request limit!",
 	RetriedMessage: "Retried but still beyond request limit!",
+	Distributed:    defaultDistributedConfig,
 }
 
 func (filter *GenericLimiter) init() {
 	filter.uuid = util.GetUUID()
 	filter.retryDeplyInMs = time.Duration(filter.RetryDelayInMs) * time.Millisecond
 	filter.interval = util.GetDurationOrDefault(filter.Interval, 1*time.Second)
+	if filter.Distributed.Enabled {
+		filter.distributed = newDistributedLimiter(&filter.Distributed, filter.uuid)
+	}
+}
+
+// allowN checks the limit locally, or across the gateways if distributed limiting is enabled
+func (filter *GenericLimiter) allowN(tokenType, kind, token string, max, burst, n int) bool {
+	if filter.distributed != nil {
+		return filter.distributed.allowN(tokenType, kind, token, max, burst, filter.interval, n)
+	}
+	return rate.GetRateLimiter(filter.uuid+"_"+kind, token, max, burst, filter.interval).AllowN(time.Now(), n)
 }
 
 func (filter *GenericLimiter) internalProcess(tokenType, token string, ctx *fasthttp.RequestCtx) {
-	filter.internalProcessWithValues(tokenType, token, ctx, 1, ctx.Request.GetRequestLength())
+	filter.internalProcessWithValues(tokenType, token, ctx, filter.getHits(ctx), ctx.Request.GetRequestLength())
+}
+
+// getHits returns the cost estimated by query_cost_estimation if charged by
+// query cost, the cost is capped to the burst, or the request would never pass
+func (filter *GenericLimiter) getHits(ctx *fasthttp.RequestCtx) int {
+	if !filter.ChargeByQueryCost {
+		return 1
+	}
+	cost, ok := ctx.Get(common.QUERYCOST).(int)
+	if !ok || cost < 1 {
+		return 1
+	}
+	limit := filter.BurstRequests
+	if limit <= 0 {
+		limit = filter.MaxRequests
+	}
+	if limit > 0 && cost > limit {
+		return limit
+	}
+	return cost
 }
 
 func (filter *GenericLimiter) internalProcessWithValues(tokenType, token string, ctx *fasthttp.RequestCtx, hits, bytes int) {
@@ -90,11 +128,11 @@ func (filter *GenericLimiter) internalProcessWithValues(tokenType, token string,
 	RetryRateLimit:
 		hitLimit := false
 		var limitType string
-		if filter.MaxRequests > 0 && !rate.GetRateLimiter(filter.uuid+"_limit_requests", token, int(filter.MaxRequests), int(filter.BurstRequests), filter.interval).AllowN(time.Now(), hits) {
+		if filter.MaxRequests > 0 && !filter.allowN(tokenType, "limit_requests", token, filter.MaxRequests, filter.BurstRequests, hits) {
 			limitType = fmt.Sprintf(">requests: %v/%v", filter.MaxRequests, filter.interval.String())
 			hitLimit = true
 		} else {
-			if filter.MaxBytes > 0 && !rate.GetRateLimiter(filter.uuid+"_limit_bytes", token, int(filter.MaxBytes), int(filter.BurstBytes), filter.interval).AllowN(time.Now(), bytes) {
+			if filter.MaxBytes > 0 && !filter.allowN(tokenType, "limit_bytes", token, filter.MaxBytes, filter.BurstBytes, bytes) {
 				limitType = fmt.Sprintf(">bytes: %v/%v", filter.MaxBytes, filter.interval.String())
 				hitLimit = true
 			}
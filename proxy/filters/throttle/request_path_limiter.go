@@ -31,14 +31,19 @@ import (
 	"infini.sh/framework/core/global"
 	"infini.sh/framework/core/pipeline"
 	"infini.sh/framework/core/rate"
+	"infini.sh/framework/core/util"
 	"infini.sh/framework/lib/fasthttp"
 	"regexp"
+	"time"
 )
 
 type RequestPathLimitFilter struct {
 	WarnMessage bool          `config:"log_warn_message"`
 	Message     string        `config:"message"`
 	Rules       []*MatchRules `config:"rules"`
+
+	Distributed DistributedConfig `config:"distributed"`
+	distributed *distributedLimiter
 }
 
 func init() {
@@ -48,7 +53,8 @@ func init() {
 func NewRequestPathLimitFilter(c *config.Config) (pipeline.Filter, error) {
 
 	runner := RequestPathLimitFilter{
-		Message: "Reach request limit!",
+		Message:     "Reach request limit!",
+		Distributed: defaultDistributedConfig,
 	}
 
 	if err := c.Unpack(&runner); err != nil {
@@ -61,6 +67,10 @@ func NewRequestPathLimitFilter(c *config.Config) (pipeline.Filter, error) {
 		}
 	}
 
+	if runner.Distributed.Enabled {
+		runner.distributed = newDistributedLimiter(&runner.Distributed, util.GetUUID())
+	}
+
 	return &runner, nil
 }
 
@@ -68,6 +78,13 @@ func (filter *RequestPathLimitFilter) Name() string {
 	return "request_path_limiter"
 }
 
+func (filter *RequestPathLimitFilter) allow(rule *MatchRules, item string) bool {
+	if filter.distributed != nil {
+		return filter.distributed.allowN("path", rule.Pattern, item, int(rule.MaxQPS), int(rule.MaxQPS), time.Second, 1)
+	}
+	return rate.GetRateLimiterPerSecond(rule.Pattern, item, int(rule.MaxQPS)).Allow()
+}
+
 type MatchRules struct {
 	Pattern      string `config:"pattern"` //pattern
 	MaxQPS       int64  `config:"max_qps"` //max_qps
@@ -125,7 +142,7 @@ func (filter *RequestPathLimitFilter) Filter(ctx *fasthttp.RequestCtx) {
 			}
 
 			if item != "" {
-				if !rate.GetRateLimiterPerSecond(v.Pattern, item, int(v.MaxQPS)).Allow() {
+				if !filter.allow(v, item) {
 
 					if global.Env().IsDebug {
 						log.Debug(key, " reach limited ", v.Pattern, ",extract:", item)
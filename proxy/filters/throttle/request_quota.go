@@ -0,0 +1,184 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package throttle
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"infini.sh/framework/core/config"
+	"infini.sh/framework/core/global"
+	"infini.sh/framework/core/pipeline"
+	"infini.sh/framework/core/rate"
+	"infini.sh/framework/core/stats"
+	"infini.sh/framework/core/util"
+	"infini.sh/framework/lib/fasthttp"
+	"infini.sh/gateway/common"
+	"infini.sh/gateway/common/quota"
+)
+
+const (
+	quotaKeyUser    = "user"
+	quotaKeyAPIKey  = "api_key"
+	quotaKeyContext = "context"
+)
+
+type RequestQuotaFilter struct {
+	Namespace          string       `config:"namespace"` //tenants are identified by the namespace and the key
+	KeyType            string       `config:"key_type"`  //user, api_key or context
+	Context            []string     `config:"context"`   //context values to identify the tenant
+	Limits             quota.Limits `config:"limits"`
+	SoftLimitRatio     float64      `config:"soft_limit_ratio"`
+	AddResponseHeaders bool         `config:"add_response_headers"`
+	FlushInterval      string       `config:"flush_interval"`
+	Status             int          `config:"status"`
+	Message            string       `config:"message"`
+	WarnMessage        bool         `config:"log_warn_message"`
+
+	uuid string
+}
+
+func init() {
+	pipeline.RegisterFilterPluginWithConfigMetadata("request_quota", NewRequestQuotaFilter, &RequestQuotaFilter{})
+}
+
+func NewRequestQuotaFilter(c *config.Config) (pipeline.Filter, error) {
+	runner := RequestQuotaFilter{
+		KeyType:            quotaKeyUser,
+		SoftLimitRatio:     0.8,
+		AddResponseHeaders: true,
+		FlushInterval:      "10s",
+		Status:             429,
+		Message:            "Quota exceeded!",
+	}
+	if err := c.Unpack(&runner); err != nil {
+		return nil, fmt.Errorf("failed to unpack the filter configuration : %s", err)
+	}
+
+	switch runner.KeyType {
+	case quotaKeyUser, quotaKeyAPIKey:
+	case quotaKeyContext:
+		if len(runner.Context) == 0 {
+			return nil, fmt.Errorf("context is required for key_type [%v]", quotaKeyContext)
+		}
+	default:
+		return nil, fmt.Errorf("invalid key_type [%v], only support: %v, %v, %v", runner.KeyType, quotaKeyUser, quotaKeyAPIKey, quotaKeyContext)
+	}
+
+	if runner.Namespace == "" {
+		runner.Namespace = runner.KeyType
+	}
+	runner.uuid = util.GetUUID()
+
+	quota.Default().RegisterDefaultLimits(runner.Namespace, runner.Limits)
+	quota.Start(util.GetDurationOrDefault(runner.FlushInterval, 10*time.Second))
+
+	return &runner, nil
+}
+
+func (filter *RequestQuotaFilter) Name() string {
+	return "request_quota"
+}
+
+func (filter *RequestQuotaFilter) getKey(ctx *fasthttp.RequestCtx) string {
+	switch filter.KeyType {
+	case quotaKeyUser:
+		exists, user, _ := ctx.Request.ParseBasicAuth()
+		if exists {
+			return string(user)
+		}
+	case quotaKeyAPIKey:
+		exists, apiID, _ := ctx.ParseAPIKey()
+		if exists {
+			return string(apiID)
+		}
+	case quotaKeyContext:
+		data := []string{}
+		for _, v := range filter.Context {
+			x, err := ctx.GetValue(v)
+			if err != nil {
+				log.Debugf("context:%v,%v,%v", v, x, err)
+				continue
+			}
+			data = append(data, util.ToString(x))
+		}
+		return util.JoinArray(data, ",")
+	}
+	return ""
+}
+
+func (filter *RequestQuotaFilter) Filter(ctx *fasthttp.RequestCtx) {
+	key := filter.getKey(ctx)
+	if key == "" {
+		return
+	}
+
+	cost := 1
+	if v, ok := ctx.Get(common.QUERYCOST).(int); ok && v > 0 {
+		cost = v
+	}
+
+	tenant := quota.TenantID(filter.Namespace, key)
+	now := time.Now()
+	result := quota.Default().Check(tenant, quota.Usage{
+		Requests: 1,
+		Bytes:    int64(ctx.Request.GetRequestLength()),
+		Cost:     int64(cost),
+	}, filter.Limits, filter.SoftLimitRatio, now)
+
+	if filter.AddResponseHeaders && result.Limited {
+		ctx.Response.Header.Set("X-Quota-Window", result.Window)
+		ctx.Response.Header.Set("X-Quota-Metric", result.Metric)
+		ctx.Response.Header.Set("X-Quota-Limit", strconv.FormatInt(result.Limit, 10))
+		ctx.Response.Header.Set("X-Quota-Remaining", strconv.FormatInt(result.Remaining, 10))
+		ctx.Response.Header.Set("X-Quota-Reset", strconv.FormatInt(int64(result.Reset.Sub(now).Seconds()), 10))
+	}
+
+	if !result.Allowed {
+		stats.Increment("quota", filter.Namespace+".exceeded")
+		if filter.WarnMessage {
+			log.Warnf("quota exceeded: %v, %v %v: %v", tenant, result.Window, result.Metric, result.Limit)
+		}
+		ctx.SetStatusCode(filter.Status)
+		ctx.WriteString(filter.Message)
+		ctx.Finished()
+		return
+	}
+
+	if result.Soft {
+		stats.Increment("quota", filter.Namespace+".soft_limited")
+		if filter.AddResponseHeaders {
+			ctx.Response.Header.Set("X-Quota-Warning", fmt.Sprintf("%v %v quota is almost used up", result.Window, result.Metric))
+		}
+		if filter.WarnMessage && rate.GetRateLimiterPerSecond("quota_soft_limit", filter.uuid+tenant, 1).Allow() {
+			log.Warnf("quota soft limit reached: %v, %v %v, remaining: %v/%v", tenant, result.Window, result.Metric, result.Remaining, result.Limit)
+		}
+	}
+
+	if global.Env().IsDebug {
+		log.Tracef("quota of [%v]: %v %v, remaining: %v/%v", tenant, result.Window, result.Metric, result.Remaining, result.Limit)
+	}
+}
@@ -173,6 +173,42 @@ func (module *GatewayModule) handleConfigureChange() {
 		}
 	})
 
+	NotifyOnConfigSectionChange("role", func(pCfg, cCfg *Config) {
+		newConfig := []common.RoleConfig{}
+		if cCfg != nil {
+			err := cCfg.Unpack(&newConfig)
+			if err != nil {
+				log.Error(err)
+				return
+			}
+		}
+
+		keys := map[string]bool{}
+		for _, v := range newConfig {
+			keys[v.ID] = v.ID != ""
+			keys[v.Name] = v.Name != ""
+		}
+
+		//the roles removed from the config should not be granted anymore
+		if pCfg != nil {
+			oldConfig := []common.RoleConfig{}
+			err := pCfg.Unpack(&oldConfig)
+			if err != nil {
+				log.Error(err)
+			}
+			for _, v := range oldConfig {
+				if !keys[v.ID] && !keys[v.Name] {
+					common.RemoveRoleConfig(v)
+				}
+			}
+		}
+
+		//roles are checked per request, no need to restart the entry points
+		for _, v := range newConfig {
+			common.RegisterRoleConfig(v)
+		}
+	})
+
 	NotifyOnConfigSectionChange("entry", func(pCfg, cCfg *Config) {
 
 		defer func() {
@@ -295,6 +331,18 @@ func (module *GatewayModule) loadEntryPoints() map[string]*entry.Entrypoint {
 		}
 	}
 
+	roleConfigs := []common.RoleConfig{}
+	ok, err = env.ParseConfig("role", &roleConfigs)
+	if ok && err != nil && global.Env().SystemConfig.Configs.PanicOnConfigError {
+		panic(err)
+	}
+
+	if ok {
+		for _, v := range roleConfigs {
+			common.RegisterRoleConfig(v)
+		}
+	}
+
 	log.Trace("num of entry configs:", len(entryConfigs))
 	entryPoints := map[string]*entry.Entrypoint{}
 	for _, v := range entryConfigs {
@@ -325,6 +373,13 @@ func (module *GatewayModule) Start() error {
 
 	module.handleConfigureChange()
 
+	if module.ORM.Enabled {
+		api := api2.GatewayAPI{}
+		if err := api.LoadRoles(); err != nil {
+			log.Error("failed to load roles, ", err)
+		}
+	}
+
 	return nil
 }
 
@@ -0,0 +1,238 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package elastic
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"github.com/buger/jsonparser"
+	log "github.com/cihub/seelog"
+	"infini.sh/framework/core/elastic"
+	"infini.sh/framework/core/global"
+	"infini.sh/framework/core/stats"
+	"infini.sh/framework/core/util"
+	"infini.sh/framework/lib/fasthttp"
+)
+
+type TaskCancellationConfig struct {
+	Enabled       bool   `config:"enabled"`
+	CheckInterval string `config:"check_interval"` //interval to check if the client is still connected
+	Timeout       string `config:"timeout"`        //timeout of the requests to cancel the task
+}
+
+const (
+	headerOpaqueID       = "X-Opaque-Id"
+	headerClientOpaqueID = "X-Client-Opaque-Id"
+)
+
+// the scroll requests run as indices:data/read/scroll, not matched by *search*
+const taskListURI = "/_tasks?nodes=_local&actions=*search*,*scroll*&detailed=false"
+
+const (
+	cancelReasonDisconnected = "client_disconnected"
+	cancelReasonTimeout      = "timeout"
+)
+
+type taskCanceller struct {
+	checkInterval time.Duration
+	timeout       time.Duration
+}
+
+func newTaskCanceller(cfg *TaskCancellationConfig) *taskCanceller {
+	return &taskCanceller{
+		checkInterval: util.GetDurationOrDefault(cfg.CheckInterval, 200*time.Millisecond),
+		timeout:       util.GetDurationOrDefault(cfg.Timeout, 5*time.Second),
+	}
+}
+
+var cancellablePaths = [][]byte{[]byte("/_search"), []byte("/_msearch"), []byte("/_count"), []byte("/_search/scroll")}
+var scrollIDPath = []byte("/_search/scroll/")
+
+// isCancellableRequest only allows searches, they are expensive and safe to be cancelled
+func isCancellableRequest(req *fasthttp.Request) bool {
+	method := req.Header.Method()
+	if !util.CompareStringAndBytes(method, fasthttp.MethodGet) && !util.CompareStringAndBytes(method, fasthttp.MethodPost) {
+		return false
+	}
+
+	path := req.PhantomURI().Path()
+	//the scroll id may be passed in the path, eg: /_search/scroll/<scroll_id>
+	if bytes.Contains(path, scrollIDPath) {
+		return true
+	}
+	for _, v := range cancellablePaths {
+		if bytes.HasSuffix(path, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// tagRequest sets a new X-Opaque-Id to find the tasks of the request, the one
+// of the client is never used, as it may be shared by other requests whose
+// tasks would be cancelled too, it is moved to X-Client-Opaque-Id instead
+func tagRequest(req *fasthttp.Request) (opaqueID, clientID string) {
+	//the header was already moved if the request is retried
+	clientID = string(req.Header.Peek(headerClientOpaqueID))
+	if clientID == "" {
+		clientID = string(req.Header.Peek(headerOpaqueID))
+		if clientID != "" {
+			req.Header.Set(headerClientOpaqueID, clientID)
+		}
+	}
+	opaqueID = "gateway-" + util.GetUUID()
+	req.Header.Set(headerOpaqueID, opaqueID)
+	if clientID != "" && global.Env().IsDebug {
+		log.Debugf("request [%v] with X-Opaque-Id [%v] is tagged as [%v]", req.PhantomURI().String(), clientID, opaqueID)
+	}
+	return opaqueID, clientID
+}
+
+// restoreOpaqueID returns the X-Opaque-Id of the client in the response
+func restoreOpaqueID(res *fasthttp.Response, clientID string) {
+	if clientID != "" && len(res.Header.Peek(headerOpaqueID)) > 0 {
+		res.Header.Set(headerOpaqueID, clientID)
+	}
+}
+
+// doCancellableRequest tags the request with X-Opaque-Id, and cancels the
+// upstream task if the client disconnected or the request timed out
+func (p *ReverseProxy) doCancellableRequest(pc fasthttp.ClientAPI, host string, metadata *elastic.ElasticsearchMetadata, myctx *fasthttp.RequestCtx, res *fasthttp.Response) error {
+	req := &myctx.Request
+	opaqueID, clientID := tagRequest(req)
+	authorization := string(req.Header.Peek(fasthttp.HeaderAuthorization))
+
+	done := make(chan error, 1)
+	go func() {
+		err := p.doRequest(pc, req, res)
+		restoreOpaqueID(res, clientID)
+		done <- err
+	}()
+
+	ticker := time.NewTicker(p.canceller.checkInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case err := <-done:
+			if err == fasthttp.ErrTimeout {
+				go p.cancelTask(metadata, host, opaqueID, authorization, cancelReasonTimeout)
+			}
+			return err
+		case <-ticker.C:
+			if myctx.Conn() != nil && isConnClosed(myctx.Conn()) {
+				go p.cancelTask(metadata, host, opaqueID, authorization, cancelReasonDisconnected)
+				//the request and response are still in use until the upstream returns
+				return <-done
+			}
+		}
+	}
+}
+
+// cancelTask finds the tasks by X-Opaque-Id on the node which ran the request and cancels them
+func (p *ReverseProxy) cancelTask(metadata *elastic.ElasticsearchMetadata, host, opaqueID, authorization, reason string) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Errorf("error in cancelling task [%v] on [%v], %v", opaqueID, host, r)
+		}
+	}()
+
+	client := metadata.GetHttpClient(host)
+	data, err := p.doTaskRequest(client, metadata, host, fasthttp.MethodGet, taskListURI, authorization)
+	if err != nil {
+		stats.Increment("reverse_proxy", "task_cancel_failed")
+		log.Warnf("failed to list tasks of [%v] on [%v], %v", opaqueID, host, err)
+		return
+	}
+
+	tasks := findTasksByOpaqueID(data, opaqueID)
+	if len(tasks) == 0 {
+		if global.Env().IsDebug {
+			log.Debugf("no task found for [%v] on [%v], it may have finished", opaqueID, host)
+		}
+		return
+	}
+
+	for _, task := range tasks {
+		_, err := p.doTaskRequest(client, metadata, host, fasthttp.MethodPost, fmt.Sprintf("/_tasks/%v/_cancel", task), authorization)
+		if err != nil {
+			stats.Increment("reverse_proxy", "task_cancel_failed")
+			log.Warnf("failed to cancel task [%v] of [%v] on [%v], %v", task, opaqueID, host, err)
+			continue
+		}
+		stats.Increment("reverse_proxy", "task_cancelled")
+		stats.Increment("reverse_proxy", "task_cancelled."+reason)
+		log.Debugf("task [%v] of [%v] on [%v] was cancelled, reason: %v", task, opaqueID, host, reason)
+	}
+}
+
+func (p *ReverseProxy) doTaskRequest(client fasthttp.ClientAPI, metadata *elastic.ElasticsearchMetadata, host, method, uri, authorization string) ([]byte, error) {
+	req := fasthttp.AcquireRequest()
+	res := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(res)
+
+	req.SetRequestURI(fmt.Sprintf("%v://%v%v", metadata.GetSchema(), host, uri))
+	req.Header.SetMethod(method)
+	req.SetHost(host)
+	if authorization != "" {
+		req.Header.Set(fasthttp.HeaderAuthorization, authorization)
+	}
+
+	//the losing hedged requests are cancelled even if task_cancellation is disabled
+	timeout := 5 * time.Second
+	if p.canceller != nil {
+		timeout = p.canceller.timeout
+	}
+	if err := client.DoTimeout(req, res, timeout); err != nil {
+		return nil, err
+	}
+	if res.StatusCode() != fasthttp.StatusOK {
+		return nil, fmt.Errorf("invalid status code, %v %v", res.StatusCode(), util.SubString(util.UnsafeBytesToString(res.GetRawBody()), 0, 256))
+	}
+	return append([]byte{}, res.GetRawBody()...), nil
+}
+
+// findTasksByOpaqueID returns the parent tasks with the X-Opaque-Id in the
+// response of the tasks api, the child tasks will be cancelled along with them
+func findTasksByOpaqueID(data []byte, opaqueID string) []string {
+	tasks := []string{}
+	jsonparser.ObjectEach(data, func(node []byte, nodeValue []byte, dataType jsonparser.ValueType, offset int) error {
+		jsonparser.ObjectEach(nodeValue, func(id []byte, task []byte, dataType jsonparser.ValueType, offset int) error {
+			v, _ := jsonparser.GetString(task, "headers", headerOpaqueID)
+			if v != opaqueID {
+				return nil
+			}
+			if _, err := jsonparser.GetString(task, "parent_task_id"); err == nil {
+				return nil
+			}
+			tasks = append(tasks, string(id))
+			return nil
+		}, "tasks")
+		return nil
+	}, "nodes")
+	return tasks
+}
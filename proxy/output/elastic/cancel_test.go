@@ -0,0 +1,140 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package elastic
+
+import (
+	"net"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"infini.sh/framework/lib/fasthttp"
+)
+
+func TestFindTasksByOpaqueID(t *testing.T) {
+	data := []byte(`{"nodes":{"node-1":{"name":"node-1","tasks":{
+		"node-1:100":{"node":"node-1","id":100,"action":"indices:data/read/search","headers":{"X-Opaque-Id":"gateway-1"}},
+		"node-1:101":{"node":"node-1","id":101,"action":"indices:data/read/search[phase/query]","parent_task_id":"node-1:100","headers":{"X-Opaque-Id":"gateway-1"}},
+		"node-1:102":{"node":"node-1","id":102,"action":"indices:data/read/search","headers":{"X-Opaque-Id":"gateway-2"}}
+	}}}}`)
+	assert.Equal(t, []string{"node-1:100"}, findTasksByOpaqueID(data, "gateway-1"))
+	assert.Equal(t, 0, len(findTasksByOpaqueID(data, "gateway-3")))
+}
+
+func TestIsCancellableRequest(t *testing.T) {
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+
+	req.Header.SetMethod(fasthttp.MethodPost)
+	req.SetRequestURI("/index/_search")
+	assert.True(t, isCancellableRequest(req))
+
+	req.SetRequestURI("/_search/scroll")
+	assert.True(t, isCancellableRequest(req))
+
+	req.SetRequestURI("/_search/scroll/DXF1ZXJ5QW5kRmV0Y2gBAAAAAAAAAD4WYm9laVYtZndUQlNsdDcwakFMNjU1QQ==")
+	assert.True(t, isCancellableRequest(req))
+
+	req.SetRequestURI("/index/_doc")
+	assert.False(t, isCancellableRequest(req))
+
+	req.Header.SetMethod(fasthttp.MethodDelete)
+	req.SetRequestURI("/_search/scroll")
+	assert.False(t, isCancellableRequest(req))
+}
+
+func TestTaskListActions(t *testing.T) {
+	uri, err := url.Parse(taskListURI)
+	assert.Nil(t, err)
+	patterns := strings.Split(uri.Query().Get("actions"), ",")
+	match := func(action string) bool {
+		for _, v := range patterns {
+			if regexp.MustCompile("^" + strings.ReplaceAll(regexp.QuoteMeta(v), `\*`, ".*") + "$").MatchString(action) {
+				return true
+			}
+		}
+		return false
+	}
+	assert.True(t, match("indices:data/read/search"))
+	assert.True(t, match("indices:data/read/msearch"))
+	assert.True(t, match("indices:data/read/scroll"))
+	assert.False(t, match("indices:data/write/bulk"))
+}
+
+func TestTagRequest(t *testing.T) {
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+
+	opaqueID, clientID := tagRequest(req)
+	assert.True(t, strings.HasPrefix(opaqueID, "gateway-"))
+	assert.Equal(t, "", clientID)
+	assert.Equal(t, opaqueID, string(req.Header.Peek(headerOpaqueID)))
+
+	req.Header.Set(headerOpaqueID, "client-1")
+	opaqueID, clientID = tagRequest(req)
+	assert.Equal(t, "client-1", clientID)
+	assert.NotEqual(t, "client-1", opaqueID)
+	assert.Equal(t, opaqueID, string(req.Header.Peek(headerOpaqueID)))
+	assert.Equal(t, "client-1", string(req.Header.Peek(headerClientOpaqueID)))
+
+	//retried, a new id for the new tasks
+	retried, clientID := tagRequest(req)
+	assert.Equal(t, "client-1", clientID)
+	assert.NotEqual(t, opaqueID, retried)
+
+	res := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(res)
+	res.Header.Set(headerOpaqueID, retried)
+	restoreOpaqueID(res, clientID)
+	assert.Equal(t, "client-1", string(res.Header.Peek(headerOpaqueID)))
+}
+
+func TestIsConnClosed(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer l.Close()
+
+	client, err := net.Dial("tcp", l.Addr().String())
+	assert.Nil(t, err)
+	server, err := l.Accept()
+	assert.Nil(t, err)
+	defer server.Close()
+
+	assert.False(t, isConnClosed(server))
+
+	//pending data is peeked but not consumed
+	client.Write([]byte("x"))
+	time.Sleep(10 * time.Millisecond)
+	assert.False(t, isConnClosed(server))
+	buf := make([]byte, 1)
+	n, _ := server.Read(buf)
+	assert.Equal(t, 1, n)
+
+	client.Close()
+	time.Sleep(10 * time.Millisecond)
+	assert.True(t, isConnClosed(server))
+}
@@ -23,7 +23,12 @@
 
 package elastic
 
-import "time"
+import (
+	"time"
+
+	"infini.sh/gateway/common/pressure"
+	"infini.sh/gateway/proxy/retry"
+)
 
 type ProxyConfig struct {
 	Elasticsearch string `config:"elasticsearch"`
@@ -38,6 +43,9 @@ type ProxyConfig struct {
 	RetryOnBackendBusy                bool `config:"retry_on_backend_busy"`
 	RetryDelayInMs                    int  `config:"retry_delay_in_ms"`
 
+	//retry budget, backoff and per status code policies
+	Retry retry.Config `config:"retry"`
+
 	MaxConnWaitTimeout    time.Duration `config:"max_conn_wait_timeout"`
 	MaxIdleConnDuration   time.Duration `config:"max_idle_conn_duration"`
 	MaxConnDuration       time.Duration `config:"max_conn_duration"`
@@ -61,6 +69,32 @@ type ProxyConfig struct {
 
 	Weights map[string]int `config:"weights"`
 
+	//new or recovered nodes ramp up to their full weight within the slow start window
+	SlowStart struct {
+		Enabled  bool   `config:"enabled"`
+		Duration string `config:"duration"`
+		Interval string `config:"interval"`
+	} `config:"slow_start"`
+
+	//send a duplicated read request to another node when the first one is slow
+	Hedging HedgingConfig `config:"hedging"`
+
+	//route scroll and pit continuations to the upstream which issued the id
+	StickyRouting StickyRoutingConfig `config:"sticky_routing"`
+
+	//cancel the upstream task when the client disconnected or the request timed out
+	TaskCancellation TaskCancellationConfig `config:"task_cancellation"`
+
+	//steer the traffic away from the nodes under thread pool pressure
+	PressureAware struct {
+		Enabled   bool            `config:"enabled"`
+		Collector pressure.Config `config:"collector"`
+	} `config:"pressure_aware"`
+
+	//connections to pre-establish before new node takes traffic, best-effort
+	MinIdleConnection int           `config:"min_idle_connection_per_node"`
+	WarmupTimeout     time.Duration `config:"warmup_timeout"`
+
 	Refresh struct {
 		Enabled  bool   `config:"enabled"`
 		Interval string `config:"interval"`
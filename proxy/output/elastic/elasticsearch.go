@@ -37,6 +37,8 @@ import (
 	"infini.sh/framework/core/rate"
 	"infini.sh/framework/core/util"
 	"infini.sh/framework/lib/fasthttp"
+	"infini.sh/gateway/common/pressure"
+	"infini.sh/gateway/proxy/retry"
 )
 
 type Elasticsearch struct {
@@ -62,6 +64,22 @@ func (filter *Elasticsearch) Filter(ctx *fasthttp.RequestCtx) {
 		return
 	}
 
+	if filter.config.StickyRouting.Enabled {
+		if route, ok := lookupCursorRoute(&ctx.Request, time.Now()); ok {
+			target := filter
+			if route.cluster != filter.config.Elasticsearch {
+				target = getInstance(route.cluster)
+			}
+			if target != nil && target.getMetadata() != nil {
+				if global.Env().IsDebug {
+					log.Tracef("route request [%v] to [%v][%v] by sticky routing", ctx.Request.PhantomURI().String(), route.cluster, route.host)
+				}
+				target.instance.delegateRequest(target.config.Elasticsearch, target.getMetadata(), ctx, route.host)
+				return
+			}
+		}
+	}
+
 	if !filter.config.SkipAvailableCheck && filter.getMetadata() != nil && !filter.getMetadata().IsAvailable() {
 		if filter.config.CheckClusterHealthWhenNotAvailable {
 			if rate.GetRateLimiter("cluster_check_health", filter.getMetadata().Config.ID, 1, 1, time.Second*1).Allow() {
@@ -89,6 +107,14 @@ func init() {
 }
 
 func New(c *config.Config) (pipeline.Filter, error) {
+	cfg, err := newProxyConfig(c)
+	if err != nil {
+		return nil, err
+	}
+	return newElasticsearch(cfg), nil
+}
+
+func newProxyConfig(c *config.Config) (*ProxyConfig, error) {
 
 	cfg := ProxyConfig{
 		Balancer:                           "weight",
@@ -114,20 +140,43 @@ func New(c *config.Config) (pipeline.Filter, error) {
 		WriteTimeout: util.GetDurationOrDefault("0s", 0*time.Hour), //same as read timeout
 		//idle alive connection will be closed
 		MaxIdleConnDuration: util.GetDurationOrDefault("30s", 30*time.Second),
+		WarmupTimeout:       util.GetDurationOrDefault("5s", 5*time.Second),
+	}
+	cfg.Retry = retry.DefaultConfig
+	cfg.SlowStart.Duration = "60s"
+	cfg.SlowStart.Interval = "1s"
+	cfg.StickyRouting = StickyRoutingConfig{
+		DefaultKeepAlive: "5m",
+	}
+	cfg.PressureAware.Collector = pressure.DefaultConfig()
+	cfg.Hedging = HedgingConfig{
+		Percentile:    95,
+		BudgetPercent: 5,
+		MinDelay:      "5ms",
+		WindowSize:    1000,
+		MinSamples:    100,
 	}
 
 	if err := c.Unpack(&cfg); err != nil {
 		return nil, fmt.Errorf("failed to unpack the filter configuration : %s", err)
 	}
 
-	runner := Elasticsearch{config: &cfg}
+	return &cfg, nil
+}
+
+func newElasticsearch(cfg *ProxyConfig) *Elasticsearch {
+	runner := Elasticsearch{config: cfg}
 	runner.metadata = elastic.GetMetadata(cfg.Elasticsearch)
 
-	runner.instance = NewReverseProxy(&cfg)
+	runner.instance = NewReverseProxy(cfg)
+
+	if cfg.StickyRouting.Enabled {
+		registerInstance(&runner)
+	}
 
 	log.Debugf("init elasticsearch proxy instance: %v", cfg.Elasticsearch)
 
-	return &runner, nil
+	return &runner
 }
 
 func (filter *Elasticsearch) getMetadata() *elastic.ElasticsearchMetadata {
@@ -0,0 +1,545 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package elastic
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"infini.sh/framework/core/config"
+	"infini.sh/framework/core/elastic"
+	"infini.sh/framework/core/global"
+	"infini.sh/framework/core/pipeline"
+	"infini.sh/framework/core/queue"
+	"infini.sh/framework/core/rate"
+	"infini.sh/framework/core/stats"
+	"infini.sh/framework/core/util"
+	"infini.sh/framework/lib/fasthttp"
+	"infini.sh/gateway/common"
+)
+
+const (
+	writeModeSwitch = "switch"
+	writeModeQueue  = "queue"
+)
+
+type FailoverHealthCheck struct {
+	Interval            string `config:"interval"`
+	FailureThreshold    int    `config:"failure_threshold"`     //consecutive failed checks to fail over
+	SuccessThreshold    int    `config:"success_threshold"`     //consecutive successful checks of the primary to fail back
+	MinFailoverDuration string `config:"min_failover_duration"` //stay on the standby at least this long
+}
+
+type FailoverConfig struct {
+	Clusters    []string            `config:"clusters"` //the first one is the primary
+	HealthCheck FailoverHealthCheck `config:"health_check"`
+	WriteMode   string              `config:"write_mode"` //switch or queue
+	Queue       string              `config:"queue"`      //queue for parked writes
+}
+
+// ElasticsearchFailover wraps an elasticsearch output per cluster, and routes
+// requests to the active one
+type ElasticsearchFailover struct {
+	config    *FailoverConfig
+	instances []*Elasticsearch
+
+	interval            time.Duration
+	minFailoverDuration time.Duration
+
+	locker     sync.RWMutex
+	active     int
+	failoverAt time.Time
+	draining   bool
+	failures   []int
+	successes  []int
+
+	drainRunning bool
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// the running instances by the primary cluster, they share the stats and the
+// queue of the parked writes, so the one replaced by a reloaded flow is closed
+var (
+	failoversLocker sync.Mutex
+	failovers       = map[string]*ElasticsearchFailover{}
+)
+
+func (filter *ElasticsearchFailover) Name() string {
+	return "elasticsearch_failover"
+}
+
+func init() {
+	pipeline.RegisterFilterPluginWithConfigMetadata("elasticsearch_failover", NewFailover, &FailoverConfig{})
+}
+
+func NewFailover(c *config.Config) (pipeline.Filter, error) {
+	cfg := FailoverConfig{
+		WriteMode: writeModeSwitch,
+		HealthCheck: FailoverHealthCheck{
+			Interval:            "5s",
+			FailureThreshold:    3,
+			SuccessThreshold:    5,
+			MinFailoverDuration: "60s",
+		},
+	}
+	if err := c.Unpack(&cfg); err != nil {
+		return nil, fmt.Errorf("failed to unpack the filter configuration : %s", err)
+	}
+
+	if len(cfg.Clusters) < 2 {
+		return nil, fmt.Errorf("at least two clusters are required for failover")
+	}
+
+	if cfg.WriteMode != writeModeSwitch && cfg.WriteMode != writeModeQueue {
+		return nil, fmt.Errorf("invalid write_mode [%v], only support: %v, %v", cfg.WriteMode, writeModeSwitch, writeModeQueue)
+	}
+
+	if cfg.WriteMode == writeModeQueue && cfg.Queue == "" {
+		cfg.Queue = fmt.Sprintf("failover-%v", cfg.Clusters[0])
+	}
+
+	if cfg.HealthCheck.FailureThreshold <= 0 {
+		cfg.HealthCheck.FailureThreshold = 1
+	}
+	if cfg.HealthCheck.SuccessThreshold <= 0 {
+		cfg.HealthCheck.SuccessThreshold = 1
+	}
+
+	filter := ElasticsearchFailover{
+		config:              &cfg,
+		interval:            util.GetDurationOrDefault(cfg.HealthCheck.Interval, 5*time.Second),
+		minFailoverDuration: util.GetDurationOrDefault(cfg.HealthCheck.MinFailoverDuration, 60*time.Second),
+		failures:            make([]int, len(cfg.Clusters)),
+		successes:           make([]int, len(cfg.Clusters)),
+		closed:              make(chan struct{}),
+	}
+
+	//each cluster shares the same proxy settings
+	for _, v := range cfg.Clusters {
+		proxyConfig, err := newProxyConfig(c)
+		if err != nil {
+			return nil, err
+		}
+		proxyConfig.Elasticsearch = v
+		filter.instances = append(filter.instances, newElasticsearch(proxyConfig))
+	}
+
+	stats.RegisterStats(fmt.Sprintf("elasticsearch_failover.%v.active", cfg.Clusters[0]), func() interface{} {
+		active, _ := filter.getActive()
+		return cfg.Clusters[active]
+	})
+
+	failoversLocker.Lock()
+	old := failovers[cfg.Clusters[0]]
+	failovers[cfg.Clusters[0]] = &filter
+	failoversLocker.Unlock()
+	if old != nil {
+		old.Close()
+	}
+
+	go filter.checkHealth()
+
+	log.Debugf("init elasticsearch failover instance: %v", util.JoinArray(cfg.Clusters, ","))
+
+	return &filter, nil
+}
+
+// Close stops the health checks and the drain of the parked writes, the
+// requests are still sent to the active cluster
+func (filter *ElasticsearchFailover) Close() error {
+	filter.closeOnce.Do(func() {
+		close(filter.closed)
+	})
+	failoversLocker.Lock()
+	if failovers[filter.config.Clusters[0]] == filter {
+		delete(failovers, filter.config.Clusters[0])
+	}
+	failoversLocker.Unlock()
+	return nil
+}
+
+func (filter *ElasticsearchFailover) isClosed() bool {
+	select {
+	case <-filter.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (filter *ElasticsearchFailover) Filter(ctx *fasthttp.RequestCtx) {
+	filter.locker.RLock()
+	active := filter.active
+	park := filter.config.WriteMode == writeModeQueue && (active != 0 || filter.draining) && !isReadRequest(&ctx.Request)
+	if park {
+		//parked under the read lock, so that the final drain won't miss it
+		err := queue.Push(queue.GetOrInitConfig(filter.config.Queue), ctx.Request.Encode())
+		filter.locker.RUnlock()
+		if err != nil {
+			log.Errorf("failed to park write to queue [%v], %v", filter.config.Queue, err)
+			stats.Increment("elasticsearch_failover", filter.config.Clusters[0]+".park_failed")
+			ctx.SetContentType(util.ContentTypeJson)
+			ctx.Response.SwapBody([]byte(fmt.Sprintf("{\"error\":true,\"message\":\"primary cluster [%v] is not available, and failed to queue the request\"}", filter.config.Clusters[0])))
+			ctx.SetStatusCode(503)
+			ctx.Finished()
+			return
+		}
+		stats.Increment("elasticsearch_failover", filter.config.Clusters[0]+".parked_writes")
+		ctx.SetDestination(fmt.Sprintf("%v:%v", "queue", filter.config.Queue))
+		ctx.SetContentType(util.ContentTypeJson)
+		ctx.Response.Header.Set("X-Request-Parked", "true")
+		ctx.Response.SwapBody([]byte(fmt.Sprintf("{\"acknowledged\":true,\"message\":\"primary cluster [%v] is not available, request was queued\"}", filter.config.Clusters[0])))
+		ctx.SetStatusCode(202)
+		ctx.Finished()
+		return
+	}
+	filter.locker.RUnlock()
+
+	filter.instances[active].Filter(ctx)
+}
+
+func (filter *ElasticsearchFailover) getActive() (int, bool) {
+	filter.locker.RLock()
+	defer filter.locker.RUnlock()
+	return filter.active, filter.draining
+}
+
+var readPaths = [][]byte{[]byte("/_search"), []byte("/_msearch"), []byte("/_count"), []byte("/_mget"), []byte("/_field_caps")}
+var cursorPaths = [][]byte{[]byte("/_search/scroll"), []byte("/_pit")}
+
+// isReadRequest returns true for requests that don't change the data
+func isReadRequest(req *fasthttp.Request) bool {
+	method := req.Header.Method()
+	if util.CompareStringAndBytes(method, fasthttp.MethodGet) || util.CompareStringAndBytes(method, fasthttp.MethodHead) {
+		return true
+	}
+
+	path := req.PhantomURI().Path()
+	//scroll and pit contexts only live in the cluster which created them
+	for _, v := range cursorPaths {
+		if bytes.Contains(path, v) {
+			return true
+		}
+	}
+
+	if !util.CompareStringAndBytes(method, fasthttp.MethodPost) {
+		return false
+	}
+
+	for _, v := range readPaths {
+		if bytes.HasSuffix(path, v) {
+			return true
+		}
+	}
+	return false
+}
+
+func (filter *ElasticsearchFailover) checkHealth() {
+	ticker := time.NewTicker(filter.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-filter.closed:
+			return
+		case <-ticker.C:
+		}
+		if global.ShuttingDown() {
+			return
+		}
+
+		healthy := make([]bool, len(filter.config.Clusters))
+		for i, v := range filter.config.Clusters {
+			healthy[i] = common.CheckElasticsearchHealth(v)
+		}
+
+		filter.updateState(healthy, time.Now())
+	}
+}
+
+// updateState records the check results, fails over after consecutive failures
+// and fails back to the primary with hysteresis
+func (filter *ElasticsearchFailover) updateState(healthy []bool, now time.Time) {
+	filter.locker.Lock()
+	defer filter.locker.Unlock()
+
+	for i, ok := range healthy {
+		if ok {
+			filter.successes[i]++
+			filter.failures[i] = 0
+		} else {
+			filter.failures[i]++
+			filter.successes[i] = 0
+		}
+	}
+
+	if filter.active != 0 {
+		if filter.successes[0] >= filter.config.HealthCheck.SuccessThreshold && now.Sub(filter.failoverAt) >= filter.minFailoverDuration {
+			log.Infof("primary cluster [%v] recovered, fail back from [%v]", filter.config.Clusters[0], filter.config.Clusters[filter.active])
+			filter.failback()
+			return
+		}
+	} else if filter.draining && !filter.drainRunning {
+		//the last drain was aborted, such as the consumer was not ready, retry it
+		filter.startDrain()
+	}
+
+	if filter.failures[filter.active] < filter.config.HealthCheck.FailureThreshold {
+		return
+	}
+
+	//the standby failed, go back to the primary if it is healthy, the min
+	//failover duration only prevents flapping while the standby works
+	if filter.active != 0 && healthy[0] {
+		log.Warnf("cluster [%v] failed %v health checks, fail back to [%v]", filter.config.Clusters[filter.active], filter.failures[filter.active], filter.config.Clusters[0])
+		filter.failback()
+		return
+	}
+
+	for i := 1; i < len(healthy); i++ {
+		if i != filter.active && healthy[i] {
+			log.Warnf("cluster [%v] failed %v health checks, fail over to [%v]", filter.config.Clusters[filter.active], filter.failures[filter.active], filter.config.Clusters[i])
+			filter.active = i
+			filter.failoverAt = now
+			stats.Increment("elasticsearch_failover", filter.config.Clusters[0]+".failover")
+			return
+		}
+	}
+
+	if rate.GetRateLimiterPerSecond("elasticsearch_failover", filter.config.Clusters[0], 1).Allow() {
+		log.Errorf("cluster [%v] is not available, and no healthy standby cluster to fail over", filter.config.Clusters[filter.active])
+	}
+}
+
+// failback switches to the primary, the parked writes are drained before the
+// new writes are sent to the primary
+func (filter *ElasticsearchFailover) failback() {
+	filter.active = 0
+	stats.Increment("elasticsearch_failover", filter.config.Clusters[0]+".failback")
+	if filter.config.WriteMode == writeModeQueue {
+		filter.draining = true
+		filter.startDrain()
+	}
+}
+
+func (filter *ElasticsearchFailover) startDrain() {
+	if !filter.drainRunning {
+		filter.drainRunning = true
+		go filter.drain()
+	}
+}
+
+// drain replays the parked writes to the primary in order, new writes keep
+// being parked until the queue is empty, an aborted drain is restarted by the
+// next health check
+func (filter *ElasticsearchFailover) drain() {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Errorf("error in draining parked writes of [%v], %v", filter.config.Queue, r)
+		}
+		filter.locker.Lock()
+		filter.drainRunning = false
+		filter.locker.Unlock()
+	}()
+
+	qConfig := queue.GetOrInitConfig(filter.config.Queue)
+	consumer := queue.GetOrInitConsumerConfig(qConfig.ID, "group-001", "failover-001")
+	consumerInstance, err := queue.AcquireConsumer(qConfig, consumer, "elasticsearch_failover")
+	if err != nil || consumerInstance == nil {
+		log.Errorf("failed to acquire consumer of [%v], %v", filter.config.Queue, err)
+		return
+	}
+	defer queue.ReleaseConsumer(qConfig, consumer, consumerInstance)
+
+	metadata := elastic.GetMetadata(filter.config.Clusters[0])
+	if metadata == nil {
+		log.Errorf("cluster metadata [%v] not ready", filter.config.Clusters[0])
+		return
+	}
+
+	for {
+		if global.ShuttingDown() || filter.isClosed() {
+			return
+		}
+
+		if active, _ := filter.getActive(); active != 0 {
+			//failed over again, the rest will be drained on next failback
+			return
+		}
+
+		if !queue.ConsumerHasLag(qConfig, consumer) {
+			//no more writes could be parked while holding the lock
+			filter.locker.Lock()
+			if !queue.ConsumerHasLag(qConfig, consumer) {
+				filter.draining = false
+				filter.locker.Unlock()
+				log.Infof("parked writes of [%v] were drained", filter.config.Clusters[0])
+				return
+			}
+			filter.locker.Unlock()
+		}
+
+		ok, err := filter.drainMessages(qConfig, consumer, consumerInstance, metadata)
+		if err != nil {
+			log.Warnf("failed to drain parked writes to [%v], %v", filter.config.Clusters[0], err)
+		}
+		if !ok {
+			time.Sleep(filter.interval)
+		}
+	}
+}
+
+// drainMessages replays a batch of messages, the offset is only committed
+// after the message was accepted or moved to the invalid queue
+func (filter *ElasticsearchFailover) drainMessages(qConfig *queue.QueueConfig, consumer *queue.ConsumerConfig, consumerInstance queue.ConsumerAPI, metadata *elastic.ElasticsearchMetadata) (bool, error) {
+	offset, err := queue.GetOffset(qConfig, consumer)
+	if err != nil {
+		return false, err
+	}
+
+	consumer.KeepActive()
+	messages, _, err := consumerInstance.FetchMessages(&queue.Context{}, consumer.FetchMaxMessages)
+	if err != nil {
+		return false, err
+	}
+	if len(messages) == 0 {
+		return false, nil
+	}
+
+	defer func() {
+		if ok, err := queue.CommitOffset(qConfig, consumer, offset); !ok || err != nil {
+			log.Errorf("failed to commit offset of [%v], %v", filter.config.Queue, err)
+		}
+	}()
+
+	for _, msg := range messages {
+		data := msg.Data
+		for {
+			status, retryable, invalid, err := replayRequest(metadata, data)
+			if err != nil {
+				if !isInvalidStatus(status) {
+					//keep the order, retry from this message later
+					return false, err
+				}
+				log.Errorf("invalid parked write, push to dead letter queue: %v-invalid, %v", filter.config.Queue, err)
+				invalid = data
+			}
+			if len(invalid) > 0 {
+				if err := queue.Push(queue.GetOrInitConfig(filter.config.Queue+"-invalid"), invalid); err != nil {
+					return false, err
+				}
+			}
+			if len(retryable) == 0 {
+				break
+			}
+
+			//only the failed items of the bulk request are retried, the whole
+			//message is replayed again if the drain was stopped
+			log.Warnf("some items of the parked bulk write to [%v] failed, retry them later", filter.config.Clusters[0])
+			time.Sleep(filter.interval)
+			if global.ShuttingDown() || filter.isClosed() {
+				return false, nil
+			}
+			if active, _ := filter.getActive(); active != 0 {
+				return false, nil
+			}
+			data = retryable
+		}
+		stats.Increment("elasticsearch_failover", filter.config.Clusters[0]+".drained_writes")
+		offset = msg.NextOffset
+	}
+	return true, nil
+}
+
+// isInvalidStatus returns true if the write would never succeed, such as a bad
+// request or a missing document, it is moved to the dead letter queue
+func isInvalidStatus(status int) bool {
+	return status > 0 && status != 429 && status < 500
+}
+
+var replayRetryRules = elastic.RetryRules{Retry429: true, Default: true, Retry4xx: false}
+var replayBufferPool = elastic.NewBulkBufferPool("elasticsearch_failover", 1024*1024*1024, 100000)
+
+// replayRequest sends the parked write to the cluster, only the 2xx responses
+// are accepted, the failed items of the bulk requests are returned as the
+// encoded requests, the retryable ones and the invalid ones separately
+func replayRequest(metadata *elastic.ElasticsearchMetadata, data []byte) (status int, retryable, invalid []byte, err error) {
+	req := fasthttp.AcquireRequest()
+	res := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(res)
+
+	if err := req.Decode(data); err != nil {
+		return 400, nil, nil, err
+	}
+
+	host := metadata.GetActiveHost()
+	req.SetHost(host)
+	clonedURI := req.CloneURI()
+	clonedURI.SetScheme(metadata.GetSchema())
+	req.SetURI(clonedURI)
+	fasthttp.ReleaseURI(clonedURI)
+
+	if err := metadata.GetHttpClient(host).Do(req, res); err != nil {
+		return 0, nil, nil, err
+	}
+
+	status = res.StatusCode()
+	if status < 200 || status >= 300 {
+		return status, nil, nil, fmt.Errorf("invalid status code, %v %v", status, util.SubString(util.UnsafeBytesToString(res.GetRawBody()), 0, 256))
+	}
+
+	if !util.ContainStr(string(req.PhantomURI().Path()), "_bulk") {
+		return status, nil, nil, nil
+	}
+
+	//the bulk request is accepted even if some of the items failed
+	successItems := replayBufferPool.AcquireBulkBuffer()
+	nonRetryableItems := replayBufferPool.AcquireBulkBuffer()
+	retryableItems := replayBufferPool.AcquireBulkBuffer()
+	defer func() {
+		replayBufferPool.ReturnBulkBuffer(successItems)
+		replayBufferPool.ReturnBulkBuffer(nonRetryableItems)
+		replayBufferPool.ReturnBulkBuffer(retryableItems)
+	}()
+
+	containError, _, _ := elastic.HandleBulkResponse(req, res, util.MapStr{}, req.GetRawBody(), res.GetRawBody(), successItems, nonRetryableItems, retryableItems, elastic.BulkResponseParseConfig{}, replayRetryRules)
+	if !containError {
+		return status, nil, nil, nil
+	}
+
+	if nonRetryableItems.GetMessageCount() > 0 {
+		nonRetryableItems.SafetyEndWithNewline()
+		invalid = append([]byte{}, req.OverrideBodyEncode(nonRetryableItems.GetMessageBytes(), true)...)
+	}
+	if retryableItems.GetMessageCount() > 0 {
+		retryableItems.SafetyEndWithNewline()
+		retryable = append([]byte{}, req.OverrideBodyEncode(retryableItems.GetMessageBytes(), true)...)
+	}
+	return status, retryable, invalid, nil
+}
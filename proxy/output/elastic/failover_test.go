@@ -0,0 +1,154 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package elastic
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"infini.sh/framework/lib/fasthttp"
+)
+
+func TestIsReadRequest(t *testing.T) {
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+
+	req.Header.SetMethod(fasthttp.MethodGet)
+	req.SetRequestURI("/index/_doc/1")
+	assert.True(t, isReadRequest(req))
+
+	req.Header.SetMethod(fasthttp.MethodPost)
+	req.SetRequestURI("/index/_search")
+	assert.True(t, isReadRequest(req))
+
+	req.SetRequestURI("/_search/scroll")
+	assert.True(t, isReadRequest(req))
+
+	req.SetRequestURI("/_bulk")
+	assert.False(t, isReadRequest(req))
+
+	req.Header.SetMethod(fasthttp.MethodPut)
+	req.SetRequestURI("/index/_doc/1")
+	assert.False(t, isReadRequest(req))
+}
+
+func TestFailoverHysteresis(t *testing.T) {
+	filter := ElasticsearchFailover{
+		config: &FailoverConfig{
+			Clusters:    []string{"primary", "standby"},
+			WriteMode:   writeModeSwitch,
+			HealthCheck: FailoverHealthCheck{FailureThreshold: 2, SuccessThreshold: 2},
+		},
+		minFailoverDuration: time.Minute,
+		failures:            make([]int, 2),
+		successes:           make([]int, 2),
+	}
+
+	now := time.Now()
+	filter.updateState([]bool{false, true}, now)
+	assert.Equal(t, 0, filter.active)
+	filter.updateState([]bool{false, true}, now)
+	assert.Equal(t, 1, filter.active)
+
+	//primary recovered, but stays on the standby for the min duration
+	filter.updateState([]bool{true, true}, now.Add(10*time.Second))
+	filter.updateState([]bool{true, true}, now.Add(20*time.Second))
+	assert.Equal(t, 1, filter.active)
+
+	//flapping resets the consecutive successes
+	filter.updateState([]bool{false, true}, now.Add(70*time.Second))
+	filter.updateState([]bool{true, true}, now.Add(80*time.Second))
+	assert.Equal(t, 1, filter.active)
+
+	filter.updateState([]bool{true, true}, now.Add(90*time.Second))
+	assert.Equal(t, 0, filter.active)
+	assert.False(t, filter.draining)
+}
+
+func TestFailbackWhenStandbyFailed(t *testing.T) {
+	filter := ElasticsearchFailover{
+		config: &FailoverConfig{
+			Clusters:    []string{"primary", "standby"},
+			WriteMode:   writeModeSwitch,
+			HealthCheck: FailoverHealthCheck{FailureThreshold: 2, SuccessThreshold: 2},
+		},
+		minFailoverDuration: time.Minute,
+		failures:            make([]int, 2),
+		successes:           make([]int, 2),
+	}
+
+	now := time.Now()
+	filter.updateState([]bool{false, true}, now)
+	filter.updateState([]bool{false, true}, now)
+	assert.Equal(t, 1, filter.active)
+
+	//the standby died within the min failover duration, the primary is back
+	filter.updateState([]bool{true, false}, now.Add(10*time.Second))
+	assert.Equal(t, 1, filter.active)
+	filter.updateState([]bool{true, false}, now.Add(20*time.Second))
+	assert.Equal(t, 0, filter.active)
+
+	//no healthy cluster to go to, stay on the standby
+	filter.updateState([]bool{false, true}, now.Add(30*time.Second))
+	filter.updateState([]bool{false, true}, now.Add(40*time.Second))
+	assert.Equal(t, 1, filter.active)
+	filter.updateState([]bool{false, false}, now.Add(50*time.Second))
+	filter.updateState([]bool{false, false}, now.Add(60*time.Second))
+	assert.Equal(t, 1, filter.active)
+}
+
+func TestIsInvalidStatus(t *testing.T) {
+	assert.False(t, isInvalidStatus(0))
+	assert.False(t, isInvalidStatus(429))
+	assert.False(t, isInvalidStatus(503))
+	assert.True(t, isInvalidStatus(400))
+	assert.True(t, isInvalidStatus(404))
+	assert.True(t, isInvalidStatus(301))
+}
+
+func TestCloseFailover(t *testing.T) {
+	filter := &ElasticsearchFailover{
+		config:   &FailoverConfig{Clusters: []string{"primary", "standby"}},
+		interval: time.Hour,
+		closed:   make(chan struct{}),
+	}
+
+	done := make(chan struct{})
+	go func() {
+		filter.checkHealth()
+		close(done)
+	}()
+
+	assert.False(t, filter.isClosed())
+	assert.Nil(t, filter.Close())
+	assert.Nil(t, filter.Close())
+	assert.True(t, filter.isClosed())
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the health check was not stopped")
+	}
+}
@@ -0,0 +1,400 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package elastic
+
+import (
+	"bytes"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/buger/jsonparser"
+	log "github.com/cihub/seelog"
+	"infini.sh/framework/core/elastic"
+	"infini.sh/framework/core/global"
+	"infini.sh/framework/core/stats"
+	"infini.sh/framework/core/util"
+	"infini.sh/framework/lib/fasthttp"
+)
+
+type HedgingConfig struct {
+	Enabled       bool    `config:"enabled"`
+	Percentile    float64 `config:"percentile"`     //hedge when the first request is slower than this latency percentile
+	BudgetPercent float64 `config:"budget_percent"` //max percentage of extra requests caused by hedging
+	MinDelay      string  `config:"min_delay"`
+	WindowSize    int     `config:"window_size"` //number of latency samples to keep
+	MinSamples    int     `config:"min_samples"` //no hedging before enough samples are collected
+}
+
+var hedgeablePaths = [][]byte{[]byte("/_search"), []byte("/_msearch"), []byte("/_count")}
+var scrollPath = []byte("/scroll")
+
+const cancelReasonHedgeLost = "hedge_lost"
+
+// isHedgeableRequest only allows read requests, they are safe to be sent twice
+func isHedgeableRequest(req *fasthttp.Request) bool {
+	method := req.Header.Method()
+	get := util.CompareStringAndBytes(method, fasthttp.MethodGet) || util.CompareStringAndBytes(method, fasthttp.MethodHead)
+	if !get && !util.CompareStringAndBytes(method, fasthttp.MethodPost) {
+		return false
+	}
+
+	path := req.PhantomURI().Path()
+	//scroll continuations move the cursor forward, don't duplicate them
+	if bytes.Contains(path, scrollPath) {
+		return false
+	}
+
+	//the initial scroll search and the point in time search open a search
+	//context, the duplicated one would be leaked on the losing node
+	if req.PhantomURI().QueryArgs().Has("scroll") {
+		return false
+	}
+	if body := req.GetRawBody(); len(body) > 0 {
+		if _, _, _, err := jsonparser.Get(body, "pit"); err == nil {
+			return false
+		}
+	}
+
+	if get {
+		return true
+	}
+
+	for _, v := range hedgeablePaths {
+		if bytes.HasSuffix(path, v) {
+			return true
+		}
+	}
+	return false
+}
+
+type latencyTracker struct {
+	locker     sync.Mutex
+	samples    []time.Duration
+	offset     int
+	full       bool
+	percentile float64
+	cached     time.Duration
+	dirty      int
+}
+
+func newLatencyTracker(size int, percentile float64) *latencyTracker {
+	return &latencyTracker{samples: make([]time.Duration, size), percentile: percentile}
+}
+
+func (t *latencyTracker) record(d time.Duration) {
+	t.locker.Lock()
+	t.samples[t.offset] = d
+	t.offset++
+	if t.offset >= len(t.samples) {
+		t.offset = 0
+		t.full = true
+	}
+	t.dirty++
+	t.locker.Unlock()
+}
+
+func (t *latencyTracker) size() int {
+	if t.full {
+		return len(t.samples)
+	}
+	return t.offset
+}
+
+// value returns the latency of the configured percentile, it is recalculated
+// after every 100 new samples
+func (t *latencyTracker) value() time.Duration {
+	t.locker.Lock()
+	defer t.locker.Unlock()
+
+	if t.cached > 0 && t.dirty < 100 {
+		return t.cached
+	}
+
+	size := t.size()
+	if size == 0 {
+		return 0
+	}
+
+	sorted := make([]time.Duration, size)
+	copy(sorted, t.samples[:size])
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	idx := int(float64(size)*t.percentile/100) - 1
+	if idx < 0 {
+		idx = 0
+	}
+	if idx >= size {
+		idx = size - 1
+	}
+	t.cached = sorted[idx]
+	t.dirty = 0
+	return t.cached
+}
+
+// hedgeBudget limits hedged requests to a percentage of the total requests,
+// the counters are halved periodically so that the budget follows recent traffic
+type hedgeBudget struct {
+	locker   sync.Mutex
+	percent  float64
+	requests float64
+	hedges   float64
+}
+
+const hedgeBudgetDecayThreshold = 10000
+
+func (b *hedgeBudget) onRequest() {
+	b.locker.Lock()
+	b.requests++
+	if b.requests > hedgeBudgetDecayThreshold {
+		b.requests = b.requests / 2
+		b.hedges = b.hedges / 2
+	}
+	b.locker.Unlock()
+}
+
+func (b *hedgeBudget) tryAcquire() bool {
+	b.locker.Lock()
+	defer b.locker.Unlock()
+	if b.hedges+1 > b.requests*b.percent/100 {
+		return false
+	}
+	b.hedges++
+	return true
+}
+
+type hedger struct {
+	config   *HedgingConfig
+	minDelay time.Duration
+	latency  *latencyTracker
+	budget   *hedgeBudget
+}
+
+func newHedger(cfg *HedgingConfig) *hedger {
+	if cfg.WindowSize <= 0 {
+		cfg.WindowSize = 1000
+	}
+	return &hedger{
+		config:   cfg,
+		minDelay: util.GetDurationOrDefault(cfg.MinDelay, 5*time.Millisecond),
+		latency:  newLatencyTracker(cfg.WindowSize, cfg.Percentile),
+		budget:   &hedgeBudget{percent: cfg.BudgetPercent},
+	}
+}
+
+// delay returns how long to wait before sending the hedged request, zero
+// means hedging is not ready yet
+func (h *hedger) delay() time.Duration {
+	h.latency.locker.Lock()
+	size := h.latency.size()
+	h.latency.locker.Unlock()
+	if size < h.config.MinSamples {
+		return 0
+	}
+	d := h.latency.value()
+	if d < h.minDelay {
+		d = h.minDelay
+	}
+	return d
+}
+
+type hedgedResult struct {
+	host string
+	req  *fasthttp.Request
+	res  *fasthttp.Response
+	err  error
+}
+
+func (r *hedgedResult) release() {
+	fasthttp.ReleaseRequest(r.req)
+	fasthttp.ReleaseResponse(r.res)
+}
+
+func (p *ReverseProxy) doRequest(pc fasthttp.ClientAPI, req *fasthttp.Request, res *fasthttp.Response) error {
+	if p.proxyConfig.Timeout > 0 {
+		return pc.DoTimeout(req, res, p.proxyConfig.Timeout)
+	}
+	return pc.Do(req, res)
+}
+
+// pickHedgeHost chooses an available node other than the given one
+func (p *ReverseProxy) pickHedgeHost(host string, metadata *elastic.ElasticsearchMetadata) (string, fasthttp.ClientAPI) {
+	p.locker.RLock()
+	defer p.locker.RUnlock()
+
+	size := len(p.endpoints)
+	if size < 2 {
+		return "", nil
+	}
+
+	seed := rand.Intn(size)
+	for i := 0; i < size; i++ {
+		e := p.endpoints[(seed+i)%size]
+		if e == host || !elastic.IsHostAvailable(e) {
+			continue
+		}
+		if metadata.Config.ClientMode == "host" {
+			if c, ok := p.hostClients[e]; ok {
+				return e, c
+			}
+		} else if c, ok := p.clients[e]; ok {
+			return e, c
+		}
+	}
+	return "", nil
+}
+
+// doHedgedRequest sends the request to the chosen host, if there is no response
+// within the percentile latency, a duplicated request will be sent to another
+// node, the first response wins, the task of the slower one is cancelled by the
+// X-Opaque-Id and its response is released in background, the tasks are also
+// cancelled as doCancellableRequest if the task cancellation is enabled
+func (p *ReverseProxy) doHedgedRequest(pc fasthttp.ClientAPI, host string, metadata *elastic.ElasticsearchMetadata, myctx *fasthttp.RequestCtx, res *fasthttp.Response) (string, error) {
+	req := &myctx.Request
+
+	p.hedger.budget.onRequest()
+
+	delay := p.hedger.delay()
+	if delay <= 0 {
+		start := time.Now()
+		var err error
+		if p.canceller != nil {
+			err = p.doCancellableRequest(pc, host, metadata, myctx, res)
+		} else {
+			err = p.doRequest(pc, req, res)
+		}
+		if err == nil {
+			p.hedger.latency.record(time.Since(start))
+		}
+		return host, err
+	}
+
+	results := make(chan *hedgedResult, 2)
+	send := func(c fasthttp.ClientAPI, h string, r *fasthttp.Request) {
+		go func() {
+			result := &hedgedResult{host: h, req: r, res: fasthttp.AcquireResponse()}
+			start := time.Now()
+			result.err = p.doRequest(c, r, result.res)
+			if result.err == nil {
+				p.hedger.latency.record(time.Since(start))
+			}
+			results <- result
+		}()
+	}
+
+	//tag the requests, so the task of the loser can be found and cancelled
+	opaqueID, clientID := tagRequest(req)
+	authorization := string(req.Header.Peek(fasthttp.HeaderAuthorization))
+
+	primary := fasthttp.AcquireRequest()
+	req.CopyTo(primary)
+	send(pc, host, primary)
+	pending := 1
+
+	timer := util.AcquireTimer(delay)
+	defer util.ReleaseTimer(timer)
+	hedgeTimer := timer.C
+
+	var tick <-chan time.Time
+	if p.canceller != nil && myctx.Conn() != nil {
+		ticker := time.NewTicker(p.canceller.checkInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	sent := []string{host}
+	hedgeHost := ""
+	cancelled := false
+	var first *hedgedResult
+	for first == nil {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == fasthttp.ErrTimeout && p.canceller != nil {
+				go p.cancelTask(metadata, r.host, opaqueID, authorization, cancelReasonTimeout)
+			}
+			//the first one failed, wait for the other
+			if r.err != nil && pending > 0 {
+				r.release()
+				continue
+			}
+			first = r
+		case <-hedgeTimer:
+			hedgeTimer = nil
+			h, hedgeClient := p.pickHedgeHost(host, metadata)
+			if h == "" {
+				continue
+			}
+			if !p.hedger.budget.tryAcquire() {
+				stats.Increment("reverse_proxy", "hedge_budget_exceeded")
+				continue
+			}
+			hedgeHost = h
+			hedged := fasthttp.AcquireRequest()
+			req.CopyTo(hedged)
+			hedged.SetHost(hedgeHost)
+			send(hedgeClient, hedgeHost, hedged)
+			sent = append(sent, hedgeHost)
+			pending++
+			stats.Increment("reverse_proxy", "hedge_sent")
+			if global.Env().IsDebug {
+				log.Tracef("request [%v] to [%v] is slower than %v, hedged to [%v]", req.PhantomURI().String(), host, delay, hedgeHost)
+			}
+		case <-tick:
+			if isConnClosed(myctx.Conn()) {
+				tick = nil
+				hedgeTimer = nil
+				cancelled = true
+				for _, h := range sent {
+					go p.cancelTask(metadata, h, opaqueID, authorization, cancelReasonDisconnected)
+				}
+			}
+		}
+	}
+
+	if first.host != host {
+		stats.Increment("reverse_proxy", "hedge_wins")
+	}
+
+	first.res.CopyTo(res)
+	first.release()
+	restoreOpaqueID(res, clientID)
+
+	if pending > 0 {
+		if !cancelled {
+			loser := host
+			if first.host == host {
+				loser = hedgeHost
+			}
+			go p.cancelTask(metadata, loser, opaqueID, authorization, cancelReasonHedgeLost)
+		}
+		go func() {
+			r := <-results
+			r.release()
+		}()
+	}
+
+	return first.host, first.err
+}
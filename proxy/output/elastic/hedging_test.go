@@ -0,0 +1,99 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package elastic
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"infini.sh/framework/lib/fasthttp"
+)
+
+func TestIsHedgeableRequest(t *testing.T) {
+	req := fasthttp.Request{}
+
+	req.Header.SetMethod(fasthttp.MethodGet)
+	req.SetRequestURI("/index/_doc/1")
+	assert.True(t, isHedgeableRequest(&req))
+
+	req.Header.SetMethod(fasthttp.MethodPost)
+	req.SetRequestURI("/index/_search")
+	assert.True(t, isHedgeableRequest(&req))
+
+	req.SetRequestURI("/_msearch")
+	assert.True(t, isHedgeableRequest(&req))
+
+	req.SetRequestURI("/_search/scroll")
+	assert.False(t, isHedgeableRequest(&req))
+
+	req.SetRequestURI("/index/_doc")
+	assert.False(t, isHedgeableRequest(&req))
+
+	//the search contexts would be leaked on the losing node
+	req.SetRequestURI("/index/_search?scroll=1m")
+	assert.False(t, isHedgeableRequest(&req))
+
+	req.SetRequestURI("/_search")
+	req.SetBodyString(`{"pit":{"id":"46ToAwMDaWR5BXV1aWQy","keep_alive":"1m"},"query":{"match_all":{}}}`)
+	assert.False(t, isHedgeableRequest(&req))
+	req.Header.SetMethod(fasthttp.MethodGet)
+	assert.False(t, isHedgeableRequest(&req))
+	req.SetBodyString(`{"query":{"term":{"pit":"x"}}}`)
+	assert.True(t, isHedgeableRequest(&req))
+	req.ResetBody()
+
+	req.Header.SetMethod(fasthttp.MethodDelete)
+	req.SetRequestURI("/index/_search")
+	assert.False(t, isHedgeableRequest(&req))
+}
+
+func TestLatencyTrackerPercentile(t *testing.T) {
+	tracker := newLatencyTracker(100, 95)
+	for i := 1; i <= 100; i++ {
+		tracker.record(time.Duration(i) * time.Millisecond)
+	}
+	assert.Equal(t, 95*time.Millisecond, tracker.value())
+
+	//ring buffer overwrites the oldest samples
+	for i := 0; i < 100; i++ {
+		tracker.record(time.Second)
+	}
+	assert.Equal(t, time.Second, tracker.value())
+}
+
+func TestHedgeBudget(t *testing.T) {
+	budget := hedgeBudget{percent: 10}
+	for i := 0; i < 100; i++ {
+		budget.onRequest()
+	}
+
+	acquired := 0
+	for i := 0; i < 20; i++ {
+		if budget.tryAcquire() {
+			acquired++
+		}
+	}
+	assert.Equal(t, 10, acquired)
+}
@@ -29,6 +29,7 @@ import (
 	"fmt"
 	"github.com/emirpasic/gods/sets/hashset"
 	"infini.sh/framework/core/errors"
+	"math"
 	"math/rand"
 	"net"
 	"sort"
@@ -43,7 +44,9 @@ import (
 	task2 "infini.sh/framework/core/task"
 	"infini.sh/framework/core/util"
 	"infini.sh/framework/lib/fasthttp"
+	"infini.sh/gateway/common/pressure"
 	"infini.sh/gateway/proxy/balancer"
+	retry2 "infini.sh/gateway/proxy/retry"
 )
 
 type ReverseProxy struct {
@@ -61,8 +64,25 @@ type ReverseProxy struct {
 	client      fasthttp.ClientAPI
 	host        string
 	HTTPPool    *fasthttp.RequestResponsePool
+
+	//discovered hosts and their weights, endpoints is the subset taking traffic
+	candidates        []string
+	baseWeights       map[string]int
+	joinedAt          map[string]time.Time
+	warming           map[string]bool
+	slowStartDuration time.Duration
+
+	hedger  *hedger
+	retrier *retry2.Retrier
+
+	stickyKeepAlive time.Duration
+	canceller       *taskCanceller
+	pressureAware   bool
 }
 
+const slowStartWeightScale = 100
+const pressureWeightScale = 10
+
 func isEndpointValid(node elastic.NodesInfo, cfg *ProxyConfig) bool {
 
 	var hasExclude = false
@@ -161,7 +181,7 @@ func (p *ReverseProxy) refreshNodes(force bool) {
 	}
 	cfg := p.proxyConfig
 
-	ws := []int{}
+	weights := map[string]int{}
 	esConfig := elastic.GetConfig(cfg.Elasticsearch)
 
 	metadata := elastic.GetOrInitMetadata(esConfig)
@@ -275,7 +295,7 @@ func (p *ReverseProxy) refreshNodes(force bool) {
 		if !o || w <= 0 {
 			w = 1
 		}
-		ws = append(ws, w)
+		weights[endpoint] = w
 		newHosts = append(newHosts, endpoint)
 	}
 
@@ -286,23 +306,230 @@ func (p *ReverseProxy) refreshNodes(force bool) {
 
 	sort.Strings(newHosts)
 
-	if util.JoinArray(newHosts, ", ") == util.JoinArray(p.endpoints, ", ") {
+	if util.JoinArray(newHosts, ", ") == util.JoinArray(p.candidates, ", ") {
 		log.Debugf("hosts of [%v] no change, skip", esConfig.Name)
 		return
 	}
 
-	//replace with new hostClients
-	//TODO add locker
-	p.bla = balancer.NewBalancer(ws)
+	//nodes joined after the first discovery are new or recovered, they need warmup
+	joined := []string{}
+	if len(p.candidates) > 0 {
+		for _, endpoint := range newHosts {
+			if !containsHost(p.candidates, endpoint) {
+				joined = append(joined, endpoint)
+			}
+		}
+	}
+
 	newHostsStr := util.JoinArray(newHosts, ", ")
 	if rate.GetRateLimiterPerSecond("elasticsearch", esConfig.Name+newHostsStr, 1).Allow() {
-		log.Infof("elasticsearch [%v] hosts: [%v] => [%v]", esConfig.Name, util.JoinArray(p.endpoints, ", "), newHostsStr)
+		log.Infof("elasticsearch [%v] hosts: [%v] => [%v]", esConfig.Name, util.JoinArray(p.candidates, ", "), newHostsStr)
+	}
+
+	p.candidates = newHosts
+	p.baseWeights = weights
+	for k := range p.joinedAt {
+		if !containsHost(newHosts, k) {
+			delete(p.joinedAt, k)
+		}
+	}
+
+	now := time.Now()
+	for _, endpoint := range joined {
+		if cfg.MinIdleConnection > 0 && !p.proxyConfig.FixedClient {
+			p.warming[endpoint] = true
+			go p.warmupNode(endpoint, esConfig.ClientMode, metadata.GetSchema())
+		} else if p.slowStartDuration > 0 {
+			p.joinedAt[endpoint] = now
+		}
 	}
-	p.endpoints = newHosts
+
+	//replace with new hostClients
+	p.rebuildBalancer(now)
 	log.Trace(esConfig.Name, " elasticsearch client nodes refreshed")
 
 }
 
+func containsHost(hosts []string, host string) bool {
+	for _, v := range hosts {
+		if v == host {
+			return true
+		}
+	}
+	return false
+}
+
+func sameHosts(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// rebuildBalancer distributes traffic to the warmed candidates, weights of
+// nodes in the slow start window are scaled by the elapsed time, the caller
+// must hold the lock
+func (p *ReverseProxy) rebuildBalancer(now time.Time) {
+	endpoints := []string{}
+	ws := []int{}
+	for _, endpoint := range p.candidates {
+		if p.warming[endpoint] {
+			continue
+		}
+		w := p.baseWeights[endpoint]
+		if p.slowStartDuration > 0 {
+			joined, ok := p.joinedAt[endpoint]
+			if ok && now.Sub(joined) >= p.slowStartDuration {
+				delete(p.joinedAt, endpoint)
+			}
+			w = balancer.SlowStartWeight(w*slowStartWeightScale, joined, p.slowStartDuration, now)
+		}
+		if p.pressureAware {
+			var saturated bool
+			w, saturated = p.pressureWeight(endpoint, w)
+			if saturated {
+				continue
+			}
+		}
+		endpoints = append(endpoints, endpoint)
+		ws = append(ws, w)
+	}
+
+	//all nodes are warming or saturated, no choice but use them anyway
+	if len(endpoints) == 0 {
+		for _, endpoint := range p.candidates {
+			endpoints = append(endpoints, endpoint)
+			ws = append(ws, p.baseWeights[endpoint])
+		}
+	}
+
+	if len(endpoints) == 0 {
+		return
+	}
+
+	//the weights are fixed, the same balancer as the nodes without slow start
+	if p.slowStartDuration <= 0 && !p.pressureAware {
+		p.bla = balancer.NewBalancer(ws)
+		p.endpoints = endpoints
+		return
+	}
+
+	//keep the state of the balancer if only the weights changed, otherwise
+	//the ramping nodes get no traffic at low request rates
+	if b, ok := p.bla.(*balancer.SmoothBalancer); ok && sameHosts(p.endpoints, endpoints) && b.Update(ws) {
+		return
+	}
+	p.bla = balancer.NewSmoothBalancer(ws)
+	p.endpoints = endpoints
+}
+
+// pressureWeight lowers the weight by the thread pool pressure of the node,
+// saturated nodes should not take traffic if there are other choices
+func (p *ReverseProxy) pressureWeight(endpoint string, w int) (int, bool) {
+	search, ok := pressure.GetNodeScore(p.proxyConfig.Elasticsearch, endpoint, pressure.PoolSearch)
+	if !ok {
+		return w * pressureWeightScale, false
+	}
+	write, _ := pressure.GetNodeScore(p.proxyConfig.Elasticsearch, endpoint, pressure.PoolWrite)
+	score := math.Max(search, write)
+	if score >= 1 {
+		return 0, true
+	}
+	w = int(float64(w*pressureWeightScale) * (1 - score))
+	if w < 1 {
+		w = 1
+	}
+	return w, false
+}
+
+// applyPressure rebuilds the balancer by the latest pressure of the nodes
+func (p *ReverseProxy) applyPressure() {
+	p.locker.Lock()
+	defer p.locker.Unlock()
+	p.rebuildBalancer(time.Now())
+}
+
+// rampWeights steps up the weights of nodes within the slow start window
+func (p *ReverseProxy) rampWeights() {
+	p.locker.Lock()
+	defer p.locker.Unlock()
+
+	if len(p.joinedAt) == 0 {
+		return
+	}
+
+	if global.Env().IsDebug {
+		log.Tracef("ramping up weights for elasticsearch [%v], %v", p.proxyConfig.Elasticsearch, p.joinedAt)
+	}
+
+	p.rebuildBalancer(time.Now())
+}
+
+// warmupNode tries to open the configured idle connections to the new node by
+// sending concurrent lightweight requests, then lets the node take traffic, it
+// is best-effort, fewer connections are opened if some requests finish before
+// the others start, and the failures don't hold the node back
+func (p *ReverseProxy) warmupNode(endpoint, clientMode, schema string) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Errorf("failed to warmup node [%v], %v", endpoint, r)
+		}
+		p.locker.Lock()
+		delete(p.warming, endpoint)
+		if containsHost(p.candidates, endpoint) {
+			if p.slowStartDuration > 0 {
+				p.joinedAt[endpoint] = time.Now()
+			}
+			p.rebuildBalancer(time.Now())
+		}
+		p.locker.Unlock()
+	}()
+
+	p.locker.RLock()
+	var c fasthttp.ClientAPI
+	if clientMode == "host" {
+		c = p.hostClients[endpoint]
+	} else {
+		c = p.clients[endpoint]
+	}
+	p.locker.RUnlock()
+
+	if c == nil {
+		return
+	}
+
+	start := time.Now()
+	wg := sync.WaitGroup{}
+	for i := 0; i < p.proxyConfig.MinIdleConnection; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := fasthttp.AcquireRequest()
+			res := fasthttp.AcquireResponse()
+			defer fasthttp.ReleaseRequest(req)
+			defer fasthttp.ReleaseResponse(res)
+			req.SetRequestURI(schema + "://" + endpoint + "/")
+			req.Header.SetMethod(fasthttp.MethodHead)
+			err := c.DoTimeout(req, res, p.proxyConfig.WarmupTimeout)
+			if err != nil {
+				stats.Increment("reverse_proxy", "warmup_failure")
+				if global.Env().IsDebug {
+					log.Debugf("failed to warmup connection to [%v], %v", endpoint, err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	stats.Increment("reverse_proxy", "warmup_node")
+	log.Debugf("elasticsearch [%v] node [%v] warmed up with %v connections in %v", p.proxyConfig.Elasticsearch, endpoint, p.proxyConfig.MinIdleConnection, time.Since(start))
+}
+
 func NewReverseProxy(cfg *ProxyConfig) *ReverseProxy {
 
 	p := ReverseProxy{
@@ -311,6 +538,30 @@ func NewReverseProxy(cfg *ProxyConfig) *ReverseProxy {
 		hostClients: map[string]*fasthttp.HostClient{},
 		clients:     map[string]*fasthttp.Client{},
 		locker:      sync.RWMutex{},
+		baseWeights: map[string]int{},
+		joinedAt:    map[string]time.Time{},
+		warming:     map[string]bool{},
+	}
+
+	if cfg.SlowStart.Enabled {
+		p.slowStartDuration = util.GetDurationOrDefault(cfg.SlowStart.Duration, 60*time.Second)
+	}
+
+	if cfg.StickyRouting.Enabled {
+		p.stickyKeepAlive = util.GetDurationOrDefault(cfg.StickyRouting.DefaultKeepAlive, 5*time.Minute)
+	}
+
+	if cfg.TaskCancellation.Enabled {
+		p.canceller = newTaskCanceller(&cfg.TaskCancellation)
+	}
+
+	if cfg.Hedging.Enabled {
+		p.hedger = newHedger(&cfg.Hedging)
+	}
+
+	p.retrier = retry2.New("elasticsearch."+cfg.Elasticsearch, &cfg.Retry, time.Duration(cfg.RetryDelayInMs)*time.Millisecond)
+	if cfg.RetryOnBackendBusy {
+		p.retrier.AddPolicyIfMissing(retry2.Policy{Status: []int{fasthttp.StatusTooManyRequests}, MaxRetries: cfg.MaxRetryTimes})
 	}
 
 	p.refreshNodes(true)
@@ -334,6 +585,32 @@ func NewReverseProxy(cfg *ProxyConfig) *ReverseProxy {
 			}
 			task2.RegisterScheduleTask(task)
 		}
+
+		if cfg.PressureAware.Enabled {
+			p.pressureAware = true
+			pressure.Watch(cfg.Elasticsearch, cfg.PressureAware.Collector)
+			task := task2.ScheduleTask{
+				Description: fmt.Sprintf("steer traffic by thread pool pressure for elasticsearch [%v]", cfg.Elasticsearch),
+				Type:        "interval",
+				Interval:    cfg.PressureAware.Collector.Interval,
+				Task: func(ctx context.Context) {
+					p.applyPressure()
+				},
+			}
+			task2.RegisterScheduleTask(task)
+		}
+
+		if p.slowStartDuration > 0 {
+			task := task2.ScheduleTask{
+				Description: fmt.Sprintf("ramp up weights for elasticsearch [%v]", cfg.Elasticsearch),
+				Type:        "interval",
+				Interval:    cfg.SlowStart.Interval,
+				Task: func(ctx context.Context) {
+					p.rampWeights()
+				},
+			}
+			task2.RegisterScheduleTask(task)
+		}
 	}
 
 	p.HTTPPool = fasthttp.NewRequestResponsePool("es_proxy_" + cfg.Elasticsearch)
@@ -346,6 +623,9 @@ func (p *ReverseProxy) getHostClient() (clientAvailable bool, client *fasthttp.H
 		panic("ReverseProxy has been closed")
 	}
 
+	p.locker.RLock()
+	defer p.locker.RUnlock()
+
 	if len(p.hostClients) == 0 || len(p.endpoints) == 0 {
 		log.Error("no upstream was found")
 		return false, nil, ""
@@ -445,6 +725,12 @@ RANDOM:
 var failureMessage = []string{"connection refused", "no such host", "timed out", "Connection: close"}
 
 func (p *ReverseProxy) DelegateRequest(elasticsearch string, metadata *elastic.ElasticsearchMetadata, myctx *fasthttp.RequestCtx) {
+	p.delegateRequest(elasticsearch, metadata, myctx, "")
+}
+
+// delegateRequest sends the request to the sticky host if it is still
+// available, or to the host chosen by the balancer
+func (p *ReverseProxy) delegateRequest(elasticsearch string, metadata *elastic.ElasticsearchMetadata, myctx *fasthttp.RequestCtx, stickyHost string) {
 
 	if p.proxyConfig.SkipEnrichMetadata {
 		//update context
@@ -499,13 +785,17 @@ func (p *ReverseProxy) DelegateRequest(elasticsearch string, metadata *elastic.E
 	var retryChooseHost = true
 	var skippedHost *hashset.Set
 	retry := 0
+	p.retrier.OnRequest()
 START:
 
 	if retryChooseHost {
 		retryChooseHost = false
 
 		oldHost := host
-		if p.proxyConfig.FixedClient {
+		if stickyHost != "" && (skippedHost == nil || !skippedHost.Contains(stickyHost)) && (p.proxyConfig.SkipAvailableCheck || elastic.IsHostAvailable(stickyHost)) {
+			host = stickyHost
+			pc = metadata.GetHttpClient(host)
+		} else if p.proxyConfig.FixedClient {
 			pc = p.client
 			host = p.host
 		} else {
@@ -558,10 +848,12 @@ START:
 	metadata.CheckNodeTrafficThrottle(host, 1, myctx.Request.GetRequestLength(), 0)
 
 	var err error
-	if p.proxyConfig.Timeout > 0 {
-		err = pc.DoTimeout(&myctx.Request, res, p.proxyConfig.Timeout)
+	if p.hedger != nil && retry == 0 && stickyHost == "" && !p.proxyConfig.FixedClient && isHedgeableRequest(&myctx.Request) {
+		host, err = p.doHedgedRequest(pc, host, metadata, myctx, res)
+	} else if p.canceller != nil && isCancellableRequest(&myctx.Request) {
+		err = p.doCancellableRequest(pc, host, metadata, myctx, res)
 	} else {
-		err = pc.Do(&myctx.Request, res)
+		err = p.doRequest(pc, &myctx.Request, res)
 	}
 
 	if err != nil {
@@ -621,9 +913,9 @@ START:
 
 		if retryAble {
 			retry++
-			if p.proxyConfig.MaxRetryTimes > 0 && retry < p.proxyConfig.MaxRetryTimes {
-				if p.proxyConfig.RetryDelayInMs > 0 && !retryChooseHost { // No delay is required when switching hosts.
-					time.Sleep(time.Duration(p.proxyConfig.RetryDelayInMs) * time.Millisecond)
+			if p.proxyConfig.MaxRetryTimes > 0 && retry < p.proxyConfig.MaxRetryTimes && p.retrier.AllowRetry() {
+				if !retryChooseHost { // No delay is required when switching hosts.
+					time.Sleep(p.retrier.Delay(retry-1, res))
 				}
 				myctx.Request.Header.Add("RETRY_AT", time.Now().String())
 				goto START
@@ -646,6 +938,29 @@ START:
 		if global.Env().IsDebug {
 			log.Tracef("request [%v] [%v] [%v] [%v]", myctx.Request.PhantomURI().String(), util.SubString(util.UnsafeBytesToString(myctx.Request.GetRawBody()), 0, 256), res.StatusCode(), util.SubString(util.UnsafeBytesToString(res.GetRawBody()), 0, 256))
 		}
+
+		if p.proxyConfig.StickyRouting.Enabled {
+			recordCursorRoute(elasticsearch, host, &myctx.Request, res, p.stickyKeepAlive, time.Now())
+		}
+
+		//retry by the policy of the status code
+		policy := p.retrier.GetPolicy(res.StatusCode())
+		if policy != nil && retry < policy.MaxRetries && (!policy.ReadonlyOnly || retry2.IsReadonlyRequest(&myctx.Request)) && p.retrier.AllowRetry() {
+			time.Sleep(p.retrier.Delay(retry, res))
+			retry++
+			if policy.SwitchHost && !p.proxyConfig.FixedClient {
+				if skippedHost == nil {
+					skippedHost = hashset.New()
+				}
+				skippedHost.Add(host)
+				retryChooseHost = true
+			}
+			if global.Env().IsDebug {
+				log.Tracef("retry request [%v] on status [%v], #%v", myctx.Request.PhantomURI().String(), res.StatusCode(), retry)
+			}
+			myctx.Request.Header.Add("RETRY_AT", time.Now().String())
+			goto START
+		}
 	}
 
 	if !p.proxyConfig.SkipKeepOriginalURI {
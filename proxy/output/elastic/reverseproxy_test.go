@@ -0,0 +1,72 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package elastic
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"infini.sh/gateway/proxy/balancer"
+)
+
+func TestRebuildBalancer(t *testing.T) {
+	now := time.Now()
+	p := &ReverseProxy{
+		candidates:  []string{"node-1", "node-2"},
+		baseWeights: map[string]int{"node-1": 1, "node-2": 1},
+		joinedAt:    map[string]time.Time{},
+		warming:     map[string]bool{},
+	}
+
+	//slow start is disabled, the weights never change
+	p.rebuildBalancer(now)
+	_, smooth := p.bla.(*balancer.SmoothBalancer)
+	assert.False(t, smooth)
+	hits := map[string]int{}
+	for i := 0; i < 10; i++ {
+		hits[p.endpoints[p.bla.Distribute()]]++
+	}
+	assert.Equal(t, map[string]int{"node-1": 5, "node-2": 5}, hits)
+
+	//the new node ramps up from the minimal weight
+	p.slowStartDuration = 100 * time.Second
+	p.joinedAt["node-2"] = now
+	p.rebuildBalancer(now)
+	_, smooth = p.bla.(*balancer.SmoothBalancer)
+	assert.True(t, smooth)
+	hits = map[string]int{}
+	for i := 0; i < 101; i++ {
+		hits[p.endpoints[p.bla.Distribute()]]++
+	}
+	assert.Equal(t, map[string]int{"node-1": 100, "node-2": 1}, hits)
+
+	//the window passed, both at the full weight
+	p.rebuildBalancer(now.Add(200 * time.Second))
+	hits = map[string]int{}
+	for i := 0; i < 10; i++ {
+		hits[p.endpoints[p.bla.Distribute()]]++
+	}
+	assert.Equal(t, map[string]int{"node-1": 5, "node-2": 5}, hits)
+}
@@ -0,0 +1,264 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package elastic
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buger/jsonparser"
+	"infini.sh/framework/core/stats"
+	"infini.sh/framework/core/util"
+	"infini.sh/framework/lib/fasthttp"
+)
+
+type StickyRoutingConfig struct {
+	Enabled          bool   `config:"enabled"`
+	DefaultKeepAlive string `config:"default_keep_alive"` //used when the keep alive is not specified in the request
+}
+
+// cursorRoute is the upstream which issued a scroll or pit id
+type cursorRoute struct {
+	cluster string
+	host    string
+	expire  time.Time
+}
+
+// cursorStore keeps routes by the digest of the ids, expired routes are
+// removed periodically
+type cursorStore struct {
+	locker      sync.RWMutex
+	routes      map[string]cursorRoute
+	lastCleanup time.Time
+}
+
+var cursorRoutes = &cursorStore{routes: map[string]cursorRoute{}}
+
+func (s *cursorStore) get(id string, now time.Time) (cursorRoute, bool) {
+	s.locker.RLock()
+	route, ok := s.routes[util.MD5digestString(id)]
+	s.locker.RUnlock()
+	if !ok || now.After(route.expire) {
+		return route, false
+	}
+	return route, true
+}
+
+func (s *cursorStore) set(id string, route cursorRoute, now time.Time) {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	s.routes[util.MD5digestString(id)] = route
+	if now.Sub(s.lastCleanup) > time.Minute {
+		s.lastCleanup = now
+		for k, v := range s.routes {
+			if now.After(v.expire) {
+				delete(s.routes, k)
+			}
+		}
+	}
+}
+
+func (s *cursorStore) delete(id string) {
+	s.locker.Lock()
+	delete(s.routes, util.MD5digestString(id))
+	s.locker.Unlock()
+}
+
+var (
+	scrollContinuationPath = []byte("/_search/scroll")
+	searchSuffix           = []byte("/_search")
+	pitSuffix              = []byte("/_pit")
+	openSearchPitSuffix    = []byte("/_search/point_in_time")
+	pitKeyword             = []byte("\"pit\"")
+)
+
+const (
+	cursorNone = iota
+	cursorScroll
+	cursorPIT
+)
+
+// getCursorIDs returns the scroll or pit ids referenced by the request
+func getCursorIDs(req *fasthttp.Request) (int, []string) {
+	path := req.PhantomURI().Path()
+
+	if i := bytes.Index(path, scrollContinuationPath); i >= 0 {
+		ids := []string{}
+		//the id in path, eg: /_search/scroll/<id>
+		rest := bytes.Trim(path[i+len(scrollContinuationPath):], "/")
+		if len(rest) > 0 {
+			ids = append(ids, strings.Split(string(rest), ",")...)
+		}
+		if v := req.PhantomURI().QueryArgs().Peek("scroll_id"); len(v) > 0 {
+			ids = append(ids, string(v))
+		}
+		ids = append(ids, getStringOrArray(req.GetRawBody(), "scroll_id")...)
+		return cursorScroll, ids
+	}
+
+	if req.Header.IsDelete() && (bytes.HasSuffix(path, pitSuffix) || bytes.HasSuffix(path, openSearchPitSuffix)) {
+		body := req.GetRawBody()
+		ids := getStringOrArray(body, "id")
+		ids = append(ids, getStringOrArray(body, "pit_id")...)
+		return cursorPIT, ids
+	}
+
+	if bytes.HasSuffix(path, searchSuffix) {
+		body := req.GetRawBody()
+		if bytes.Contains(body, pitKeyword) {
+			if id, err := jsonparser.GetString(body, "pit", "id"); err == nil && id != "" {
+				return cursorPIT, []string{id}
+			}
+		}
+	}
+
+	return cursorNone, nil
+}
+
+func getStringOrArray(data []byte, key string) []string {
+	if len(data) == 0 {
+		return nil
+	}
+	v, t, _, err := jsonparser.Get(data, key)
+	if err != nil {
+		return nil
+	}
+	switch t {
+	case jsonparser.String:
+		return []string{string(v)}
+	case jsonparser.Array:
+		ids := []string{}
+		jsonparser.ArrayEach(v, func(value []byte, dataType jsonparser.ValueType, offset int, err error) {
+			if dataType == jsonparser.String {
+				ids = append(ids, string(value))
+			}
+		})
+		return ids
+	}
+	return nil
+}
+
+// lookupCursorRoute returns the upstream of the first known id in the request
+func lookupCursorRoute(req *fasthttp.Request, now time.Time) (cursorRoute, bool) {
+	kind, ids := getCursorIDs(req)
+	if kind == cursorNone {
+		return cursorRoute{}, false
+	}
+	for _, id := range ids {
+		if route, ok := cursorRoutes.get(id, now); ok {
+			return route, true
+		}
+	}
+	return cursorRoute{}, false
+}
+
+// recordCursorRoute remembers the upstream of the scroll or pit id returned
+// by the response, and forgets the ids once they are cleared
+func recordCursorRoute(cluster, host string, req *fasthttp.Request, res *fasthttp.Response, defaultKeepAlive time.Duration, now time.Time) {
+	if res.StatusCode() != fasthttp.StatusOK {
+		return
+	}
+
+	kind, ids := getCursorIDs(req)
+	if req.Header.IsDelete() {
+		for _, id := range ids {
+			cursorRoutes.delete(id)
+		}
+		return
+	}
+
+	path := req.PhantomURI().Path()
+	args := req.PhantomURI().QueryArgs()
+	var id string
+	var keepAlive []byte
+	switch {
+	case kind == cursorScroll:
+		id, _ = jsonparser.GetString(res.GetRawBody(), "_scroll_id")
+		keepAlive = args.Peek("scroll")
+		if len(keepAlive) == 0 {
+			keepAlive, _, _, _ = jsonparser.Get(req.GetRawBody(), "scroll")
+		}
+	case kind == cursorPIT:
+		id, _ = jsonparser.GetString(res.GetRawBody(), "pit_id")
+		keepAlive, _, _, _ = jsonparser.Get(req.GetRawBody(), "pit", "keep_alive")
+	case bytes.HasSuffix(path, searchSuffix) && args.Has("scroll"):
+		id, _ = jsonparser.GetString(res.GetRawBody(), "_scroll_id")
+		keepAlive = args.Peek("scroll")
+	case bytes.HasSuffix(path, pitSuffix):
+		id, _ = jsonparser.GetString(res.GetRawBody(), "id")
+		keepAlive = args.Peek("keep_alive")
+	case bytes.HasSuffix(path, openSearchPitSuffix):
+		id, _ = jsonparser.GetString(res.GetRawBody(), "pit_id")
+		keepAlive = args.Peek("keep_alive")
+	}
+
+	if id == "" {
+		return
+	}
+
+	cursorRoutes.set(id, cursorRoute{
+		cluster: cluster,
+		host:    host,
+		expire:  now.Add(parseKeepAlive(string(keepAlive), defaultKeepAlive)),
+	}, now)
+	stats.Increment("reverse_proxy", "sticky_routes")
+}
+
+// parseKeepAlive parses the time units of elasticsearch, eg: 1m, 30s, 1d
+func parseKeepAlive(v string, defaultValue time.Duration) time.Duration {
+	if v == "" {
+		return defaultValue
+	}
+	if strings.HasSuffix(v, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(v, "d"))
+		if err != nil {
+			return defaultValue
+		}
+		return time.Duration(days) * 24 * time.Hour
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return defaultValue
+	}
+	return d
+}
+
+// instances are the elasticsearch outputs by cluster, continuations may be
+// routed to another cluster which issued the id
+var instances = sync.Map{}
+
+func registerInstance(filter *Elasticsearch) {
+	instances.LoadOrStore(filter.config.Elasticsearch, filter)
+}
+
+func getInstance(cluster string) *Elasticsearch {
+	v, ok := instances.Load(cluster)
+	if !ok {
+		return nil
+	}
+	return v.(*Elasticsearch)
+}
@@ -0,0 +1,107 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package elastic
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"infini.sh/framework/lib/fasthttp"
+)
+
+func TestParseKeepAlive(t *testing.T) {
+	assert.Equal(t, time.Minute, parseKeepAlive("1m", time.Second))
+	assert.Equal(t, 30*time.Second, parseKeepAlive("30s", time.Second))
+	assert.Equal(t, 48*time.Hour, parseKeepAlive("2d", time.Second))
+	assert.Equal(t, time.Second, parseKeepAlive("", time.Second))
+	assert.Equal(t, time.Second, parseKeepAlive("invalid", time.Second))
+}
+
+func TestGetCursorIDs(t *testing.T) {
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+
+	req.Header.SetMethod(fasthttp.MethodPost)
+	req.SetRequestURI("/_search/scroll")
+	req.SetBody([]byte(`{"scroll":"1m","scroll_id":"abc"}`))
+	kind, ids := getCursorIDs(req)
+	assert.Equal(t, cursorScroll, kind)
+	assert.Equal(t, []string{"abc"}, ids)
+
+	req.Header.SetMethod(fasthttp.MethodDelete)
+	req.SetRequestURI("/_search/scroll/a,b")
+	req.SetBody(nil)
+	kind, ids = getCursorIDs(req)
+	assert.Equal(t, cursorScroll, kind)
+	assert.Equal(t, []string{"a", "b"}, ids)
+
+	req.SetRequestURI("/_pit")
+	req.SetBody([]byte(`{"id":"pit-1"}`))
+	kind, ids = getCursorIDs(req)
+	assert.Equal(t, cursorPIT, kind)
+	assert.Equal(t, []string{"pit-1"}, ids)
+
+	req.Header.SetMethod(fasthttp.MethodPost)
+	req.SetRequestURI("/_search")
+	req.SetBody([]byte(`{"query":{"match_all":{}},"pit":{"id":"pit-2","keep_alive":"1m"}}`))
+	kind, ids = getCursorIDs(req)
+	assert.Equal(t, cursorPIT, kind)
+	assert.Equal(t, []string{"pit-2"}, ids)
+
+	req.SetRequestURI("/index/_search")
+	req.SetBody([]byte(`{"query":{"match_all":{}}}`))
+	kind, _ = getCursorIDs(req)
+	assert.Equal(t, cursorNone, kind)
+}
+
+func TestRecordCursorRoute(t *testing.T) {
+	req := fasthttp.AcquireRequest()
+	res := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(res)
+
+	now := time.Now()
+	req.Header.SetMethod(fasthttp.MethodPost)
+	req.SetRequestURI("/index/_search?scroll=1m")
+	res.SetStatusCode(200)
+	res.SetBody([]byte(`{"_scroll_id":"scroll-1","hits":{}}`))
+	recordCursorRoute("es1", "127.0.0.1:9200", req, res, 5*time.Minute, now)
+
+	req.SetRequestURI("/_search/scroll")
+	req.SetBody([]byte(`{"scroll_id":"scroll-1"}`))
+	route, ok := lookupCursorRoute(req, now)
+	assert.True(t, ok)
+	assert.Equal(t, "es1", route.cluster)
+	assert.Equal(t, "127.0.0.1:9200", route.host)
+
+	_, ok = lookupCursorRoute(req, now.Add(2*time.Minute))
+	assert.False(t, ok)
+
+	req.Header.SetMethod(fasthttp.MethodDelete)
+	res.SetBody([]byte(`{"succeeded":true}`))
+	recordCursorRoute("es1", "127.0.0.1:9200", req, res, 5*time.Minute, now)
+	_, ok = lookupCursorRoute(req, now)
+	assert.False(t, ok)
+}
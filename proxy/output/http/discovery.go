@@ -0,0 +1,136 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package http
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"infini.sh/framework/core/global"
+	"infini.sh/framework/core/util"
+	"infini.sh/framework/lib/fasthttp"
+)
+
+type DiscoveryConfig struct {
+	Enabled     bool     `config:"enabled"`
+	Type        string   `config:"type"` //dns for A/AAAA records, srv for SRV records
+	Name        string   `config:"name"`
+	Port        int      `config:"port"`     //port for A/AAAA records
+	Interval    string   `config:"interval"` //max refresh interval, shorter TTL of the records takes precedence
+	MinInterval string   `config:"min_interval"`
+	Nameservers []string `config:"nameservers"` //default to /etc/resolv.conf
+	Timeout     string   `config:"timeout"`
+}
+
+func (filter *HTTPFilter) resolveUpstreams() ([]upstream, time.Duration, error) {
+	switch filter.Discovery.Type {
+	case discoveryTypeSRV:
+		return filter.resolver.resolveSRV(filter.Discovery.Name)
+	default:
+		return filter.resolver.resolveHosts(filter.Discovery.Name, filter.Discovery.Port)
+	}
+}
+
+// refreshUpstreams resolves the records and updates the client pool, returns
+// the duration to wait before next refresh
+func (filter *HTTPFilter) refreshUpstreams() (time.Duration, error) {
+	interval := util.GetDurationOrDefault(filter.Discovery.Interval, 30*time.Second)
+	minInterval := util.GetDurationOrDefault(filter.Discovery.MinInterval, time.Second)
+
+	upstreams, ttl, err := filter.resolveUpstreams()
+	if err != nil {
+		return interval, err
+	}
+
+	if len(upstreams) == 0 {
+		return interval, fmt.Errorf("no upstream was resolved for [%v]", filter.Discovery.Name)
+	}
+
+	filter.updateUpstreams(upstreams)
+
+	if ttl > 0 && ttl < interval {
+		interval = ttl
+	}
+	if interval < minInterval {
+		interval = minInterval
+	}
+	return interval, nil
+}
+
+// updateUpstreams creates clients for new hosts and closes the removed ones
+func (filter *HTTPFilter) updateUpstreams(upstreams []upstream) {
+	hosts := []string{}
+	weights := []int{}
+	current := map[string]bool{}
+	for _, v := range upstreams {
+		current[v.host] = true
+		hosts = append(hosts, v.host)
+		weights = append(weights, v.weight)
+		if _, ok := filter.clients.Load(v.host); !ok {
+			filter.clients.Store(v.host, filter.newClient())
+		}
+	}
+
+	filter.hostsLocker.Lock()
+	old := filter.Hosts
+	filter.Hosts = hosts
+	filter.weights = weights
+	filter.hostsLocker.Unlock()
+
+	for _, v := range old {
+		if current[v] {
+			continue
+		}
+		c, ok := filter.clients.Load(v)
+		if ok {
+			filter.clients.Delete(v)
+			if client, ok := c.(*fasthttp.Client); ok {
+				client.CloseIdleConnections()
+			}
+		}
+	}
+
+	if util.JoinArray(old, ",") != util.JoinArray(hosts, ",") {
+		log.Infof("http upstreams of [%v] changed: [%v] => [%v]", filter.Discovery.Name, util.JoinArray(old, ", "), util.JoinArray(hosts, ", "))
+	}
+}
+
+func (filter *HTTPFilter) startDiscovery(interval time.Duration) {
+	go func() {
+		for {
+			time.Sleep(interval)
+			if global.ShuttingDown() {
+				return
+			}
+			var err error
+			interval, err = filter.refreshUpstreams()
+			if err != nil {
+				log.Warnf("failed to discover upstreams of [%v], keep the current ones, %v", filter.Discovery.Name, err)
+			} else if global.Env().IsDebug {
+				log.Tracef("upstreams of [%v] refreshed, next refresh in %v", filter.Discovery.Name, interval)
+			}
+		}
+	}()
+}
@@ -0,0 +1,416 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package http
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	discoveryTypeDNS = "dns"
+	discoveryTypeSRV = "srv"
+)
+
+type upstream struct {
+	host     string
+	weight   int
+	priority uint16
+}
+
+// dnsResolver resolves A/AAAA or SRV records with their TTL, it queries the
+// nameservers directly, and falls back to the system resolver without TTL
+type dnsResolver struct {
+	nameservers []string
+	timeout     time.Duration
+}
+
+func newDNSResolver(nameservers []string, timeout time.Duration) *dnsResolver {
+	if len(nameservers) == 0 {
+		nameservers = loadNameservers("/etc/resolv.conf")
+	}
+	for i, v := range nameservers {
+		if _, _, err := net.SplitHostPort(v); err != nil {
+			nameservers[i] = net.JoinHostPort(v, "53")
+		}
+	}
+	return &dnsResolver{nameservers: nameservers, timeout: timeout}
+}
+
+func loadNameservers(file string) []string {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	servers := []string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			servers = append(servers, fields[1])
+		}
+	}
+	return servers
+}
+
+// resolveHosts returns ip:port of the A/AAAA records and the min TTL
+func (r *dnsResolver) resolveHosts(name string, port int) ([]upstream, time.Duration, error) {
+	if len(r.nameservers) == 0 {
+		ips, err := net.DefaultResolver.LookupHost(context.Background(), name)
+		if err != nil {
+			return nil, 0, err
+		}
+		result := []upstream{}
+		for _, ip := range ips {
+			result = append(result, upstream{host: net.JoinHostPort(ip, fmt.Sprint(port)), weight: 1})
+		}
+		return result, 0, nil
+	}
+
+	result := []upstream{}
+	var minTTL time.Duration
+	var lastErr error
+	for _, t := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		answers, err := r.query(name, t)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		for _, v := range answers {
+			result = append(result, upstream{host: net.JoinHostPort(v.ip.String(), fmt.Sprint(port)), weight: 1})
+			minTTL = minDuration(minTTL, v.ttl)
+		}
+	}
+	if len(result) == 0 && lastErr != nil {
+		return nil, 0, lastErr
+	}
+	return result, minTTL, nil
+}
+
+// resolveSRV returns the targets with the lowest priority and the min TTL,
+// targets are resolved by the additional records or A/AAAA lookups
+func (r *dnsResolver) resolveSRV(name string) ([]upstream, time.Duration, error) {
+	if len(r.nameservers) == 0 {
+		_, addrs, err := net.DefaultResolver.LookupSRV(context.Background(), "", "", name)
+		if err != nil {
+			return nil, 0, err
+		}
+		result := []upstream{}
+		for _, v := range addrs {
+			result = append(result, upstream{host: net.JoinHostPort(strings.TrimSuffix(v.Target, "."), fmt.Sprint(v.Port)), weight: int(v.Weight), priority: v.Priority})
+		}
+		return lowestPriority(result), 0, nil
+	}
+
+	answers, err := r.query(name, dnsmessage.TypeSRV)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	result := []upstream{}
+	var minTTL time.Duration
+	for _, v := range answers {
+		if v.srv == nil {
+			continue
+		}
+		minTTL = minDuration(minTTL, v.ttl)
+		target := strings.TrimSuffix(v.srv.Target.String(), ".")
+		ips := v.additional[v.srv.Target.String()]
+		if len(ips) == 0 {
+			resolved, ttl, err := r.resolveHosts(target, int(v.srv.Port))
+			if err != nil || len(resolved) == 0 {
+				continue
+			}
+			minTTL = minDuration(minTTL, ttl)
+			for _, x := range resolved {
+				x.weight = int(v.srv.Weight)
+				x.priority = v.srv.Priority
+				result = append(result, x)
+			}
+			continue
+		}
+		for _, ip := range ips {
+			result = append(result, upstream{host: net.JoinHostPort(ip.String(), fmt.Sprint(v.srv.Port)), weight: int(v.srv.Weight), priority: v.srv.Priority})
+		}
+	}
+	return lowestPriority(result), minTTL, nil
+}
+
+type dnsAnswer struct {
+	ttl        time.Duration
+	ip         net.IP
+	srv        *dnsmessage.SRVResource
+	additional map[string][]net.IP
+}
+
+func (r *dnsResolver) query(name string, t dnsmessage.Type) ([]dnsAnswer, error) {
+	if !strings.HasSuffix(name, ".") {
+		name = name + "."
+	}
+	n, err := dnsmessage.NewName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	id := uint16(rand.Intn(65536))
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, RecursionDesired: true})
+	builder.EnableCompression()
+	if err := builder.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := builder.Question(dnsmessage.Question{Name: n, Type: t, Class: dnsmessage.ClassINET}); err != nil {
+		return nil, err
+	}
+	msg, err := builder.Finish()
+	if err != nil {
+		return nil, err
+	}
+
+	var lastErr error
+	for _, server := range r.nameservers {
+		answers, err := r.exchange(server, msg, id, t)
+		if err == nil {
+			return answers, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+var errTruncated = errors.New("dns response is truncated")
+
+// exchange sends the query over udp, and retries over tcp if the response is
+// truncated, such as the SRV records of the large clusters
+func (r *dnsResolver) exchange(server string, msg []byte, id uint16, t dnsmessage.Type) ([]dnsAnswer, error) {
+	buf, err := r.exchangeUDP(server, msg, id)
+	if err != nil {
+		return nil, err
+	}
+	answers, err := parseAnswers(buf, server, t)
+	if err != errTruncated {
+		return answers, err
+	}
+	if buf, err = r.exchangeTCP(server, msg, id); err != nil {
+		return nil, err
+	}
+	return parseAnswers(buf, server, t)
+}
+
+// matchResponse checks the response is the answer of the query, the stale
+// or spoofed responses with other ids are ignored
+func matchResponse(buf []byte, id uint16) bool {
+	var p dnsmessage.Parser
+	header, err := p.Start(buf)
+	return err == nil && header.Response && header.ID == id
+}
+
+func (r *dnsResolver) exchangeUDP(server string, msg []byte, id uint16) ([]byte, error) {
+	conn, err := net.DialTimeout("udp", server, r.timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(r.timeout))
+
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 4096)
+	for {
+		size, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		if matchResponse(buf[:size], id) {
+			return buf[:size], nil
+		}
+	}
+}
+
+func (r *dnsResolver) exchangeTCP(server string, msg []byte, id uint16) ([]byte, error) {
+	conn, err := net.DialTimeout("tcp", server, r.timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(r.timeout))
+
+	//messages over tcp are prefixed with the two bytes length, RFC 1035 4.2.2
+	packet := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(packet, uint16(len(msg)))
+	copy(packet[2:], msg)
+	if _, err := conn.Write(packet); err != nil {
+		return nil, err
+	}
+
+	length := make([]byte, 2)
+	if _, err := io.ReadFull(conn, length); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, binary.BigEndian.Uint16(length))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return nil, err
+	}
+	if !matchResponse(buf, id) {
+		return nil, fmt.Errorf("dns response id mismatch on [%v]", server)
+	}
+	return buf, nil
+}
+
+func parseAnswers(buf []byte, server string, t dnsmessage.Type) ([]dnsAnswer, error) {
+	var p dnsmessage.Parser
+	header, err := p.Start(buf)
+	if err != nil {
+		return nil, err
+	}
+	if header.Truncated {
+		return nil, errTruncated
+	}
+	if header.RCode != dnsmessage.RCodeSuccess {
+		return nil, fmt.Errorf("dns query failed on [%v], %v", server, header.RCode)
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return nil, err
+	}
+
+	answers := []dnsAnswer{}
+	for {
+		h, err := p.AnswerHeader()
+		if err == dnsmessage.ErrSectionDone {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		ttl := time.Duration(h.TTL) * time.Second
+		if h.Type != t {
+			if err := p.SkipAnswer(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		switch h.Type {
+		case dnsmessage.TypeA:
+			res, err := p.AResource()
+			if err != nil {
+				return nil, err
+			}
+			answers = append(answers, dnsAnswer{ttl: ttl, ip: net.IP(res.A[:])})
+		case dnsmessage.TypeAAAA:
+			res, err := p.AAAAResource()
+			if err != nil {
+				return nil, err
+			}
+			answers = append(answers, dnsAnswer{ttl: ttl, ip: net.IP(res.AAAA[:])})
+		case dnsmessage.TypeSRV:
+			res, err := p.SRVResource()
+			if err != nil {
+				return nil, err
+			}
+			answers = append(answers, dnsAnswer{ttl: ttl, srv: &res})
+		default:
+			if err := p.SkipAnswer(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if t != dnsmessage.TypeSRV || len(answers) == 0 {
+		return answers, nil
+	}
+
+	//addresses of SRV targets may be carried in the additional section
+	additional := map[string][]net.IP{}
+	if err := p.SkipAllAuthorities(); err != nil {
+		return answers, nil
+	}
+	for {
+		h, err := p.AdditionalHeader()
+		if err != nil {
+			break
+		}
+		switch h.Type {
+		case dnsmessage.TypeA:
+			res, err := p.AResource()
+			if err != nil {
+				return answers, nil
+			}
+			additional[h.Name.String()] = append(additional[h.Name.String()], net.IP(res.A[:]))
+		case dnsmessage.TypeAAAA:
+			res, err := p.AAAAResource()
+			if err != nil {
+				return answers, nil
+			}
+			additional[h.Name.String()] = append(additional[h.Name.String()], net.IP(res.AAAA[:]))
+		default:
+			if err := p.SkipAdditional(); err != nil {
+				return answers, nil
+			}
+		}
+	}
+	for i := range answers {
+		answers[i].additional = additional
+	}
+	return answers, nil
+}
+
+// lowestPriority keeps the targets with the lowest priority, as defined by RFC 2782
+func lowestPriority(upstreams []upstream) []upstream {
+	if len(upstreams) == 0 {
+		return upstreams
+	}
+	sort.SliceStable(upstreams, func(i, j int) bool {
+		return upstreams[i].priority < upstreams[j].priority
+	})
+	result := []upstream{}
+	for _, v := range upstreams {
+		if v.priority != upstreams[0].priority {
+			break
+		}
+		result = append(result, v)
+	}
+	return result
+}
+
+func minDuration(a, b time.Duration) time.Duration {
+	if a == 0 || (b > 0 && b < a) {
+		return b
+	}
+	return a
+}
@@ -0,0 +1,128 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package http
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestLowestPriority(t *testing.T) {
+	upstreams := []upstream{
+		{host: "a:80", priority: 20, weight: 10},
+		{host: "b:80", priority: 10, weight: 5},
+		{host: "c:80", priority: 10, weight: 1},
+	}
+	result := lowestPriority(upstreams)
+	assert.Equal(t, 2, len(result))
+	assert.Equal(t, "b:80", result[0].host)
+	assert.Equal(t, "c:80", result[1].host)
+}
+
+func TestMinDuration(t *testing.T) {
+	assert.Equal(t, 5*time.Second, minDuration(0, 5*time.Second))
+	assert.Equal(t, 3*time.Second, minDuration(5*time.Second, 3*time.Second))
+	assert.Equal(t, 3*time.Second, minDuration(3*time.Second, 0))
+}
+
+func TestLoadNameservers(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "resolv.conf")
+	os.WriteFile(file, []byte("# comment\nsearch local\nnameserver 10.0.0.1\nnameserver ::1\n"), 0644)
+	assert.Equal(t, []string{"10.0.0.1", "::1"}, loadNameservers(file))
+
+	r := newDNSResolver([]string{"10.0.0.2", "10.0.0.3:5353"}, time.Second)
+	assert.Equal(t, []string{"10.0.0.2:53", "10.0.0.3:5353"}, r.nameservers)
+}
+
+func buildResponse(t *testing.T, query []byte, id uint16, truncated bool) []byte {
+	var p dnsmessage.Parser
+	_, err := p.Start(query)
+	assert.Nil(t, err)
+	q, err := p.Question()
+	assert.Nil(t, err)
+
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, Response: true, Truncated: truncated})
+	builder.StartQuestions()
+	builder.Question(q)
+	builder.StartAnswers()
+	if !truncated {
+		builder.AResource(dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: 30},
+			dnsmessage.AResource{A: [4]byte{10, 0, 0, 1}})
+	}
+	msg, err := builder.Finish()
+	assert.Nil(t, err)
+	return msg
+}
+
+func TestExchangeTruncated(t *testing.T) {
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer udp.Close()
+	tcp, err := net.Listen("tcp", udp.LocalAddr().String())
+	if err != nil {
+		t.Skip("tcp port is in use, ", err)
+	}
+	defer tcp.Close()
+
+	go func() {
+		buf := make([]byte, 512)
+		size, addr, err := udp.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		id := binary.BigEndian.Uint16(buf)
+		//the stale response is ignored
+		udp.WriteTo(buildResponse(t, buf[:size], id+1, false), addr)
+		udp.WriteTo(buildResponse(t, buf[:size], id, true), addr)
+	}()
+	go func() {
+		conn, err := tcp.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		length := make([]byte, 2)
+		io.ReadFull(conn, length)
+		query := make([]byte, binary.BigEndian.Uint16(length))
+		io.ReadFull(conn, query)
+		msg := buildResponse(t, query, binary.BigEndian.Uint16(query), false)
+		binary.BigEndian.PutUint16(length, uint16(len(msg)))
+		conn.Write(append(length, msg...))
+	}()
+
+	r := newDNSResolver([]string{udp.LocalAddr().String()}, time.Second)
+	answers, err := r.query("es.example.com", dnsmessage.TypeA)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(answers))
+	assert.Equal(t, "10.0.0.1", answers[0].ip.String())
+	assert.Equal(t, 30*time.Second, answers[0].ttl)
+}
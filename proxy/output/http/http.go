@@ -46,6 +46,7 @@ import (
 	"infini.sh/framework/core/pipeline"
 	"infini.sh/framework/core/util"
 	"infini.sh/framework/lib/fasthttp"
+	"infini.sh/gateway/proxy/retry"
 )
 
 type HTTPFilter struct {
@@ -81,6 +82,16 @@ type HTTPFilter struct {
 	MaxRedirectsCount int  `config:"max_redirects_count"`
 	FollowRedirects   bool `config:"follow_redirects"`
 	HTTPPool          *fasthttp.RequestResponsePool
+
+	//retry budget, backoff and per status code policies
+	Retry   retry.Config `config:"retry"`
+	retrier *retry.Retrier
+
+	//discover hosts by dns records
+	Discovery   DiscoveryConfig `config:"discovery"`
+	resolver    *dnsResolver
+	hostsLocker sync.RWMutex
+	weights     []int
 }
 
 func (filter *HTTPFilter) Name() string {
@@ -88,11 +99,31 @@ func (filter *HTTPFilter) Name() string {
 }
 
 func (filter *HTTPFilter) getHost() string {
+	filter.hostsLocker.RLock()
+	defer filter.hostsLocker.RUnlock()
+
 	max := len(filter.Hosts)
 	if max == 1 {
 		return filter.Hosts[0]
 	}
 
+	//weighted random pick, weights come from SRV records
+	if len(filter.weights) == max {
+		total := 0
+		for _, w := range filter.weights {
+			total += w
+		}
+		if total > 0 {
+			seed := rand.Intn(total)
+			for i, w := range filter.weights {
+				seed -= w
+				if seed < 0 {
+					return filter.Hosts[i]
+				}
+			}
+		}
+	}
+
 	seed := rand.Intn(max)
 	if seed >= len(filter.Hosts) {
 		log.Warn("invalid upstream offset, reset to 0")
@@ -101,17 +132,46 @@ func (filter *HTTPFilter) getHost() string {
 	return filter.Hosts[seed]
 }
 
+func (filter *HTTPFilter) getHosts() []string {
+	filter.hostsLocker.RLock()
+	defer filter.hostsLocker.RUnlock()
+	return filter.Hosts
+}
+
 func (filter *HTTPFilter) Filter(ctx *fasthttp.RequestCtx) {
 	var err error
 
+	filter.retrier.OnRequest()
+
 	host := filter.getHost()
-	err = filter.forward(host, ctx)
-	if err == nil {
-		return
+	retries := 0
+	for {
+		err = filter.forward(host, ctx)
+		if err == nil {
+			//retry by the policy of the status code
+			policy := filter.retrier.GetPolicy(ctx.Response.StatusCode())
+			if policy == nil || retries >= policy.MaxRetries || (policy.ReadonlyOnly && !retry.IsReadonlyRequest(&ctx.Request)) || !filter.retrier.AllowRetry() {
+				return
+			}
+			time.Sleep(filter.retrier.Delay(retries, &ctx.Response))
+			if policy.SwitchHost {
+				host = filter.getNextHost(host)
+			}
+		} else {
+			if retries >= filter.MaxRetryTimes || !filter.retrier.AllowRetry() {
+				break
+			}
+			time.Sleep(filter.retrier.Delay(retries, nil))
+			host = filter.getNextHost(host)
+		}
+		retries++
+		if global.Env().IsDebug {
+			log.Tracef("retry request [%v] to host [%v], #%v", ctx.PhantomURI().String(), host, retries)
+		}
 	}
 
 	if filter.SkipFailureHost {
-		for _, v := range filter.Hosts {
+		for _, v := range filter.getHosts() {
 			err = filter.forward(v, ctx)
 			if err == nil {
 				break
@@ -125,6 +185,17 @@ func (filter *HTTPFilter) Filter(ctx *fasthttp.RequestCtx) {
 
 }
 
+// getNextHost picks the host next to the given one
+func (filter *HTTPFilter) getNextHost(host string) string {
+	hosts := filter.getHosts()
+	for i, v := range hosts {
+		if v == host {
+			return hosts[(i+1)%len(hosts)]
+		}
+	}
+	return filter.getHost()
+}
+
 // Hop-by-hop headers. These are removed when sent to the backend.
 // As of RFC 7230, hop-by-hop headers are required to appear in the
 // Connection header field. These are the headers defined by the
@@ -296,11 +367,19 @@ func init() {
 func NewHTTPFilter(c *config.Config) (pipeline.Filter, error) {
 
 	runner := HTTPFilter{
-		SkipFailureHost:       true,
-		MaxConnection:         5000,
-		MaxRetryTimes:         0,
-		MaxRedirectsCount:     10,
-		RetryDelayInMs:        1000,
+		SkipFailureHost:   true,
+		MaxConnection:     5000,
+		MaxRetryTimes:     0,
+		MaxRedirectsCount: 10,
+		RetryDelayInMs:    1000,
+		Retry:             retry.DefaultConfig,
+		Discovery: DiscoveryConfig{
+			Type:        discoveryTypeDNS,
+			Port:        80,
+			Interval:    "30s",
+			MinInterval: "1s",
+			Timeout:     "3s",
+		},
 		TLSInsecureSkipVerify: true,
 		ReadBufferSize:        4096 * 4,
 		WriteBufferSize:       4096 * 4,
@@ -327,35 +406,57 @@ func NewHTTPFilter(c *config.Config) (pipeline.Filter, error) {
 		runner.Hosts = append(runner.Hosts, runner.Host)
 	}
 
+	runner.clients = sync.Map{}
+
+	retryKey := "http." + util.JoinArray(runner.Hosts, ",")
+	if runner.Discovery.Enabled {
+		if runner.Discovery.Name == "" {
+			return nil, fmt.Errorf("discovery name for http filter can't be nil")
+		}
+		retryKey = "http." + runner.Discovery.Name
+		runner.resolver = newDNSResolver(runner.Discovery.Nameservers, util.GetDurationOrDefault(runner.Discovery.Timeout, 3*time.Second))
+		interval, err := runner.refreshUpstreams()
+		if err != nil {
+			if len(runner.Hosts) == 0 {
+				return nil, fmt.Errorf("failed to discover upstreams of [%v], %v", runner.Discovery.Name, err)
+			}
+			log.Warnf("failed to discover upstreams of [%v], fallback to static hosts, %v", runner.Discovery.Name, err)
+		}
+		runner.startDiscovery(interval)
+	}
+
 	if len(runner.Hosts) <= 0 {
 		panic("hosts for http filter can't be nil")
 	}
 
-	runner.clients = sync.Map{}
+	runner.retrier = retry.New(retryKey, &runner.Retry, time.Duration(runner.RetryDelayInMs)*time.Millisecond)
 
 	for _, host := range runner.Hosts {
-
-		c := &fasthttp.Client{
-			Name:                          "reverse_proxy",
-			DisableHeaderNamesNormalizing: true,
-			DisablePathNormalizing:        true,
-			MaxConnsPerHost:               runner.MaxConnection,
-			MaxResponseBodySize:           runner.MaxResponseBodySize,
-			MaxConnWaitTimeout:            runner.MaxConnWaitTimeout,
-			MaxConnDuration:               runner.MaxConnDuration,
-			MaxIdleConnDuration:           runner.MaxIdleConnDuration,
-			ReadTimeout:                   runner.ReadTimeout,
-			WriteTimeout:                  runner.WriteTimeout,
-			ReadBufferSize:                runner.ReadBufferSize,
-			WriteBufferSize:               runner.WriteBufferSize,
-			DialDualStack:                 true,
-			TLSConfig:                     api.SimpleGetTLSConfig(runner.TLSConfig),
+		if _, ok := runner.clients.Load(host); !ok {
+			runner.clients.Store(host, runner.newClient())
 		}
-
-		runner.clients.Store(host, c)
 	}
 
 	runner.HTTPPool = fasthttp.NewRequestResponsePool("http_filter")
 
 	return &runner, nil
 }
+
+func (filter *HTTPFilter) newClient() *fasthttp.Client {
+	return &fasthttp.Client{
+		Name:                          "reverse_proxy",
+		DisableHeaderNamesNormalizing: true,
+		DisablePathNormalizing:        true,
+		MaxConnsPerHost:               filter.MaxConnection,
+		MaxResponseBodySize:           filter.MaxResponseBodySize,
+		MaxConnWaitTimeout:            filter.MaxConnWaitTimeout,
+		MaxConnDuration:               filter.MaxConnDuration,
+		MaxIdleConnDuration:           filter.MaxIdleConnDuration,
+		ReadTimeout:                   filter.ReadTimeout,
+		WriteTimeout:                  filter.WriteTimeout,
+		ReadBufferSize:                filter.ReadBufferSize,
+		WriteBufferSize:               filter.WriteBufferSize,
+		DialDualStack:                 true,
+		TLSConfig:                     api.SimpleGetTLSConfig(filter.TLSConfig),
+	}
+}
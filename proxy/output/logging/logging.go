@@ -34,6 +34,7 @@ import (
 	"infini.sh/framework/core/pipeline"
 	"infini.sh/framework/core/util"
 	"infini.sh/framework/lib/fastjson_marshal"
+	"infini.sh/gateway/common"
 	"infini.sh/gateway/common/model"
 
 	"time"
@@ -244,6 +245,13 @@ func (this *RequestLogging) Filter(ctx *fasthttp.RequestCtx) {
 		}
 	}
 
+	if ctx.Has(common.QUERYCOST) {
+		cost := ctx.Get(common.QUERYCOST)
+		if cost != nil {
+			request.Elastic["query_cost"] = cost
+		}
+	}
+
 	//request.DataFlow = &model.DataFlow{}
 	request.DataFlow.From = request.RemoteIP
 
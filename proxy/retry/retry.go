@@ -0,0 +1,273 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package retry
+
+import (
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"infini.sh/framework/core/global"
+	"infini.sh/framework/core/stats"
+	"infini.sh/framework/core/util"
+	"infini.sh/framework/lib/fasthttp"
+)
+
+// Policy defines how to retry responses with the given status codes
+type Policy struct {
+	Status       []int `config:"status"`
+	MaxRetries   int   `config:"max_retries"`
+	SwitchHost   bool  `config:"switch_host"`   //retry on another host
+	ReadonlyOnly bool  `config:"readonly_only"` //only retry GET/HEAD requests
+}
+
+type Config struct {
+	BudgetPercent       float64 `config:"budget_percent"`         //retries at most this percentage of live traffic, 0 means no budget
+	MinRetriesPerSecond int     `config:"min_retries_per_second"` //always allow a few retries for low traffic
+
+	InitialBackoff string  `config:"initial_backoff"`
+	MaxBackoff     string  `config:"max_backoff"`
+	Multiplier     float64 `config:"multiplier"`
+	Jitter         float64 `config:"jitter"` //0 to 1, the random part of each backoff
+
+	RespectRetryAfter bool   `config:"respect_retry_after"`
+	MaxRetryAfter     string `config:"max_retry_after"`
+
+	Policies []Policy `config:"policies"`
+}
+
+var DefaultConfig = Config{
+	MinRetriesPerSecond: 10,
+	MaxBackoff:          "10s",
+	Multiplier:          1,
+	RespectRetryAfter:   true,
+	MaxRetryAfter:       "30s",
+}
+
+type Retrier struct {
+	key            string
+	config         *Config
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	maxRetryAfter  time.Duration
+	budget         *Budget
+}
+
+// New creates a retrier, retriers share the same budget by key, defaultDelay
+// is used when the initial backoff is not configured
+func New(key string, cfg *Config, defaultDelay time.Duration) *Retrier {
+	r := Retrier{key: key, config: cfg}
+	r.initialBackoff = util.GetDurationOrDefault(cfg.InitialBackoff, defaultDelay)
+	r.maxBackoff = util.GetDurationOrDefault(cfg.MaxBackoff, 10*time.Second)
+	r.maxRetryAfter = util.GetDurationOrDefault(cfg.MaxRetryAfter, 30*time.Second)
+	if cfg.Multiplier < 1 {
+		cfg.Multiplier = 1
+	}
+	if cfg.BudgetPercent > 0 {
+		r.budget = GetBudget(key, cfg.BudgetPercent, cfg.MinRetriesPerSecond)
+	}
+	return &r
+}
+
+// OnRequest records a live request to the budget
+func (r *Retrier) OnRequest() {
+	if r.budget != nil {
+		r.budget.OnRequest()
+	}
+}
+
+// AllowRetry withdraws a retry from the budget
+func (r *Retrier) AllowRetry() bool {
+	if r.budget == nil {
+		return true
+	}
+	if r.budget.Withdraw() {
+		stats.Increment("retry", r.key+".retries")
+		return true
+	}
+	stats.Increment("retry", r.key+".budget_exhausted")
+	if global.Env().IsDebug {
+		log.Debugf("retry budget of [%v] exhausted", r.key)
+	}
+	return false
+}
+
+// GetPolicy returns the policy matches the status code, or nil
+func (r *Retrier) GetPolicy(status int) *Policy {
+	for i := range r.config.Policies {
+		for _, v := range r.config.Policies[i].Status {
+			if v == status {
+				return &r.config.Policies[i]
+			}
+		}
+	}
+	return nil
+}
+
+// AddPolicyIfMissing appends the policy when none of its status codes is covered
+func (r *Retrier) AddPolicyIfMissing(policy Policy) {
+	for _, v := range policy.Status {
+		if r.GetPolicy(v) != nil {
+			return
+		}
+	}
+	r.config.Policies = append(r.config.Policies, policy)
+}
+
+// Backoff returns the exponential backoff with jitter of the given attempt, starting from 0
+func (r *Retrier) Backoff(attempt int) time.Duration {
+	return Backoff(r.initialBackoff, r.maxBackoff, r.config.Multiplier, r.config.Jitter, attempt)
+}
+
+// Delay returns the backoff of the attempt, or the Retry-After of the response if respected
+func (r *Retrier) Delay(attempt int, res *fasthttp.Response) time.Duration {
+	if r.config.RespectRetryAfter && res != nil && res.StatusCode() == fasthttp.StatusTooManyRequests {
+		d, ok := ParseRetryAfter(res.Header.Peek(fasthttp.HeaderRetryAfter), time.Now())
+		if ok {
+			if d > r.maxRetryAfter {
+				d = r.maxRetryAfter
+			}
+			return d
+		}
+	}
+	return r.Backoff(attempt)
+}
+
+func Backoff(initial, max time.Duration, multiplier, jitter float64, attempt int) time.Duration {
+	if initial <= 0 {
+		return 0
+	}
+	d := float64(initial) * math.Pow(multiplier, float64(attempt))
+	if max > 0 && d > float64(max) {
+		d = float64(max)
+	}
+	if jitter > 0 {
+		if jitter > 1 {
+			jitter = 1
+		}
+		d = d*(1-jitter) + rand.Float64()*d*jitter
+	}
+	return time.Duration(d)
+}
+
+// ParseRetryAfter parses the Retry-After header, in seconds or in http date
+func ParseRetryAfter(v []byte, now time.Time) (time.Duration, bool) {
+	if len(v) == 0 {
+		return 0, false
+	}
+	str := string(v)
+	if seconds, err := strconv.Atoi(str); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	t, err := http.ParseTime(str)
+	if err != nil {
+		return 0, false
+	}
+	d := t.Sub(now)
+	if d < 0 {
+		d = 0
+	}
+	return d, true
+}
+
+// IsReadonlyRequest returns true for GET and HEAD requests
+func IsReadonlyRequest(req *fasthttp.Request) bool {
+	return req.Header.IsGet() || req.Header.IsHead()
+}
+
+const budgetWindow = 10
+
+type budgetBucket struct {
+	second   int64
+	requests int
+	retries  int
+}
+
+// Budget tracks requests and retries in a sliding window of seconds
+type Budget struct {
+	locker       sync.Mutex
+	percent      float64
+	minPerSecond int
+	buckets      [budgetWindow]budgetBucket
+}
+
+var budgets = sync.Map{}
+
+// GetBudget returns the shared budget by key
+func GetBudget(key string, percent float64, minPerSecond int) *Budget {
+	v, _ := budgets.LoadOrStore(key, &Budget{percent: percent, minPerSecond: minPerSecond})
+	return v.(*Budget)
+}
+
+func (b *Budget) bucket(now int64) *budgetBucket {
+	bucket := &b.buckets[now%budgetWindow]
+	if bucket.second != now {
+		bucket.second = now
+		bucket.requests = 0
+		bucket.retries = 0
+	}
+	return bucket
+}
+
+func (b *Budget) OnRequest() {
+	b.onRequest(time.Now().Unix())
+}
+
+func (b *Budget) onRequest(now int64) {
+	b.locker.Lock()
+	b.bucket(now).requests++
+	b.locker.Unlock()
+}
+
+func (b *Budget) Withdraw() bool {
+	return b.withdraw(time.Now().Unix())
+}
+
+func (b *Budget) withdraw(now int64) bool {
+	b.locker.Lock()
+	defer b.locker.Unlock()
+
+	requests := 0
+	retries := 0
+	for _, v := range b.buckets {
+		if v.second > now-budgetWindow {
+			requests += v.requests
+			retries += v.retries
+		}
+	}
+
+	allowed := float64(requests)*b.percent/100 + float64(b.minPerSecond*budgetWindow)
+	if float64(retries+1) > allowed {
+		return false
+	}
+	b.bucket(now).retries++
+	return true
+}
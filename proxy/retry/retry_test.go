@@ -0,0 +1,94 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package retry
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackoff(t *testing.T) {
+	assert.Equal(t, 100*time.Millisecond, Backoff(100*time.Millisecond, time.Second, 2, 0, 0))
+	assert.Equal(t, 400*time.Millisecond, Backoff(100*time.Millisecond, time.Second, 2, 0, 2))
+	assert.Equal(t, time.Second, Backoff(100*time.Millisecond, time.Second, 2, 0, 10))
+	assert.Equal(t, time.Duration(0), Backoff(0, time.Second, 2, 0, 3))
+
+	for i := 0; i < 100; i++ {
+		d := Backoff(100*time.Millisecond, time.Second, 2, 0.5, 1)
+		assert.True(t, d >= 100*time.Millisecond && d <= 200*time.Millisecond)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Now()
+
+	d, ok := ParseRetryAfter([]byte("5"), now)
+	assert.True(t, ok)
+	assert.Equal(t, 5*time.Second, d)
+
+	d, ok = ParseRetryAfter([]byte(now.Add(10*time.Second).UTC().Format(http.TimeFormat)), now)
+	assert.True(t, ok)
+	assert.True(t, d > 8*time.Second && d <= 10*time.Second)
+
+	_, ok = ParseRetryAfter([]byte("invalid"), now)
+	assert.False(t, ok)
+
+	_, ok = ParseRetryAfter(nil, now)
+	assert.False(t, ok)
+}
+
+func TestBudget(t *testing.T) {
+	b := Budget{percent: 10}
+	now := time.Now().Unix()
+	for i := 0; i < 100; i++ {
+		b.onRequest(now)
+	}
+
+	allowed := 0
+	for i := 0; i < 20; i++ {
+		if b.withdraw(now) {
+			allowed++
+		}
+	}
+	assert.Equal(t, 10, allowed)
+
+	//old requests are out of the window
+	assert.False(t, b.withdraw(now+budgetWindow))
+}
+
+func TestGetPolicy(t *testing.T) {
+	cfg := DefaultConfig
+	cfg.Policies = []Policy{{Status: []int{502, 503}, MaxRetries: 2}}
+	r := New("test", &cfg, time.Second)
+	assert.Nil(t, r.GetPolicy(429))
+	assert.Equal(t, 2, r.GetPolicy(503).MaxRetries)
+
+	r.AddPolicyIfMissing(Policy{Status: []int{429}, MaxRetries: 5})
+	r.AddPolicyIfMissing(Policy{Status: []int{503}, MaxRetries: 5})
+	assert.Equal(t, 5, r.GetPolicy(429).MaxRetries)
+	assert.Equal(t, 2, r.GetPolicy(503).MaxRetries)
+}